@@ -2,98 +2,57 @@ package address
 
 import (
 	"bytes"
-	"encoding/base32"
+	"crypto/hmac"
+	"crypto/sha512"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 
 	"github.com/frankh/nano/types"
-	"github.com/frankh/nano/utils"
 	"github.com/golang/crypto/blake2b"
 	// We've forked golang's ed25519 implementation
 	// to use blake2b instead of sha3
 	"github.com/frankh/crypto/ed25519"
 )
 
-// nano uses a non-standard base32 character set.
-const EncodeNano = "13456789abcdefghijkmnopqrstuwxyz"
-
-var NanoEncoding = base32.NewEncoding(EncodeNano)
-
-func ValidateAddress(account types.Account) bool {
-	_, err := AddressToPub(account)
+func ValidateAddress(address string) bool {
+	_, err := types.ParseAccount(address)
 
 	return err == nil
 }
 
-func AddressToPub(account types.Account) (public_key []byte, err error) {
-	address := string(account)
-
-	if address[:4] == "xrb_" {
-		address = address[4:]
-	} else if address[:5] == "nano_" {
-		address = address[5:]
-	} else {
-		return nil, errors.New("Invalid address format")
-	}
-	// A valid nano address is 64 bytes long
-	// First 5 are simply a hard-coded string nano_ for ease of use
-	// The following 52 characters form the address, and the final
-	// 8 are a checksum.
-	// They are base 32 encoded with a custom encoding.
-	if len(address) == 60 {
-		// The nano address string is 260bits which doesn't fall on a
-		// byte boundary. pad with zeros to 280bits.
-		// (zeros are encoded as 1 in nano's 32bit alphabet)
-		key_b32nano := "1111" + address[0:52]
-		input_checksum := address[52:]
-
-		key_bytes, err := NanoEncoding.DecodeString(key_b32nano)
-		if err != nil {
-			return nil, err
-		}
-		// strip off upper 24 bits (3 bytes). 20 padding was added by us,
-		// 4 is unused as account is 256 bits.
-		key_bytes = key_bytes[3:]
-
-		// nano checksum is calculated by hashing the key and reversing the bytes
-		valid := NanoEncoding.EncodeToString(GetAddressChecksum(key_bytes)) == input_checksum
-		if valid {
-			return key_bytes, nil
-		} else {
-			return nil, errors.New("Invalid address checksum")
-		}
-	}
-
-	return nil, errors.New("Invalid address format")
-}
-
-func GetAddressChecksum(pub ed25519.PublicKey) []byte {
-	hash, err := blake2b.New(5, nil)
+func AddressToPub(address string) (public_key ed25519.PublicKey, err error) {
+	account, err := types.ParseAccount(address)
 	if err != nil {
-		panic("Unable to create hash")
+		return nil, err
 	}
-
-	hash.Write(pub)
-	return utils.Reversed(hash.Sum(nil))
+	return ed25519.PublicKey(account[:]), nil
 }
 
 func PubKeyToAddress(pub ed25519.PublicKey) types.Account {
-	// Pubkey is 256bits, base32 must be multiple of 5 bits
-	// to encode properly.
-	// Pad the start with 0's and strip them off after base32 encoding
-	padded := append([]byte{0, 0, 0}, pub...)
-	address := NanoEncoding.EncodeToString(padded)[4:]
-	checksum := NanoEncoding.EncodeToString(GetAddressChecksum(pub))
-
-	return types.Account("nano_" + address + checksum)
+	return types.AccountFromBytes(pub)
 }
 
-func KeypairFromPrivateKey(private_key string) (ed25519.PublicKey, ed25519.PrivateKey) {
-	private_bytes, _ := hex.DecodeString(private_key)
-	pub, priv, _ := ed25519.GenerateKey(bytes.NewReader(private_bytes))
+// KeypairFromPrivateKey takes a hex encoded 32 byte private key, or the
+// 64 byte expanded form which has the public key appended.
+func KeypairFromPrivateKey(private_key string) (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	private_bytes, err := hex.DecodeString(private_key)
+	if err != nil {
+		return nil, nil, errors.New("Private key is not valid hex")
+	}
+	if len(private_bytes) != 32 && len(private_bytes) != 64 {
+		return nil, nil, errors.New("Private key must be 32 or 64 bytes")
+	}
 
-	return pub, priv
+	pub, priv, err := ed25519.GenerateKey(bytes.NewReader(private_bytes[:32]))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(private_bytes) == 64 && !bytes.Equal(pub, private_bytes[32:]) {
+		return nil, nil, errors.New("Private key doesn't match its public key")
+	}
+
+	return pub, priv, nil
 }
 
 func KeypairFromSeed(seed string, index uint32) (ed25519.PublicKey, ed25519.PrivateKey) {
@@ -129,6 +88,46 @@ func KeypairFromSeed(seed string, index uint32) (ed25519.PublicKey, ed25519.Priv
 	return pub, priv
 }
 
+// BIP44 coin type registered for nano
+const Bip44CoinType = 165
+
+func slip10Child(key []byte, chainCode []byte, index uint32) ([]byte, []byte) {
+	// ed25519 only supports hardened derivation
+	data := make([]byte, 37)
+	copy(data[1:33], key)
+	binary.BigEndian.PutUint32(data[33:], index|0x80000000)
+
+	mac := hmac.New(sha512.New, chainCode)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+	return sum[:32], sum[32:]
+}
+
+// KeypairFromBip39Seed derives the key at 44'/165'/index' from a 64 byte
+// BIP39 seed using SLIP-0010, as hardware and mobile wallets do.
+func KeypairFromBip39Seed(seed string, index uint32) (ed25519.PublicKey, ed25519.PrivateKey) {
+	seed_data, err := hex.DecodeString(seed)
+	if err != nil {
+		panic("Invalid seed")
+	}
+
+	mac := hmac.New(sha512.New, []byte("ed25519 seed"))
+	mac.Write(seed_data)
+	sum := mac.Sum(nil)
+	key, chainCode := sum[:32], sum[32:]
+
+	for _, i := range []uint32{44, Bip44CoinType, index} {
+		key, chainCode = slip10Child(key, chainCode, i)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(bytes.NewReader(key))
+	if err != nil {
+		panic("Unable to generate ed25519 key")
+	}
+
+	return pub, priv
+}
+
 func GenerateKey() (ed25519.PublicKey, ed25519.PrivateKey) {
 	pubkey, privkey, err := ed25519.GenerateKey(nil)
 	if err != nil {
@@ -3,11 +3,9 @@ package address
 import (
 	"encoding/hex"
 	"testing"
-
-	"github.com/frankh/nano/types"
 )
 
-var valid_addresses = []types.Account{
+var valid_addresses = []string{
 	"nano_38nm8t5rimw6h6j7wyokbs8jiygzs7baoha4pqzhfw1k79npyr1km8w6y7r8",
 	"nano_1awsn43we17c1oshdru4azeqjz9wii41dy8npubm4rg11so7dx3jtqgoeahy",
 	"nano_3arg3asgtigae3xckabaaewkx3bzsh7nwz7jkmjos79ihyaxwphhm6qgjps4",
@@ -17,7 +15,7 @@ var valid_addresses = []types.Account{
 	"xrb_1anrzcuwe64rwxzcco8dkhpyxpi8kd7zsjc1oeimpc3ppca4mrjtwnqposrs",
 }
 
-var invalid_addresses = []types.Account{
+var invalid_addresses = []string{
 	"nano_38nm8t5rimw6h6j7wyokbs8jiygzs7baoha4pqzhfw1k79npyr1km8w6y7r7",
 	"xrc_38nm8t5rimw6h6j7wyokbs8jiygzs7baoha4pqzhfw1k79npyr1km8w6y7r8",
 	"nano38nm8t5rimw6h6j7wyokbs8jiygzs7baoha4pqzhfw1k79npyr1km8w6y7r8",
@@ -27,7 +25,7 @@ var invalid_addresses = []types.Account{
 }
 
 func TestAddressToPub(t *testing.T) {
-	pub, _ := AddressToPub(types.Account("nano_3t6k35gi95xu6tergt6p69ck76ogmitsa8mnijtpxm9fkcm736xtoncuohr3"))
+	pub, _ := AddressToPub("nano_3t6k35gi95xu6tergt6p69ck76ogmitsa8mnijtpxm9fkcm736xtoncuohr3")
 
 	if hex.EncodeToString(pub) != "e89208dd038fbb269987689621d52292ae9c35941a7484756ecced92a65093ba" {
 		t.Errorf("Address got wrong public key")
@@ -53,7 +51,7 @@ func TestKeypairFromSeed(t *testing.T) {
 	seed := "1234567890123456789012345678901234567890123456789012345678901234"
 
 	// Generated from the official RaiBlocks wallet using above seed.
-	expected := map[uint32]types.Account{
+	expected := map[uint32]string{
 		0: "nano_3iwi45me3cgo9aza9wx5f7rder37hw11xtc1ek8psqxw5oxb8cujjad6qp9y",
 		1: "nano_3a9d1h6wt3zp8cqd6dhhgoyizmk1ciemqkrw97ysrphn7anm6xko1wxakaa1",
 		2: "nano_1dz36wby1azyjgh7t9nopjm3k5rduhmntercoz545my9s8nm7gcuthuq9fmq",
@@ -63,7 +61,7 @@ func TestKeypairFromSeed(t *testing.T) {
 
 	for i := uint32(0); i < uint32(len(expected)); i++ {
 		pub, _ := KeypairFromSeed(seed, i)
-		if PubKeyToAddress(pub) != expected[i] {
+		if PubKeyToAddress(pub).String() != expected[i] {
 			t.Errorf("Wallet generation from seed created the wrong address")
 		}
 	}
@@ -75,3 +73,70 @@ func BenchmarkGenerateAddress(b *testing.B) {
 		PubKeyToAddress(pub)
 	}
 }
+
+func TestKeypairFromBip39Seed(t *testing.T) {
+	// Test vector from the nano BIP39/BIP44 documentation
+	seed := "0dc285fde768f7ff29b66ce7252d56ed92fe003b605907f7a4f683c3dc8586d34a914d3c71fc099bb38ee4a59e5b081a3497b7a323e90cc68f67b5837690310c"
+
+	pub, priv := KeypairFromBip39Seed(seed, 0)
+	if hex.EncodeToString(priv[:32]) != "3be4fc2ef3f3b7374e6fc4fb6e7bb153f8a2998b3b3dab50853eabe128024143" {
+		t.Errorf("Derived wrong private key %x", priv[:32])
+	}
+	if PubKeyToAddress(pub).String() != "nano_1pu7p5n3ghq1i1p4rhmek41f5add1uh34xpb94nkbxe8g4a6x1p69emk8y1d" {
+		t.Errorf("Derived wrong address %s", PubKeyToAddress(pub))
+	}
+}
+
+func TestKeypairFromPrivateKey(t *testing.T) {
+	pub, priv, err := KeypairFromPrivateKey("34F0A37AAD20F4A260F0A5B3CB3D7FB50673212263E58A380BC10474BB039CE4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if PubKeyToAddress(pub).String() != "nano_3e3j5tkog48pnny9dmfzj1r16pg8t1e76dz5tmac6iq689wyjfpiij4txtdo" {
+		t.Errorf("Wrong address for private key %s", PubKeyToAddress(pub))
+	}
+
+	if _, _, err := KeypairFromPrivateKey(hex.EncodeToString(priv)); err != nil {
+		t.Errorf("Failed to read expanded private key: %s", err)
+	}
+
+	invalid := []string{
+		"",
+		"34F0",
+		"ZZF0A37AAD20F4A260F0A5B3CB3D7FB50673212263E58A380BC10474BB039CE4",
+		hex.EncodeToString(priv[:32]) + hex.EncodeToString(make([]byte, 32)),
+	}
+	for _, private := range invalid {
+		if _, _, err := KeypairFromPrivateKey(private); err == nil {
+			t.Errorf("Read invalid private key %s", private)
+		}
+	}
+}
+
+func FuzzAddressToPub(f *testing.F) {
+	for _, addr := range append(valid_addresses, invalid_addresses...) {
+		f.Add(addr)
+	}
+	f.Add("")
+	f.Add("nano_")
+	f.Fuzz(func(t *testing.T, account string) {
+		pub, err := AddressToPub(account)
+		if err != nil {
+			return
+		}
+		if len(pub) != 32 {
+			t.Fatalf("Public key is %d bytes", len(pub))
+		}
+		if _, err := AddressToPub(PubKeyToAddress(pub).String()); err != nil {
+			t.Errorf("Address didn't round trip: %s", err)
+		}
+	})
+}
+
+func FuzzKeypairFromPrivateKey(f *testing.F) {
+	f.Add("34F0A37AAD20F4A260F0A5B3CB3D7FB50673212263E58A380BC10474BB039CE4")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, private string) {
+		KeypairFromPrivateKey(private)
+	})
+}
@@ -2,30 +2,31 @@ package blocks
 
 import (
 	"encoding/binary"
-	"encoding/hex"
 	"encoding/json"
 	"hash"
-	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/metrics"
 	"github.com/frankh/nano/types"
 	"github.com/frankh/nano/uint128"
-	"github.com/frankh/nano/utils"
 	"github.com/golang/crypto/blake2b"
+	"github.com/pkg/errors"
 	// We've forked golang's ed25519 implementation
 	// to use blake2b instead of sha3
 	"github.com/frankh/crypto/ed25519"
 )
 
-const LiveGenesisBlockHash types.BlockHash = "991CF190094C00F0B68E2E5F75F6BEE95A2E0BD93CEAA4A6734DB9F19B728948"
-const LiveGenesisSourceHash types.BlockHash = "E89208DD038FBB269987689621D52292AE9C35941A7484756ECCED92A65093BA"
+var LiveGenesisBlockHash = mustBlockHash("991CF190094C00F0B68E2E5F75F6BEE95A2E0BD93CEAA4A6734DB9F19B728948")
+var LiveGenesisSourceHash = mustBlockHash("E89208DD038FBB269987689621D52292AE9C35941A7484756ECCED92A65093BA")
 
 var GenesisAmount uint128.Uint128 = uint128.FromInts(0xffffffffffffffff, 0xffffffffffffffff)
 var WorkThreshold = uint64(0xffffffc000000000)
 
 const TestPrivateKey string = "34F0A37AAD20F4A260F0A5B3CB3D7FB50673212263E58A380BC10474BB039CE4"
 
-var TestGenesisBlock = FromJson([]byte(`{
+var TestGenesisBlock = mustFromJson([]byte(`{
 	"type": "open",
 	"source": "B0311EA55708D6A53C75CDBF88300259C6D018522FE3D4D0A242E431F9E8B6D0",
 	"representative": "nano_3e3j5tkog48pnny9dmfzj1r16pg8t1e76dz5tmac6iq689wyjfpiij4txtdo",
@@ -34,7 +35,7 @@ var TestGenesisBlock = FromJson([]byte(`{
 	"signature": "ECDA914373A2F0CA1296475BAEE40500A7F0A7AD72A5A80C81D7FAB7F6C802B2CC7DB50F5DD0FB25B2EF11761FA7344A158DD5A700B21BD47DE5BD0F63153A02"
 }`)).(*OpenBlock)
 
-var LiveGenesisBlock = FromJson([]byte(`{
+var LiveGenesisBlock = mustFromJson([]byte(`{
 	"type":           "open",
 	"source":         "E89208DD038FBB269987689621D52292AE9C35941A7484756ECCED92A65093BA",
 	"representative": "nano_3t6k35gi95xu6tergt6p69ck76ogmitsa8mnijtpxm9fkcm736xtoncuohr3",
@@ -126,8 +127,7 @@ func (b *OpenBlock) PreviousBlockHash() types.BlockHash {
 }
 
 func (b *OpenBlock) RootHash() types.BlockHash {
-	pub, _ := address.AddressToPub(b.Account)
-	return types.BlockHash(hex.EncodeToString(pub))
+	return types.BlockHash(b.Account)
 }
 
 func (b *ReceiveBlock) RootHash() types.BlockHash {
@@ -167,11 +167,19 @@ func (*ReceiveBlock) Type() BlockType {
 }
 
 func (b *OpenBlock) VerifySignature() (bool, error) {
-	pub, _ := address.AddressToPub(b.Account)
-	res := ed25519.Verify(pub, b.Hash().ToBytes(), b.Signature.ToBytes())
+	hash := b.Hash()
+	res := ed25519.Verify(b.Account[:], hash[:], b.Signature[:])
 	return res, nil
 }
 
+// VerifyBlockSignature checks a block was signed by the account whose
+// chain it's in, which only open blocks include.
+func VerifyBlockSignature(b Block, account types.Account) bool {
+	hash := b.Hash()
+	signature := b.GetSignature()
+	return ed25519.Verify(account[:], hash[:], signature[:])
+}
+
 type RawBlock struct {
 	Type           BlockType
 	Source         types.BlockHash
@@ -184,51 +192,50 @@ type RawBlock struct {
 	Destination    types.Account
 }
 
-func FromJson(b []byte) (block Block) {
-	var raw RawBlock
-	json.Unmarshal(b, &raw)
-	common := CommonBlock{
-		Work:      raw.Work,
-		Signature: raw.Signature,
+func FromJson(b []byte) (block Block, err error) {
+	var header struct {
+		Type BlockType `json:"type"`
+	}
+	err = json.Unmarshal(b, &header)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse block")
 	}
 
-	switch raw.Type {
+	switch header.Type {
 	case Open:
-		b := OpenBlock{
-			raw.Source,
-			raw.Representative,
-			raw.Account,
-			common,
-		}
-		block = &b
+		block = &OpenBlock{}
 	case Send:
-		b := SendBlock{
-			raw.Previous,
-			raw.Destination,
-			raw.Balance,
-			common,
-		}
-		block = &b
+		block = &SendBlock{}
 	case Receive:
-		b := ReceiveBlock{
-			raw.Previous,
-			raw.Source,
-			common,
-		}
-		block = &b
+		block = &ReceiveBlock{}
 	case Change:
-		b := ChangeBlock{
-			raw.Previous,
-			raw.Representative,
-			common,
-		}
-		block = &b
+		block = &ChangeBlock{}
 	default:
-		panic("Unknown block type")
+		return nil, errors.Errorf("Unknown block type %q", header.Type)
 	}
 
+	err = json.Unmarshal(b, block)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse %s block", header.Type)
+	}
+	return block, nil
+}
+
+// Only for blocks built into the binary.
+func mustFromJson(b []byte) Block {
+	block, err := FromJson(b)
+	if err != nil {
+		panic(err)
+	}
 	return block
+}
 
+func mustBlockHash(s string) types.BlockHash {
+	hash, err := types.BlockHashFromString(s)
+	if err != nil {
+		panic(err)
+	}
+	return hash
 }
 
 func (b RawBlock) Hash() (result []byte) {
@@ -247,12 +254,15 @@ func (b RawBlock) Hash() (result []byte) {
 }
 
 func (b RawBlock) HashToString() (result types.BlockHash) {
-	return types.BlockHash(strings.ToUpper(hex.EncodeToString(b.Hash())))
+	return types.BlockHashFromBytes(b.Hash())
 }
 
-func SignMessage(private_key string, message []byte) (signature []byte) {
-	_, priv := address.KeypairFromPrivateKey(private_key)
-	return ed25519.Sign(priv, message)
+func SignMessage(private_key string, message []byte) (signature []byte, err error) {
+	_, priv, err := address.KeypairFromPrivateKey(private_key)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.Sign(priv, message), nil
 }
 
 func HashBytes(inputs ...[]byte) (result []byte) {
@@ -269,30 +279,19 @@ func HashBytes(inputs ...[]byte) (result []byte) {
 }
 
 func HashReceive(previous types.BlockHash, source types.BlockHash) (result []byte) {
-	previous_bytes, _ := hex.DecodeString(string(previous))
-	source_bytes, _ := hex.DecodeString(string(source))
-	return HashBytes(previous_bytes, source_bytes)
+	return HashBytes(previous[:], source[:])
 }
 
 func HashChange(previous types.BlockHash, representative types.Account) (result []byte) {
-	previous_bytes, _ := hex.DecodeString(string(previous))
-	repr_bytes, _ := address.AddressToPub(representative)
-	return HashBytes(previous_bytes, repr_bytes)
+	return HashBytes(previous[:], representative[:])
 }
 
 func HashSend(previous types.BlockHash, destination types.Account, balance uint128.Uint128) (result []byte) {
-	previous_bytes, _ := hex.DecodeString(string(previous))
-	dest_bytes, _ := address.AddressToPub(destination)
-	balance_bytes := balance.GetBytes()
-
-	return HashBytes(previous_bytes, dest_bytes, balance_bytes)
+	return HashBytes(previous[:], destination[:], balance.GetBytes())
 }
 
 func HashOpen(source types.BlockHash, representative types.Account, account types.Account) (result []byte) {
-	source_bytes, _ := hex.DecodeString(string(source))
-	repr_bytes, _ := address.AddressToPub(representative)
-	account_bytes, _ := address.AddressToPub(account)
-	return HashBytes(source_bytes, repr_bytes, account_bytes)
+	return HashBytes(source[:], representative[:], account[:])
 }
 
 // ValidateWork takes the "work" value (little endian from hex)
@@ -325,25 +324,54 @@ func validateNonce(digest hash.Hash, block []byte, nonce uint64) bool {
 }
 
 func ValidateBlockWork(b Block) bool {
-	hash_bytes := b.RootHash().ToBytes()
-	work_bytes, _ := hex.DecodeString(string(b.GetWork()))
+	root := b.RootHash()
+	work := make([]byte, 8)
+	binary.LittleEndian.PutUint64(work, uint64(b.GetWork()))
 
-	res := ValidateWork(hash_bytes, utils.Reversed(work_bytes))
-	return res
+	return ValidateWork(root[:], work)
 }
 
+// Number of goroutines GenerateWorkForHash searches with. Each tries
+// every WorkThreads'th nonce, so with more than one the work found isn't
+// always the lowest valid nonce.
+var WorkThreads = 1
+
+// The rate of attempts is the node's work generation hash rate
+var workAttempts = metrics.NewCounter("nano_work_attempts_total",
+	"Nonces tried while generating work.")
+var workDuration = metrics.NewHistogram("nano_work_generation_seconds",
+	"Time taken to generate work.",
+	[]float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300})
+
 func GenerateWorkForHash(b types.BlockHash) types.Work {
-	block_hash := b.ToBytes()
-	digest, err := blake2b.New(8, nil)
-	if err != nil {
-		panic("Unable to create hash")
+	threads := WorkThreads
+	if threads < 1 {
+		threads = 1
 	}
-	var nonce uint64
-	for ; !validateNonce(digest, block_hash, nonce); nonce++ {
+	start := time.Now()
+	defer func() { workDuration.Observe(time.Since(start).Seconds()) }()
+
+	found := make(chan uint64, threads)
+	var done int32
+	for i := 0; i < threads; i++ {
+		go func(nonce uint64) {
+			digest, err := blake2b.New(8, nil)
+			if err != nil {
+				panic("Unable to create hash")
+			}
+			attempts := 0
+			defer func() { workAttempts.Add(float64(attempts)) }()
+			for ; atomic.LoadInt32(&done) == 0; nonce += uint64(threads) {
+				attempts++
+				if validateNonce(digest, b[:], nonce) {
+					atomic.StoreInt32(&done, 1)
+					found <- nonce
+					return
+				}
+			}
+		}(uint64(i))
 	}
-	work := make([]byte, 8)
-	binary.BigEndian.PutUint64(work, nonce)
-	return types.Work(hex.EncodeToString(work))
+	return types.Work(<-found)
 }
 
 func GenerateWork(b Block) types.Work {
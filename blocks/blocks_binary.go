@@ -0,0 +1,169 @@
+package blocks
+
+import (
+	"encoding"
+	"encoding/binary"
+
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/pkg/errors"
+)
+
+// Binary encodings match the reference node's wire and database layouts:
+// the block's fields in order, then the signature, then the work as a
+// little endian uint64. Balances are big endian.
+
+const (
+	OpenBlockSize    = 32 + 32 + 32 + 64 + 8
+	SendBlockSize    = 32 + 32 + 16 + 64 + 8
+	ReceiveBlockSize = 32 + 32 + 64 + 8
+	ChangeBlockSize  = 32 + 32 + 64 + 8
+)
+
+// BinarySize returns the encoded size of a block type, or 0 if unknown.
+func BinarySize(t BlockType) int {
+	switch t {
+	case Open:
+		return OpenBlockSize
+	case Send:
+		return SendBlockSize
+	case Receive:
+		return ReceiveBlockSize
+	case Change:
+		return ChangeBlockSize
+	}
+	return 0
+}
+
+func appendCommon(data []byte, c CommonBlock) []byte {
+	work := make([]byte, 8)
+	binary.LittleEndian.PutUint64(work, uint64(c.Work))
+	data = append(data, c.Signature[:]...)
+	return append(data, work...)
+}
+
+// Reads the signature and work from the end of an encoded block.
+func readCommon(data []byte) CommonBlock {
+	var c CommonBlock
+	copy(c.Signature[:], data[len(data)-72:])
+	c.Work = types.Work(binary.LittleEndian.Uint64(data[len(data)-8:]))
+	return c
+}
+
+func checkSize(data []byte, t BlockType) error {
+	if len(data) != BinarySize(t) {
+		return errors.Errorf("%s block must be %d bytes, got %d", t, BinarySize(t), len(data))
+	}
+	return nil
+}
+
+func (b OpenBlock) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, OpenBlockSize)
+	data = append(data, b.SourceHash[:]...)
+	data = append(data, b.Representative[:]...)
+	data = append(data, b.Account[:]...)
+	return appendCommon(data, b.CommonBlock), nil
+}
+
+func (b *OpenBlock) UnmarshalBinary(data []byte) error {
+	if err := checkSize(data, Open); err != nil {
+		return err
+	}
+	*b = OpenBlock{
+		types.BlockHashFromBytes(data[0:32]),
+		types.AccountFromBytes(data[32:64]),
+		types.AccountFromBytes(data[64:96]),
+		readCommon(data),
+	}
+	return nil
+}
+
+func (b SendBlock) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, SendBlockSize)
+	data = append(data, b.PreviousHash[:]...)
+	data = append(data, b.Destination[:]...)
+	data = append(data, b.Balance.GetBytes()...)
+	return appendCommon(data, b.CommonBlock), nil
+}
+
+func (b *SendBlock) UnmarshalBinary(data []byte) error {
+	if err := checkSize(data, Send); err != nil {
+		return err
+	}
+	*b = SendBlock{
+		types.BlockHashFromBytes(data[0:32]),
+		types.AccountFromBytes(data[32:64]),
+		uint128.FromBytes(data[64:80]),
+		readCommon(data),
+	}
+	return nil
+}
+
+func (b ReceiveBlock) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, ReceiveBlockSize)
+	data = append(data, b.PreviousHash[:]...)
+	data = append(data, b.SourceHash[:]...)
+	return appendCommon(data, b.CommonBlock), nil
+}
+
+func (b *ReceiveBlock) UnmarshalBinary(data []byte) error {
+	if err := checkSize(data, Receive); err != nil {
+		return err
+	}
+	*b = ReceiveBlock{
+		types.BlockHashFromBytes(data[0:32]),
+		types.BlockHashFromBytes(data[32:64]),
+		readCommon(data),
+	}
+	return nil
+}
+
+func (b ChangeBlock) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, ChangeBlockSize)
+	data = append(data, b.PreviousHash[:]...)
+	data = append(data, b.Representative[:]...)
+	return appendCommon(data, b.CommonBlock), nil
+}
+
+func (b *ChangeBlock) UnmarshalBinary(data []byte) error {
+	if err := checkSize(data, Change); err != nil {
+		return err
+	}
+	*b = ChangeBlock{
+		types.BlockHashFromBytes(data[0:32]),
+		types.AccountFromBytes(data[32:64]),
+		readCommon(data),
+	}
+	return nil
+}
+
+// ToBinary encodes a block without its type, which has to be stored or
+// sent alongside it.
+func ToBinary(block Block) ([]byte, error) {
+	m, ok := block.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, errors.Errorf("Unknown block type %s", block.Type())
+	}
+	return m.MarshalBinary()
+}
+
+func FromBinary(t BlockType, data []byte) (block Block, err error) {
+	switch t {
+	case Open:
+		block = &OpenBlock{}
+	case Send:
+		block = &SendBlock{}
+	case Receive:
+		block = &ReceiveBlock{}
+	case Change:
+		block = &ChangeBlock{}
+	default:
+		return nil, errors.Errorf("Unknown block type %q", t)
+	}
+
+	err = block.(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
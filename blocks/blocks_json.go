@@ -0,0 +1,168 @@
+package blocks
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/pkg/errors"
+)
+
+// JSON encodings match the reference node's block JSON, field order
+// included. Hashes and signatures are upper case hex, work is lower
+// case hex and send balances are 32 upper case hex characters.
+
+type openBlockJson struct {
+	Type           BlockType       `json:"type"`
+	Source         types.BlockHash `json:"source"`
+	Representative types.Account   `json:"representative"`
+	Account        types.Account   `json:"account"`
+	Work           types.Work      `json:"work"`
+	Signature      types.Signature `json:"signature"`
+}
+
+type sendBlockJson struct {
+	Type        BlockType       `json:"type"`
+	Previous    types.BlockHash `json:"previous"`
+	Destination types.Account   `json:"destination"`
+	Balance     string          `json:"balance"`
+	Work        types.Work      `json:"work"`
+	Signature   types.Signature `json:"signature"`
+}
+
+type receiveBlockJson struct {
+	Type      BlockType       `json:"type"`
+	Previous  types.BlockHash `json:"previous"`
+	Source    types.BlockHash `json:"source"`
+	Work      types.Work      `json:"work"`
+	Signature types.Signature `json:"signature"`
+}
+
+type changeBlockJson struct {
+	Type           BlockType       `json:"type"`
+	Previous       types.BlockHash `json:"previous"`
+	Representative types.Account   `json:"representative"`
+	Work           types.Work      `json:"work"`
+	Signature      types.Signature `json:"signature"`
+}
+
+func checkType(actual BlockType, expected BlockType) error {
+	if actual != expected {
+		return errors.Errorf("Expected %s block but got %s", expected, actual)
+	}
+	return nil
+}
+
+// Fields that are left out aren't unmarshalled so need checking separately.
+func checkComplete(data []byte, fields ...string) error {
+	var present map[string]json.RawMessage
+	err := json.Unmarshal(data, &present)
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if _, ok := present[field]; !ok {
+			return errors.Errorf("Block is missing %s", field)
+		}
+	}
+	return nil
+}
+
+func (b OpenBlock) MarshalJSON() ([]byte, error) {
+	return json.Marshal(openBlockJson{Open, b.SourceHash, b.Representative, b.Account, b.Work, b.Signature})
+}
+
+func (b *OpenBlock) UnmarshalJSON(data []byte) error {
+	var raw openBlockJson
+	err := json.Unmarshal(data, &raw)
+	if err == nil {
+		err = checkType(raw.Type, Open)
+	}
+	if err == nil {
+		err = checkComplete(data, "source", "representative", "account", "work", "signature")
+	}
+	if err != nil {
+		return err
+	}
+
+	*b = OpenBlock{raw.Source, raw.Representative, raw.Account, CommonBlock{Work: raw.Work, Signature: raw.Signature}}
+	return nil
+}
+
+func (b SendBlock) MarshalJSON() ([]byte, error) {
+	balance := strings.ToUpper(b.Balance.Hex())
+	return json.Marshal(sendBlockJson{Send, b.PreviousHash, b.Destination, balance, b.Work, b.Signature})
+}
+
+func (b *SendBlock) UnmarshalJSON(data []byte) error {
+	var raw sendBlockJson
+	err := json.Unmarshal(data, &raw)
+	if err == nil {
+		err = checkType(raw.Type, Send)
+	}
+	if err == nil {
+		err = checkComplete(data, "previous", "destination", "balance", "work", "signature")
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(raw.Balance) != 32 {
+		return errors.Errorf("Send balance must be 32 hex characters")
+	}
+	balance, err := uint128.FromHex(raw.Balance)
+	if err != nil {
+		return err
+	}
+
+	*b = SendBlock{raw.Previous, raw.Destination, balance, CommonBlock{Work: raw.Work, Signature: raw.Signature}}
+	return nil
+}
+
+func (b ReceiveBlock) MarshalJSON() ([]byte, error) {
+	return json.Marshal(receiveBlockJson{Receive, b.PreviousHash, b.SourceHash, b.Work, b.Signature})
+}
+
+func (b *ReceiveBlock) UnmarshalJSON(data []byte) error {
+	var raw receiveBlockJson
+	err := json.Unmarshal(data, &raw)
+	if err == nil {
+		err = checkType(raw.Type, Receive)
+	}
+	if err == nil {
+		err = checkComplete(data, "previous", "source", "work", "signature")
+	}
+	if err != nil {
+		return err
+	}
+
+	*b = ReceiveBlock{raw.Previous, raw.Source, CommonBlock{Work: raw.Work, Signature: raw.Signature}}
+	return nil
+}
+
+func (b ChangeBlock) MarshalJSON() ([]byte, error) {
+	return json.Marshal(changeBlockJson{Change, b.PreviousHash, b.Representative, b.Work, b.Signature})
+}
+
+func (b *ChangeBlock) UnmarshalJSON(data []byte) error {
+	var raw changeBlockJson
+	err := json.Unmarshal(data, &raw)
+	if err == nil {
+		err = checkType(raw.Type, Change)
+	}
+	if err == nil {
+		err = checkComplete(data, "previous", "representative", "work", "signature")
+	}
+	if err != nil {
+		return err
+	}
+
+	*b = ChangeBlock{raw.Previous, raw.Representative, CommonBlock{Work: raw.Work, Signature: raw.Signature}}
+	return nil
+}
+
+// ToJson encodes a block as the reference node does.
+func ToJson(block Block) ([]byte, error) {
+	return json.Marshal(block)
+}
@@ -2,17 +2,17 @@ package blocks
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"strings"
 	"testing"
 
-	"github.com/frankh/nano/address"
 	"github.com/frankh/nano/utils"
 )
 
 func TestSignMessage(t *testing.T) {
 	test_private_key_data := "34F0A37AAD20F4A260F0A5B3CB3D7FB50673212263E58A380BC10474BB039CE4"
 
-	block := FromJson([]byte(`{
+	block, err := FromJson([]byte(`{
 		"type":           "open",
 		"source":         "B0311EA55708D6A53C75CDBF88300259C6D018522FE3D4D0A242E431F9E8B6D0",
 		"representative": "nano_3e3j5tkog48pnny9dmfzj1r16pg8t1e76dz5tmac6iq689wyjfpiij4txtdo",
@@ -20,11 +20,18 @@ func TestSignMessage(t *testing.T) {
 		"work":           "9680625b39d3363d",
 		"signature":      "ECDA914373A2F0CA1296475BAEE40500A7F0A7AD72A5A80C81D7FAB7F6C802B2CC7DB50F5DD0FB25B2EF11761FA7344A158DD5A700B21BD47DE5BD0F63153A02"
 	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	signature_bytes := SignMessage(test_private_key_data, block.Hash().ToBytes())
+	hash := block.Hash()
+	signature_bytes, err := SignMessage(test_private_key_data, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
 	signature := strings.ToUpper(hex.EncodeToString(signature_bytes))
 
-	if signature != string(block.GetSignature()) {
+	if signature != block.GetSignature().String() {
 		t.Errorf("Signature %s was expected to be %s", signature, block.GetSignature())
 	}
 
@@ -45,8 +52,8 @@ func BenchmarkGenerateWork(b *testing.B) {
 func TestValidateWork(t *testing.T) {
 	WorkThreshold = 0xffffffc000000000
 
-	live_block_hash, _ := address.AddressToPub(LiveGenesisBlock.Account)
-	live_work_bytes, _ := hex.DecodeString(string(LiveGenesisBlock.Work))
+	live_block_hash := LiveGenesisBlock.Account[:]
+	live_work_bytes, _ := hex.DecodeString(LiveGenesisBlock.Work.String())
 	live_bad_work, _ := hex.DecodeString("0000000000000000")
 
 	if !ValidateBlockWork(LiveGenesisBlock) {
@@ -70,3 +77,111 @@ func TestHashOpen(t *testing.T) {
 		t.Errorf("Genesis block hash is not correct, expected %s, got %s", LiveGenesisBlockHash, LiveGenesisBlock.Hash())
 	}
 }
+
+// Blocks from the live network, encoded as the reference node does
+var jsonBlocks = map[string]string{
+	"687DCB9C8EB8AF9F39D8107C3432A8732EDBED1E3B5E2E0F6B86643D1EB5E24F": `{"type":"send","previous":"B6460102018F076CC32FF2F65AD397299C47F8CA2BE784D5DE394D592C22BE8B","destination":"nano_3zxyk85ky9bc7h83sf5zq3cffnryah55k9oftotiqgdamsgz3opd3q4boh9m","balance":"0000003D11C83DBCFF748EB4B7F7A3C0","work":"bc2f6d2a9ac42776","signature":"59DDEEE5C8ECCC8F20DEF3AF3C4F0726F879082ED051D0C62A54CD69C4A66B020369B7033C5B0F77654173AB24D5C7A64CC4FFF0BDB368FCC989E41A65656904"}`,
+	"7D3E9D79342AA73B7148CB46706D23ED8BB0041A5316D67A053F336ABF0E6B60": `{"type":"receive","previous":"233FF43F2ADE055D4D4BCC1C19A3100B720C21E5548A547B9B21938BBDBB19EE","source":"28A1763099135DADB3F223C0A4138269C7146A6431AF0597D24276BB0A24BAFC","work":"7ccd7bb32c64f262","signature":"BA254A264BAA0BCBA5962A77E15D4EB021043FFFEA9E4391E179D467C66C69675E9634F9C124060FC65D5B2F67FCA38E8BA93BF910EB337010BC51E652B0640D"}`,
+	"4AABA9923AC794B635B8C3CC275C37F0D28E43D44EB5E27F8B23955E335D5DD3": `{"type":"change","previous":"611A6FA8736497E6C1BD9AE42090F0F646F56B32B6E02F804C2295B3888A2FED","representative":"nano_3rep4ox5pni5axcwo64tt53pdeekni319p6r9r5q36xwtu6qcym6f4674c6w","work":"c171346d8313e01d","signature":"A772CD1736F8DF3C6E382BDC7EED1D48628A65263CE50B12A603B6782D2C3E5EE2280B3C97ACEA67FF003CA3690B2BBEE160E375D0CAA220109D63ED35BBAD0F"}`,
+	"991CF190094C00F0B68E2E5F75F6BEE95A2E0BD93CEAA4A6734DB9F19B728948": `{"type":"open","source":"E89208DD038FBB269987689621D52292AE9C35941A7484756ECCED92A65093BA","representative":"nano_3t6k35gi95xu6tergt6p69ck76ogmitsa8mnijtpxm9fkcm736xtoncuohr3","account":"nano_3t6k35gi95xu6tergt6p69ck76ogmitsa8mnijtpxm9fkcm736xtoncuohr3","work":"62f05417dd3fb691","signature":"9F0C933C8ADE004D808EA1985FA746A7E95BA2A38F867640F53EC8F180BDFE9E2C1268DEAD7C2664F356E37ABA362BC58E46DBA03E523A7B5A19E4B6EB12BB02"}`,
+}
+
+func TestJson(t *testing.T) {
+	for hash, raw := range jsonBlocks {
+		block, err := FromJson([]byte(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Hash().String() != hash {
+			t.Errorf("Parsed %s block has wrong hash %s", block.Type(), block.Hash())
+		}
+
+		encoded, err := ToJson(block)
+		if err != nil || string(encoded) != raw {
+			t.Errorf("Block didn't round trip\n%s\n%s", raw, encoded)
+		}
+	}
+}
+
+func TestJsonInvalid(t *testing.T) {
+	invalid := []string{
+		`{"type":"send","previous":"B646","destination":"nano_3zxyk85ky9bc7h83sf5zq3cffnryah55k9oftotiqgdamsgz3opd3q4boh9m","balance":"0000003D11C83DBCFF748EB4B7F7A3C0","work":"bc2f6d2a9ac42776","signature":"59DDEEE5C8ECCC8F20DEF3AF3C4F0726F879082ED051D0C62A54CD69C4A66B020369B7033C5B0F77654173AB24D5C7A64CC4FFF0BDB368FCC989E41A65656904"}`,
+		`{"type":"send","previous":"B6460102018F076CC32FF2F65AD397299C47F8CA2BE784D5DE394D592C22BE8B","destination":"nano_3zxyk85ky9bc7h83sf5zq3cffnryah55k9oftotiqgdamsgz3opd3q4boh9n","balance":"0000003D11C83DBCFF748EB4B7F7A3C0","work":"bc2f6d2a9ac42776","signature":"59DDEEE5C8ECCC8F20DEF3AF3C4F0726F879082ED051D0C62A54CD69C4A66B020369B7033C5B0F77654173AB24D5C7A64CC4FFF0BDB368FCC989E41A65656904"}`,
+		`{"type":"send","previous":"B6460102018F076CC32FF2F65AD397299C47F8CA2BE784D5DE394D592C22BE8B","destination":"nano_3zxyk85ky9bc7h83sf5zq3cffnryah55k9oftotiqgdamsgz3opd3q4boh9m","balance":"1000","work":"bc2f6d2a9ac42776","signature":"59DDEEE5C8ECCC8F20DEF3AF3C4F0726F879082ED051D0C62A54CD69C4A66B020369B7033C5B0F77654173AB24D5C7A64CC4FFF0BDB368FCC989E41A65656904"}`,
+		`{"type":"change","previous":"611A6FA8736497E6C1BD9AE42090F0F646F56B32B6E02F804C2295B3888A2FED","representative":"nano_3rep4ox5pni5axcwo64tt53pdeekni319p6r9r5q36xwtu6qcym6f4674c6w","work":"c171346d","signature":"59DDEEE5C8ECCC8F20DEF3AF3C4F0726F879082ED051D0C62A54CD69C4A66B020369B7033C5B0F77654173AB24D5C7A64CC4FFF0BDB368FCC989E41A65656904"}`,
+	}
+
+	for _, raw := range invalid {
+		var b SendBlock
+		var c ChangeBlock
+		if json.Unmarshal([]byte(raw), &b) == nil && json.Unmarshal([]byte(raw), &c) == nil {
+			t.Errorf("Parsed invalid block %s", raw)
+		}
+	}
+
+	var b ReceiveBlock
+	if json.Unmarshal([]byte(jsonBlocks[LiveGenesisBlockHash.String()]), &b) == nil {
+		t.Errorf("Parsed open block as a receive")
+	}
+
+	for _, raw := range append(invalid, ``, `[]`, `{"type":"state"}`, `{"type":"open"`) {
+		if _, err := FromJson([]byte(raw)); err == nil {
+			t.Errorf("FromJson parsed invalid block %s", raw)
+		}
+	}
+}
+
+func FuzzFromJson(f *testing.F) {
+	for _, raw := range jsonBlocks {
+		f.Add([]byte(raw))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		block, err := FromJson(data)
+		if err != nil {
+			return
+		}
+		ValidateBlockWork(block)
+		encoded, err := ToJson(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := FromJson(encoded)
+		if err != nil {
+			t.Fatalf("Re-encoded block didn't parse: %s", err)
+		}
+		if decoded.Hash() != block.Hash() {
+			t.Errorf("Block hash changed after round trip")
+		}
+	})
+}
+
+func TestBinary(t *testing.T) {
+	for hash, raw := range jsonBlocks {
+		block, _ := FromJson([]byte(raw))
+		data, err := ToBinary(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != BinarySize(block.Type()) {
+			t.Errorf("Encoded %s block is %d bytes", block.Type(), len(data))
+		}
+
+		decoded, err := FromBinary(block.Type(), data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Hash().String() != hash || decoded.GetWork() != block.GetWork() || decoded.GetSignature() != block.GetSignature() {
+			t.Errorf("Block didn't round trip %s", hash)
+		}
+
+		if _, err := FromBinary(block.Type(), data[1:]); err == nil {
+			t.Errorf("Decoded truncated %s block", block.Type())
+		}
+	}
+
+	// The work is little endian, as on the wire
+	data, _ := ToBinary(LiveGenesisBlock)
+	if hex.EncodeToString(data[len(data)-8:]) != "91b63fdd1754f062" {
+		t.Errorf("Work encoded badly %x", data[len(data)-8:])
+	}
+}
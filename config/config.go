@@ -0,0 +1,388 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/logging"
+	"github.com/frankh/nano/uint128"
+	toml "github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
+)
+
+// Environment variables override settings by their path in the JSON, upper
+// cased and joined with underscores after this prefix, e.g. NANO_NODE_LISTEN.
+// Lists are comma separated.
+const EnvPrefix = "NANO_"
+
+// A Duration is written as a string such as "20s" or "5m".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+type Config struct {
+	// live or test
+	Network string `json:"network"`
+	// Defaults to DATA for the live network and TESTDATA for the test network
+	DataDir string     `json:"data_dir"`
+	Node    NodeConfig `json:"node"`
+	// Not served yet, the settings are checked so configurations can be
+	// written ahead of it
+	RPC       ServerConfig `json:"rpc"`
+	WebSocket ServerConfig `json:"websocket"`
+	// Prometheus metrics, served on /metrics
+	Metrics ServerConfig `json:"metrics"`
+	Work    WorkConfig   `json:"work"`
+	// Private keys of representatives to vote with. Not used yet as the
+	// node doesn't vote, the keys are checked so configurations can be
+	// written ahead of it
+	Representatives []string       `json:"representatives"`
+	Logging         LogConfig      `json:"logging"`
+	Receiver        ReceiverConfig `json:"receiver"`
+}
+
+type NodeConfig struct {
+	Listen            string   `json:"listen"`
+	PacketSize        int      `json:"packet_size"`
+	KeepaliveInterval Duration `json:"keepalive_interval"`
+	PeersToShare      int      `json:"peers_to_share"`
+	// Realtime TCP connections allowed to or from one IP address
+	ConnectionsPerIP int `json:"connections_per_ip"`
+	// Bytes a second that may be sent to one peer, 0 for no limit
+	BandwidthPerPeer int `json:"bandwidth_per_peer"`
+	// Peers to contact on startup, as host:port
+	Peers []string `json:"peers"`
+}
+
+type ServerConfig struct {
+	Enabled bool   `json:"enabled"`
+	Listen  string `json:"listen"`
+}
+
+type WorkConfig struct {
+	Threads int `json:"threads"`
+}
+
+// The node can receive sends to a wallet file's accounts as they arrive.
+// The wallet password is read from $NANO_WALLET_PASSWORD.
+type ReceiverConfig struct {
+	Enabled bool   `json:"enabled"`
+	Wallet  string `json:"wallet"`
+	// Smallest send to receive in Mnano, smaller ones are left receivable
+	Threshold string   `json:"threshold"`
+	Interval  Duration `json:"interval"`
+}
+
+type LogConfig struct {
+	Level string `json:"level"`
+	// Levels for components and the components under them, overriding
+	// Level, e.g. {"node.net": "debug"}
+	Components map[string]string `json:"components"`
+	// Logs go to stderr when empty
+	File string `json:"file"`
+}
+
+func Default() *Config {
+	return &Config{
+		Network: "live",
+		Node: NodeConfig{
+			Listen:            ":7075",
+			PacketSize:        512,
+			KeepaliveInterval: Duration{20 * time.Second},
+			PeersToShare:      8,
+			ConnectionsPerIP:  4,
+			BandwidthPerPeer:  256 * 1024,
+			Peers:             []string{"[::ffff:192.168.0.70]:7075"},
+		},
+		RPC:             ServerConfig{false, "[::1]:7076"},
+		WebSocket:       ServerConfig{true, ":7078"},
+		Metrics:         ServerConfig{false, "[::1]:7077"},
+		Work:            WorkConfig{runtime.NumCPU()},
+		Representatives: []string{},
+		Logging:         LogConfig{"info", map[string]string{}, ""},
+		Receiver:        ReceiverConfig{false, "", "0.000001", Duration{time.Minute}},
+	}
+}
+
+// Load builds the configuration from the defaults, overridden by the file
+// at path if path isn't empty, overridden by environment variables. The
+// file is TOML if its name ends in .toml and JSON otherwise, with the same
+// setting names either way. The result is validated.
+func Load(path string) (*Config, error) {
+	c := Default()
+
+	if path != "" {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(path, ".toml") {
+			raw, err = tomlToJSON(raw)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not parse config file %s", path)
+			}
+		}
+		err = c.parse(raw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse config file %s", path)
+		}
+	}
+
+	err := c.ApplyEnv(os.Environ())
+	if err != nil {
+		return nil, err
+	}
+
+	return c, c.Validate()
+}
+
+// Settings missing from the file keep their current values, unknown
+// settings are an error so typos don't go unnoticed.
+func (c *Config) parse(raw []byte) error {
+	var fields map[string]interface{}
+	err := json.Unmarshal(raw, &fields)
+	if err != nil {
+		return err
+	}
+	err = checkFields(reflect.TypeOf(*c), fields, "")
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, c)
+}
+
+// TOML tables and keys map directly onto JSON objects, so TOML files are
+// converted and then read like JSON ones.
+func tomlToJSON(raw []byte) ([]byte, error) {
+	tree, err := toml.LoadBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(tree.ToMap())
+}
+
+func jsonName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+func checkFields(t reflect.Type, fields map[string]interface{}, path string) error {
+	for name, value := range fields {
+		field, ok := fieldByJsonName(t, name)
+		if !ok {
+			return errors.Errorf("Unknown setting %s%s", path, name)
+		}
+		if nested, ok := value.(map[string]interface{}); ok && field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(Duration{}) {
+			if err := checkFields(field.Type, nested, path+name+"."); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func fieldByJsonName(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if jsonName(t.Field(i)) == name {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// ApplyEnv overrides settings from environment variables, given as
+// KEY=value like os.Environ.
+func (c *Config) ApplyEnv(environ []string) error {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if i := strings.IndexByte(kv, '='); i > 0 && strings.HasPrefix(kv, EnvPrefix) {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return applyEnv(reflect.ValueOf(c).Elem(), EnvPrefix, env)
+}
+
+func applyEnv(v reflect.Value, prefix string, env map[string]string) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name := prefix + strings.ToUpper(jsonName(v.Type().Field(i)))
+
+		if field.Kind() == reflect.Struct && field.Type() != reflect.TypeOf(Duration{}) {
+			if err := applyEnv(field, name+"_", env); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := env[name]
+		if !ok {
+			continue
+		}
+		if err := setFromString(field, value); err != nil {
+			return errors.Wrapf(err, "could not parse %s", name)
+		}
+	}
+	return nil
+}
+
+func setFromString(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeOf(Duration{}) {
+		return field.Addr().Interface().(*Duration).UnmarshalText([]byte(value))
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		field.Set(reflect.ValueOf(splitList(value)))
+	case reflect.Map:
+		// Given as key=value pairs, e.g. node.net=debug,store=warn
+		m := make(map[string]string)
+		for _, pair := range splitList(value) {
+			i := strings.IndexByte(pair, '=')
+			if i < 0 {
+				return errors.Errorf("%q is not a key=value pair", pair)
+			}
+			m[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+		}
+		field.Set(reflect.ValueOf(m))
+	default:
+		return errors.Errorf("Unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func checkAddress(name string, addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Errorf("%s %q is not a host:port address", name, addr)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return errors.Errorf("%s %q has an invalid port", name, addr)
+	}
+	return nil
+}
+
+// Validate checks every setting, returning all the problems found.
+func (c *Config) Validate() error {
+	problems := make([]string, 0)
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	checkf := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	checkf(c.Network == "live" || c.Network == "test", "network must be live or test, not %q", c.Network)
+	check(checkAddress("node.listen", c.Node.Listen))
+	// The reference node's largest message is well under 512 bytes, UDP
+	// payloads can't be larger than 65507
+	checkf(c.Node.PacketSize >= 512 && c.Node.PacketSize <= 65507, "node.packet_size must be between 512 and 65507")
+	checkf(c.Node.KeepaliveInterval.Duration >= time.Second, "node.keepalive_interval must be at least 1s")
+	checkf(c.Node.PeersToShare >= 1 && c.Node.PeersToShare <= 8, "node.peers_to_share must be between 1 and 8")
+	checkf(c.Node.ConnectionsPerIP >= 1, "node.connections_per_ip must be at least 1")
+	checkf(c.Node.BandwidthPerPeer >= 0, "node.bandwidth_per_peer can't be negative")
+	for _, peer := range c.Node.Peers {
+		check(checkAddress("node.peers entry", peer))
+	}
+	if c.RPC.Enabled {
+		check(checkAddress("rpc.listen", c.RPC.Listen))
+	}
+	if c.WebSocket.Enabled {
+		check(checkAddress("websocket.listen", c.WebSocket.Listen))
+	}
+	if c.Metrics.Enabled {
+		check(checkAddress("metrics.listen", c.Metrics.Listen))
+	}
+	checkf(c.Work.Threads >= 1, "work.threads must be at least 1")
+	for i, key := range c.Representatives {
+		if _, _, err := address.KeypairFromPrivateKey(key); err != nil {
+			problems = append(problems, fmt.Sprintf("representatives entry %d is not a private key: %s", i, err))
+		}
+	}
+	if _, err := logging.ParseLevel(c.Logging.Level); err != nil {
+		problems = append(problems, fmt.Sprintf("logging.level: %s", err))
+	}
+	for component, level := range c.Logging.Components {
+		if _, err := logging.ParseLevel(level); err != nil {
+			problems = append(problems, fmt.Sprintf("logging.components %s: %s", component, err))
+		}
+	}
+	if c.Receiver.Enabled {
+		checkf(c.Receiver.Wallet != "", "receiver.wallet must be set when the receiver is enabled")
+		checkf(c.Receiver.Interval.Duration >= time.Second, "receiver.interval must be at least 1s")
+	}
+	if _, err := uint128.Parse(c.Receiver.Threshold, uint128.MNano); err != nil {
+		problems = append(problems, fmt.Sprintf("receiver.threshold: %s", err))
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("Invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Dump writes the configuration as JSON, in the format Load reads.
+// Representative keys are replaced so they aren't printed, so with any
+// set the output has to have them put back before it can be loaded.
+func (c *Config) Dump() ([]byte, error) {
+	redacted := *c
+	redacted.Representatives = make([]string, len(c.Representatives))
+	for i := range redacted.Representatives {
+		redacted.Representatives[i] = "<redacted>"
+	}
+
+	var buf bytes.Buffer
+	raw, err := json.Marshal(&redacted)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Indent(&buf, raw, "", "  ")
+	buf.WriteByte('\n')
+	return buf.Bytes(), err
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultValid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Errorf("Default config is invalid: %s", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	c := Default()
+	err := c.parse([]byte(`{"network": "test", "node": {"keepalive_interval": "1m", "peers": []}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Network != "test" || c.Node.KeepaliveInterval.Duration != time.Minute || len(c.Node.Peers) != 0 {
+		t.Errorf("Settings weren't read from the file")
+	}
+	if c.Node.Listen != ":7075" {
+		t.Errorf("Setting missing from the file lost its default")
+	}
+
+	err = Default().parse([]byte(`{"node": {"listn": ":7075"}}`))
+	if err == nil || !strings.Contains(err.Error(), "node.listn") {
+		t.Errorf("Unknown setting wasn't rejected: %v", err)
+	}
+}
+
+func TestParseToml(t *testing.T) {
+	raw, err := tomlToJSON([]byte(`
+network = "test"
+
+[node]
+keepalive_interval = "1m"
+packet_size = 600
+peers = ["[::1]:7075"]
+
+[logging.components]
+"node.net" = "debug"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Default()
+	if err := c.parse(raw); err != nil {
+		t.Fatal(err)
+	}
+	if c.Network != "test" || c.Node.KeepaliveInterval.Duration != time.Minute || c.Node.PacketSize != 600 ||
+		len(c.Node.Peers) != 1 || c.Logging.Components["node.net"] != "debug" {
+		t.Errorf("Settings weren't read from the TOML %+v", c)
+	}
+
+	if _, err := tomlToJSON([]byte(`network = `)); err == nil {
+		t.Errorf("Invalid TOML wasn't rejected")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	c := Default()
+	err := c.ApplyEnv([]string{
+		"NANO_NODE_LISTEN=:7000",
+		"NANO_NODE_PEERS=a:1, b:2",
+		"NANO_WEBSOCKET_ENABLED=false",
+		"NANO_WORK_THREADS=3",
+		"NANO_NODE_KEEPALIVE_INTERVAL=5s",
+		"NANO_LOGGING_COMPONENTS=node.net=debug, store=warn",
+		"HOME=/root",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Node.Listen != ":7000" || c.WebSocket.Enabled || c.Work.Threads != 3 {
+		t.Errorf("Settings weren't read from the environment")
+	}
+	if len(c.Node.Peers) != 2 || c.Node.Peers[1] != "b:2" {
+		t.Errorf("List wasn't split: %v", c.Node.Peers)
+	}
+	if c.Node.KeepaliveInterval.Duration != 5*time.Second {
+		t.Errorf("Duration wasn't parsed")
+	}
+	if len(c.Logging.Components) != 2 || c.Logging.Components["node.net"] != "debug" {
+		t.Errorf("Map wasn't parsed: %v", c.Logging.Components)
+	}
+
+	if err := Default().ApplyEnv([]string{"NANO_WORK_THREADS=many"}); err == nil {
+		t.Errorf("Invalid number wasn't rejected")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := Default()
+	c.Network = "beta"
+	c.Node.Listen = "7075"
+	c.Work.Threads = 0
+	c.Node.ConnectionsPerIP = 0
+	c.Node.BandwidthPerPeer = -1
+	c.Representatives = []string{"not a key"}
+	c.Logging.Components = map[string]string{"store": "loud"}
+	c.Receiver.Enabled = true
+	c.Receiver.Threshold = "1.2.3"
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("Invalid config was accepted")
+	}
+	for _, setting := range []string{"network", "node.listen", "node.connections_per_ip", "node.bandwidth_per_peer", "work.threads", "representatives", "logging.components store", "receiver.wallet", "receiver.threshold"} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Errorf("Problem with %s wasn't reported", setting)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	c := Default()
+	c.Representatives = []string{"34F0A37AAD20F4A260F0A5B3CB3D7FB50673212263E58A380BC10474BB039CE4"}
+	raw, err := c.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), c.Representatives[0]) {
+		t.Errorf("Representative key was dumped")
+	}
+
+	d := Default()
+	if err := d.parse(raw); err != nil {
+		t.Fatal(err)
+	}
+	if d.Node.KeepaliveInterval != c.Node.KeepaliveInterval || d.Node.Listen != c.Node.Listen {
+		t.Errorf("Dump didn't read back the same")
+	}
+}
@@ -0,0 +1,218 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Lines are written in logfmt, e.g.
+//   time=2018-01-02T15:04:05.000Z level=info component=node.net msg="Added peer" peer=[::1]:7075
+// so they can be read by people and parsed by log collectors.
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if s == name {
+			return Level(i), nil
+		}
+	}
+	return Info, errors.Errorf("Unknown log level %q, must be one of %s", s, strings.Join(levelNames, ", "))
+}
+
+var lock sync.Mutex
+var output io.Writer = os.Stderr
+var defaultLevel = Info
+
+// Levels set for components, a component without one uses its parent's,
+// so setting "node" covers "node.net" too.
+var levels = make(map[string]Level)
+
+var now = time.Now
+
+func SetOutput(w io.Writer) {
+	lock.Lock()
+	output = w
+	lock.Unlock()
+}
+
+// SetLevel sets the lowest level logged for a component and the
+// components under it, or for every component if component is empty.
+func SetLevel(component string, level Level) {
+	lock.Lock()
+	defer lock.Unlock()
+	if component == "" {
+		defaultLevel = level
+	} else {
+		levels[component] = level
+	}
+}
+
+// ResetLevels logs info and above for every component.
+func ResetLevels() {
+	lock.Lock()
+	defer lock.Unlock()
+	defaultLevel = Info
+	levels = make(map[string]Level)
+}
+
+func componentLevel(component string) Level {
+	for {
+		if level, ok := levels[component]; ok {
+			return level
+		}
+		i := strings.LastIndexByte(component, '.')
+		if i < 0 {
+			return defaultLevel
+		}
+		component = component[:i]
+	}
+}
+
+// Messages a rate limited logger has held back, by component, level and
+// message.
+type limitState struct {
+	last       time.Time
+	suppressed int
+}
+
+var limits = make(map[string]*limitState)
+
+// A Logger tags lines with its component and fields. Fields are given as
+// alternating keys and values.
+type Logger struct {
+	component string
+	fields    []interface{}
+	interval  time.Duration
+}
+
+func New(component string) *Logger {
+	return &Logger{component, nil, 0}
+}
+
+// With returns a logger that adds fields to every line.
+func (l *Logger) With(fields ...interface{}) *Logger {
+	all := make([]interface{}, 0, len(l.fields)+len(fields))
+	all = append(append(all, l.fields...), fields...)
+	return &Logger{l.component, all, l.interval}
+}
+
+// Limit returns a logger that writes each message at most once per
+// interval, for errors that can repeat for every packet. The number held
+// back is added to the next line written.
+func (l *Logger) Limit(interval time.Duration) *Logger {
+	return &Logger{l.component, l.fields, interval}
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	return level >= componentLevel(l.component)
+}
+
+func (l *Logger) Debug(msg string, fields ...interface{}) {
+	l.log(Debug, msg, fields)
+}
+
+func (l *Logger) Info(msg string, fields ...interface{}) {
+	l.log(Info, msg, fields)
+}
+
+func (l *Logger) Warn(msg string, fields ...interface{}) {
+	l.log(Warn, msg, fields)
+}
+
+func (l *Logger) Error(msg string, fields ...interface{}) {
+	l.log(Error, msg, fields)
+}
+
+func (l *Logger) log(level Level, msg string, fields []interface{}) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if level < componentLevel(l.component) {
+		return
+	}
+
+	t := now()
+	suppressed := 0
+	if l.interval > 0 {
+		key := l.component + "\xff" + level.String() + "\xff" + msg
+		state := limits[key]
+		if state != nil && t.Sub(state.last) < l.interval {
+			state.suppressed++
+			return
+		}
+		if state != nil {
+			suppressed = state.suppressed
+		}
+		limits[key] = &limitState{t, 0}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("time=")
+	b.WriteString(t.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+	writeField(&b, "level", level)
+	writeField(&b, "component", l.component)
+	writeField(&b, "msg", msg)
+	writeFields(&b, l.fields)
+	writeFields(&b, fields)
+	if suppressed > 0 {
+		writeField(&b, "suppressed", suppressed)
+	}
+	b.WriteByte('\n')
+	output.Write(b.Bytes())
+}
+
+func writeFields(b *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 == len(fields) {
+			writeField(b, "extra", fields[i])
+			break
+		}
+		writeField(b, fmt.Sprint(fields[i]), fields[i+1])
+	}
+}
+
+func writeField(b *bytes.Buffer, key string, value interface{}) {
+	var s string
+	switch v := value.(type) {
+	case error:
+		s = v.Error()
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(key)
+	b.WriteByte('=')
+	if s == "" || strings.ContainsAny(s, " =\"\\\n\t") {
+		s = fmt.Sprintf("%q", s)
+	}
+	b.WriteString(s)
+}
@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func capture() *bytes.Buffer {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	ResetLevels()
+	t := time.Date(2018, 1, 2, 15, 4, 5, 0, time.UTC)
+	now = func() time.Time { return t }
+	return &buf
+}
+
+func TestFormat(t *testing.T) {
+	buf := capture()
+
+	New("node.net").With("peer", "[::1]:7075").Info("Added peer", "count", 3, "err", errors.New("bad thing"), "empty", "")
+	expected := `time=2018-01-02T15:04:05.000Z level=info component=node.net msg="Added peer" peer=[::1]:7075 count=3 err="bad thing" empty=""` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Wrong log line:\n%s", buf.String())
+	}
+}
+
+func TestLevels(t *testing.T) {
+	buf := capture()
+	SetLevel("", Warn)
+	SetLevel("node", Debug)
+	SetLevel("node.net", Error)
+
+	New("store").Info("hidden")
+	New("store").Warn("shown store")
+	New("node.blocks").Debug("shown node.blocks")
+	New("node.net").Warn("hidden")
+	New("node.net.udp").Error("shown node.net.udp")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || strings.Contains(buf.String(), "hidden") {
+		t.Errorf("Wrong lines logged:\n%s", buf.String())
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("Unknown level parsed")
+	}
+	if level, _ := ParseLevel("warn"); level != Warn {
+		t.Errorf("Wrong level parsed")
+	}
+}
+
+func TestLimit(t *testing.T) {
+	buf := capture()
+	start := now()
+	logger := New("node.net").Limit(time.Minute)
+
+	for i := 0; i < 5; i++ {
+		logger.Warn("Failed to read packet")
+	}
+	logger.Warn("Failed to send keepalive")
+	if strings.Count(buf.String(), "\n") != 2 {
+		t.Fatalf("Repeated message not limited:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	now = func() time.Time { return start.Add(time.Minute) }
+	logger.Warn("Failed to read packet")
+	if !strings.Contains(buf.String(), "suppressed=4") {
+		t.Errorf("Suppressed count not logged:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,225 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/frankh/nano/logging"
+)
+
+// Metrics are served in the Prometheus text format. The node only needs
+// counters, gauges and histograms so they're implemented here rather than
+// pulling in the client library.
+
+var logger = logging.New("metrics")
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+var registry = make(map[string]metric)
+var registryLock sync.Mutex
+
+func register(m metric) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if registry[m.name()] != nil {
+		panic("Metric registered twice: " + m.name())
+	}
+	registry[m.name()] = m
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, names[i], labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// A Counter only goes up, optionally split by labels. Values are given
+// for the labels in the order they were named.
+type Counter struct {
+	metricName string
+	help       string
+	labels     []string
+	lock       sync.Mutex
+	values     map[string]float64
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{name, help, labels, sync.Mutex{}, make(map[string]float64)}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if len(labelValues) != len(c.labels) {
+		panic("Wrong number of label values for " + c.metricName)
+	}
+	key := strings.Join(labelValues, "\xff")
+	c.lock.Lock()
+	c.values[key] += v
+	c.lock.Unlock()
+}
+
+// Value returns the count for the given label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.values[strings.Join(labelValues, "\xff")]
+}
+
+func (c *Counter) name() string {
+	return c.metricName
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	writeHeader(w, c.metricName, c.help, "counter")
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %s\n", c.metricName, formatValue(c.values[""]))
+		return
+	}
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		labels := formatLabels(c.labels, strings.Split(key, "\xff"))
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, labels, formatValue(c.values[key]))
+	}
+}
+
+// A GaugeFunc is read when metrics are requested, for values the node
+// already keeps track of.
+type GaugeFunc struct {
+	metricName string
+	help       string
+	fn         func() float64
+}
+
+func NewGaugeFunc(name string, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{name, help, fn}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) name() string {
+	return g.metricName
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.metricName, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.metricName, formatValue(g.fn()))
+}
+
+// A Histogram counts observations into buckets by their upper bounds,
+// which must be in increasing order.
+type Histogram struct {
+	metricName string
+	help       string
+	buckets    []float64
+	lock       sync.Mutex
+	counts     []uint64
+	count      uint64
+	sum        float64
+}
+
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	h := &Histogram{name, help, buckets, sync.Mutex{}, make([]uint64, len(buckets)), 0, 0}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) name() string {
+	return h.metricName
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	writeHeader(w, h.metricName, h.help, "histogram")
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.metricName, formatValue(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.metricName, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.metricName, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.metricName, h.count)
+}
+
+// Write writes every metric in the text format, sorted by name.
+func Write(w io.Writer) {
+	registryLock.Lock()
+	metrics := make([]metric, 0, len(registry))
+	for _, m := range registry {
+		metrics = append(metrics, m)
+	}
+	registryLock.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name() < metrics[j].name() })
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	Write(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", Handler)
+	logger.Info("Serving metrics", "addr", addr)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_counter_total", "A counter.", "type", "result")
+	c.Inc("b", "ok")
+	c.Add(2, "a", `say "hi"`)
+	c.Inc("b", "ok")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	expected := `# HELP test_counter_total A counter.
+# TYPE test_counter_total counter
+test_counter_total{type="a",result="say \"hi\""} 2
+test_counter_total{type="b",result="ok"} 2
+`
+	if buf.String() != expected {
+		t.Errorf("Wrong counter output:\n%s", buf.String())
+	}
+	if c.Value("b", "ok") != 2 {
+		t.Errorf("Wrong counter value")
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_seconds", "A histogram.", []float64{1, 5})
+	h.Observe(0.5)
+	h.Observe(2)
+	h.Observe(10)
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	expected := `# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="5"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 12.5
+test_seconds_count 3
+`
+	if buf.String() != expected {
+		t.Errorf("Wrong histogram output:\n%s", buf.String())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	NewGaugeFunc("test_gauge", "A gauge.", func() float64 { return 7 })
+	NewCounter("test_handler_total", "Another counter.")
+
+	w := httptest.NewRecorder()
+	Handler(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	if !strings.Contains(body, "test_gauge 7\n") || !strings.Contains(body, "test_handler_total 0\n") {
+		t.Errorf("Metrics missing from output:\n%s", body)
+	}
+	if strings.Index(body, "test_gauge") > strings.Index(body, "test_handler_total") {
+		t.Errorf("Metrics not sorted by name")
+	}
+}
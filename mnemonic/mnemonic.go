@@ -0,0 +1,140 @@
+package mnemonic
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"strings"
+
+	"github.com/golang/crypto/pbkdf2"
+	"github.com/pkg/errors"
+)
+
+// BIP39 mnemonics encode 128 to 256 bits of entropy plus a checksum of
+// one bit per 32 bits of entropy, as words of 11 bits each. A 24 word
+// mnemonic holds 256 bits, exactly one nano seed.
+
+var words = strings.Fields(english)
+var wordIndex = make(map[string]int, len(words))
+
+func init() {
+	for i, word := range words {
+		wordIndex[word] = i
+	}
+}
+
+// Generate returns a new random mnemonic with the given bits of entropy,
+// use 256 for a mnemonic that can be converted to a nano seed.
+func Generate(bits int) (string, error) {
+	if bits < 128 || bits > 256 || bits%32 != 0 {
+		return "", errors.Errorf("Invalid entropy size %d bits", bits)
+	}
+
+	entropy := make([]byte, bits/8)
+	_, err := rand.Read(entropy)
+	if err != nil {
+		return "", errors.Wrap(err, "could not generate entropy")
+	}
+	return FromEntropy(entropy)
+}
+
+func checksum(entropy []byte) byte {
+	hash := sha256.Sum256(entropy)
+	checksumBits := uint(len(entropy) / 4)
+	return hash[0] >> (8 - checksumBits)
+}
+
+func FromEntropy(entropy []byte) (string, error) {
+	if len(entropy) < 16 || len(entropy) > 32 || len(entropy)%4 != 0 {
+		return "", errors.Errorf("Invalid entropy length %d bytes", len(entropy))
+	}
+
+	checksumBits := uint(len(entropy) / 4)
+	data := append(append([]byte{}, entropy...), checksum(entropy)<<(8-checksumBits))
+
+	count := (len(entropy)*8 + int(checksumBits)) / 11
+	result := make([]string, count)
+	for i := 0; i < count; i++ {
+		index := 0
+		for bit := i * 11; bit < (i+1)*11; bit++ {
+			index = index<<1 | int(data[bit/8]>>(7-uint(bit%8))&1)
+		}
+		result[i] = words[index]
+	}
+
+	return strings.Join(result, " "), nil
+}
+
+// ToEntropy decodes a mnemonic, returning an error if a word is not in
+// the word list or the checksum doesn't match.
+func ToEntropy(mnemonic string) ([]byte, error) {
+	fields := strings.Fields(strings.ToLower(mnemonic))
+	if len(fields) < 12 || len(fields) > 24 || len(fields)%3 != 0 {
+		return nil, errors.Errorf("Invalid mnemonic length %d words", len(fields))
+	}
+
+	data := make([]byte, (len(fields)*11+7)/8)
+	for i, word := range fields {
+		index, ok := wordIndex[word]
+		if !ok {
+			return nil, errors.Errorf("Invalid mnemonic word %s", word)
+		}
+		for j := 0; j < 11; j++ {
+			bit := i*11 + j
+			if index&(1<<uint(10-j)) != 0 {
+				data[bit/8] |= 1 << (7 - uint(bit%8))
+			}
+		}
+	}
+
+	entropyBytes := len(fields) * 4 / 3
+	entropy := data[:entropyBytes]
+	checksumBits := uint(entropyBytes / 4)
+	if data[entropyBytes]>>(8-checksumBits) != checksum(entropy) {
+		return nil, errors.New("Invalid mnemonic checksum")
+	}
+
+	return entropy, nil
+}
+
+func Validate(mnemonic string) bool {
+	_, err := ToEntropy(mnemonic)
+	return err == nil
+}
+
+// FromSeed encodes a nano seed as a 24 word mnemonic.
+func FromSeed(seed string) (string, error) {
+	seed_bytes, err := hex.DecodeString(seed)
+	if err != nil || len(seed_bytes) != 32 {
+		return "", errors.Errorf("Seed must be 64 hex characters")
+	}
+	return FromEntropy(seed_bytes)
+}
+
+// ToSeed decodes a 24 word mnemonic to the nano seed it encodes, for use
+// with address.KeypairFromSeed.
+func ToSeed(mnemonic string) (string, error) {
+	entropy, err := ToEntropy(mnemonic)
+	if err != nil {
+		return "", err
+	}
+	if len(entropy) != 32 {
+		return "", errors.Errorf("A nano seed needs a 24 word mnemonic")
+	}
+	return strings.ToUpper(hex.EncodeToString(entropy)), nil
+}
+
+// Bip39Seed stretches a mnemonic and optional passphrase into the 64 byte
+// BIP39 seed used by address.KeypairFromBip39Seed. The passphrase is used
+// as given, callers must NFKD normalise non-ASCII passphrases.
+func Bip39Seed(mnemonic string, passphrase string) (string, error) {
+	_, err := ToEntropy(mnemonic)
+	if err != nil {
+		return "", err
+	}
+
+	normalised := strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+	seed := pbkdf2.Key([]byte(normalised), []byte("mnemonic"+passphrase), 2048, 64, sha512.New)
+	return hex.EncodeToString(seed), nil
+}
@@ -0,0 +1,97 @@
+package mnemonic
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Test vectors from the BIP39 specification
+var vectors = []struct {
+	entropy  string
+	mnemonic string
+	seed     string
+}{
+	{
+		"00000000000000000000000000000000",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+		"c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04",
+	},
+	{
+		"7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f",
+		"legal winner thank year wave sausage worth useful legal winner thank yellow",
+		"2e8905819b8723fe2c1d161860e5ee1830318dbf49a83bd451cfb8440c28bd6fa457fe1296106559a3c80937a1c1069be3a3a5bd381ee6260e8d9739fce1f607",
+	},
+	{
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon art",
+		"bda85446c68413707090a52022edd26a1c9462295029f2e60cd7c4f2bbd3097170af7a4d73245cafa9c3cca8d561a7c3de6f5d4a10be8ed2a5e608d68f92fcc8",
+	},
+}
+
+func TestVectors(t *testing.T) {
+	for _, v := range vectors {
+		entropy, _ := hex.DecodeString(v.entropy)
+		m, err := FromEntropy(entropy)
+		if err != nil || m != v.mnemonic {
+			t.Errorf("Wrong mnemonic for %s: %s", v.entropy, m)
+		}
+
+		decoded, err := ToEntropy(v.mnemonic)
+		if err != nil || hex.EncodeToString(decoded) != v.entropy {
+			t.Errorf("Wrong entropy for %s: %x %s", v.mnemonic, decoded, err)
+		}
+
+		seed, err := Bip39Seed(v.mnemonic, "TREZOR")
+		if err != nil || seed != v.seed {
+			t.Errorf("Wrong seed for %s: %s", v.mnemonic, seed)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if !Validate(strings.ToUpper(vectors[0].mnemonic)) {
+		t.Errorf("Mnemonic should be case insensitive")
+	}
+
+	if Validate(strings.Replace(vectors[0].mnemonic, "about", "abandon", 1)) {
+		t.Errorf("Mnemonic with bad checksum was validated")
+	}
+
+	if Validate(strings.Replace(vectors[0].mnemonic, "about", "aboot", 1)) {
+		t.Errorf("Mnemonic with unknown word was validated")
+	}
+
+	if Validate("abandon abandon about") {
+		t.Errorf("Short mnemonic was validated")
+	}
+}
+
+func TestSeed(t *testing.T) {
+	seed := "1234567890123456789012345678901234567890123456789012345678901234"
+
+	m, err := FromSeed(seed)
+	if err != nil || len(strings.Fields(m)) != 24 {
+		t.Fatalf("Failed to encode seed: %s", err)
+	}
+
+	decoded, err := ToSeed(m)
+	if err != nil || decoded != seed {
+		t.Errorf("Seed didn't round trip %s", decoded)
+	}
+
+	if _, err := ToSeed(vectors[0].mnemonic); err == nil {
+		t.Errorf("12 word mnemonic shouldn't convert to a nano seed")
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	m, err := Generate(256)
+	if err != nil || !Validate(m) || len(strings.Fields(m)) != 24 {
+		t.Errorf("Generated invalid mnemonic %s", m)
+	}
+
+	if _, err := Generate(100); err == nil {
+		t.Errorf("Expected error for invalid entropy size")
+	}
+}
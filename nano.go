@@ -1,17 +1,303 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/config"
+	"github.com/frankh/nano/logging"
+	"github.com/frankh/nano/metrics"
 	"github.com/frankh/nano/node"
 	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/ws"
 )
 
+// Global flags, given before the command. Other than -config they
+// override the configuration file when given.
+var (
+	configPath  = flag.String("config", os.Getenv("NANO_CONFIG"), "configuration file, defaults to $NANO_CONFIG")
+	dataDir     = flag.String("data", "", "data directory, defaults to DATA for the live network and TESTDATA for the test network")
+	network     = flag.String("network", "live", "network to use, live or test")
+	listenAddr  = flag.String("listen", ":7075", "address to listen for node messages on")
+	wsAddr      = flag.String("ws", ":7078", "address to serve websocket notifications on")
+	metricsAddr = flag.String("metrics", "[::1]:7077", "address to serve Prometheus metrics on, off unless given")
+)
+
+var logger = logging.New("nano")
+
+// The effective configuration, loaded before any command runs
+var conf *config.Config
+
+// A command takes the arguments after its name, and returns errUsage
+// when they're wrong.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var errUsage = fmt.Errorf("wrong arguments")
+
+var commands = map[string]map[string]command{
+	"node": {
+		"run": {"", nodeRun},
+	},
+	"wallet": {
+		"create":  {"[-password PASSWORD] [-seed SEED | -mnemonic WORDS] FILE", walletCreate},
+		"balance": {"[-password PASSWORD] [-unit UNIT] FILE", walletBalance},
+		"send":    {"[-password PASSWORD] [-unit UNIT] FILE FROM TO AMOUNT", walletSend},
+		"receive": {"[-password PASSWORD] FILE [ACCOUNT]", walletReceive},
+	},
+	"key": {
+		"generate": {"", keyGenerate},
+		"expand":   {"PRIVATE_KEY", keyExpand},
+	},
+	"address": {
+		"validate": {"ADDRESS", addressValidate},
+	},
+	"block": {
+		"hash":     {"JSON", blockHash},
+		"sign":     {"PRIVATE_KEY JSON", blockSign},
+		"validate": {"[-account ACCOUNT] JSON", blockValidate},
+	},
+	"work": {
+		"generate": {"HASH", workGenerate},
+		"validate": {"HASH WORK", workValidate},
+	},
+	"config": {
+		"dump": {"", configDump},
+	},
+	"ledger": {
+		"info":   {"", ledgerInfo},
+		"check":  {"[-repair]", ledgerCheck},
+		"export": {"FILE", ledgerExport},
+		"import": {"[-validate] FILE", ledgerImport},
+	},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: nano [flags] COMMAND SUBCOMMAND [arguments]\n\nflags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\ncommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		subnames := make([]string, 0, len(commands[name]))
+		for subname := range commands[name] {
+			subnames = append(subnames, subname)
+		}
+		sort.Strings(subnames)
+		for _, subname := range subnames {
+			fmt.Fprintf(os.Stderr, "  %s %s %s\n", name, subname, commands[name][subname].usage)
+		}
+	}
+}
+
 func main() {
-	store.Init(store.LiveConfig)
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+
+	// Running the node is the default, as before there were commands
+	if len(args) == 0 {
+		args = []string{"node", "run"}
+	}
+	if len(args) < 2 || commands[args[0]] == nil {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]][args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	err := loadConfig()
+	if err == nil {
+		err = cmd.run(args[2:])
+	}
+	if err == errUsage {
+		fmt.Fprintf(os.Stderr, "usage: nano %s %s %s\n", args[0], args[1], cmd.usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Parses a subcommand's flags, checking the number of arguments left.
+func parseFlags(flags *flag.FlagSet, args []string, min int, max int) error {
+	flags.SetOutput(ioutil.Discard)
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	if flags.NArg() < min || flags.NArg() > max {
+		return errUsage
+	}
+	return nil
+}
+
+func loadConfig() error {
+	var err error
+	conf, err = config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "data":
+			conf.DataDir = *dataDir
+		case "network":
+			conf.Network = *network
+		case "listen":
+			conf.Node.Listen = *listenAddr
+		case "ws":
+			conf.WebSocket.Enabled = true
+			conf.WebSocket.Listen = *wsAddr
+		case "metrics":
+			conf.Metrics.Enabled = true
+			conf.Metrics.Listen = *metricsAddr
+		}
+	})
+	err = conf.Validate()
+	if err != nil {
+		return err
+	}
+
+	blocks.WorkThreads = conf.Work.Threads
+	return configureLogging()
+}
+
+// Levels were checked by validating the configuration
+func configureLogging() error {
+	level, _ := logging.ParseLevel(conf.Logging.Level)
+	logging.SetLevel("", level)
+	for component, name := range conf.Logging.Components {
+		level, _ := logging.ParseLevel(name)
+		logging.SetLevel(component, level)
+	}
+
+	if conf.Logging.File != "" {
+		f, err := os.OpenFile(conf.Logging.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		logging.SetOutput(f)
+		// For anything logging through the standard library
+		log.SetOutput(f)
+	}
+	return nil
+}
+
+func initStore() error {
+	config := store.LiveConfig
+	if conf.Network == "test" {
+		config = store.TestConfig
+	}
+	if conf.DataDir != "" {
+		config.Path = conf.DataDir
+	}
+	store.Init(config)
+	return nil
+}
+
+func configDump(args []string) error {
+	if err := parseFlags(flag.NewFlagSet("config dump", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	raw, err := conf.Dump()
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(raw)
+	return nil
+}
+
+// Peers are given as host:port, hosts are resolved and every address
+// they have is added.
+func configPeers() []node.Peer {
+	peers := make([]node.Peer, 0)
+	for _, addr := range conf.Node.Peers {
+		host, port, _ := net.SplitHostPort(addr)
+		p, _ := strconv.Atoi(port)
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			logger.Warn("Could not resolve peer", "peer", addr, "err", err)
+			continue
+		}
+		for _, ip := range ips {
+			peers = append(peers, node.Peer{IP: ip, Port: uint16(p)})
+		}
+	}
+	return peers
+}
+
+// Applies the node settings and starts from the configured peers, for
+// running the node and for commands that publish blocks.
+func initNode() {
+	node.PacketSize = conf.Node.PacketSize
+	node.PeersToShare = conf.Node.PeersToShare
+	node.ConnectionsPerIP = conf.Node.ConnectionsPerIP
+	node.BandwidthPerPeer = conf.Node.BandwidthPerPeer
+	node.KeepaliveInterval = conf.Node.KeepaliveInterval.Duration
+	node.SetPeers(configPeers())
+}
+
+// Arguments that hold JSON can be given as - to read stdin instead.
+func readArg(arg string) ([]byte, error) {
+	if arg == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return []byte(strings.TrimSpace(arg)), nil
+}
+
+func nodeRun(args []string) error {
+	if err := parseFlags(flag.NewFlagSet("node run", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	if err := initStore(); err != nil {
+		return err
+	}
+	initNode()
+	processor := node.StartBlockProcessor()
+	receiver, err := startReceiver()
+	if err != nil {
+		processor.Stop()
+		return err
+	}
 
-	keepAliveSender := node.NewAlarm(node.AlarmFn(node.SendKeepAlives), []interface{}{node.PeerList}, 20*time.Second)
-	node.ListenForUdp()
+	keepAliveSender := node.NewAlarm(node.AlarmFn(node.SendKeepAlives), nil, conf.Node.KeepaliveInterval.Duration)
+	uncheckedPruner := node.NewAlarm(node.AlarmFn(node.PruneUnchecked), nil, time.Minute)
+	electionExpirer := node.NewAlarm(node.AlarmFn(node.ExpireElections), nil, time.Minute)
+	if conf.WebSocket.Enabled {
+		go ws.ListenAndServe(conf.WebSocket.Listen)
+	}
+	if conf.Metrics.Enabled {
+		go metrics.ListenAndServe(conf.Metrics.Listen)
+	}
+	go node.ListenForTcp(conf.Node.Listen)
+	node.ListenForUdp(conf.Node.Listen)
 
 	keepAliveSender.Stop()
+	uncheckedPruner.Stop()
+	electionExpirer.Stop()
+	if receiver != nil {
+		receiver.Stop()
+	}
+	processor.Stop()
+	return nil
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+)
+
+func keyGenerate(args []string) error {
+	if err := parseFlags(flag.NewFlagSet("key generate", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+
+	pub, priv := address.GenerateKey()
+	fmt.Printf("Private: %s\n", strings.ToUpper(hex.EncodeToString(priv[:32])))
+	fmt.Printf("Public:  %s\n", strings.ToUpper(hex.EncodeToString(pub)))
+	fmt.Printf("Account: %s\n", address.PubKeyToAddress(pub))
+	return nil
+}
+
+func keyExpand(args []string) error {
+	flags := flag.NewFlagSet("key expand", flag.ContinueOnError)
+	if err := parseFlags(flags, args, 1, 1); err != nil {
+		return err
+	}
+
+	pub, _, err := address.KeypairFromPrivateKey(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Public:  %s\n", strings.ToUpper(hex.EncodeToString(pub)))
+	fmt.Printf("Account: %s\n", address.PubKeyToAddress(pub))
+	return nil
+}
+
+func addressValidate(args []string) error {
+	flags := flag.NewFlagSet("address validate", flag.ContinueOnError)
+	if err := parseFlags(flags, args, 1, 1); err != nil {
+		return err
+	}
+
+	account, err := types.ParseAccount(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Valid, public key %s\n", types.BlockHash(account))
+	return nil
+}
+
+func readBlock(arg string) (blocks.Block, error) {
+	data, err := readArg(arg)
+	if err != nil {
+		return nil, err
+	}
+	return blocks.FromJson(data)
+}
+
+func blockHash(args []string) error {
+	flags := flag.NewFlagSet("block hash", flag.ContinueOnError)
+	if err := parseFlags(flags, args, 1, 1); err != nil {
+		return err
+	}
+
+	block, err := readBlock(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Println(block.Hash())
+	return nil
+}
+
+func blockSign(args []string) error {
+	flags := flag.NewFlagSet("block sign", flag.ContinueOnError)
+	if err := parseFlags(flags, args, 2, 2); err != nil {
+		return err
+	}
+
+	_, priv, err := address.KeypairFromPrivateKey(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	block, err := readBlock(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	signature := block.Hash().Sign(priv)
+	switch b := block.(type) {
+	case *blocks.OpenBlock:
+		b.Signature = signature
+	case *blocks.SendBlock:
+		b.Signature = signature
+	case *blocks.ReceiveBlock:
+		b.Signature = signature
+	case *blocks.ChangeBlock:
+		b.Signature = signature
+	}
+
+	data, err := blocks.ToJson(block)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// Open blocks say which account signed them, for other blocks it's given
+// with -account or looked up from the previous block in the ledger.
+func blockValidate(args []string) error {
+	flags := flag.NewFlagSet("block validate", flag.ContinueOnError)
+	accountFlag := flags.String("account", "", "account the block belongs to")
+	if err := parseFlags(flags, args, 1, 1); err != nil {
+		return err
+	}
+
+	block, err := readBlock(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var account types.Account
+	if open, ok := block.(*blocks.OpenBlock); ok {
+		account = open.Account
+	} else if *accountFlag != "" {
+		account, err = types.ParseAccount(*accountFlag)
+		if err != nil {
+			return err
+		}
+	} else {
+		if err := initStore(); err != nil {
+			return err
+		}
+		previous := store.FetchSideband(block.PreviousBlockHash())
+		if previous == nil {
+			return fmt.Errorf("previous block %s isn't in the ledger, give the account with -account", block.PreviousBlockHash())
+		}
+		account = previous.Account
+	}
+
+	work := blocks.ValidateBlockWork(block)
+	signature := blocks.VerifyBlockSignature(block, account)
+	fmt.Printf("Hash:      %s\n", block.Hash())
+	fmt.Printf("Work:      %s\n", validString(work))
+	fmt.Printf("Signature: %s\n", validString(signature))
+	if !work || !signature {
+		return fmt.Errorf("block is invalid")
+	}
+	return nil
+}
+
+func validString(valid bool) string {
+	if valid {
+		return "valid"
+	}
+	return "invalid"
+}
+
+// Work is for a block hash, or for an account when opening it.
+func parseRoot(s string) (types.BlockHash, error) {
+	hash, err := types.BlockHashFromString(s)
+	if err == nil {
+		return hash, nil
+	}
+	account, err := types.ParseAccount(s)
+	if err != nil {
+		return hash, fmt.Errorf("%s is neither a block hash nor an account", s)
+	}
+	return types.BlockHash(account), nil
+}
+
+func workGenerate(args []string) error {
+	flags := flag.NewFlagSet("work generate", flag.ContinueOnError)
+	if err := parseFlags(flags, args, 1, 1); err != nil {
+		return err
+	}
+
+	root, err := parseRoot(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Println(blocks.GenerateWorkForHash(root))
+	return nil
+}
+
+func workValidate(args []string) error {
+	flags := flag.NewFlagSet("work validate", flag.ContinueOnError)
+	if err := parseFlags(flags, args, 2, 2); err != nil {
+		return err
+	}
+
+	root, err := parseRoot(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	work, err := types.WorkFromString(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, 8)
+	binary.LittleEndian.PutUint64(nonce, uint64(work))
+	valid := blocks.ValidateWork(root[:], nonce)
+	fmt.Println(validString(valid))
+	if !valid {
+		return fmt.Errorf("work is invalid")
+	}
+	return nil
+}
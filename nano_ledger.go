@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/frankh/nano/store"
+)
+
+func ledgerInfo(args []string) error {
+	if err := parseFlags(flag.NewFlagSet("ledger info", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	if err := initStore(); err != nil {
+		return err
+	}
+
+	count, accounts := store.CountBlocks()
+	fmt.Printf("Path:             %s\n", store.Conf.Path)
+	fmt.Printf("Genesis:          %s\n", store.Conf.GenesisBlock.Hash())
+	fmt.Printf("Database version: %d\n", store.DbVersion)
+	fmt.Printf("Blocks:           %d\n", count)
+	fmt.Printf("Accounts:         %d\n", accounts)
+	fmt.Printf("Unchecked blocks: %d\n", store.UncheckedCount())
+	return nil
+}
+
+func ledgerCheck(args []string) error {
+	flags := flag.NewFlagSet("ledger check", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "rewrite sidebands, account entries and receivables that don't match the blocks")
+	if err := parseFlags(flags, args, 0, 0); err != nil {
+		return err
+	}
+	if err := initStore(); err != nil {
+		return err
+	}
+
+	result := store.CheckLedger(*repair)
+	for _, issue := range result.Issues {
+		fmt.Println(issue)
+	}
+	fmt.Printf("Checked %d blocks in %d accounts with %d representatives, found %d problems\n",
+		result.Blocks, result.Accounts, len(result.Weights), len(result.Issues))
+
+	for _, issue := range result.Issues {
+		if !issue.Repaired {
+			return fmt.Errorf("ledger has problems")
+		}
+	}
+	return nil
+}
+
+func ledgerExport(args []string) error {
+	flags := flag.NewFlagSet("ledger export", flag.ContinueOnError)
+	if err := parseFlags(flags, args, 1, 1); err != nil {
+		return err
+	}
+	if err := initStore(); err != nil {
+		return err
+	}
+
+	f, err := os.Create(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	err = store.ExportSnapshot(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func ledgerImport(args []string) error {
+	flags := flag.NewFlagSet("ledger import", flag.ContinueOnError)
+	validate := flags.Bool("validate", false, "check every block's work, signature and balance")
+	if err := parseFlags(flags, args, 1, 1); err != nil {
+		return err
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := initStore(); err != nil {
+		return err
+	}
+	return store.ImportSnapshot(f, *validate)
+}
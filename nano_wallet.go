@@ -0,0 +1,269 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/node"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/frankh/nano/wallet"
+)
+
+var units = map[string]uint128.Unit{}
+
+func init() {
+	for _, unit := range []uint128.Unit{uint128.Raw, uint128.Nano, uint128.KNano, uint128.MNano} {
+		units[unit.String()] = unit
+	}
+}
+
+// Wallet commands take the wallet password from -password or the
+// NANO_WALLET_PASSWORD environment variable, so it needn't be typed on
+// the command line.
+func passwordFlag(flags *flag.FlagSet) *string {
+	return flags.String("password", os.Getenv("NANO_WALLET_PASSWORD"), "wallet password, defaults to $NANO_WALLET_PASSWORD")
+}
+
+func openWallet(path string, password string) (*wallet.WalletFile, error) {
+	f, err := wallet.OpenWalletFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, f.Unlock(password)
+}
+
+func walletCreate(args []string) error {
+	flags := flag.NewFlagSet("wallet create", flag.ContinueOnError)
+	password := passwordFlag(flags)
+	seed := flags.String("seed", "", "hex seed to restore, a new one is generated by default")
+	words := flags.String("mnemonic", "", "24 word mnemonic to restore")
+	if err := parseFlags(flags, args, 1, 1); err != nil {
+		return err
+	}
+	if *password == "" {
+		return fmt.Errorf("a password is needed to encrypt the wallet")
+	}
+
+	var s *wallet.SeedWallet
+	var err error
+	restoring := true
+	switch {
+	case *words != "":
+		s, err = wallet.NewMnemonicWallet(*words, "", wallet.DerivationNano)
+	case *seed != "":
+		s, err = wallet.NewSeedWallet(*seed)
+	default:
+		restoring = false
+		*seed, err = wallet.GenerateSeed()
+		if err == nil {
+			s, err = wallet.NewSeedWallet(*seed)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Accounts are looked up in the ledger as they're derived
+	if err := initStore(); err != nil {
+		return err
+	}
+	if restoring {
+		fmt.Printf("Restored %d accounts\n", s.Restore(wallet.DefaultGapLimit))
+	} else {
+		fmt.Printf("Seed: %s\nWrite it down, it's the only way to recover the wallet\n", *seed)
+	}
+	if len(s.Indices()) == 0 {
+		s.NewAccount()
+	}
+
+	f, err := wallet.CreateWalletFile(flags.Arg(0), s, *password)
+	if err != nil {
+		return err
+	}
+	accounts, _ := f.Accounts()
+	for _, account := range accounts {
+		fmt.Println(account)
+	}
+	return nil
+}
+
+func walletBalance(args []string) error {
+	flags := flag.NewFlagSet("wallet balance", flag.ContinueOnError)
+	password := passwordFlag(flags)
+	unit := flags.String("unit", uint128.MNano.String(), "unit to show balances in")
+	if err := parseFlags(flags, args, 1, 1); err != nil {
+		return err
+	}
+	u, ok := units[*unit]
+	if !ok {
+		return fmt.Errorf("unknown unit %s", *unit)
+	}
+	if err := initStore(); err != nil {
+		return err
+	}
+
+	f, err := openWallet(flags.Arg(0), *password)
+	if err != nil {
+		return err
+	}
+	accounts, _ := f.Accounts()
+	for _, account := range accounts {
+		w, _ := f.Wallet(account)
+		receivable := uint128.Uint128{}
+		for _, r := range store.FetchReceivable(account) {
+			receivable = receivable.Add(r.Amount)
+		}
+		fmt.Printf("%s %s %s (%s receivable)\n", account, w.GetBalance().Format(u), u, receivable.Format(u))
+	}
+	total, _ := f.GetBalance()
+	fmt.Printf("Total %s %s\n", total.Format(u), u)
+	return nil
+}
+
+// Blocks published by wallet commands are queued to be sent, the command
+// waits at most this long for them to be written before exiting.
+const publishFlushTimeout = 10 * time.Second
+
+// Stores a block created by the wallet and sends it to peers.
+func processAndPublish(block blocks.Block) error {
+	if err := node.ProcessLocal(block); err != nil {
+		return err
+	}
+	fmt.Println(block.Hash())
+	if err := node.PublishBlock(block); err != nil {
+		return err
+	}
+	return node.FlushUdp(publishFlushTimeout)
+}
+
+// Starts receiving sends to the configured wallet's accounts while the
+// node runs, returns nil if the receiver isn't enabled.
+func startReceiver() (*wallet.AutoReceiver, error) {
+	if !conf.Receiver.Enabled {
+		return nil, nil
+	}
+	// Checked when the configuration was validated
+	threshold, _ := uint128.Parse(conf.Receiver.Threshold, uint128.MNano)
+
+	f, err := openWallet(conf.Receiver.Wallet, os.Getenv("NANO_WALLET_PASSWORD"))
+	if err != nil {
+		return nil, err
+	}
+	r, err := f.AutoReceiver(threshold)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Start(conf.Receiver.Interval.Duration); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func walletSend(args []string) error {
+	flags := flag.NewFlagSet("wallet send", flag.ContinueOnError)
+	password := passwordFlag(flags)
+	unit := flags.String("unit", uint128.MNano.String(), "unit the amount is in")
+	if err := parseFlags(flags, args, 4, 4); err != nil {
+		return err
+	}
+	u, ok := units[*unit]
+	if !ok {
+		return fmt.Errorf("unknown unit %s", *unit)
+	}
+	from, err := types.ParseAccount(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	to, err := types.ParseAccount(flags.Arg(2))
+	if err != nil {
+		return err
+	}
+	amount, err := uint128.Parse(flags.Arg(3), u)
+	if err != nil {
+		return err
+	}
+	if err := initStore(); err != nil {
+		return err
+	}
+	initNode()
+
+	f, err := openWallet(flags.Arg(0), *password)
+	if err != nil {
+		return err
+	}
+	w, err := f.Wallet(from)
+	if err != nil {
+		return err
+	}
+	if err := w.GeneratePowSync(); err != nil {
+		return err
+	}
+	block, err := w.Send(to, amount)
+	if err != nil {
+		return err
+	}
+	return processAndPublish(block)
+}
+
+// Receives every receivable send to the wallet's accounts, or to one of
+// them. Accounts are opened with the wallet's representative, or as their
+// own representative if it hasn't been set.
+func walletReceive(args []string) error {
+	flags := flag.NewFlagSet("wallet receive", flag.ContinueOnError)
+	password := passwordFlag(flags)
+	if err := parseFlags(flags, args, 1, 2); err != nil {
+		return err
+	}
+	if err := initStore(); err != nil {
+		return err
+	}
+	initNode()
+
+	f, err := openWallet(flags.Arg(0), *password)
+	if err != nil {
+		return err
+	}
+	accounts, _ := f.Accounts()
+	if flags.NArg() == 2 {
+		account, err := types.ParseAccount(flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		accounts = []types.Account{account}
+	}
+
+	for _, account := range accounts {
+		w, err := f.Wallet(account)
+		if err != nil {
+			return err
+		}
+		representative, ok := f.Representative()
+		if !ok {
+			representative = account
+		}
+
+		for _, receivable := range store.FetchReceivable(account) {
+			if err := w.GeneratePowSync(); err != nil {
+				return err
+			}
+			var block blocks.Block
+			if w.Head == nil {
+				block, err = w.Open(receivable.Hash, representative)
+			} else {
+				block, err = w.Receive(receivable.Hash)
+			}
+			if err != nil {
+				return err
+			}
+			if err := processAndPublish(block); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
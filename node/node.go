@@ -5,16 +5,28 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"time"
 
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/logging"
 	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/ws"
 )
 
+var logger = logging.New("node")
+
+// Bad messages can arrive for every packet, so are logged at most once a
+// minute
+var badMessageLogger = logger.Limit(time.Minute)
+
 var MagicNumber = [2]byte{'R', 'C'}
 
-const VersionMax = 0x05
+// VersionMax is the newest protocol version this node speaks, see
+// Features. Peers that haven't sent us a message yet are sent
+// VersionUsing, others the newest version both sides support.
+const VersionMax = 0x11
 const VersionUsing = 0x05
 const VersionMin = 0x04
 
@@ -29,6 +41,13 @@ const (
 	Message_bulk_pull
 	Message_bulk_push
 	Message_frontier_req
+	Message_bulk_pull_blocks
+	Message_node_id_handshake
+	Message_bulk_pull_account
+	Message_telemetry_req
+	Message_telemetry_ack
+	Message_asc_pull_req
+	Message_asc_pull_ack
 )
 
 const (
@@ -38,6 +57,7 @@ const (
 	BlockType_receive
 	BlockType_open
 	BlockType_change
+	BlockType_state
 )
 
 type Peer struct {
@@ -46,6 +66,10 @@ type Peer struct {
 	LastReachout *time.Time
 }
 
+// The header ends with the reference node's 16 bit little endian
+// extensions field, Extensions is its low byte and BlockType its high
+// byte. What the bits mean depends on the message type, see the
+// extension constants and the header's methods.
 type MessageHeader struct {
 	MagicNumber  [2]byte
 	VersionMax   byte
@@ -56,6 +80,61 @@ type MessageHeader struct {
 	BlockType    byte
 }
 
+// Flags in the low byte of the extensions
+const (
+	// confirm_req and confirm_ack, the item count has 8 bits
+	ExtensionConfirmV2 byte = 0x01
+	// bulk_pull, the message has a count
+	ExtensionBulkPullCount byte = 0x01
+	// bulk_pull, blocks are sent from the start rather than the end
+	ExtensionBulkPullAscending byte = 0x02
+	// frontier_req, only confirmed frontiers are sent
+	ExtensionFrontierConfirmed byte = 0x02
+)
+
+// ExtensionBits returns the whole extensions field.
+func (m *MessageHeader) ExtensionBits() uint16 {
+	return uint16(m.Extensions) | uint16(m.BlockType)<<8
+}
+
+func (m *MessageHeader) SetExtensionBits(ext uint16) {
+	m.Extensions = byte(ext)
+	m.BlockType = byte(ext >> 8)
+}
+
+// ItemBlockType returns the type of the block in a publish, confirm_req
+// or confirm_ack, the low 4 bits of BlockType. The high 4 bits are the
+// item count.
+func (m *MessageHeader) ItemBlockType() byte {
+	return m.BlockType & 0x0f
+}
+
+func (m *MessageHeader) SetItemBlockType(blockType byte) {
+	m.BlockType = m.BlockType&0xf0 | blockType&0x0f
+}
+
+// ItemCount returns the number of hashes in a confirm_req or confirm_ack.
+// It's 4 bits, or 8 with ExtensionConfirmV2 where the low 4 are in the
+// high half of Extensions.
+func (m *MessageHeader) ItemCount() int {
+	count := int(m.BlockType >> 4)
+	if m.Extensions&ExtensionConfirmV2 != 0 {
+		count = count<<4 | int(m.Extensions>>4)
+	}
+	return count
+}
+
+// SetItemCount sets the item count, which can be at most 255.
+func (m *MessageHeader) SetItemCount(count int) {
+	m.Extensions &^= 0xf0 | ExtensionConfirmV2
+	if count < 16 {
+		m.BlockType = m.BlockType&0x0f | byte(count)<<4
+		return
+	}
+	m.Extensions |= ExtensionConfirmV2 | byte(count&0x0f)<<4
+	m.BlockType = m.BlockType&0x0f | byte(count>>4)<<4
+}
+
 type MessageKeepAlive struct {
 	MessageHeader
 	Peers []Peer
@@ -66,9 +145,17 @@ type MessageConfirmAck struct {
 	MessageVote
 }
 
+// A confirm_req has either a block, or hashes of blocks with their roots
+// when the header's block type is BlockType_not_a_block.
 type MessageConfirmReq struct {
 	MessageHeader
 	MessageBlock
+	Roots []HashRoot
+}
+
+type HashRoot struct {
+	Hash types.BlockHash
+	Root types.BlockHash
 }
 
 type MessagePublish struct {
@@ -77,9 +164,13 @@ type MessagePublish struct {
 }
 
 type Message interface {
+	Header() *MessageHeader
 	Write(buf *bytes.Buffer) error
 }
 
+// Keepalives always list this many peers, unused entries are zeroed.
+const keepAlivePeers = 8
+
 func CreateKeepAlive(peers []Peer) *MessageKeepAlive {
 	var m MessageKeepAlive
 	m.MessageHeader.MagicNumber = MagicNumber
@@ -87,9 +178,68 @@ func CreateKeepAlive(peers []Peer) *MessageKeepAlive {
 	m.MessageHeader.VersionUsing = VersionUsing
 	m.MessageHeader.VersionMin = VersionMin
 	m.MessageHeader.MessageType = Message_keepalive
+	m.Peers = make([]Peer, 0, keepAlivePeers)
+	for _, peer := range peers {
+		if len(m.Peers) == keepAlivePeers {
+			break
+		}
+		m.Peers = append(m.Peers, peer)
+	}
+	for len(m.Peers) < keepAlivePeers {
+		m.Peers = append(m.Peers, Peer{net.IPv6zero, 0, nil})
+	}
+	return &m
+}
+
+// CreateConfirmReq asks for votes on blocks by their hashes and roots,
+// at most 255 of them.
+func CreateConfirmReq(roots []HashRoot) *MessageConfirmReq {
+	var m MessageConfirmReq
+	m.MessageHeader.MagicNumber = MagicNumber
+	m.MessageHeader.VersionMax = VersionMax
+	m.MessageHeader.VersionUsing = VersionUsing
+	m.MessageHeader.VersionMin = VersionMin
+	m.MessageHeader.MessageType = Message_confirm_req
+	m.MessageHeader.SetItemBlockType(BlockType_not_a_block)
+	m.MessageHeader.SetItemCount(len(roots))
+	m.Roots = roots
 	return &m
 }
 
+// Returns a header for a new message of the given type.
+func newHeader(messageType byte) MessageHeader {
+	return MessageHeader{
+		MagicNumber:  MagicNumber,
+		VersionMax:   VersionMax,
+		VersionUsing: VersionUsing,
+		VersionMin:   VersionMin,
+		MessageType:  messageType,
+	}
+}
+
+// Reads exactly len(b) bytes.
+func readBytes(buf *bytes.Buffer, b []byte) error {
+	if n, _ := buf.Read(b); n != len(b) {
+		return errors.New("Message too short")
+	}
+	return nil
+}
+
+func CreatePublish(block blocks.Block) (*MessagePublish, error) {
+	var m MessagePublish
+	err := m.MessageBlock.FromBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	m.MessageHeader.MagicNumber = MagicNumber
+	m.MessageHeader.VersionMax = VersionMax
+	m.MessageHeader.VersionUsing = VersionUsing
+	m.MessageHeader.VersionMin = VersionMin
+	m.MessageHeader.MessageType = Message_publish
+	m.MessageHeader.SetItemBlockType(m.MessageBlock.Type)
+	return &m, nil
+}
+
 func (p *Peer) Addr() *net.UDPAddr {
 	addr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", p.IP.String(), p.Port))
 	return addr
@@ -99,11 +249,63 @@ func (p *Peer) String() string {
 	return fmt.Sprintf("%s:%d", p.IP.String(), p.Port)
 }
 
-func handleMessage(buf *bytes.Buffer) {
+// Number of blocks from the network, and separately created locally, that
+// can wait to be stored.
+const blockQueueSize = 8192
+
+// Blocks are stored by the processor once it's started, or synchronously
+// before then.
+var processor *store.BlockProcessor
+
+func StartBlockProcessor() *store.BlockProcessor {
+	processor = store.NewBlockProcessor(blockQueueSize, blockStored)
+	return processor
+}
+
+// Network blocks are dropped when the processor can't keep up, peers
+// will send them again or they'll be requested when something needs them.
+func storeNetworkBlock(block blocks.Block) {
+	if processor == nil {
+		if store.StoreBlock(block) == nil {
+			blockStored(block)
+		}
+		return
+	}
+	if !processor.Add(block) {
+		blocksDropped.Inc()
+	}
+}
+
+// ProcessLocal stores a block created by this node, ahead of any blocks
+// waiting from the network.
+func ProcessLocal(block blocks.Block) error {
+	if processor == nil {
+		err := store.StoreBlock(block)
+		if err == nil {
+			blockStored(block)
+		}
+		return err
+	}
+	return processor.AddLocal(block)
+}
+
+// Announces a newly stored block and starts electing it.
+func blockStored(block blocks.Block) {
+	ws.NewBlock(block)
+	startElection(block)
+}
+
+func handleMessage(buf *bytes.Buffer, from Peer) {
 	var header MessageHeader
 	header.ReadHeader(bytes.NewBuffer(buf.Bytes()))
 	if header.MagicNumber != MagicNumber {
-		log.Printf("Ignored message. Wrong magic number %s", header.MagicNumber)
+		badMessageLogger.Warn("Ignored message with wrong magic number", "peer", from.String(), "magic", fmt.Sprintf("%x", header.MagicNumber))
+		parseFailures.Inc(messageTypeName(header.MessageType))
+		return
+	}
+	messagesIn.Inc(messageTypeName(header.MessageType))
+	if reason, ok := checkVersion(from, &header); !ok {
+		rejectPeer(from, reason)
 		return
 	}
 
@@ -112,45 +314,157 @@ func handleMessage(buf *bytes.Buffer) {
 		var m MessageKeepAlive
 		err := m.Read(buf)
 		if err != nil {
-			log.Printf("Failed to read keepalive: %s", err)
+			badMessageLogger.Warn("Failed to read keepalive", "peer", from.String(), "err", err)
+			parseFailures.Inc(messageTypeName(header.MessageType))
+		}
+		logger.Debug("Read keepalive", "peer", from.String(), "peers", len(m.Peers))
+		err = m.Handle(from)
+		if err != nil {
+			logger.Warn("Failed to handle keepalive", "peer", from.String(), "err", err)
+		}
+	case Message_node_id_handshake:
+		var m MessageNodeIdHandshake
+		err := m.Read(buf)
+		if err != nil {
+			badMessageLogger.Warn("Failed to read node_id_handshake", "peer", from.String(), "err", err)
+			parseFailures.Inc(messageTypeName(header.MessageType))
+			break
 		}
-		log.Println("Read keepalive")
-		err = m.Handle()
+		err = m.Handle(from)
 		if err != nil {
-			log.Printf("Failed to handle keepalive")
+			netErrLogger.Warn("Failed to respond to handshake", "peer", from.String(), "err", err)
 		}
 	case Message_publish:
 		var m MessagePublish
 		err := m.Read(buf)
 		if err != nil {
-			log.Printf("Failed to read publish: %s", err)
+			badMessageLogger.Warn("Failed to read publish", "peer", from.String(), "err", err)
+			parseFailures.Inc(messageTypeName(header.MessageType))
 		} else {
-			store.StoreBlock(m.ToBlock())
+			block, err := m.ToBlock()
+			if err != nil {
+				badMessageLogger.Warn("Failed to read publish", "peer", from.String(), "err", err)
+				parseFailures.Inc(messageTypeName(header.MessageType))
+			} else {
+				storeNetworkBlock(block)
+			}
 		}
 	case Message_confirm_ack:
 		var m MessageConfirmAck
 		err := m.Read(buf)
 		if err != nil {
-			log.Printf("Failed to read confirm: %s", err)
+			badMessageLogger.Warn("Failed to read confirm_ack", "peer", from.String(), "err", err)
+			parseFailures.Inc(messageTypeName(header.MessageType))
 		} else {
-			store.StoreBlock(m.ToBlock())
+			hashes, err := m.VoteHashes()
+			if err != nil {
+				badMessageLogger.Warn("Failed to read confirm_ack", "peer", from.String(), "err", err)
+				parseFailures.Inc(messageTypeName(header.MessageType))
+				break
+			}
+			if !m.Verify() {
+				badMessageLogger.Warn("Ignored confirm_ack with invalid signature", "peer", from.String(), "account", m.VoteAccount())
+				break
+			}
+			ws.Vote(m.VoteAccount(), m.VoteSignature(), m.Sequence, hashes)
+			// Votes by hash don't carry the block
+			if m.Hashes == nil {
+				storeNetworkBlock(m.Block)
+			}
+			tallyVote(m.VoteAccount(), hashes)
+		}
+	case Message_asc_pull_ack:
+		var m MessageAscPullAck
+		err := m.Read(buf)
+		if err != nil {
+			badMessageLogger.Warn("Failed to read asc_pull_ack", "peer", from.String(), "err", err)
+			parseFailures.Inc(messageTypeName(header.MessageType))
+			break
+		}
+		err = m.Handle(from)
+		if err != nil {
+			badMessageLogger.Warn("Failed to handle asc_pull_ack", "peer", from.String(), "err", err)
 		}
 	default:
-		log.Printf("Ignored message. Cannot handle message type %d\n", header.MessageType)
+		logger.Debug("Ignored message with unhandled type", "peer", from.String(), "type", messageTypeName(header.MessageType))
 	}
 }
 
-func (m *MessageKeepAlive) Handle() error {
+// Anyone can send a keepalive listing any addresses, so neither the
+// sender nor the peers it lists are added to the peer list until they've
+// completed a handshake.
+//
+// Over an inbound channel the first entry has an unspecified address and
+// the port the peer listens on, as the remote end of the connection is
+// an ephemeral port that can't be reached once it's closed.
+func (m *MessageKeepAlive) Handle(from Peer) error {
+	if len(m.Peers) > 0 && m.Peers[0].IP.IsUnspecified() && m.Peers[0].Port != 0 {
+		if setListeningPort(from, m.Peers[0].Port) && IsValidated(from) {
+			addValidatedPeer(from)
+		}
+	}
+
+	if !knownPeer(from) {
+		startHandshake(from)
+	}
 	for _, peer := range m.Peers {
-		if !PeerSet[peer.String()] {
-			PeerSet[peer.String()] = true
-			PeerList = append(PeerList, peer)
-			log.Printf("Added new peer to list: %s, now %d peers", peer.String(), len(PeerList))
+		// Unused entries are zeroed
+		if peer.Port == 0 || peer.IP.IsUnspecified() {
+			continue
+		}
+		if !knownPeer(peer) {
+			startHandshake(peer)
 		}
 	}
 	return nil
 }
 
+func removePeer(peer Peer) {
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	if !PeerSet[peer.String()] {
+		return
+	}
+	delete(PeerSet, peer.String())
+	for i := range PeerList {
+		if PeerList[i].String() == peer.String() {
+			PeerList = append(PeerList[:i], PeerList[i+1:]...)
+			break
+		}
+	}
+	logger.Info("Removed peer", "peer", peer.String(), "peers", len(PeerList))
+}
+
+// Adds a validated peer to the peer list.
+func addPeer(peer Peer) {
+	peersLock.Lock()
+	if PeerSet[peer.String()] {
+		peersLock.Unlock()
+		return
+	}
+	PeerSet[peer.String()] = true
+	PeerList = append(PeerList, peer)
+	count := len(PeerList)
+	peersLock.Unlock()
+
+	logger.Info("Added peer", "peer", peer.String(), "peers", count)
+	ws.PeerAdded(peer.String())
+}
+
+// Adds a peer validated by a handshake from the endpoint it can be reached
+// at, which for an inbound channel isn't known until the peer sends a
+// keepalive with the port it listens on.
+func addValidatedPeer(from Peer) {
+	peer, ok := peerEndpoint(from)
+	if !ok {
+		return
+	}
+	if peer.String() != from.String() {
+		copyNodeId(from, peer)
+	}
+	addPeer(peer)
+}
+
 func (m *MessageKeepAlive) Read(buf *bytes.Buffer) error {
 	var header MessageHeader
 	err := header.ReadHeader(buf)
@@ -196,7 +510,7 @@ func (m *MessageKeepAlive) Write(buf *bytes.Buffer) error {
 	}
 
 	for _, peer := range m.Peers {
-		_, err = buf.Write(peer.IP)
+		_, err = buf.Write(peer.IP.To16())
 		if err != nil {
 			return err
 		}
@@ -223,7 +537,7 @@ func (m *MessageConfirmAck) Read(buf *bytes.Buffer) error {
 	if m.MessageHeader.MessageType != Message_confirm_ack {
 		return errors.New("Tried to read wrong message type")
 	}
-	err = m.MessageVote.Read(m.MessageHeader.BlockType, buf)
+	err = m.MessageVote.Read(m.MessageHeader.ItemBlockType(), m.MessageHeader.ItemCount(), buf)
 	if err != nil {
 		return err
 	}
@@ -254,7 +568,26 @@ func (m *MessageConfirmReq) Read(buf *bytes.Buffer) error {
 	if m.MessageHeader.MessageType != Message_confirm_req {
 		return errors.New("Tried to read wrong message type")
 	}
-	err = m.MessageBlock.Read(m.MessageHeader.BlockType, buf)
+
+	m.Roots = nil
+	if m.MessageHeader.ItemBlockType() == BlockType_not_a_block {
+		count := m.MessageHeader.ItemCount()
+		if count == 0 {
+			return errors.New("No roots in confirm_req")
+		}
+		m.Roots = make([]HashRoot, count)
+		for i := range m.Roots {
+			if err := readBytes(buf, m.Roots[i].Hash[:]); err != nil {
+				return err
+			}
+			if err := readBytes(buf, m.Roots[i].Root[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err = m.MessageBlock.Read(m.MessageHeader.ItemBlockType(), buf)
 	if err != nil {
 		return err
 	}
@@ -268,6 +601,14 @@ func (m *MessageConfirmReq) Write(buf *bytes.Buffer) error {
 		return err
 	}
 
+	if m.Roots != nil {
+		for _, root := range m.Roots {
+			buf.Write(root.Hash[:])
+			buf.Write(root.Root[:])
+		}
+		return nil
+	}
+
 	err = m.MessageBlock.Write(buf)
 	if err != nil {
 		return err
@@ -285,7 +626,7 @@ func (m *MessagePublish) Read(buf *bytes.Buffer) error {
 	if m.MessageHeader.MessageType != Message_publish {
 		return errors.New("Tried to read wrong message type")
 	}
-	err = m.MessageBlock.Read(m.MessageHeader.BlockType, buf)
+	err = m.MessageBlock.Read(m.MessageHeader.ItemBlockType(), buf)
 	if err != nil {
 		return err
 	}
@@ -307,6 +648,12 @@ func (m *MessagePublish) Write(buf *bytes.Buffer) error {
 	return nil
 }
 
+// Header lets a message's header be set before it's sent to a peer,
+// every message embeds it.
+func (m *MessageHeader) Header() *MessageHeader {
+	return m
+}
+
 func (m *MessageHeader) WriteHeader(buf *bytes.Buffer) error {
 	var errs []error
 	errs = append(errs,
@@ -0,0 +1,334 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+)
+
+// asc_pull is the reference node's ascending bootstrap. A request asks
+// for blocks, account info or frontiers and the ack for it carries the
+// same type and ID. The extensions hold the size of everything after the
+// header.
+
+// Types of asc_pull payloads
+const (
+	AscPull_invalid byte = iota
+	AscPull_blocks
+	AscPull_account_info
+	AscPull_frontiers
+)
+
+// Whether an asc_pull start or target is a block hash or an account
+const (
+	AscPullHashOrAccount byte = iota
+	AscPullAccount
+	AscPullBlock
+)
+
+// Blocks from Start, a block hash or account, at most Count of them.
+type AscPullBlocksReq struct {
+	Start     [32]byte
+	Count     byte
+	StartType byte
+}
+
+// Info about the account of Target, a block hash or account.
+type AscPullAccountInfoReq struct {
+	Target     [32]byte
+	TargetType byte
+}
+
+// Frontiers of accounts from Start, at most Count of them.
+type AscPullFrontiersReq struct {
+	Start types.Account
+	Count uint16
+}
+
+// A request has one payload, matching Type.
+type MessageAscPullReq struct {
+	MessageHeader
+	Type        byte
+	Id          uint64
+	Blocks      *AscPullBlocksReq
+	AccountInfo *AscPullAccountInfoReq
+	Frontiers   *AscPullFrontiersReq
+}
+
+type AscPullAccountInfo struct {
+	Account              types.Account
+	Open                 types.BlockHash
+	Head                 types.BlockHash
+	BlockCount           uint64
+	ConfirmationFrontier types.BlockHash
+	ConfirmationHeight   uint64
+}
+
+type Frontier struct {
+	Account types.Account
+	Hash    types.BlockHash
+}
+
+// An ack has one payload, matching Type.
+type MessageAscPullAck struct {
+	MessageHeader
+	Type        byte
+	Id          uint64
+	Blocks      []MessageBlock
+	AccountInfo *AscPullAccountInfo
+	Frontiers   []Frontier
+}
+
+func CreateAscPullReq(id uint64) *MessageAscPullReq {
+	return &MessageAscPullReq{MessageHeader: newHeader(Message_asc_pull_req), Id: id}
+}
+
+func CreateAscPullAck(id uint64) *MessageAscPullAck {
+	return &MessageAscPullAck{MessageHeader: newHeader(Message_asc_pull_ack), Id: id}
+}
+
+// Reads the type and ID, and returns the rest of the payload as sized by
+// the header.
+func readAscPull(header *MessageHeader, buf *bytes.Buffer) (byte, uint64, *bytes.Buffer, error) {
+	payload := make([]byte, header.ExtensionBits())
+	if err := readBytes(buf, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	if len(payload) < 9 {
+		return 0, 0, nil, errors.New("Message too short")
+	}
+	return payload[0], binary.BigEndian.Uint64(payload[1:9]), bytes.NewBuffer(payload[9:]), nil
+}
+
+// Writes the type, ID and payload, and sets the header's size.
+func writeAscPull(header *MessageHeader, payloadType byte, id uint64, payload []byte, buf *bytes.Buffer) error {
+	size := 9 + len(payload)
+	if size > 0xffff {
+		return errors.New("asc_pull payload too large")
+	}
+	header.SetExtensionBits(uint16(size))
+	err := header.WriteHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	var idBytes [8]byte
+	binary.BigEndian.PutUint64(idBytes[:], id)
+	buf.WriteByte(payloadType)
+	buf.Write(idBytes[:])
+	buf.Write(payload)
+	return nil
+}
+
+func (m *MessageAscPullReq) Read(buf *bytes.Buffer) error {
+	err := m.MessageHeader.ReadHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	if m.MessageHeader.MessageType != Message_asc_pull_req {
+		return errors.New("Tried to read wrong message type")
+	}
+
+	var payload *bytes.Buffer
+	m.Type, m.Id, payload, err = readAscPull(&m.MessageHeader, buf)
+	if err != nil {
+		return err
+	}
+
+	m.Blocks, m.AccountInfo, m.Frontiers = nil, nil, nil
+	switch m.Type {
+	case AscPull_blocks:
+		m.Blocks = new(AscPullBlocksReq)
+		var rest [2]byte
+		if err := readBytes(payload, m.Blocks.Start[:]); err != nil {
+			return err
+		}
+		if err := readBytes(payload, rest[:]); err != nil {
+			return err
+		}
+		m.Blocks.Count, m.Blocks.StartType = rest[0], rest[1]
+	case AscPull_account_info:
+		m.AccountInfo = new(AscPullAccountInfoReq)
+		var rest [1]byte
+		if err := readBytes(payload, m.AccountInfo.Target[:]); err != nil {
+			return err
+		}
+		if err := readBytes(payload, rest[:]); err != nil {
+			return err
+		}
+		m.AccountInfo.TargetType = rest[0]
+	case AscPull_frontiers:
+		m.Frontiers = new(AscPullFrontiersReq)
+		var rest [2]byte
+		if err := readBytes(payload, m.Frontiers.Start[:]); err != nil {
+			return err
+		}
+		if err := readBytes(payload, rest[:]); err != nil {
+			return err
+		}
+		m.Frontiers.Count = binary.BigEndian.Uint16(rest[:])
+	default:
+		return errors.New("Unknown asc_pull type")
+	}
+	return nil
+}
+
+func (m *MessageAscPullReq) Write(buf *bytes.Buffer) error {
+	var payload bytes.Buffer
+	switch {
+	case m.Blocks != nil:
+		m.Type = AscPull_blocks
+		payload.Write(m.Blocks.Start[:])
+		payload.Write([]byte{m.Blocks.Count, m.Blocks.StartType})
+	case m.AccountInfo != nil:
+		m.Type = AscPull_account_info
+		payload.Write(m.AccountInfo.Target[:])
+		payload.WriteByte(m.AccountInfo.TargetType)
+	case m.Frontiers != nil:
+		m.Type = AscPull_frontiers
+		var count [2]byte
+		binary.BigEndian.PutUint16(count[:], m.Frontiers.Count)
+		payload.Write(m.Frontiers.Start[:])
+		payload.Write(count[:])
+	default:
+		return errors.New("No asc_pull payload")
+	}
+	return writeAscPull(&m.MessageHeader, m.Type, m.Id, payload.Bytes(), buf)
+}
+
+func (m *MessageAscPullAck) Read(buf *bytes.Buffer) error {
+	err := m.MessageHeader.ReadHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	if m.MessageHeader.MessageType != Message_asc_pull_ack {
+		return errors.New("Tried to read wrong message type")
+	}
+
+	var payload *bytes.Buffer
+	m.Type, m.Id, payload, err = readAscPull(&m.MessageHeader, buf)
+	if err != nil {
+		return err
+	}
+
+	m.Blocks, m.AccountInfo, m.Frontiers = nil, nil, nil
+	switch m.Type {
+	case AscPull_blocks:
+		// Each block is preceded by its type, the list ends with not_a_block
+		m.Blocks = []MessageBlock{}
+		for {
+			blockType, err := payload.ReadByte()
+			if err != nil {
+				return errors.New("Message too short")
+			}
+			if blockType == BlockType_not_a_block {
+				break
+			}
+			var block MessageBlock
+			if err := block.Read(blockType, payload); err != nil {
+				return err
+			}
+			m.Blocks = append(m.Blocks, block)
+		}
+	case AscPull_account_info:
+		m.AccountInfo = new(AscPullAccountInfo)
+		info := m.AccountInfo
+		var numbers [16]byte
+		for _, b := range [][]byte{info.Account[:], info.Open[:], info.Head[:], numbers[:8], info.ConfirmationFrontier[:], numbers[8:]} {
+			if err := readBytes(payload, b); err != nil {
+				return err
+			}
+		}
+		info.BlockCount = binary.BigEndian.Uint64(numbers[:8])
+		info.ConfirmationHeight = binary.BigEndian.Uint64(numbers[8:])
+	case AscPull_frontiers:
+		// The list ends with a zero account and hash
+		m.Frontiers = []Frontier{}
+		for {
+			var f Frontier
+			if err := readBytes(payload, f.Account[:]); err != nil {
+				return err
+			}
+			if err := readBytes(payload, f.Hash[:]); err != nil {
+				return err
+			}
+			if f == (Frontier{}) {
+				break
+			}
+			m.Frontiers = append(m.Frontiers, f)
+		}
+	default:
+		return errors.New("Unknown asc_pull type")
+	}
+	return nil
+}
+
+func (m *MessageAscPullAck) Write(buf *bytes.Buffer) error {
+	var payload bytes.Buffer
+	switch {
+	case m.Blocks != nil:
+		m.Type = AscPull_blocks
+		for _, block := range m.Blocks {
+			payload.WriteByte(block.Type)
+			if err := block.Write(&payload); err != nil {
+				return err
+			}
+		}
+		payload.WriteByte(BlockType_not_a_block)
+	case m.AccountInfo != nil:
+		m.Type = AscPull_account_info
+		info := m.AccountInfo
+		var numbers [16]byte
+		binary.BigEndian.PutUint64(numbers[:8], info.BlockCount)
+		binary.BigEndian.PutUint64(numbers[8:], info.ConfirmationHeight)
+		payload.Write(info.Account[:])
+		payload.Write(info.Open[:])
+		payload.Write(info.Head[:])
+		payload.Write(numbers[:8])
+		payload.Write(info.ConfirmationFrontier[:])
+		payload.Write(numbers[8:])
+	case m.Frontiers != nil:
+		m.Type = AscPull_frontiers
+		for _, f := range m.Frontiers {
+			payload.Write(f.Account[:])
+			payload.Write(f.Hash[:])
+		}
+		var end Frontier
+		payload.Write(end.Account[:])
+		payload.Write(end.Hash[:])
+	default:
+		return errors.New("No asc_pull payload")
+	}
+	return writeAscPull(&m.MessageHeader, m.Type, m.Id, payload.Bytes(), buf)
+}
+
+// AddBlock adds a block to a blocks ack.
+func (m *MessageAscPullAck) AddBlock(block blocks.Block) error {
+	var b MessageBlock
+	if err := b.FromBlock(block); err != nil {
+		return err
+	}
+	m.Blocks = append(m.Blocks, b)
+	return nil
+}
+
+// Stores the blocks from an ack to a request for a missing block. Acks
+// that weren't asked for are ignored so peers can't push blocks this way.
+func (m *MessageAscPullAck) Handle(from Peer) error {
+	if !takeAscPullRequest(m.Id) {
+		return errors.New("Unrequested asc_pull ack")
+	}
+	for i := range m.Blocks {
+		block, err := m.Blocks[i].ToBlock()
+		if err != nil {
+			return err
+		}
+		storeNetworkBlock(block)
+	}
+	return nil
+}
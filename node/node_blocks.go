@@ -2,180 +2,90 @@ package node
 
 import (
 	"bytes"
-	"encoding/hex"
 	"errors"
 
-	"github.com/frankh/nano/address"
 	"github.com/frankh/nano/blocks"
-	"github.com/frankh/nano/types"
-	"github.com/frankh/nano/uint128"
-	"github.com/frankh/nano/utils"
 )
 
-type MessageBlockCommon struct {
-	Signature [64]byte
-	Work      [8]byte
-}
-
+// A block in a message, the encoding is shared with the store and lives
+// in the blocks package.
 type MessageBlock struct {
-	Type             byte
-	SourceOrPrevious [32]byte // Source for open, previous for others
-	RepDestOrSource  [32]byte // Rep for open/change, dest for send, source for receive
-	Account          [32]byte // Account for open
-	Balance          [16]byte // Balance for send
-	MessageBlockCommon
+	Type  byte
+	Block blocks.Block
 }
 
-func (m *MessageBlockCommon) ReadCommon(buf *bytes.Buffer) error {
-	n, err := buf.Read(m.Signature[:])
-
-	if n != len(m.Signature) {
-		return errors.New("Wrong number of bytes in signature")
-	}
-	if err != nil {
-		return err
-	}
-
-	work := make([]byte, 8)
-	n, err = buf.Read(work)
-	work = utils.Reversed(work)
-
-	copy(m.Work[:], work)
-
-	if n != len(m.Work) {
-		return errors.New("Wrong number of bytes in work")
-	}
-	if err != nil {
-		return err
-	}
-
-	return nil
+var blockTypes = map[byte]blocks.BlockType{
+	BlockType_send:    blocks.Send,
+	BlockType_receive: blocks.Receive,
+	BlockType_open:    blocks.Open,
+	BlockType_change:  blocks.Change,
 }
 
-func (m *MessageBlockCommon) WriteCommon(buf *bytes.Buffer) error {
-	n, err := buf.Write(m.Signature[:])
-
-	if n != len(m.Signature) {
-		return errors.New("Wrong number of bytes in signature")
-	}
-	if err != nil {
-		return err
+func blockTypeCode(t blocks.BlockType) (byte, bool) {
+	for code, blockType := range blockTypes {
+		if blockType == t {
+			return code, true
+		}
 	}
+	return BlockType_invalid, false
+}
 
-	n, err = buf.Write(utils.Reversed(m.Work[:]))
-
-	if n != len(m.Work) {
-		return errors.New("Wrong number of bytes in work")
-	}
-	if err != nil {
-		return err
+func (m *MessageBlock) ToBlock() (blocks.Block, error) {
+	if m.Block == nil {
+		return nil, errors.New("Unknown block type")
 	}
-
-	return nil
+	return m.Block, nil
 }
 
-func (m *MessageBlock) ToBlock() blocks.Block {
-	common := blocks.CommonBlock{
-		Work:      types.Work(hex.EncodeToString(m.Work[:])),
-		Signature: types.Signature(hex.EncodeToString(m.Signature[:])),
+// FromBlock fills in the message block from a block, the inverse of ToBlock.
+func (m *MessageBlock) FromBlock(block blocks.Block) error {
+	code, ok := blockTypeCode(block.Type())
+	if !ok {
+		return errors.New("Unknown block type")
 	}
 
-	switch m.Type {
-	case BlockType_open:
-		block := blocks.OpenBlock{
-			types.BlockHash(hex.EncodeToString(m.SourceOrPrevious[:])),
-			address.PubKeyToAddress(m.RepDestOrSource[:]),
-			address.PubKeyToAddress(m.Account[:]),
-			common,
-		}
-		return &block
-	case BlockType_send:
-		block := blocks.SendBlock{
-			types.BlockHash(hex.EncodeToString(m.SourceOrPrevious[:])),
-			address.PubKeyToAddress(m.RepDestOrSource[:]),
-			uint128.FromBytes(m.Balance[:]),
-			common,
-		}
-		return &block
-	case BlockType_receive:
-		block := blocks.ReceiveBlock{
-			types.BlockHash(hex.EncodeToString(m.SourceOrPrevious[:])),
-			types.BlockHash(hex.EncodeToString(m.RepDestOrSource[:])),
-			common,
-		}
-		return &block
-	case BlockType_change:
-		block := blocks.ChangeBlock{
-			types.BlockHash(hex.EncodeToString(m.SourceOrPrevious[:])),
-			address.PubKeyToAddress(m.RepDestOrSource[:]),
-			common,
-		}
-		return &block
-	default:
-		return nil
-	}
+	m.Type = code
+	m.Block = block
+	return nil
 }
 
 func (m *MessageBlock) Read(messageBlockType byte, buf *bytes.Buffer) error {
 	m.Type = messageBlockType
+	m.Block = nil
 
-	n1, err1 := buf.Read(m.SourceOrPrevious[:])
-	n2, err2 := buf.Read(m.RepDestOrSource[:])
-
-	if messageBlockType == BlockType_open {
-		n, err := buf.Read(m.Account[:])
-		if err != nil || n != 32 {
-			return errors.New("Failed to read account")
-		}
-	}
-
-	if messageBlockType == BlockType_send {
-		n, err := buf.Read(m.Balance[:])
-		if err != nil || n != 16 {
-			return errors.New("Failed to read balance")
-		}
+	blockType, ok := blockTypes[messageBlockType]
+	if !ok {
+		return errors.New("Unknown block type")
 	}
 
-	err3 := m.MessageBlockCommon.ReadCommon(buf)
-
-	if err1 != nil || err2 != nil || err3 != nil {
+	data := make([]byte, blocks.BinarySize(blockType))
+	n, err := buf.Read(data)
+	if err != nil || n != len(data) {
 		return errors.New("Failed to read block")
 	}
 
-	if n1 != 32 || n2 != 32 {
-		return errors.New("Wrong number of bytes read")
+	block, err := blocks.FromBinary(blockType, data)
+	if err != nil {
+		return err
 	}
-
+	m.Block = block
 	return nil
 }
 
 func (m *MessageBlock) Write(buf *bytes.Buffer) error {
-	n1, err1 := buf.Write(m.SourceOrPrevious[:])
-	n2, err2 := buf.Write(m.RepDestOrSource[:])
-
-	if m.Type == BlockType_open {
-		n, err := buf.Write(m.Account[:])
-		if err != nil || n != 32 {
-			return errors.New("Failed to write account")
-		}
+	if m.Block == nil {
+		return errors.New("No block to write")
 	}
 
-	if m.Type == BlockType_send {
-		n, err := buf.Write(m.Balance[:])
-		if err != nil || n != 16 {
-			return errors.New("Failed to write balance")
-		}
+	data, err := blocks.ToBinary(m.Block)
+	if err != nil {
+		return err
 	}
 
-	err3 := m.MessageBlockCommon.WriteCommon(buf)
-
-	if err1 != nil || err2 != nil || err3 != nil {
+	n, err := buf.Write(data)
+	if err != nil || n != len(data) {
 		return errors.New("Failed to write block")
 	}
 
-	if n1 != 32 || n2 != 32 {
-		return errors.New("Wrong number of bytes written")
-	}
-
 	return nil
 }
@@ -0,0 +1,200 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+// Bootstrap messages are only sent over TCP by the reference node, they
+// can be read and written but aren't handled yet.
+
+// Requests an account's chain from Start, a block hash or account, back
+// to End, or Count blocks if it isn't zero.
+type MessageBulkPull struct {
+	MessageHeader
+	Start [32]byte
+	End   types.BlockHash
+	Count uint32
+}
+
+// Header only, the blocks follow on the connection.
+type MessageBulkPush struct {
+	MessageHeader
+}
+
+// Requests frontiers from StartAccount, for accounts modified in the last
+// Age seconds, at most Count of them.
+type MessageFrontierReq struct {
+	MessageHeader
+	StartAccount types.Account
+	Age          uint32
+	Count        uint32
+}
+
+// Flags of bulk_pull_account, the reference node's pending flags
+const (
+	BulkPullAccountHashAndAmount        byte = 0x00
+	BulkPullAccountAddressOnly          byte = 0x01
+	BulkPullAccountHashAmountAndAddress byte = 0x02
+)
+
+// Requests an account's receivables of at least MinimumAmount.
+type MessageBulkPullAccount struct {
+	MessageHeader
+	Account       types.Account
+	MinimumAmount uint128.Uint128
+	Flags         byte
+}
+
+func CreateBulkPull(start [32]byte, end types.BlockHash, count uint32) *MessageBulkPull {
+	m := MessageBulkPull{newHeader(Message_bulk_pull), start, end, count}
+	if count != 0 {
+		m.MessageHeader.Extensions |= ExtensionBulkPullCount
+	}
+	return &m
+}
+
+func CreateFrontierReq(start types.Account, age uint32, count uint32) *MessageFrontierReq {
+	return &MessageFrontierReq{newHeader(Message_frontier_req), start, age, count}
+}
+
+func (m *MessageBulkPull) Read(buf *bytes.Buffer) error {
+	err := m.MessageHeader.ReadHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	if m.MessageHeader.MessageType != Message_bulk_pull {
+		return errors.New("Tried to read wrong message type")
+	}
+
+	if err := readBytes(buf, m.Start[:]); err != nil {
+		return err
+	}
+	if err := readBytes(buf, m.End[:]); err != nil {
+		return err
+	}
+
+	m.Count = 0
+	if m.MessageHeader.Extensions&ExtensionBulkPullCount != 0 {
+		// A zero byte, the count and 3 reserved bytes
+		var extended [8]byte
+		if err := readBytes(buf, extended[:]); err != nil {
+			return err
+		}
+		if extended[0] != 0 {
+			return errors.New("Invalid bulk_pull count")
+		}
+		m.Count = binary.LittleEndian.Uint32(extended[1:5])
+	}
+	return nil
+}
+
+func (m *MessageBulkPull) Write(buf *bytes.Buffer) error {
+	err := m.MessageHeader.WriteHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	buf.Write(m.Start[:])
+	buf.Write(m.End[:])
+	if m.MessageHeader.Extensions&ExtensionBulkPullCount != 0 {
+		var extended [8]byte
+		binary.LittleEndian.PutUint32(extended[1:5], m.Count)
+		buf.Write(extended[:])
+	}
+	return nil
+}
+
+func (m *MessageBulkPush) Read(buf *bytes.Buffer) error {
+	err := m.MessageHeader.ReadHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	if m.MessageHeader.MessageType != Message_bulk_push {
+		return errors.New("Tried to read wrong message type")
+	}
+	return nil
+}
+
+func (m *MessageBulkPush) Write(buf *bytes.Buffer) error {
+	return m.MessageHeader.WriteHeader(buf)
+}
+
+func (m *MessageFrontierReq) Read(buf *bytes.Buffer) error {
+	err := m.MessageHeader.ReadHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	if m.MessageHeader.MessageType != Message_frontier_req {
+		return errors.New("Tried to read wrong message type")
+	}
+
+	var numbers [8]byte
+	if err := readBytes(buf, m.StartAccount[:]); err != nil {
+		return err
+	}
+	if err := readBytes(buf, numbers[:]); err != nil {
+		return err
+	}
+	m.Age = binary.LittleEndian.Uint32(numbers[0:4])
+	m.Count = binary.LittleEndian.Uint32(numbers[4:8])
+	return nil
+}
+
+func (m *MessageFrontierReq) Write(buf *bytes.Buffer) error {
+	err := m.MessageHeader.WriteHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	var numbers [8]byte
+	binary.LittleEndian.PutUint32(numbers[0:4], m.Age)
+	binary.LittleEndian.PutUint32(numbers[4:8], m.Count)
+	buf.Write(m.StartAccount[:])
+	buf.Write(numbers[:])
+	return nil
+}
+
+func (m *MessageBulkPullAccount) Read(buf *bytes.Buffer) error {
+	err := m.MessageHeader.ReadHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	if m.MessageHeader.MessageType != Message_bulk_pull_account {
+		return errors.New("Tried to read wrong message type")
+	}
+
+	var amount [16]byte
+	if err := readBytes(buf, m.Account[:]); err != nil {
+		return err
+	}
+	if err := readBytes(buf, amount[:]); err != nil {
+		return err
+	}
+	m.MinimumAmount = uint128.FromBytes(amount[:])
+	m.Flags, err = buf.ReadByte()
+	if err != nil {
+		return errors.New("Message too short")
+	}
+	return nil
+}
+
+func (m *MessageBulkPullAccount) Write(buf *bytes.Buffer) error {
+	err := m.MessageHeader.WriteHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	buf.Write(m.Account[:])
+	buf.Write(m.MinimumAmount.GetBytes())
+	buf.WriteByte(m.Flags)
+	return nil
+}
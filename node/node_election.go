@@ -0,0 +1,167 @@
+package node
+
+import (
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/frankh/nano/ws"
+)
+
+// An election starts for each block stored. Votes for the block are
+// tallied by the voting weight of the representatives they're from, and
+// the block is confirmed once the tally reaches quorum. Elections that
+// don't reach quorum within ElectionTimeout expire.
+var ElectionTimeout = 5 * time.Minute
+
+// Limits the elections running at once, as during bootstrap every block
+// stored would start one. Blocks stored while there are this many aren't
+// elected.
+var MaxElections = 5000
+
+// Representatives count as online for this long after their last vote.
+var OnlineRepTimeout = 5 * time.Minute
+
+// Quorum is QuorumPercent of the weight of the online representatives,
+// or of OnlineWeightMinimum when less than that is online, as the
+// reference node does.
+var QuorumPercent = 67
+var OnlineWeightMinimum = uint128.MNano.Raw().Mul(uint128.FromInts(0, 60000000))
+
+type election struct {
+	block   blocks.Block
+	started time.Time
+	voters  map[types.Account]bool
+	tally   uint128.Uint128
+}
+
+type onlineRep struct {
+	weight   uint128.Uint128
+	lastVote time.Time
+}
+
+var elections = make(map[types.BlockHash]*election)
+var onlineReps = make(map[types.Account]onlineRep)
+var electionsLock sync.Mutex
+
+// Starts an election for a newly stored block.
+func startElection(block blocks.Block) {
+	hash := block.Hash()
+	electionsLock.Lock()
+	if _, ok := elections[hash]; ok || len(elections) >= MaxElections {
+		electionsLock.Unlock()
+		return
+	}
+	elections[hash] = &election{block, time.Now(), make(map[types.Account]bool), uint128.Uint128{}}
+	electionsLock.Unlock()
+
+	electionsStarted.Inc()
+	ws.ElectionStarted(hash)
+}
+
+// Must be called with electionsLock held.
+func quorum(now time.Time) uint128.Uint128 {
+	online := uint128.Uint128{}
+	for _, rep := range onlineReps {
+		if now.Sub(rep.lastVote) < OnlineRepTimeout {
+			online = online.Add(rep.weight)
+		}
+	}
+	if online.Compare(OnlineWeightMinimum) < 0 {
+		online = OnlineWeightMinimum
+	}
+	return online.Div(uint128.FromInts(0, 100)).Mul(uint128.FromInts(0, uint64(QuorumPercent)))
+}
+
+// Adds a verified vote to the elections for the blocks it's for, and
+// confirms those that reach quorum.
+func tallyVote(representative types.Account, hashes []types.BlockHash) {
+	weight := store.RepresentativeWeight(representative)
+	if weight.IsZero() {
+		return
+	}
+
+	now := time.Now()
+	confirmed := make([]*election, 0)
+	electionsLock.Lock()
+	onlineReps[representative] = onlineRep{weight, now}
+	threshold := quorum(now)
+	for _, hash := range hashes {
+		e := elections[hash]
+		if e == nil || e.voters[representative] {
+			continue
+		}
+		e.voters[representative] = true
+		e.tally = e.tally.Add(weight)
+		if e.tally.Compare(threshold) >= 0 {
+			delete(elections, hash)
+			confirmed = append(confirmed, e)
+		}
+	}
+	electionsLock.Unlock()
+
+	for _, e := range confirmed {
+		stopElection(e, true)
+		notifyConfirmation(e.block)
+	}
+}
+
+func stopElection(e *election, confirmed bool) {
+	result := "expired"
+	if confirmed {
+		result = "confirmed"
+	}
+	electionsStopped.Inc(result)
+	electionDuration.Observe(time.Since(e.started).Seconds())
+	ws.ElectionStopped(e.block.Hash(), confirmed)
+}
+
+// Confirmations name the account whose chain the block is in and the
+// amount it moved.
+func notifyConfirmation(block blocks.Block) {
+	hash := block.Hash()
+	sideband := store.FetchSideband(hash)
+	if sideband == nil {
+		return
+	}
+	history, err := store.FetchHistory(sideband.Account, store.HistoryOptions{Head: &hash, Count: 1})
+	if err != nil || len(history) == 0 {
+		logger.Warn("Failed to read confirmed block", "hash", hash, "err", err)
+		return
+	}
+	ws.Confirmation(block, sideband.Account, history[0].Amount)
+}
+
+// ExpireElections stops elections that haven't reached quorum within
+// ElectionTimeout, and forgets representatives that have gone offline.
+func ExpireElections(params []interface{}) {
+	now := time.Now()
+	expired := make([]*election, 0)
+	electionsLock.Lock()
+	for hash, e := range elections {
+		if now.Sub(e.started) >= ElectionTimeout {
+			delete(elections, hash)
+			expired = append(expired, e)
+		}
+	}
+	for account, rep := range onlineReps {
+		if now.Sub(rep.lastVote) >= OnlineRepTimeout {
+			delete(onlineReps, account)
+		}
+	}
+	electionsLock.Unlock()
+
+	for _, e := range expired {
+		stopElection(e, false)
+	}
+}
+
+// ElectionCount returns the number of elections running.
+func ElectionCount() int {
+	electionsLock.Lock()
+	defer electionsLock.Unlock()
+	return len(elections)
+}
@@ -0,0 +1,366 @@
+package node
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/frankh/crypto/ed25519"
+	"github.com/frankh/nano/metrics"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/golang/crypto/blake2b"
+)
+
+// Peers prove who they are with a node_id_handshake: we send a random
+// cookie as a query, and the peer responds with its node ID and the
+// cookie signed with the node ID's key. A peer is validated once it has
+// responded correctly, and only validated peers are added to the peer
+// list from keepalives.
+//
+// In v2 handshakes the response also has a random salt and the genesis
+// block hash, and the signature is of the hash of the cookie, salt and
+// genesis, so peers on other networks are rejected.
+
+// Extension flags of node_id_handshake messages, a message can carry a
+// query, a response or both. HandshakeV2 on a query asks for a v2
+// response, and on a response says it is one.
+const (
+	HandshakeQuery    byte = 0x01
+	HandshakeResponse byte = 0x02
+	HandshakeV2       byte = 0x04
+)
+
+// Unanswered queries are forgotten after handshakeTimeout, and at most
+// maxPendingHandshakes are kept so keepalives full of made up peers can't
+// grow the table without limit.
+const handshakeTimeout = time.Minute
+const maxPendingHandshakes = 1024
+
+// Queries from each endpoint are answered at most once per
+// handshakeResponseInterval, so a flood of queries with spoofed sources
+// can't keep the node signing responses.
+const handshakeResponseInterval = time.Second
+
+type NodeIdResponse struct {
+	Account   types.Account
+	Signature types.Signature
+	V2        *NodeIdResponseV2
+}
+
+type NodeIdResponseV2 struct {
+	Salt    [32]byte
+	Genesis types.BlockHash
+}
+
+type MessageNodeIdHandshake struct {
+	MessageHeader
+	Query    *[32]byte
+	Response *NodeIdResponse
+}
+
+var handshakes = metrics.NewCounter("nano_handshakes_total",
+	"Node ID handshake responses received, by result.", "result")
+
+// Cookies sent to peers that haven't responded yet, by endpoint
+var pendingHandshakes = make(map[string]pendingHandshake)
+
+// Node IDs of validated peers, by endpoint
+var nodeIds = make(map[string]types.Account)
+
+// When each endpoint's last query was answered
+var handshakeResponses = make(map[string]time.Time)
+var handshakeLock sync.Mutex
+
+type pendingHandshake struct {
+	cookie [32]byte
+	sent   time.Time
+}
+
+var nodeKey ed25519.PrivateKey
+var nodeKeyOnce sync.Once
+
+func loadNodeKey() ed25519.PrivateKey {
+	nodeKeyOnce.Do(func() {
+		nodeKey = store.FetchNodeKey()
+	})
+	return nodeKey
+}
+
+// NodeId returns the account this node identifies itself to peers with.
+func NodeId() types.Account {
+	var account types.Account
+	// The second half of an ed25519 private key is its public key
+	copy(account[:], loadNodeKey()[32:])
+	return account
+}
+
+// PeerNodeId returns the node ID of a validated peer.
+func PeerNodeId(peer Peer) (types.Account, bool) {
+	handshakeLock.Lock()
+	defer handshakeLock.Unlock()
+	id, ok := nodeIds[peer.String()]
+	return id, ok
+}
+
+func IsValidated(peer Peer) bool {
+	_, ok := PeerNodeId(peer)
+	return ok
+}
+
+// Records a validated peer's node ID under another endpoint it can be
+// reached at.
+func copyNodeId(from Peer, to Peer) {
+	handshakeLock.Lock()
+	defer handshakeLock.Unlock()
+	if id, ok := nodeIds[from.String()]; ok {
+		nodeIds[to.String()] = id
+	}
+}
+
+func CreateNodeIdHandshake(query *[32]byte, response *NodeIdResponse) *MessageNodeIdHandshake {
+	var m MessageNodeIdHandshake
+	m.MessageHeader.MagicNumber = MagicNumber
+	m.MessageHeader.VersionMax = VersionMax
+	m.MessageHeader.VersionUsing = VersionUsing
+	m.MessageHeader.VersionMin = VersionMin
+	m.MessageHeader.MessageType = Message_node_id_handshake
+	m.Query = query
+	m.Response = response
+	if query != nil {
+		m.MessageHeader.Extensions |= HandshakeQuery
+	}
+	if response != nil {
+		m.MessageHeader.Extensions |= HandshakeResponse
+	}
+	// The flag covers both parts, so a query sent with a v1 response asks
+	// for a v1 response
+	if response == nil || response.V2 != nil {
+		m.MessageHeader.Extensions |= HandshakeV2
+	}
+	return &m
+}
+
+func (m *MessageNodeIdHandshake) Read(buf *bytes.Buffer) error {
+	err := m.MessageHeader.ReadHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	if m.MessageHeader.MessageType != Message_node_id_handshake {
+		return errors.New("Tried to read wrong message type")
+	}
+
+	m.Query = nil
+	m.Response = nil
+	if m.MessageHeader.Extensions&HandshakeQuery != 0 {
+		m.Query = new([32]byte)
+		if n, _ := buf.Read(m.Query[:]); n != 32 {
+			return errors.New("Failed to read handshake query")
+		}
+	}
+	if m.MessageHeader.Extensions&HandshakeResponse != 0 {
+		m.Response = new(NodeIdResponse)
+		n1, _ := buf.Read(m.Response.Account[:])
+		if m.MessageHeader.Extensions&HandshakeV2 != 0 {
+			m.Response.V2 = new(NodeIdResponseV2)
+			n2, _ := buf.Read(m.Response.V2.Salt[:])
+			n3, _ := buf.Read(m.Response.V2.Genesis[:])
+			if n2 != 32 || n3 != 32 {
+				return errors.New("Failed to read handshake response")
+			}
+		}
+		n4, _ := buf.Read(m.Response.Signature[:])
+		if n1 != 32 || n4 != 64 {
+			return errors.New("Failed to read handshake response")
+		}
+	}
+
+	return nil
+}
+
+func (m *MessageNodeIdHandshake) Write(buf *bytes.Buffer) error {
+	err := m.MessageHeader.WriteHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	if m.Query != nil {
+		buf.Write(m.Query[:])
+	}
+	if m.Response != nil {
+		buf.Write(m.Response.Account[:])
+		if m.Response.V2 != nil {
+			buf.Write(m.Response.V2.Salt[:])
+			buf.Write(m.Response.V2.Genesis[:])
+		}
+		buf.Write(m.Response.Signature[:])
+	}
+
+	return nil
+}
+
+// Returns a new cookie for a peer, or nil if one was sent recently or the
+// peer is already validated.
+func newHandshakeCookie(peer Peer) *[32]byte {
+	handshakeLock.Lock()
+	defer handshakeLock.Unlock()
+
+	key := peer.String()
+	now := time.Now()
+	if _, ok := nodeIds[key]; ok {
+		return nil
+	}
+	if pending, ok := pendingHandshakes[key]; ok && now.Sub(pending.sent) < handshakeTimeout {
+		return nil
+	}
+
+	if len(pendingHandshakes) >= maxPendingHandshakes {
+		for k, pending := range pendingHandshakes {
+			if now.Sub(pending.sent) >= handshakeTimeout {
+				delete(pendingHandshakes, k)
+			}
+		}
+	}
+	if len(pendingHandshakes) >= maxPendingHandshakes {
+		return nil
+	}
+
+	var cookie [32]byte
+	if _, err := rand.Read(cookie[:]); err != nil {
+		return nil
+	}
+	pendingHandshakes[key] = pendingHandshake{cookie, now}
+	return &cookie
+}
+
+// Returns the cookie a peer hasn't responded to yet, or a new one, for
+// starting a handshake on a new channel.
+func channelHandshakeCookie(peer Peer) *[32]byte {
+	handshakeLock.Lock()
+	pending, ok := pendingHandshakes[peer.String()]
+	handshakeLock.Unlock()
+	if ok && time.Since(pending.sent) < handshakeTimeout {
+		return &pending.cookie
+	}
+	return newHandshakeCookie(peer)
+}
+
+// startHandshake sends a query to a peer that isn't validated, unless one
+// is already waiting on a response.
+func startHandshake(peer Peer) {
+	if !PeerSupports(peer, FeatureNodeIdHandshake) {
+		return
+	}
+	cookie := newHandshakeCookie(peer)
+	if cookie == nil {
+		return
+	}
+	if err := peer.SendMessage(CreateNodeIdHandshake(cookie, nil)); err != nil {
+		netErrLogger.Warn("Failed to send handshake", "peer", peer.String(), "err", err)
+	}
+}
+
+// Returns whether a query from the peer can be answered, and if so
+// records that it was. Limited to maxPendingHandshakes endpoints like
+// the cookies sent.
+func allowHandshakeResponse(peer Peer) bool {
+	handshakeLock.Lock()
+	defer handshakeLock.Unlock()
+
+	key := peer.String()
+	now := time.Now()
+	if last, ok := handshakeResponses[key]; ok && now.Sub(last) < handshakeResponseInterval {
+		return false
+	}
+	if len(handshakeResponses) >= maxPendingHandshakes {
+		for k, last := range handshakeResponses {
+			if now.Sub(last) >= handshakeResponseInterval {
+				delete(handshakeResponses, k)
+			}
+		}
+	}
+	if len(handshakeResponses) >= maxPendingHandshakes {
+		return false
+	}
+	handshakeResponses[key] = now
+	return true
+}
+
+// Returns what a response to a cookie signs.
+func (r *NodeIdResponse) signedData(cookie [32]byte) types.BlockHash {
+	if r.V2 == nil {
+		return types.BlockHash(cookie)
+	}
+	hash, _ := blake2b.New(32, nil)
+	hash.Write(cookie[:])
+	hash.Write(r.V2.Salt[:])
+	hash.Write(r.V2.Genesis[:])
+	return types.BlockHashFromBytes(hash.Sum(nil))
+}
+
+// Creates a response to a query, v2 if it was asked for.
+func createNodeIdResponse(cookie [32]byte, v2 bool) *NodeIdResponse {
+	response := &NodeIdResponse{Account: NodeId()}
+	if v2 {
+		response.V2 = new(NodeIdResponseV2)
+		rand.Read(response.V2.Salt[:])
+		response.V2.Genesis = store.Conf.GenesisBlock.Hash()
+	}
+	response.Signature = response.signedData(cookie).Sign(loadNodeKey())
+	return response
+}
+
+// Checks a peer's response against the cookie we sent it, returning the
+// result for logging and metrics.
+func validateHandshake(peer Peer, response *NodeIdResponse) string {
+	handshakeLock.Lock()
+	defer handshakeLock.Unlock()
+
+	key := peer.String()
+	pending, ok := pendingHandshakes[key]
+	if !ok || time.Since(pending.sent) >= handshakeTimeout {
+		return "unexpected"
+	}
+	if response.V2 != nil && response.V2.Genesis != store.Conf.GenesisBlock.Hash() {
+		delete(pendingHandshakes, key)
+		return "wrong_genesis"
+	}
+	signed := response.signedData(pending.cookie)
+	if !ed25519.Verify(response.Account[:], signed[:], response.Signature[:]) {
+		delete(pendingHandshakes, key)
+		return "invalid_signature"
+	}
+	delete(pendingHandshakes, key)
+	if response.Account == NodeId() {
+		return "self"
+	}
+	nodeIds[key] = response.Account
+	return "validated"
+}
+
+func (m *MessageNodeIdHandshake) Handle(from Peer) error {
+	if m.Response != nil {
+		result := validateHandshake(from, m.Response)
+		handshakes.Inc(result)
+		if result != "validated" {
+			badMessageLogger.Warn("Rejected handshake", "peer", from.String(), "result", result)
+		} else {
+			logger.Info("Validated peer", "peer", from.String(), "node_id", m.Response.Account)
+			addValidatedPeer(from)
+		}
+	}
+
+	if m.Query != nil {
+		if !allowHandshakeResponse(from) {
+			badMessageLogger.Warn("Not answering handshake query, peer queried too recently", "peer", from.String())
+			return nil
+		}
+		response := createNodeIdResponse(*m.Query, m.MessageHeader.Extensions&HandshakeV2 != 0)
+		// Ask for the peer's ID in the same message if we don't know it
+		return from.SendMessage(CreateNodeIdHandshake(newHandshakeCookie(from), response))
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package node
+
+import (
+	"github.com/frankh/nano/metrics"
+)
+
+var messagesIn = metrics.NewCounter("nano_messages_received_total",
+	"Messages received from peers, by message type.", "type")
+var messagesOut = metrics.NewCounter("nano_messages_sent_total",
+	"Messages sent to peers, by message type.", "type")
+var parseFailures = metrics.NewCounter("nano_message_parse_failures_total",
+	"Messages received that couldn't be read, by message type.", "type")
+var blocksDropped = metrics.NewCounter("nano_blocks_dropped_total",
+	"Blocks from the network dropped because the block processor was behind.")
+
+var electionsStarted = metrics.NewCounter("nano_elections_started_total",
+	"Elections started.")
+var electionsStopped = metrics.NewCounter("nano_elections_stopped_total",
+	"Elections finished, by whether they were confirmed or expired.", "result")
+var electionDuration = metrics.NewHistogram("nano_election_duration_seconds",
+	"Time from starting an election to it finishing.",
+	[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300})
+
+func init() {
+	metrics.NewGaugeFunc("nano_peers", "Known peers.", func() float64 {
+		return float64(PeerCount())
+	})
+	metrics.NewGaugeFunc("nano_channels", "Open realtime TCP channels.", func() float64 {
+		return float64(ChannelCount())
+	})
+	metrics.NewGaugeFunc("nano_elections_active", "Elections running.", func() float64 {
+		return float64(ElectionCount())
+	})
+}
+
+// Names match the reference implementation's message types
+var messageTypeNames = map[byte]string{
+	Message_invalid:           "invalid",
+	Message_not_a_type:        "not_a_type",
+	Message_keepalive:         "keepalive",
+	Message_publish:           "publish",
+	Message_confirm_req:       "confirm_req",
+	Message_confirm_ack:       "confirm_ack",
+	Message_bulk_pull:         "bulk_pull",
+	Message_bulk_push:         "bulk_push",
+	Message_frontier_req:      "frontier_req",
+	Message_bulk_pull_blocks:  "bulk_pull_blocks",
+	Message_node_id_handshake: "node_id_handshake",
+	Message_bulk_pull_account: "bulk_pull_account",
+	Message_telemetry_req:     "telemetry_req",
+	Message_telemetry_ack:     "telemetry_ack",
+	Message_asc_pull_req:      "asc_pull_req",
+	Message_asc_pull_ack:      "asc_pull_ack",
+}
+
+func messageTypeName(t byte) string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
@@ -2,14 +2,27 @@ package node
 
 import (
 	"bytes"
-	"log"
+	"errors"
 	"math/rand"
 	"net"
+	"sync"
 	"time"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/logging"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
 )
 
-const packetSize = 512
-const numberOfPeersToShare = 8
+var netLogger = logging.New("node.net")
+
+// Network errors tend to repeat for every packet while a peer or the
+// network is down
+var netErrLogger = netLogger.Limit(time.Minute)
+
+// Defaults for the settings in the node configuration
+var PacketSize = 512
+var PeersToShare = 8
 
 var DefaultPeer = Peer{
 	net.ParseIP("::ffff:192.168.0.70"),
@@ -20,66 +33,252 @@ var DefaultPeer = Peer{
 var PeerList = []Peer{DefaultPeer}
 var PeerSet = map[string]bool{DefaultPeer.String(): true}
 
+// Guards PeerList and PeerSet. It's separate from dispatchLock as peers
+// are also picked while a message is being handled, e.g. to request a
+// missing block.
+var peersLock sync.RWMutex
+
+// SetPeers replaces the known peers, for starting from configured peers
+// rather than DefaultPeer.
+func SetPeers(peers []Peer) {
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	PeerList = make([]Peer, 0, len(peers))
+	PeerSet = make(map[string]bool)
+	for _, peer := range peers {
+		if !PeerSet[peer.String()] {
+			PeerSet[peer.String()] = true
+			PeerList = append(PeerList, peer)
+		}
+	}
+}
+
+// Missing blocks are requested at most once per interval, from a few
+// random peers
+const missingRequestInterval = time.Minute
+const missingRequestPeers = 2
+
+var missingRequests = make(map[types.BlockHash]time.Time)
+
+// IDs of the asc_pull requests sent for missing blocks, only acks to
+// these are processed
+var ascPullRequests = make(map[uint64]time.Time)
+var missingRequestsLock sync.Mutex
+
+func init() {
+	store.MissingBlockHandler = requestMissingBlock
+}
+
 func (p *Peer) SendMessage(m Message) error {
 	now := time.Now()
 	p.LastReachout = &now
 
-	outConn, err := net.DialUDP("udp", nil, p.Addr())
+	m.Header().VersionUsing = negotiatedVersion(*p)
+	buf := bytes.NewBuffer(nil)
+	err := m.Write(buf)
 	if err != nil {
 		return err
 	}
+	// The message type is the sixth byte of the header
+	messageType := messageTypeName(buf.Bytes()[5])
+	if !allowSend(*p, buf.Len()) {
+		sendErrors.Inc("bandwidth")
+		return errors.New("Peer bandwidth limit reached")
+	}
 
-	buf := bytes.NewBuffer(nil)
-	err = m.Write(buf)
-	if err != nil {
-		return err
+	// Peers new enough get messages over a TCP channel, until one is
+	// connected they're sent over UDP
+	if c := channelFor(*p); c != nil {
+		if err := c.queue(buf.Bytes()); err != nil {
+			return err
+		}
+		messagesOut.Inc(messageType)
+		return nil
+	}
+	if PeerSupports(*p, FeatureTcpRealtime) {
+		go connectTcp(*p)
 	}
-	outConn.Write(buf.Bytes())
 
-	return nil
+	return sendUdp(*p, buf.Bytes(), messageType)
+}
+
+func peerFromAddr(addr net.Addr) Peer {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return Peer{a.IP.To16(), uint16(a.Port), nil}
+	case *net.TCPAddr:
+		return Peer{a.IP.To16(), uint16(a.Port), nil}
+	}
+	return Peer{}
 }
 
-func ListenForUdp() {
-	log.Printf("Listening for udp packets on 7075")
-	ln, err := net.ListenPacket("udp", ":7075")
+// Messages are handled one at a time whether they came over UDP or a
+// channel, as handling them updates the peer list.
+var dispatchLock sync.Mutex
+
+func dispatch(buf *bytes.Buffer, from Peer) {
+	dispatchLock.Lock()
+	defer dispatchLock.Unlock()
+	handleMessage(buf, from)
+}
+
+func ListenForUdp(addr string) {
+	netLogger.Info("Listening for udp packets", "addr", addr)
+	ln, err := net.ListenPacket("udp", addr)
 	if err != nil {
 		panic(err)
 	}
+	setUdpSocket(ln)
+	serveUdp(ln)
+}
 
-	buf := make([]byte, packetSize)
+func serveUdp(ln net.PacketConn) {
+	buf := make([]byte, PacketSize)
 
 	for {
-		n, _, err := ln.ReadFrom(buf)
+		n, from, err := ln.ReadFrom(buf)
 		if err != nil {
+			// The socket was closed and replaced
+			if !isUdpSocket(ln) {
+				return
+			}
+			netErrLogger.Warn("Failed to read packet", "err", err)
 			continue
 		}
 		if n > 0 {
-			handleMessage(bytes.NewBuffer(buf[:n]))
+			dispatch(bytes.NewBuffer(buf[:n]), peerFromAddr(from))
 		}
 	}
 }
 
-func SendKeepAlive(peer Peer) error {
+// Peers returns a copy of the peer list.
+func Peers() []Peer {
+	peersLock.RLock()
+	defer peersLock.RUnlock()
+	return append([]Peer{}, PeerList...)
+}
+
+// PeerCount returns the number of known peers.
+func PeerCount() int {
+	peersLock.RLock()
+	defer peersLock.RUnlock()
+	return len(PeerList)
+}
+
+func knownPeer(peer Peer) bool {
+	peersLock.RLock()
+	defer peersLock.RUnlock()
+	return PeerSet[peer.String()]
+}
+
+// Returns up to PeersToShare random peers for a keepalive.
+func randomPeers() []Peer {
+	peersLock.RLock()
+	defer peersLock.RUnlock()
 	randomPeers := make([]Peer, 0)
 	randIndices := rand.Perm(len(PeerList))
 	for n, i := range randIndices {
-		if n == numberOfPeersToShare {
+		if n == PeersToShare {
 			break
 		}
 		randomPeers = append(randomPeers, PeerList[i])
 	}
+	return randomPeers
+}
 
-	m := CreateKeepAlive(randomPeers)
+func SendKeepAlive(peer Peer) error {
+	peers := randomPeers()
+	if channelFor(peer) != nil {
+		peers = append([]Peer{selfEndpoint()}, peers...)
+	}
+	m := CreateKeepAlive(peers)
 	return peer.SendMessage(m)
 }
 
+// PublishBlock sends a block to every known peer.
+func PublishBlock(block blocks.Block) error {
+	m, err := CreatePublish(block)
+	if err != nil {
+		return err
+	}
+
+	// Sending records when each peer was last reached out to
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	for i := range PeerList {
+		if err := PeerList[i].SendMessage(m); err != nil {
+			netErrLogger.Warn("Failed to publish block", "peer", PeerList[i].String(), "hash", block.Hash(), "err", err)
+		}
+	}
+	return nil
+}
+
 func SendKeepAlives(params []interface{}) {
-	peers := params[0].([]Peer)
+	peers := Peers()
 	timeCutoff := time.Now().Add(-5 * time.Minute)
 
 	for _, peer := range peers {
+		// Configured peers are in the list before they're validated
+		if !IsValidated(peer) {
+			startHandshake(peer)
+		}
 		if peer.LastReachout == nil || peer.LastReachout.Before(timeCutoff) {
-			SendKeepAlive(peer)
+			if err := SendKeepAlive(peer); err != nil {
+				netErrLogger.Warn("Failed to send keepalive", "peer", peer.String(), "err", err)
+			}
 		}
 	}
 }
+
+// Asks a few peers for a block that unchecked blocks are waiting on, with
+// an asc_pull for the block.
+func requestMissingBlock(hash types.BlockHash) {
+	missingRequestsLock.Lock()
+	now := time.Now()
+	if last, ok := missingRequests[hash]; ok && now.Sub(last) < missingRequestInterval {
+		missingRequestsLock.Unlock()
+		return
+	}
+	for h, last := range missingRequests {
+		if now.Sub(last) >= missingRequestInterval {
+			delete(missingRequests, h)
+		}
+	}
+	for id, sent := range ascPullRequests {
+		if now.Sub(sent) >= missingRequestInterval {
+			delete(ascPullRequests, id)
+		}
+	}
+	missingRequests[hash] = now
+	id := uint64(rand.Int63())
+	ascPullRequests[id] = now
+	missingRequestsLock.Unlock()
+
+	m := CreateAscPullReq(id)
+	m.Blocks = &AscPullBlocksReq{Start: hash, Count: 1, StartType: AscPullBlock}
+	peers := randomPeers()
+	if len(peers) > missingRequestPeers {
+		peers = peers[:missingRequestPeers]
+	}
+	netLogger.Debug("Requesting missing block", "hash", hash, "peers", len(peers))
+	for _, peer := range peers {
+		if err := peer.SendMessage(m); err != nil {
+			netErrLogger.Warn("Failed to request missing block", "peer", peer.String(), "hash", hash, "err", err)
+		}
+	}
+}
+
+// Returns whether an asc_pull ack is for a request this node sent, and
+// forgets the request.
+func takeAscPullRequest(id uint64) bool {
+	missingRequestsLock.Lock()
+	defer missingRequestsLock.Unlock()
+	_, ok := ascPullRequests[id]
+	delete(ascPullRequests, id)
+	return ok
+}
+
+// Drops expired unchecked blocks and requests those still missing.
+func PruneUnchecked(params []interface{}) {
+	store.PruneUnchecked()
+}
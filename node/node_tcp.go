@@ -0,0 +1,413 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/blocks"
+)
+
+// Realtime messages are sent to peers new enough over a persistent TCP
+// connection, a channel, listening on the same port as UDP. Messages
+// aren't delimited on the stream so their size is worked out from the
+// header. Channels are opened to peers the first time we send to them,
+// and accepted from peers that connect to us, at most ConnectionsPerIP
+// per address.
+
+// Defaults for the settings in the node configuration
+var ConnectionsPerIP = 4
+var KeepaliveInterval = 20 * time.Second
+
+const tcpDialTimeout = 5 * time.Second
+
+// Peers we failed to connect to are sent UDP until tcpRetryInterval has
+// passed.
+const tcpRetryInterval = time.Minute
+
+// Channels that haven't received anything, not even a keepalive, for
+// tcpIdleTimeout are closed.
+const tcpIdleTimeout = 5 * time.Minute
+const tcpWriteTimeout = 10 * time.Second
+
+// Messages waiting to be written to a channel, more are dropped
+const tcpSendQueue = 128
+
+type channel struct {
+	peer    Peer
+	conn    net.Conn
+	inbound bool
+	// Where the peer at the remote end of an inbound channel listens, once
+	// it has said in a keepalive
+	listening *Peer
+	send      chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Channels by endpoint, inbound ones by the remote end of the connection
+var channels = make(map[string]*channel)
+var channelsPerIP = make(map[string]int)
+
+// Inbound channels by the endpoint the peer listens on
+var listeningChannels = make(map[string]*channel)
+
+// The port we listen on, sent to peers in keepalives over channels
+var listenPort uint16
+
+// When we last tried to connect to a peer, by endpoint. Attempts older
+// than tcpRetryInterval are forgotten once maxTcpAttempts are recorded,
+// and peers are sent UDP rather than connected to while that many are
+// recent.
+const maxTcpAttempts = 4096
+
+var tcpAttempts = make(map[string]time.Time)
+var channelsLock sync.Mutex
+
+func channelFor(peer Peer) *channel {
+	channelsLock.Lock()
+	defer channelsLock.Unlock()
+	if c := channels[peer.String()]; c != nil {
+		return c
+	}
+	return listeningChannels[peer.String()]
+}
+
+// Records the port the peer at the remote end of an inbound channel
+// listens on, returning false if from isn't an inbound channel.
+func setListeningPort(from Peer, port uint16) bool {
+	channelsLock.Lock()
+	defer channelsLock.Unlock()
+	c := channels[from.String()]
+	if c == nil || !c.inbound {
+		return false
+	}
+	if c.listening == nil {
+		listening := Peer{from.IP, port, nil}
+		c.listening = &listening
+		if listeningChannels[listening.String()] == nil {
+			listeningChannels[listening.String()] = c
+		}
+	}
+	return true
+}
+
+// Returns the endpoint the peer messages from came from can be reached
+// at, or false for an inbound channel whose peer hasn't said where it
+// listens.
+func peerEndpoint(from Peer) (Peer, bool) {
+	channelsLock.Lock()
+	defer channelsLock.Unlock()
+	c := channels[from.String()]
+	if c == nil || !c.inbound {
+		return from, true
+	}
+	if c.listening == nil {
+		return Peer{}, false
+	}
+	return *c.listening, true
+}
+
+// Returns the size of a message after the header, from its type and
+// extensions.
+func payloadSize(header *MessageHeader) (int, error) {
+	blockSize := func(blockType byte) (int, error) {
+		t, ok := blockTypes[blockType]
+		if !ok {
+			return 0, errors.New("Unknown block type")
+		}
+		return blocks.BinarySize(t), nil
+	}
+
+	switch header.MessageType {
+	case Message_keepalive:
+		return keepAlivePeers * 18, nil
+	case Message_publish:
+		return blockSize(header.ItemBlockType())
+	case Message_confirm_req:
+		if header.ItemBlockType() == BlockType_not_a_block {
+			return header.ItemCount() * 64, nil
+		}
+		return blockSize(header.ItemBlockType())
+	case Message_confirm_ack:
+		if header.ItemBlockType() == BlockType_not_a_block {
+			return 104 + header.ItemCount()*32, nil
+		}
+		size, err := blockSize(header.ItemBlockType())
+		return 104 + size, err
+	case Message_bulk_pull:
+		if header.Extensions&ExtensionBulkPullCount != 0 {
+			return 72, nil
+		}
+		return 64, nil
+	case Message_bulk_push, Message_telemetry_req:
+		return 0, nil
+	case Message_frontier_req:
+		return 40, nil
+	case Message_bulk_pull_account:
+		return 49, nil
+	case Message_node_id_handshake:
+		size := 0
+		if header.Extensions&HandshakeQuery != 0 {
+			size += 32
+		}
+		if header.Extensions&HandshakeResponse != 0 {
+			size += 96
+			if header.Extensions&HandshakeV2 != 0 {
+				size += 64
+			}
+		}
+		return size, nil
+	case Message_telemetry_ack:
+		return int(header.ExtensionBits() & telemetrySizeMask), nil
+	case Message_asc_pull_req, Message_asc_pull_ack:
+		return int(header.ExtensionBits()), nil
+	}
+	return 0, errors.New("Unknown message type")
+}
+
+// Reads one message from a stream.
+func readFrame(r io.Reader) ([]byte, error) {
+	frame := make([]byte, 8)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	var header MessageHeader
+	header.ReadHeader(bytes.NewBuffer(frame))
+	if header.MagicNumber != MagicNumber {
+		return nil, errors.New("Wrong magic number")
+	}
+	size, err := payloadSize(&header)
+	if err != nil {
+		return nil, err
+	}
+
+	frame = append(frame, make([]byte, size)...)
+	if _, err := io.ReadFull(r, frame[8:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// Registers a connection as the channel to a peer and starts reading and
+// writing it.
+func addChannel(peer Peer, conn net.Conn, inbound bool) (*channel, error) {
+	channelsLock.Lock()
+	defer channelsLock.Unlock()
+
+	key := peer.String()
+	ip := peer.IP.String()
+	if channels[key] != nil {
+		return nil, errors.New("Already connected")
+	}
+	if channelsPerIP[ip] >= ConnectionsPerIP {
+		return nil, errors.New("Too many connections from address")
+	}
+
+	c := &channel{
+		peer:    peer,
+		conn:    conn,
+		inbound: inbound,
+		send:    make(chan []byte, tcpSendQueue),
+		closed:  make(chan struct{}),
+	}
+	channels[key] = c
+	channelsPerIP[ip]++
+	delete(tcpAttempts, key)
+
+	netLogger.Debug("Opened channel", "peer", key, "inbound", inbound)
+	go c.readLoop()
+	go c.writeLoop()
+	return c, nil
+}
+
+func (c *channel) close() {
+	c.closeOnce.Do(func() {
+		c.conn.Close()
+		close(c.closed)
+
+		channelsLock.Lock()
+		key := c.peer.String()
+		ip := c.peer.IP.String()
+		delete(channels, key)
+		if c.listening != nil && listeningChannels[c.listening.String()] == c {
+			delete(listeningChannels, c.listening.String())
+		}
+		channelsPerIP[ip]--
+		if channelsPerIP[ip] == 0 {
+			delete(channelsPerIP, ip)
+		}
+		channelsLock.Unlock()
+
+		netLogger.Debug("Closed channel", "peer", key)
+	})
+}
+
+// Queues a message to be written, without waiting on a slow peer.
+func (c *channel) queue(b []byte) error {
+	select {
+	case c.send <- b:
+		return nil
+	case <-c.closed:
+		return errors.New("Channel closed")
+	default:
+		sendErrors.Inc("queue_full")
+		return errors.New("Channel send queue full")
+	}
+}
+
+func (c *channel) readLoop() {
+	defer c.close()
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		frame, err := readFrame(c.conn)
+		if err != nil {
+			select {
+			case <-c.closed:
+			default:
+				netErrLogger.Warn("Failed to read from channel", "peer", c.peer.String(), "err", err)
+			}
+			return
+		}
+		dispatch(bytes.NewBuffer(frame), c.peer)
+	}
+}
+
+// Writes queued messages, and a keepalive if nothing else has been sent
+// for KeepaliveInterval.
+func (c *channel) writeLoop() {
+	defer c.close()
+	ticker := time.NewTicker(KeepaliveInterval)
+	defer ticker.Stop()
+	lastWrite := time.Now()
+
+	write := func(b []byte) bool {
+		c.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+		if _, err := c.conn.Write(b); err != nil {
+			sendErrors.Inc("write")
+			netErrLogger.Warn("Failed to write to channel", "peer", c.peer.String(), "err", err)
+			return false
+		}
+		bytesSent.Add(float64(len(b)), "tcp")
+		lastWrite = time.Now()
+		return true
+	}
+
+	for {
+		select {
+		case b := <-c.send:
+			if !write(b) {
+				return
+			}
+		case <-ticker.C:
+			if time.Since(lastWrite) < KeepaliveInterval {
+				continue
+			}
+			m := CreateKeepAlive(append([]Peer{selfEndpoint()}, randomPeers()...))
+			m.VersionUsing = negotiatedVersion(c.peer)
+			var buf bytes.Buffer
+			m.Write(&buf)
+			if !write(buf.Bytes()) {
+				return
+			}
+			messagesOut.Inc(messageTypeName(Message_keepalive))
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Opens a channel to a peer, unless there is one or we tried recently.
+func connectTcp(peer Peer) {
+	key := peer.String()
+	channelsLock.Lock()
+	if last, ok := tcpAttempts[key]; channels[key] != nil || ok && time.Since(last) < tcpRetryInterval {
+		channelsLock.Unlock()
+		return
+	}
+	if len(tcpAttempts) >= maxTcpAttempts {
+		for k, last := range tcpAttempts {
+			if time.Since(last) >= tcpRetryInterval {
+				delete(tcpAttempts, k)
+			}
+		}
+	}
+	if len(tcpAttempts) >= maxTcpAttempts {
+		channelsLock.Unlock()
+		return
+	}
+	tcpAttempts[key] = time.Now()
+	channelsLock.Unlock()
+
+	conn, err := net.DialTimeout("tcp", peer.TCPAddr().String(), tcpDialTimeout)
+	if err != nil {
+		netLogger.Debug("Failed to connect, using UDP", "peer", key, "err", err)
+		return
+	}
+	if _, err := addChannel(peer, conn, false); err != nil {
+		netLogger.Debug("Dropped connection", "peer", key, "err", err)
+		conn.Close()
+		return
+	}
+
+	// Peers expect a channel to start with a handshake
+	if cookie := channelHandshakeCookie(peer); cookie != nil {
+		if err := peer.SendMessage(CreateNodeIdHandshake(cookie, nil)); err != nil {
+			netErrLogger.Warn("Failed to send handshake", "peer", key, "err", err)
+		}
+	}
+}
+
+// Keepalives over channels start with the port we listen on, so peers
+// that accepted our connection know where to reach us.
+func selfEndpoint() Peer {
+	channelsLock.Lock()
+	defer channelsLock.Unlock()
+	return Peer{net.IPv6zero, listenPort, nil}
+}
+
+func (p *Peer) TCPAddr() *net.TCPAddr {
+	return &net.TCPAddr{IP: p.IP, Port: int(p.Port)}
+}
+
+// ListenForTcp accepts channels from peers, it's run alongside
+// ListenForUdp on the same address.
+func ListenForTcp(addr string) {
+	netLogger.Info("Listening for tcp connections", "addr", addr)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	channelsLock.Lock()
+	listenPort = uint16(ln.Addr().(*net.TCPAddr).Port)
+	channelsLock.Unlock()
+	serveTcp(ln)
+}
+
+func serveTcp(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				netErrLogger.Warn("Failed to accept connection", "err", err)
+				continue
+			}
+			return
+		}
+		peer := peerFromAddr(conn.RemoteAddr())
+		if _, err := addChannel(peer, conn, true); err != nil {
+			netErrLogger.Warn("Refused connection", "peer", peer.String(), "err", err)
+			conn.Close()
+		}
+	}
+}
+
+// ChannelCount returns the number of open TCP channels.
+func ChannelCount() int {
+	channelsLock.Lock()
+	defer channelsLock.Unlock()
+	return len(channels)
+}
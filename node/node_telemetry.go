@@ -0,0 +1,185 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/frankh/crypto/ed25519"
+	"github.com/frankh/nano/types"
+)
+
+// The size of a telemetry_ack's data is in the low 10 bits of the
+// extensions, a size of zero means the peer sent no data.
+const telemetrySizeMask uint16 = 0x3ff
+
+// Size of the telemetry data the reference node sends, newer versions may
+// append fields which are kept in Unknown so the signature still checks.
+const telemetryDataSize = 202
+
+type TelemetryData struct {
+	Signature         types.Signature
+	NodeId            types.Account
+	BlockCount        uint64
+	CementedCount     uint64
+	UncheckedCount    uint64
+	AccountCount      uint64
+	BandwidthCap      uint64
+	PeerCount         uint32
+	ProtocolVersion   byte
+	Uptime            uint64
+	GenesisBlock      types.BlockHash
+	MajorVersion      byte
+	MinorVersion      byte
+	PatchVersion      byte
+	PreReleaseVersion byte
+	Maker             byte
+	// Milliseconds since the epoch
+	Timestamp        uint64
+	ActiveDifficulty uint64
+	Unknown          []byte
+}
+
+type MessageTelemetryReq struct {
+	MessageHeader
+}
+
+type MessageTelemetryAck struct {
+	MessageHeader
+	Data *TelemetryData
+}
+
+func CreateTelemetryReq() *MessageTelemetryReq {
+	return &MessageTelemetryReq{newHeader(Message_telemetry_req)}
+}
+
+// CreateTelemetryAck signs the data with the node key and wraps it in a
+// message, or sends an empty ack if data is nil.
+func CreateTelemetryAck(data *TelemetryData) *MessageTelemetryAck {
+	m := MessageTelemetryAck{newHeader(Message_telemetry_ack), data}
+	if data != nil {
+		data.NodeId = NodeId()
+		data.Sign(loadNodeKey())
+		m.MessageHeader.SetExtensionBits(uint16(telemetryDataSize + len(data.Unknown)))
+	}
+	return &m
+}
+
+// Everything but the signature, which covers it.
+func (d *TelemetryData) writeUnsigned(buf *bytes.Buffer) {
+	var b [8]byte
+	writeUint64 := func(v uint64) {
+		binary.BigEndian.PutUint64(b[:], v)
+		buf.Write(b[:])
+	}
+
+	buf.Write(d.NodeId[:])
+	writeUint64(d.BlockCount)
+	writeUint64(d.CementedCount)
+	writeUint64(d.UncheckedCount)
+	writeUint64(d.AccountCount)
+	writeUint64(d.BandwidthCap)
+	binary.BigEndian.PutUint32(b[:4], d.PeerCount)
+	buf.Write(b[:4])
+	buf.WriteByte(d.ProtocolVersion)
+	writeUint64(d.Uptime)
+	buf.Write(d.GenesisBlock[:])
+	buf.Write([]byte{d.MajorVersion, d.MinorVersion, d.PatchVersion, d.PreReleaseVersion, d.Maker})
+	writeUint64(d.Timestamp)
+	writeUint64(d.ActiveDifficulty)
+	buf.Write(d.Unknown)
+}
+
+func (d *TelemetryData) Sign(key ed25519.PrivateKey) {
+	var buf bytes.Buffer
+	d.writeUnsigned(&buf)
+	copy(d.Signature[:], ed25519.Sign(key, buf.Bytes()))
+}
+
+// Verify checks the data was signed by the node it claims to be from.
+func (d *TelemetryData) Verify() bool {
+	var buf bytes.Buffer
+	d.writeUnsigned(&buf)
+	return ed25519.Verify(d.NodeId[:], buf.Bytes(), d.Signature[:])
+}
+
+func (d *TelemetryData) read(data []byte) error {
+	if len(data) < telemetryDataSize {
+		return errors.New("Telemetry data too short")
+	}
+	copy(d.Signature[:], data[0:64])
+	copy(d.NodeId[:], data[64:96])
+	d.BlockCount = binary.BigEndian.Uint64(data[96:104])
+	d.CementedCount = binary.BigEndian.Uint64(data[104:112])
+	d.UncheckedCount = binary.BigEndian.Uint64(data[112:120])
+	d.AccountCount = binary.BigEndian.Uint64(data[120:128])
+	d.BandwidthCap = binary.BigEndian.Uint64(data[128:136])
+	d.PeerCount = binary.BigEndian.Uint32(data[136:140])
+	d.ProtocolVersion = data[140]
+	d.Uptime = binary.BigEndian.Uint64(data[141:149])
+	copy(d.GenesisBlock[:], data[149:181])
+	d.MajorVersion = data[181]
+	d.MinorVersion = data[182]
+	d.PatchVersion = data[183]
+	d.PreReleaseVersion = data[184]
+	d.Maker = data[185]
+	d.Timestamp = binary.BigEndian.Uint64(data[186:194])
+	d.ActiveDifficulty = binary.BigEndian.Uint64(data[194:202])
+	d.Unknown = nil
+	if len(data) > telemetryDataSize {
+		d.Unknown = append([]byte{}, data[telemetryDataSize:]...)
+	}
+	return nil
+}
+
+func (m *MessageTelemetryReq) Read(buf *bytes.Buffer) error {
+	err := m.MessageHeader.ReadHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	if m.MessageHeader.MessageType != Message_telemetry_req {
+		return errors.New("Tried to read wrong message type")
+	}
+	return nil
+}
+
+func (m *MessageTelemetryReq) Write(buf *bytes.Buffer) error {
+	return m.MessageHeader.WriteHeader(buf)
+}
+
+func (m *MessageTelemetryAck) Read(buf *bytes.Buffer) error {
+	err := m.MessageHeader.ReadHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	if m.MessageHeader.MessageType != Message_telemetry_ack {
+		return errors.New("Tried to read wrong message type")
+	}
+
+	m.Data = nil
+	size := int(m.MessageHeader.ExtensionBits() & telemetrySizeMask)
+	if size == 0 {
+		return nil
+	}
+	data := make([]byte, size)
+	if err := readBytes(buf, data); err != nil {
+		return err
+	}
+	m.Data = new(TelemetryData)
+	return m.Data.read(data)
+}
+
+func (m *MessageTelemetryAck) Write(buf *bytes.Buffer) error {
+	err := m.MessageHeader.WriteHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	if m.Data != nil {
+		buf.Write(m.Data.Signature[:])
+		m.Data.writeUnsigned(buf)
+	}
+	return nil
+}
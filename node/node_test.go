@@ -3,12 +3,20 @@ package node
 import (
 	"bytes"
 	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/frankh/crypto/ed25519"
+	"github.com/frankh/nano/address"
 	"github.com/frankh/nano/blocks"
 	"github.com/frankh/nano/store"
 	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
 )
 
 var publishSend, _ = hex.DecodeString("5243050501030002B6460102018F076CC32FF2F65AD397299C47F8CA2BE784D5DE394D592C22BE8BFFBE91872F1D2A2BCC1CB47FB854D6D31E43C6391EADD5750BB9689E5DF0D6CB0000003D11C83DBCFF748EB4B7F7A3C059DDEEE5C8ECCC8F20DEF3AF3C4F0726F879082ED051D0C62A54CD69C4A66B020369B7033C5B0F77654173AB24D5C7A64CC4FFF0BDB368FCC989E41A656569047627C49A2A6D2FBC")
@@ -78,13 +86,17 @@ func TestReadWriteConfirmAck(t *testing.T) {
 		t.Errorf("Wrote message badly")
 	}
 
-	block := m.ToBlock().(*blocks.SendBlock)
+	block := toBlock(t, &m.MessageBlock).(*blocks.SendBlock)
 	if !blocks.ValidateBlockWork(block) {
 		t.Errorf("Work validation failed")
 	}
 
 	publicKey := ed25519.PublicKey(m.Account[:])
-	if !ed25519.Verify(publicKey, m.MessageVote.Hash(), m.Signature[:]) {
+	vote_hash, err := m.MessageVote.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(publicKey, vote_hash, m.Signature[:]) {
 		t.Errorf("Failed to validate signature")
 	}
 }
@@ -107,7 +119,7 @@ func TestReadWriteConfirmReq(t *testing.T) {
 		t.Errorf("Wrote message badly")
 	}
 
-	block := m.ToBlock().(*blocks.ReceiveBlock)
+	block := toBlock(t, &m.MessageBlock).(*blocks.ReceiveBlock)
 	if !blocks.ValidateBlockWork(block) {
 		t.Errorf("Work validation failed")
 	}
@@ -131,18 +143,26 @@ func TestReadWriteMessagePublish(t *testing.T) {
 		t.Errorf("Wrote message badly")
 	}
 
-	block := m.ToBlock().(*blocks.OpenBlock)
+	block := toBlock(t, &m.MessageBlock).(*blocks.OpenBlock)
 	if !blocks.ValidateBlockWork(block) {
 		t.Errorf("Work validation failed")
 	}
 
-	if block.Account != "nano_14jyjetsh8p7jxx1of38ctsa779okt9d1pdnmtjpqiukuq8zugr3bxpxf1zu" {
+	if block.Account.String() != "nano_14jyjetsh8p7jxx1of38ctsa779okt9d1pdnmtjpqiukuq8zugr3bxpxf1zu" {
 		t.Errorf("Deserialised account badly")
 	}
 }
 
-func validateTestBlock(t *testing.T, b blocks.Block, expectedHash types.BlockHash) {
-	if b.Hash() != expectedHash {
+func toBlock(t *testing.T, m *MessageBlock) blocks.Block {
+	block, err := m.ToBlock()
+	if err != nil {
+		t.Fatalf("Failed to convert block: %s", err)
+	}
+	return block
+}
+
+func validateTestBlock(t *testing.T, b blocks.Block, expectedHash string) {
+	if b.Hash().String() != expectedHash {
 		t.Errorf("Wrong blockhash %s", b.Hash())
 	}
 	if !blocks.ValidateBlockWork(b) {
@@ -162,33 +182,33 @@ func TestReadPublish(t *testing.T) {
 	if err != nil {
 		t.Errorf("Failed to read send message %s", err)
 	}
-	validateTestBlock(t, m.ToBlock(), types.BlockHash("687DCB9C8EB8AF9F39D8107C3432A8732EDBED1E3B5E2E0F6B86643D1EB5E24F"))
+	validateTestBlock(t, toBlock(t, &m.MessageBlock), "687DCB9C8EB8AF9F39D8107C3432A8732EDBED1E3B5E2E0F6B86643D1EB5E24F")
 
 	err = m.Read(bytes.NewBuffer(publishReceive))
 	if err != nil {
 		t.Errorf("Failed to read receive message %s", err)
 	}
-	validateTestBlock(t, m.ToBlock(), types.BlockHash("7D3E9D79342AA73B7148CB46706D23ED8BB0041A5316D67A053F336ABF0E6B60"))
+	validateTestBlock(t, toBlock(t, &m.MessageBlock), "7D3E9D79342AA73B7148CB46706D23ED8BB0041A5316D67A053F336ABF0E6B60")
 
 	err = m.Read(bytes.NewBuffer(publishOpen))
 	if err != nil {
 		t.Errorf("Failed to read open message %s", err)
 	}
-	validateTestBlock(t, m.ToBlock(), types.BlockHash("5F73CF212E58563734D57CCFCCEFE481DE40C96F097F594F4FA32C5585D84AA4"))
+	validateTestBlock(t, toBlock(t, &m.MessageBlock), "5F73CF212E58563734D57CCFCCEFE481DE40C96F097F594F4FA32C5585D84AA4")
 
 	err = m.Read(bytes.NewBuffer(publishChange))
 	if err != nil {
 		t.Errorf("Failed to read change message %s", err)
 	}
-	validateTestBlock(t, m.ToBlock(), types.BlockHash("4AABA9923AC794B635B8C3CC275C37F0D28E43D44EB5E27F8B23955E335D5DD3"))
+	validateTestBlock(t, toBlock(t, &m.MessageBlock), "4AABA9923AC794B635B8C3CC275C37F0D28E43D44EB5E27F8B23955E335D5DD3")
 
 	err = m.Read(bytes.NewBuffer(publishWrongWork))
-	if blocks.ValidateBlockWork(m.ToBlock()) {
+	if blocks.ValidateBlockWork(toBlock(t, &m.MessageBlock)) {
 		t.Errorf("Invalid work should fail")
 	}
 
 	err = m.Read(bytes.NewBuffer(publishWrongSig))
-	passed, _ := m.ToBlock().(*blocks.OpenBlock).VerifySignature()
+	passed, _ := toBlock(t, &m.MessageBlock).(*blocks.OpenBlock).VerifySignature()
 	if passed {
 		t.Errorf("Invalid signature should fail")
 	}
@@ -196,7 +216,7 @@ func TestReadPublish(t *testing.T) {
 
 func TestHandleMessage(t *testing.T) {
 	store.Init(store.TestConfig)
-	handleMessage(bytes.NewBuffer(publishTest))
+	handleMessage(bytes.NewBuffer(publishTest), Peer{})
 }
 
 func TestReadWriteHeader(t *testing.T) {
@@ -238,3 +258,893 @@ func TestReadWriteHeader(t *testing.T) {
 		t.Errorf("Wrote header badly")
 	}
 }
+
+func TestCreatePublish(t *testing.T) {
+	for _, raw := range [][]byte{publishSend, publishReceive, publishOpen, publishChange} {
+		var m MessagePublish
+		m.Read(bytes.NewBuffer(raw))
+
+		p, err := CreatePublish(toBlock(t, &m.MessageBlock))
+		if err != nil {
+			t.Errorf("Failed to create publish: %s", err)
+			continue
+		}
+
+		var writeBuf bytes.Buffer
+		p.Write(&writeBuf)
+		// Headers differ in version numbers
+		if !bytes.Equal(raw[8:], writeBuf.Bytes()[8:]) || raw[7] != writeBuf.Bytes()[7] {
+			t.Errorf("Publish didn't match original\n%x\n%x", raw, writeBuf.Bytes())
+		}
+	}
+}
+
+func TestToBlockUnknownType(t *testing.T) {
+	m := MessageBlock{Type: BlockType_invalid}
+	if _, err := m.ToBlock(); err == nil {
+		t.Errorf("Converted block with invalid type")
+	}
+}
+
+func FuzzReadPublish(f *testing.F) {
+	for _, raw := range [][]byte{publishSend, publishReceive, publishOpen, publishChange} {
+		f.Add(raw)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m MessagePublish
+		if m.Read(bytes.NewBuffer(data)) != nil {
+			return
+		}
+		block, err := m.ToBlock()
+		if err != nil {
+			return
+		}
+		blocks.ValidateBlockWork(block)
+		if open, ok := block.(*blocks.OpenBlock); ok {
+			open.VerifySignature()
+		}
+	})
+}
+
+func FuzzReadConfirmAck(f *testing.F) {
+	f.Add(confirmAck)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m MessageConfirmAck
+		if m.Read(bytes.NewBuffer(data)) != nil {
+			return
+		}
+		m.MessageVote.Hash()
+	})
+}
+
+func encode(t *testing.T, m Message) *bytes.Buffer {
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		t.Fatalf("Failed to write message: %s", err)
+	}
+	return &buf
+}
+
+func TestHandshake(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	defer SetPeers([]Peer{DefaultPeer})
+
+	// The remote peer is a socket the test reads the node's replies from
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	peer := Peer{addr.IP.To16(), uint16(addr.Port), nil}
+	read := func() *MessageNodeIdHandshake {
+		packet := make([]byte, 512)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(packet)
+		if err != nil {
+			t.Fatalf("No handshake sent: %s", err)
+		}
+		var m MessageNodeIdHandshake
+		if err := m.Read(bytes.NewBuffer(packet[:n])); err != nil {
+			t.Fatalf("Failed to read handshake: %s", err)
+		}
+		return &m
+	}
+
+	// A keepalive from an unknown peer starts a handshake rather than
+	// adding it
+	handleMessage(encode(t, CreateKeepAlive(nil)), peer)
+	if PeerSet[peer.String()] {
+		t.Errorf("Peer added before handshake")
+	}
+	query := read()
+	if query.Query == nil || query.Response != nil {
+		t.Fatalf("Expected a handshake query")
+	}
+
+	pub, priv := address.GenerateKey()
+	var id types.Account
+	copy(id[:], pub)
+	_, otherPriv := address.GenerateKey()
+
+	wrongKey := CreateNodeIdHandshake(nil, &NodeIdResponse{Account: id, Signature: types.BlockHash(*query.Query).Sign(otherPriv)})
+	handleMessage(encode(t, wrongKey), peer)
+	if IsValidated(peer) || PeerSet[peer.String()] {
+		t.Errorf("Peer validated with a bad signature")
+	}
+
+	// The cookie is spent by a bad response, the next keepalive starts
+	// another handshake
+	handleMessage(encode(t, CreateNodeIdHandshake(nil, &NodeIdResponse{Account: id, Signature: types.BlockHash(*query.Query).Sign(priv)})), peer)
+	if IsValidated(peer) {
+		t.Errorf("Peer validated by a response after a bad one")
+	}
+	handleMessage(encode(t, CreateKeepAlive(nil)), peer)
+	query = read()
+	if query.Query == nil {
+		t.Fatalf("Expected a new handshake query")
+	}
+
+	// The peer responds and asks for our ID in the same message
+	cookie := [32]byte{1, 2, 3}
+	reply := CreateNodeIdHandshake(&cookie, &NodeIdResponse{Account: id, Signature: types.BlockHash(*query.Query).Sign(priv)})
+	handleMessage(encode(t, reply), peer)
+	if got, ok := PeerNodeId(peer); !ok || got != id {
+		t.Errorf("Peer not validated")
+	}
+	if !PeerSet[peer.String()] {
+		t.Errorf("Validated peer not added")
+	}
+
+	response := read()
+	if response.Query != nil || response.Response == nil {
+		t.Fatalf("Expected only a handshake response")
+	}
+	nodeId := NodeId()
+	if response.Response.Account != nodeId || !ed25519.Verify(nodeId[:], cookie[:], response.Response.Signature[:]) {
+		t.Errorf("Bad handshake response")
+	}
+
+	// Queries from the same endpoint aren't all answered
+	handleMessage(encode(t, CreateNodeIdHandshake(&cookie, nil)), peer)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := conn.ReadFrom(make([]byte, 512)); err == nil {
+		t.Errorf("Answered a second query straight away")
+	}
+
+	// Responses nobody asked for don't validate a peer
+	stranger := Peer{net.ParseIP("::ffff:127.0.0.1"), 1, nil}
+	handleMessage(encode(t, reply), stranger)
+	if IsValidated(stranger) {
+		t.Errorf("Unrequested response validated a peer")
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	defer SetPeers([]Peer{DefaultPeer})
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	peer := Peer{addr.IP.To16(), uint16(addr.Port), nil}
+
+	if negotiatedVersion(peer) != VersionUsing || !PeerSupports(peer, FeatureNodeIdHandshake) {
+		t.Errorf("Unknown peer should get the default version")
+	}
+	if PeerSupports(peer, FeatureTelemetry) {
+		t.Errorf("Unimplemented feature supported")
+	}
+
+	// A legacy peer is talked to with its version and isn't sent a
+	// handshake
+	legacy := CreateKeepAlive(nil)
+	legacy.VersionMax, legacy.VersionUsing, legacy.VersionMin = 0x07, 0x07, 0x04
+	handleMessage(encode(t, legacy), peer)
+	if v, ok := GetPeerVersion(peer); !ok || v.Max != 0x07 {
+		t.Errorf("Peer version not recorded")
+	}
+	if negotiatedVersion(peer) != 0x07 || PeerSupports(peer, FeatureNodeIdHandshake) {
+		t.Errorf("Wrong version negotiated %d", negotiatedVersion(peer))
+	}
+
+	peer.SendMessage(CreateKeepAlive(nil))
+	packet := make([]byte, 512)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header MessageHeader
+	header.ReadHeader(bytes.NewBuffer(packet[:n]))
+	if header.MessageType != Message_keepalive || header.VersionUsing != 0x07 {
+		t.Errorf("Sent type %d with version %d, expected the legacy peer's keepalive", header.MessageType, header.VersionUsing)
+	}
+
+	// Peers too old or too new are dropped
+	addPeer(peer)
+	old := CreateKeepAlive(nil)
+	old.VersionMax, old.VersionUsing, old.VersionMin = 0x03, 0x03, 0x01
+	rejected := versionRejections.Value("too_old")
+	handleMessage(encode(t, old), peer)
+	if PeerSet[peer.String()] || versionRejections.Value("too_old") != rejected+1 {
+		t.Errorf("Old peer not rejected")
+	}
+	if v, _ := GetPeerVersion(peer); v.Max != 0x07 {
+		t.Errorf("Rejected message's version recorded")
+	}
+
+	future := CreateKeepAlive(nil)
+	future.VersionMax, future.VersionUsing, future.VersionMin = 0x30, 0x30, 0x20
+	rejected = versionRejections.Value("too_new")
+	handleMessage(encode(t, future), peer)
+	if versionRejections.Value("too_new") != rejected+1 {
+		t.Errorf("Peer needing a newer version not rejected")
+	}
+}
+
+// Packets for message types without captures, built from the reference
+// node's serialisation
+var (
+	bulkPull, _            = hex.DecodeString("5243131312060100" + strings.Repeat("aa", 32) + strings.Repeat("00", 32) + "0010000000000000")
+	bulkPush, _            = hex.DecodeString("5243131312070000")
+	frontierReq, _         = hex.DecodeString("5243131312080200" + strings.Repeat("bb", 32) + "ffffffffe8030000")
+	bulkPullAccount, _     = hex.DecodeString("52431313120b0000" + strings.Repeat("cc", 32) + "000000000000000000000000000f4240" + "01")
+	telemetryReq, _        = hex.DecodeString("52431313120c0000")
+	ascPullBlocks, _       = hex.DecodeString("52431313120e2b00" + "01" + "0000000000000007" + strings.Repeat("dd", 32) + "8000")
+	ascPullInfo, _         = hex.DecodeString("52431313120e2a00" + "02" + "0000000000000008" + strings.Repeat("ee", 32) + "01")
+	ascPullFrontiers, _    = hex.DecodeString("52431313120e2b00" + "03" + "0000000000000009" + strings.Repeat("11", 32) + "03e8")
+	ascPullAckInfo, _      = hex.DecodeString("52431313120f9900" + "02" + "0000000000000008" + strings.Repeat("22", 96) + "0000000000000010" + strings.Repeat("33", 32) + "000000000000000c")
+	ascPullAckFrontiers, _ = hex.DecodeString("52431313120f8900" + "03" + "0000000000000009" + strings.Repeat("44", 64) + strings.Repeat("00", 64))
+	confirmReqHashes, _    = hex.DecodeString("5243131312040021" + strings.Repeat("55", 64) + strings.Repeat("66", 64))
+	confirmAckHashes, _    = hex.DecodeString("5243131312050021" + strings.Repeat("77", 32) + strings.Repeat("88", 64) + "0100000000000000" + strings.Repeat("99", 32) + strings.Repeat("ab", 32))
+)
+
+type readWriter interface {
+	Read(buf *bytes.Buffer) error
+	Write(buf *bytes.Buffer) error
+}
+
+func TestReadWriteMessageTypes(t *testing.T) {
+	// Each message is read and written back unchanged
+	for _, test := range []struct {
+		name   string
+		packet []byte
+		m      readWriter
+	}{
+		{"keepalive", keepAlive, new(MessageKeepAlive)},
+		{"publish", publishOpen, new(MessagePublish)},
+		{"confirm_req", confirmReq, new(MessageConfirmReq)},
+		{"confirm_req hashes", confirmReqHashes, new(MessageConfirmReq)},
+		{"confirm_ack", confirmAck, new(MessageConfirmAck)},
+		{"confirm_ack hashes", confirmAckHashes, new(MessageConfirmAck)},
+		{"bulk_pull", bulkPull, new(MessageBulkPull)},
+		{"bulk_push", bulkPush, new(MessageBulkPush)},
+		{"frontier_req", frontierReq, new(MessageFrontierReq)},
+		{"bulk_pull_account", bulkPullAccount, new(MessageBulkPullAccount)},
+		{"telemetry_req", telemetryReq, new(MessageTelemetryReq)},
+		{"asc_pull_req blocks", ascPullBlocks, new(MessageAscPullReq)},
+		{"asc_pull_req account_info", ascPullInfo, new(MessageAscPullReq)},
+		{"asc_pull_req frontiers", ascPullFrontiers, new(MessageAscPullReq)},
+		{"asc_pull_ack account_info", ascPullAckInfo, new(MessageAscPullAck)},
+		{"asc_pull_ack frontiers", ascPullAckFrontiers, new(MessageAscPullAck)},
+	} {
+		if err := test.m.Read(bytes.NewBuffer(test.packet)); err != nil {
+			t.Errorf("Failed to read %s: %s", test.name, err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := test.m.Write(&buf); err != nil {
+			t.Errorf("Failed to write %s: %s", test.name, err)
+			continue
+		}
+		if !bytes.Equal(test.packet, buf.Bytes()) {
+			t.Errorf("Wrote %s badly\n%x\n%x", test.name, test.packet, buf.Bytes())
+		}
+		if test.m.Read(bytes.NewBuffer(test.packet[:len(test.packet)-1])) == nil && len(test.packet) > 8 {
+			t.Errorf("Read truncated %s", test.name)
+		}
+	}
+}
+
+func TestMessageFields(t *testing.T) {
+	var pull MessageBulkPull
+	pull.Read(bytes.NewBuffer(bulkPull))
+	if pull.Count != 16 || pull.Start[0] != 0xaa {
+		t.Errorf("Wrong bulk_pull %d %x", pull.Count, pull.Start)
+	}
+
+	var frontiers MessageFrontierReq
+	frontiers.Read(bytes.NewBuffer(frontierReq))
+	if frontiers.Age != 0xffffffff || frontiers.Count != 1000 || frontiers.Extensions&ExtensionFrontierConfirmed == 0 {
+		t.Errorf("Wrong frontier_req %d %d", frontiers.Age, frontiers.Count)
+	}
+
+	var account MessageBulkPullAccount
+	account.Read(bytes.NewBuffer(bulkPullAccount))
+	if account.MinimumAmount.String() != "1000000" || account.Flags != BulkPullAccountAddressOnly {
+		t.Errorf("Wrong bulk_pull_account %s %d", account.MinimumAmount, account.Flags)
+	}
+
+	var req MessageAscPullReq
+	req.Read(bytes.NewBuffer(ascPullFrontiers))
+	if req.Type != AscPull_frontiers || req.Id != 9 || req.Frontiers == nil || req.Frontiers.Count != 1000 {
+		t.Errorf("Wrong asc_pull_req %+v", req)
+	}
+
+	var ack MessageAscPullAck
+	ack.Read(bytes.NewBuffer(ascPullAckInfo))
+	if ack.AccountInfo == nil || ack.AccountInfo.BlockCount != 16 || ack.AccountInfo.ConfirmationHeight != 12 {
+		t.Errorf("Wrong asc_pull_ack %+v", ack.AccountInfo)
+	}
+	ack.Read(bytes.NewBuffer(ascPullAckFrontiers))
+	if len(ack.Frontiers) != 1 || ack.Frontiers[0].Account[0] != 0x44 {
+		t.Errorf("Wrong asc_pull_ack frontiers %v", ack.Frontiers)
+	}
+
+	var confirm MessageConfirmReq
+	confirm.Read(bytes.NewBuffer(confirmReqHashes))
+	if len(confirm.Roots) != 2 || confirm.Roots[1].Root[0] != 0x66 {
+		t.Errorf("Wrong confirm_req roots %v", confirm.Roots)
+	}
+
+	var vote MessageConfirmAck
+	vote.Read(bytes.NewBuffer(confirmAckHashes))
+	hashes, err := vote.VoteHashes()
+	if err != nil || len(hashes) != 2 || hashes[1][0] != 0xab {
+		t.Errorf("Wrong confirm_ack hashes %v", hashes)
+	}
+}
+
+func TestItemCount(t *testing.T) {
+	for _, count := range []int{0, 1, 15, 16, 20, 255} {
+		m := CreateConfirmReq(make([]HashRoot, count))
+		if m.ItemCount() != count || m.ItemBlockType() != BlockType_not_a_block {
+			t.Errorf("Set count %d, got %d with block type %d", count, m.ItemCount(), m.ItemBlockType())
+		}
+		if count >= 16 && m.Extensions&ExtensionConfirmV2 == 0 {
+			t.Errorf("Count %d doesn't use the v2 count", count)
+		}
+		var read MessageConfirmReq
+		if count > 0 && read.Read(encode(t, m)) != nil || len(read.Roots) != count {
+			t.Errorf("Failed to read back %d roots", count)
+		}
+	}
+
+	// The reference node's header for 20 hashes
+	header := MessageHeader{Extensions: 0x41, BlockType: 0x11}
+	if header.ItemCount() != 20 || header.ExtensionBits() != 0x1141 {
+		t.Errorf("Wrong count %d", header.ItemCount())
+	}
+}
+
+func TestAscPullAckBlocks(t *testing.T) {
+	var publish MessagePublish
+	if err := publish.Read(bytes.NewBuffer(publishSend)); err != nil {
+		t.Fatal(err)
+	}
+
+	ack := CreateAscPullAck(3)
+	ack.AddBlock(publish.Block)
+	ack.AddBlock(publish.Block)
+	packet := encode(t, ack).Bytes()
+	if int(ack.ExtensionBits()) != len(packet)-8 {
+		t.Errorf("Wrong payload size %d", ack.ExtensionBits())
+	}
+
+	var read MessageAscPullAck
+	if err := read.Read(bytes.NewBuffer(packet)); err != nil {
+		t.Fatal(err)
+	}
+	if read.Type != AscPull_blocks || read.Id != 3 || len(read.Blocks) != 2 || read.Blocks[1].Block.Hash() != publish.Block.Hash() {
+		t.Errorf("Read blocks badly")
+	}
+}
+
+func TestTelemetry(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+
+	data := &TelemetryData{BlockCount: 100, PeerCount: 7, ProtocolVersion: 0x13, MajorVersion: 25, Timestamp: 1234}
+	packet := encode(t, CreateTelemetryAck(data)).Bytes()
+	if len(packet) != 8+telemetryDataSize {
+		t.Errorf("Wrong telemetry size %d", len(packet))
+	}
+
+	var m MessageTelemetryAck
+	if err := m.Read(bytes.NewBuffer(packet)); err != nil {
+		t.Fatal(err)
+	}
+	if m.Data == nil || !m.Data.Verify() || m.Data.NodeId != NodeId() || m.Data.BlockCount != 100 || m.Data.Timestamp != 1234 {
+		t.Errorf("Read telemetry badly %+v", m.Data)
+	}
+
+	// Fields from newer versions are kept and covered by the signature
+	data.Unknown = []byte{1, 2, 3}
+	packet = encode(t, CreateTelemetryAck(data)).Bytes()
+	m.Read(bytes.NewBuffer(packet))
+	if !bytes.Equal(m.Data.Unknown, data.Unknown) || !m.Data.Verify() {
+		t.Errorf("Unknown telemetry fields lost")
+	}
+	m.Data.PeerCount++
+	if m.Data.Verify() {
+		t.Errorf("Modified telemetry verified")
+	}
+
+	if m.Read(encode(t, CreateTelemetryAck(nil))) != nil || m.Data != nil {
+		t.Errorf("Failed to read empty telemetry")
+	}
+}
+
+func TestHandshakeV2(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+
+	cookie := [32]byte{4, 5, 6}
+	var m MessageNodeIdHandshake
+	if err := m.Read(encode(t, CreateNodeIdHandshake(nil, createNodeIdResponse(cookie, true)))); err != nil {
+		t.Fatal(err)
+	}
+	if m.Extensions&HandshakeV2 == 0 || m.Response.V2 == nil || m.Response.V2.Genesis != store.Conf.GenesisBlock.Hash() {
+		t.Fatalf("Expected a v2 response")
+	}
+	signed := m.Response.signedData(cookie)
+	if !ed25519.Verify(m.Response.Account[:], signed[:], m.Response.Signature[:]) {
+		t.Errorf("Bad v2 signature")
+	}
+
+	// Our own response is valid apart from coming from us
+	peer := Peer{net.ParseIP("::ffff:127.0.0.1"), 2, nil}
+	handshakeLock.Lock()
+	pendingHandshakes[peer.String()] = pendingHandshake{cookie, time.Now()}
+	handshakeLock.Unlock()
+	if result := validateHandshake(peer, m.Response); result != "self" {
+		t.Errorf("Expected own response, got %s", result)
+	}
+
+	handshakeLock.Lock()
+	pendingHandshakes[peer.String()] = pendingHandshake{cookie, time.Now()}
+	handshakeLock.Unlock()
+	m.Response.V2.Genesis[0]++
+	if result := validateHandshake(peer, m.Response); result != "wrong_genesis" {
+		t.Errorf("Expected wrong genesis, got %s", result)
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	var stream bytes.Buffer
+	packets := [][]byte{keepAlive, publishOpen, confirmAck, confirmReqHashes, confirmAckHashes, bulkPull, bulkPush, frontierReq, telemetryReq, ascPullInfo, ascPullAckFrontiers}
+	for _, packet := range packets {
+		stream.Write(packet)
+	}
+	for _, packet := range packets {
+		frame, err := readFrame(&stream)
+		if err != nil {
+			t.Fatalf("Failed to read frame: %s", err)
+		}
+		if !bytes.Equal(frame, packet) {
+			t.Errorf("Read wrong frame\n%x\n%x", packet, frame)
+		}
+	}
+
+	if _, err := readFrame(bytes.NewBuffer(keepAlive[:20])); err == nil {
+		t.Errorf("Read truncated frame")
+	}
+	if _, err := readFrame(bytes.NewBuffer(publishWrongMagic)); err == nil {
+		t.Errorf("Read frame with wrong magic number")
+	}
+	unknown := append([]byte{}, telemetryReq...)
+	unknown[5] = 0x40
+	if _, err := readFrame(bytes.NewBuffer(unknown)); err == nil {
+		t.Errorf("Read frame of unknown type")
+	}
+}
+
+// Waits for a condition set by another goroutine.
+func waitFor(t *testing.T, what string, fn func() bool) {
+	for i := 0; i < 100; i++ {
+		if fn() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+func TestTcpChannels(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	defer SetPeers([]Peer{DefaultPeer})
+	defer func(n int) { ConnectionsPerIP = n }(ConnectionsPerIP)
+	ConnectionsPerIP = 1
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveTcp(ln)
+
+	// A peer connecting to us is answered on the same connection
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(encode(t, CreateKeepAlive(nil)).Bytes())
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	frame, err := readFrame(conn)
+	if err != nil {
+		t.Fatalf("No reply on channel: %s", err)
+	}
+	var query MessageNodeIdHandshake
+	if err := query.Read(bytes.NewBuffer(frame)); err != nil || query.Query == nil {
+		t.Fatalf("Expected a handshake query: %v", err)
+	}
+
+	// Once validated the peer is added where it listens, rather than by
+	// the remote end of the connection
+	pub, priv := address.GenerateKey()
+	var id types.Account
+	copy(id[:], pub)
+	conn.Write(encode(t, CreateNodeIdHandshake(nil, &NodeIdResponse{Account: id, Signature: types.BlockHash(*query.Query).Sign(priv)})).Bytes())
+	remoteEnd := peerFromAddr(conn.LocalAddr())
+	waitFor(t, "inbound peer to be validated", func() bool { return IsValidated(remoteEnd) })
+	if knownPeer(remoteEnd) {
+		t.Errorf("Inbound peer added by the remote end of the connection")
+	}
+	listening := Peer{remoteEnd.IP, 7076, nil}
+	conn.Write(encode(t, CreateKeepAlive([]Peer{{net.IPv6zero, 7076, nil}})).Bytes())
+	waitFor(t, "inbound peer to be added", func() bool { return knownPeer(listening) })
+	if !IsValidated(listening) || channelFor(listening) == nil {
+		t.Errorf("Inbound channel not used for the peer's listening endpoint")
+	}
+
+	// Only one connection is allowed from the address
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Second connection wasn't closed: %v", err)
+	}
+	second.Close()
+
+	conn.Close()
+	waitFor(t, "inbound channel to close", func() bool { return ChannelCount() == 0 })
+
+	// A new enough peer is connected to when it's sent a message, and sent
+	// messages over the channel once connected
+	remote, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	addr := remote.Addr().(*net.TCPAddr)
+	peer := Peer{addr.IP.To16(), uint16(addr.Port), nil}
+	checkVersion(peer, &MessageHeader{VersionMax: 0x12, VersionUsing: 0x12, VersionMin: 0x10})
+
+	peer.SendMessage(CreateKeepAlive(nil))
+	accepted, err := remote.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	accepted.SetReadDeadline(time.Now().Add(time.Second))
+	if frame, err := readFrame(accepted); err != nil || frame[5] != Message_node_id_handshake {
+		t.Fatalf("Channel didn't start with a handshake: %v", err)
+	}
+	if err := peer.SendMessage(CreateKeepAlive(nil)); err != nil {
+		t.Fatal(err)
+	}
+	frame, err = readFrame(accepted)
+	if err != nil || frame[5] != Message_keepalive || frame[3] != 0x11 {
+		t.Errorf("Keepalive not sent over channel: %v", err)
+	}
+
+	// Older peers are only sent UDP
+	legacy := Peer{net.ParseIP("::ffff:127.0.0.2"), 7075, nil}
+	checkVersion(legacy, &MessageHeader{VersionMax: 0x0c, VersionUsing: 0x0c, VersionMin: 0x04})
+	legacy.SendMessage(CreateKeepAlive(nil))
+	channelsLock.Lock()
+	_, tried := tcpAttempts[legacy.String()]
+	channelsLock.Unlock()
+	if tried {
+		t.Errorf("Tried to connect to a legacy peer")
+	}
+
+	accepted.Close()
+	waitFor(t, "outbound channel to close", func() bool { return channelFor(peer) == nil })
+}
+
+func TestUdpSocket(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	defer SetPeers([]Peer{DefaultPeer})
+
+	local, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setUdpSocket(local)
+	defer setUdpSocket(nil)
+	go serveUdp(local)
+
+	remote, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	addr := remote.LocalAddr().(*net.UDPAddr)
+	peer := Peer{addr.IP.To16(), uint16(addr.Port), nil}
+	read := func() (byte, net.Addr) {
+		packet := make([]byte, 512)
+		remote.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := remote.ReadFrom(packet)
+		if err != nil || n < 8 {
+			t.Fatalf("Nothing sent: %v", err)
+		}
+		return packet[5], from
+	}
+
+	// Messages come from the listening socket, so replies reach it
+	if err := peer.SendMessage(CreateKeepAlive(nil)); err != nil {
+		t.Fatal(err)
+	}
+	messageType, from := read()
+	if messageType != Message_keepalive || from.String() != local.LocalAddr().String() {
+		t.Errorf("Sent type %d from %s, expected a keepalive from %s", messageType, from, local.LocalAddr())
+	}
+	remote.WriteTo(encode(t, CreateKeepAlive(nil)).Bytes(), local.LocalAddr())
+	if messageType, _ := read(); messageType != Message_node_id_handshake {
+		t.Errorf("Reply to keepalive not received, got type %d", messageType)
+	}
+
+	// Peers are sent at most their bandwidth
+	setBandwidth := func(n int) {
+		bandwidthLock.Lock()
+		BandwidthPerPeer = n
+		bandwidthBuckets = make(map[string]*bandwidthBucket)
+		bandwidthLock.Unlock()
+	}
+	defer setBandwidth(BandwidthPerPeer)
+	setBandwidth(500)
+	limited := Peer{net.ParseIP("::ffff:127.0.0.3"), 7075, nil}
+	rejected := sendErrors.Value("bandwidth")
+	for i := 0; i < 3; i++ {
+		if err := limited.SendMessage(CreateKeepAlive(nil)); err != nil {
+			t.Fatalf("Keepalive %d was limited: %s", i, err)
+		}
+	}
+	if limited.SendMessage(CreateKeepAlive(nil)) == nil || sendErrors.Value("bandwidth") != rejected+1 {
+		t.Errorf("Bandwidth limit not applied")
+	}
+
+	// Failed writes are counted
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	FlushUdp(time.Second)
+	setUdpSocket(closed)
+	failed := sendErrors.Value("write")
+	if err := peer.SendMessage(CreateKeepAlive(nil)); err != nil {
+		t.Fatal(err)
+	}
+	// Flushing waits for the write
+	if err := FlushUdp(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if sendErrors.Value("write") != failed+1 {
+		t.Errorf("Write error not counted")
+	}
+}
+
+func TestRequestMissingBlock(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	defer SetPeers([]Peer{DefaultPeer})
+
+	local, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setUdpSocket(local)
+	defer setUdpSocket(nil)
+
+	remote, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	addr := remote.LocalAddr().(*net.UDPAddr)
+	peer := Peer{addr.IP.To16(), uint16(addr.Port), nil}
+	SetPeers([]Peer{peer})
+
+	genesis := blocks.TestGenesisBlock
+	_, genesisKey, _ := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	send := &blocks.SendBlock{genesis.Hash(), genesis.Account, blocks.GenesisAmount, blocks.CommonBlock{}}
+	send.Work = blocks.GenerateWork(genesis)
+	send.Signature = send.Hash().Sign(genesisKey)
+	missingRequestsLock.Lock()
+	delete(missingRequests, send.Hash())
+	missingRequestsLock.Unlock()
+	requestMissingBlock(send.Hash())
+
+	packet := make([]byte, 512)
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := remote.ReadFrom(packet)
+	if err != nil {
+		t.Fatalf("No request sent: %s", err)
+	}
+	var req MessageAscPullReq
+	if err := req.Read(bytes.NewBuffer(packet[:n])); err != nil {
+		t.Fatal(err)
+	}
+	if req.Blocks == nil || req.Blocks.Start != send.Hash() || req.Blocks.StartType != AscPullBlock {
+		t.Fatalf("Wrong request %+v", req.Blocks)
+	}
+
+	// Only acks to the request are stored, and only once
+	unrequested := CreateAscPullAck(req.Id + 1)
+	unrequested.AddBlock(send)
+	handleMessage(encode(t, unrequested), peer)
+	if store.FetchBlock(send.Hash()) != nil {
+		t.Errorf("Stored block from an unrequested ack")
+	}
+	ack := CreateAscPullAck(req.Id)
+	ack.AddBlock(send)
+	handleMessage(encode(t, ack), peer)
+	if store.FetchBlock(send.Hash()) == nil {
+		t.Errorf("Requested block not stored")
+	}
+	if takeAscPullRequest(req.Id) {
+		t.Errorf("Request not forgotten after its ack")
+	}
+}
+
+func TestVoteVerify(t *testing.T) {
+	var m MessageConfirmAck
+	if err := m.Read(bytes.NewBuffer(confirmAck)); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Verify() {
+		t.Errorf("Vote from the network didn't verify")
+	}
+	m.Sequence[0] ^= 1
+	if m.Verify() {
+		t.Errorf("Vote verified after changing its sequence")
+	}
+}
+
+func TestElections(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	defer func(minimum uint128.Uint128) { OnlineWeightMinimum = minimum }(OnlineWeightMinimum)
+	OnlineWeightMinimum = uint128.Uint128{}
+	electionsLock.Lock()
+	elections = make(map[types.BlockHash]*election)
+	electionsLock.Unlock()
+
+	genesis := blocks.TestGenesisBlock
+	_, genesisKey, _ := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	send := &blocks.SendBlock{genesis.Hash(), genesis.Account, blocks.GenesisAmount.Sub(uint128.FromInts(0, 1)), blocks.CommonBlock{}}
+	send.Work = blocks.GenerateWork(genesis)
+	send.Signature = send.Hash().Sign(genesisKey)
+	if err := ProcessLocal(send); err != nil {
+		t.Fatal(err)
+	}
+	if ElectionCount() != 1 {
+		t.Fatalf("Election not started, %d running", ElectionCount())
+	}
+
+	vote := func(key ed25519.PrivateKey) *bytes.Buffer {
+		var m MessageConfirmAck
+		m.MessageHeader = newHeader(Message_confirm_ack)
+		m.SetItemBlockType(BlockType_not_a_block)
+		m.SetItemCount(1)
+		copy(m.Account[:], key[32:])
+		m.Hashes = []types.BlockHash{send.Hash()}
+		hash, _ := m.Hash()
+		copy(m.Signature[:], ed25519.Sign(key, hash))
+		return encode(t, &m)
+	}
+
+	// Representatives without weight don't count
+	_, other := address.GenerateKey()
+	handleMessage(vote(other), Peer{})
+	if ElectionCount() != 1 {
+		t.Errorf("Confirmed by a vote without weight")
+	}
+
+	confirmed := electionsStopped.Value("confirmed")
+	handleMessage(vote(genesisKey), Peer{})
+	if ElectionCount() != 0 || electionsStopped.Value("confirmed") != confirmed+1 {
+		t.Errorf("Election not confirmed by the genesis representative")
+	}
+
+	// Elections without quorum expire
+	change := &blocks.ChangeBlock{send.Hash(), genesis.Account, blocks.CommonBlock{}}
+	change.Work = blocks.GenerateWork(send)
+	change.Signature = change.Hash().Sign(genesisKey)
+	ProcessLocal(change)
+	defer func(timeout time.Duration) { ElectionTimeout = timeout }(ElectionTimeout)
+	ElectionTimeout = 0
+	expired := electionsStopped.Value("expired")
+	ExpireElections(nil)
+	if ElectionCount() != 0 || electionsStopped.Value("expired") != expired+1 {
+		t.Errorf("Election didn't expire")
+	}
+}
+
+func TestPeerTableLimits(t *testing.T) {
+	peer := Peer{net.ParseIP("::ffff:127.0.0.1"), 1, nil}
+	header := &MessageHeader{VersionMax: VersionMax, VersionUsing: VersionUsing, VersionMin: VersionMin}
+
+	peerVersionsLock.Lock()
+	savedVersions := peerVersions
+	peerVersions = make(map[string]peerVersionEntry)
+	for i := 0; i < maxPeerVersions; i++ {
+		peerVersions[fmt.Sprint(i)] = peerVersionEntry{PeerVersion{}, time.Now()}
+	}
+	peerVersionsLock.Unlock()
+	defer func() {
+		peerVersionsLock.Lock()
+		peerVersions = savedVersions
+		peerVersionsLock.Unlock()
+	}()
+
+	checkVersion(peer, header)
+	if _, ok := GetPeerVersion(peer); ok {
+		t.Errorf("Version recorded with the table full of recent peers")
+	}
+	peerVersionsLock.Lock()
+	for key := range peerVersions {
+		peerVersions[key] = peerVersionEntry{PeerVersion{}, time.Now().Add(-peerVersionTimeout)}
+	}
+	peerVersionsLock.Unlock()
+	checkVersion(peer, header)
+	if _, ok := GetPeerVersion(peer); !ok || len(peerVersions) != 1 {
+		t.Errorf("Stale versions weren't forgotten to make room")
+	}
+
+	channelsLock.Lock()
+	savedAttempts := tcpAttempts
+	tcpAttempts = make(map[string]time.Time)
+	for i := 0; i < maxTcpAttempts; i++ {
+		tcpAttempts[fmt.Sprint(i)] = time.Now()
+	}
+	channelsLock.Unlock()
+	defer func() {
+		channelsLock.Lock()
+		tcpAttempts = savedAttempts
+		channelsLock.Unlock()
+	}()
+
+	connectTcp(peer)
+	channelsLock.Lock()
+	_, tried := tcpAttempts[peer.String()]
+	for key := range tcpAttempts {
+		tcpAttempts[key] = time.Now().Add(-tcpRetryInterval)
+	}
+	channelsLock.Unlock()
+	if tried {
+		t.Errorf("Connection attempted with the table full of recent attempts")
+	}
+	connectTcp(peer)
+	channelsLock.Lock()
+	_, tried = tcpAttempts[peer.String()]
+	count := len(tcpAttempts)
+	channelsLock.Unlock()
+	if !tried || count != 1 {
+		t.Errorf("Stale attempts weren't forgotten to make room")
+	}
+}
@@ -0,0 +1,179 @@
+package node
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/metrics"
+)
+
+// UDP messages are sent from the listening socket so peers see our
+// peering port and can reply to it. They're queued and written by one
+// goroutine, so a slow socket doesn't hold up handling messages. Before
+// ListenForUdp is called, messages go out from an unbound socket.
+
+// Defaults for the settings in the node configuration, a bandwidth of
+// zero is unlimited
+var BandwidthPerPeer = 256 * 1024
+
+// Messages waiting to be sent over UDP, more are dropped
+const udpSendQueue = 1024
+
+// At most this many peers' bandwidth is tracked, idle peers are forgotten
+// when it's reached
+const maxBandwidthBuckets = 4096
+
+var sendErrors = metrics.NewCounter("nano_send_errors_total",
+	"Messages that couldn't be sent to peers, by reason.", "reason")
+var bytesSent = metrics.NewCounter("nano_bytes_sent_total",
+	"Bytes sent to peers, by transport.", "transport")
+
+type outPacket struct {
+	peer        Peer
+	data        []byte
+	messageType string
+	// Set instead of the rest for FlushUdp, closed once the packets
+	// queued before it have been written
+	flushed chan struct{}
+}
+
+var udpConn net.PacketConn
+var udpConnLock sync.Mutex
+var udpQueue = make(chan outPacket, udpSendQueue)
+var udpSenderOnce sync.Once
+
+// Sends from conn from now on.
+func setUdpSocket(conn net.PacketConn) {
+	udpConnLock.Lock()
+	defer udpConnLock.Unlock()
+	if udpConn != nil {
+		udpConn.Close()
+	}
+	udpConn = conn
+}
+
+func isUdpSocket(conn net.PacketConn) bool {
+	udpConnLock.Lock()
+	defer udpConnLock.Unlock()
+	return udpConn == conn
+}
+
+func udpSocket() (net.PacketConn, error) {
+	udpConnLock.Lock()
+	defer udpConnLock.Unlock()
+	if udpConn == nil {
+		conn, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			return nil, err
+		}
+		udpConn = conn
+	}
+	return udpConn, nil
+}
+
+// Queues a message to be sent over UDP.
+func sendUdp(peer Peer, data []byte, messageType string) error {
+	udpSenderOnce.Do(func() {
+		go udpSender()
+	})
+	select {
+	case udpQueue <- outPacket{peer, data, messageType, nil}:
+		return nil
+	default:
+		sendErrors.Inc("queue_full")
+		return errors.New("UDP send queue full")
+	}
+}
+
+// FlushUdp waits until the messages queued so far have been written, for
+// commands that send and then exit.
+func FlushUdp(timeout time.Duration) error {
+	udpSenderOnce.Do(func() {
+		go udpSender()
+	})
+	flushed := make(chan struct{})
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case udpQueue <- outPacket{flushed: flushed}:
+	case <-timer.C:
+		return errors.New("Timed out flushing UDP send queue")
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-timer.C:
+		return errors.New("Timed out flushing UDP send queue")
+	}
+}
+
+func udpSender() {
+	for p := range udpQueue {
+		if p.flushed != nil {
+			close(p.flushed)
+			continue
+		}
+		conn, err := udpSocket()
+		if err == nil {
+			_, err = conn.WriteTo(p.data, p.peer.Addr())
+		}
+		if err != nil {
+			sendErrors.Inc("write")
+			netErrLogger.Warn("Failed to send message", "peer", p.peer.String(), "type", p.messageType, "err", err)
+			continue
+		}
+		messagesOut.Inc(p.messageType)
+		bytesSent.Add(float64(len(p.data)), "udp")
+	}
+}
+
+// Each peer may be sent BandwidthPerPeer bytes a second, with bursts of
+// up to a second's worth.
+type bandwidthBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var bandwidthBuckets = make(map[string]*bandwidthBucket)
+var bandwidthLock sync.Mutex
+
+// Takes size bytes from a peer's allowance, returning false if there
+// isn't enough.
+func allowSend(peer Peer, size int) bool {
+	bandwidthLock.Lock()
+	defer bandwidthLock.Unlock()
+	if BandwidthPerPeer <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	limit := float64(BandwidthPerPeer)
+	if len(bandwidthBuckets) >= maxBandwidthBuckets {
+		// A bucket idle for a second is full, the same as a new one
+		for key, b := range bandwidthBuckets {
+			if now.Sub(b.last) >= time.Second {
+				delete(bandwidthBuckets, key)
+			}
+		}
+	}
+
+	key := peer.String()
+	b, ok := bandwidthBuckets[key]
+	if !ok {
+		b = &bandwidthBucket{limit, now}
+		bandwidthBuckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * limit
+	if b.tokens > limit {
+		b.tokens = limit
+	}
+	b.last = now
+
+	if b.tokens < float64(size) {
+		return false
+	}
+	b.tokens -= float64(size)
+	return true
+}
@@ -0,0 +1,130 @@
+package node
+
+import (
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/metrics"
+)
+
+// A protocol feature and the version the reference node introduced it
+// in. Messages that need a feature are only sent to peers whose version
+// has it, and only if this node implements it.
+type Feature struct {
+	Name        string
+	Version     byte
+	Implemented bool
+}
+
+var (
+	FeatureNodeIdHandshake  = Feature{"node_id_handshake", 0x0c, true}
+	FeatureConfirmReqHashes = Feature{"confirm_req_hashes", 0x0d, true}
+	FeatureTcpRealtime      = Feature{"tcp_realtime", 0x11, true}
+	FeatureTelemetry        = Feature{"telemetry", 0x12, false}
+	FeatureAscPull          = Feature{"asc_pull", 0x13, false}
+)
+
+// Features lists every protocol feature in version order, VersionMax is
+// the newest version whose features this node implements.
+var Features = []Feature{
+	FeatureNodeIdHandshake,
+	FeatureConfirmReqHashes,
+	FeatureTcpRealtime,
+	FeatureTelemetry,
+	FeatureAscPull,
+}
+
+// The versions a peer sent in its last message header
+type PeerVersion struct {
+	Max   byte
+	Using byte
+	Min   byte
+}
+
+// Versions are recorded for anything that sends a valid message, so
+// peers not heard from for peerVersionTimeout are forgotten once
+// maxPeerVersions are recorded, and no more are recorded while that many
+// are recent.
+const peerVersionTimeout = 5 * time.Minute
+const maxPeerVersions = 4096
+
+type peerVersionEntry struct {
+	version PeerVersion
+	seen    time.Time
+}
+
+var peerVersions = make(map[string]peerVersionEntry)
+var peerVersionsLock sync.Mutex
+
+var versionRejections = metrics.NewCounter("nano_version_rejections_total",
+	"Messages dropped because the peer's protocol version isn't compatible, by whether it's too old or too new.", "reason")
+
+// GetPeerVersion returns the versions a peer last sent, if it's sent any
+// messages.
+func GetPeerVersion(peer Peer) (PeerVersion, bool) {
+	peerVersionsLock.Lock()
+	defer peerVersionsLock.Unlock()
+	v, ok := peerVersions[peer.String()]
+	return v.version, ok
+}
+
+// Checks the versions in a message header are compatible with ours and
+// records them for the peer, returning the reason if they aren't.
+func checkVersion(peer Peer, header *MessageHeader) (string, bool) {
+	if header.VersionUsing < VersionMin || header.VersionMax < VersionMin {
+		return "too_old", false
+	}
+	if header.VersionMin > VersionMax {
+		return "too_new", false
+	}
+
+	peerVersionsLock.Lock()
+	defer peerVersionsLock.Unlock()
+	key := peer.String()
+	now := time.Now()
+	if _, ok := peerVersions[key]; !ok && len(peerVersions) >= maxPeerVersions {
+		for k, v := range peerVersions {
+			if now.Sub(v.seen) >= peerVersionTimeout {
+				delete(peerVersions, k)
+			}
+		}
+		if len(peerVersions) >= maxPeerVersions {
+			return "", true
+		}
+	}
+	peerVersions[key] = peerVersionEntry{PeerVersion{header.VersionMax, header.VersionUsing, header.VersionMin}, now}
+	return "", true
+}
+
+// negotiatedVersion returns the version to use with a peer, the newest
+// both sides support, or VersionUsing if it hasn't sent any messages.
+func negotiatedVersion(peer Peer) byte {
+	v, ok := GetPeerVersion(peer)
+	if !ok {
+		return VersionUsing
+	}
+	if v.Max < VersionMax {
+		return v.Max
+	}
+	return VersionMax
+}
+
+// PeerSupports returns whether a feature can be used with a peer. Peers
+// that haven't sent any messages are assumed to support it, as sending
+// them an unknown message is harmless.
+func PeerSupports(peer Peer, feature Feature) bool {
+	if !feature.Implemented {
+		return false
+	}
+	if _, ok := GetPeerVersion(peer); !ok {
+		return true
+	}
+	return negotiatedVersion(peer) >= feature.Version
+}
+
+// Forgets a peer whose version we can't talk to.
+func rejectPeer(peer Peer, reason string) {
+	versionRejections.Inc(reason)
+	badMessageLogger.Warn("Rejected peer with incompatible version", "peer", peer.String(), "reason", reason)
+	removePeer(peer)
+}
@@ -4,33 +4,83 @@ import (
 	"bytes"
 	"errors"
 
+	"github.com/frankh/crypto/ed25519"
+	"github.com/frankh/nano/types"
 	"github.com/golang/crypto/blake2b"
 )
 
+// A vote is for either a block, or hashes of blocks when the header's
+// block type is BlockType_not_a_block.
 type MessageVote struct {
 	Account   [32]byte
 	Signature [64]byte
 	Sequence  [8]byte
 	MessageBlock
+	Hashes []types.BlockHash
 }
 
-func (m *MessageVote) Hash() []byte {
+// Votes for hashes are prefixed so their signatures can't be mistaken for
+// votes for a block.
+var hashVotePrefix = []byte("vote ")
+
+func (m *MessageVote) Hash() ([]byte, error) {
 	hash, _ := blake2b.New(32, nil)
 
-	hash.Write(m.MessageBlock.ToBlock().Hash().ToBytes())
+	if m.Hashes != nil {
+		hash.Write(hashVotePrefix)
+		for _, h := range m.Hashes {
+			hash.Write(h[:])
+		}
+	} else {
+		block, err := m.MessageBlock.ToBlock()
+		if err != nil {
+			return nil, err
+		}
+		block_hash := block.Hash()
+		hash.Write(block_hash[:])
+	}
 	hash.Write(m.Sequence[:])
 
-	return hash.Sum(nil)
+	return hash.Sum(nil), nil
+}
+
+// VoteHashes returns the hashes voted for, either the hashes or the hash
+// of the block.
+func (m *MessageVote) VoteHashes() ([]types.BlockHash, error) {
+	if m.Hashes != nil {
+		return m.Hashes, nil
+	}
+	block, err := m.MessageBlock.ToBlock()
+	if err != nil {
+		return nil, err
+	}
+	return []types.BlockHash{block.Hash()}, nil
+}
+
+// Verify checks the vote was signed by the representative it's from.
+func (m *MessageVote) Verify() bool {
+	hash, err := m.Hash()
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(m.Account[:], hash, m.Signature[:])
+}
+
+func (m *MessageVote) VoteAccount() types.Account {
+	return types.Account(m.Account)
 }
 
-func (m *MessageVote) Read(messageBlockType byte, buf *bytes.Buffer) error {
+func (m *MessageVote) VoteSignature() types.Signature {
+	return types.Signature(m.Signature)
+}
+
+// Read reads a vote, the block type and count come from the header.
+func (m *MessageVote) Read(messageBlockType byte, count int, buf *bytes.Buffer) error {
 	n1, err1 := buf.Read(m.Account[:])
 	n2, err2 := buf.Read(m.Signature[:])
 	n3, err3 := buf.Read(m.Sequence[:])
 
-	err4 := m.MessageBlock.Read(messageBlockType, buf)
-
-	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+	if err1 != nil || err2 != nil || err3 != nil {
 		return errors.New("Failed to read message vote")
 	}
 
@@ -38,6 +88,26 @@ func (m *MessageVote) Read(messageBlockType byte, buf *bytes.Buffer) error {
 		return errors.New("Failed to read message vote")
 	}
 
+	m.Hashes = nil
+	if messageBlockType == BlockType_not_a_block {
+		if count == 0 {
+			return errors.New("No hashes in vote")
+		}
+		m.Type = messageBlockType
+		m.Block = nil
+		m.Hashes = make([]types.BlockHash, count)
+		for i := range m.Hashes {
+			if err := readBytes(buf, m.Hashes[i][:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if m.MessageBlock.Read(messageBlockType, buf) != nil {
+		return errors.New("Failed to read message vote")
+	}
+
 	return nil
 }
 
@@ -46,7 +116,14 @@ func (m *MessageVote) Write(buf *bytes.Buffer) error {
 	n2, err2 := buf.Write(m.Signature[:])
 	n3, err3 := buf.Write(m.Sequence[:])
 
-	err4 := m.MessageBlock.Write(buf)
+	var err4 error
+	if m.Hashes != nil {
+		for _, h := range m.Hashes {
+			buf.Write(h[:])
+		}
+	} else {
+		err4 = m.MessageBlock.Write(buf)
+	}
 
 	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
 		return errors.New("Failed to read message vote")
@@ -1,19 +1,19 @@
 package store
 
 import (
-	"bytes"
-	"encoding/gob"
 	"errors"
-	"log"
 	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger"
-	"github.com/frankh/nano/address"
 	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/logging"
 	"github.com/frankh/nano/types"
 	"github.com/frankh/nano/uint128"
 )
 
+var logger = logging.New("store")
+
 type Config struct {
 	Path         string
 	GenesisBlock *blocks.OpenBlock
@@ -26,37 +26,90 @@ const (
 	MetaChange
 )
 
-type BlockItem struct {
-	badger.Item
+// Keys in the receivable index are this prefix followed by the
+// destination account and the send block hash. Block keys are always
+// 32 bytes so can't clash.
+var receivablePrefix = []byte{'r'}
+
+// Reasons storeBlock rejects a block
+var (
+	errInvalidWork   = errors.New("Invalid work for block")
+	errBlockStored   = errors.New("Block already stored")
+	errUnknownType   = errors.New("Unknown block type")
+	errMissingParent = errors.New("Cannot find parent block")
+	errMissingSource = errors.New("Cannot find source send block")
+	errFork          = errors.New("Block forks an existing block")
+	errBadSignature  = errors.New("Invalid signature for block")
+	errNegativeSpend = errors.New("Send increases balance")
+	errUnreceivable  = errors.New("Source send isn't receivable by the account")
+)
+
+// A send that hasn't been received by its destination yet
+type Receivable struct {
+	Hash   types.BlockHash
+	Amount uint128.Uint128
 }
 
-func (i *BlockItem) ToBlock() blocks.Block {
-	meta := i.UserMeta()
-	value, _ := i.Value()
+type BlockItem struct {
+	*badger.Item
+}
 
-	dec := gob.NewDecoder(bytes.NewBuffer(value))
-	var result blocks.Block
+func blockMeta(t blocks.BlockType) byte {
+	switch t {
+	case blocks.Open:
+		return MetaOpen
+	case blocks.Receive:
+		return MetaReceive
+	case blocks.Send:
+		return MetaSend
+	case blocks.Change:
+		return MetaChange
+	}
+	panic("Unknown block type")
+}
 
+func metaBlockType(meta byte) blocks.BlockType {
 	switch meta {
 	case MetaOpen:
-		var b blocks.OpenBlock
-		dec.Decode(&b)
-		result = &b
+		return blocks.Open
 	case MetaReceive:
-		var b blocks.ReceiveBlock
-		dec.Decode(&b)
-		result = &b
+		return blocks.Receive
 	case MetaSend:
-		var b blocks.SendBlock
-		dec.Decode(&b)
-		result = &b
+		return blocks.Send
 	case MetaChange:
-		var b blocks.ChangeBlock
-		dec.Decode(&b)
-		result = &b
+		return blocks.Change
 	}
+	return ""
+}
 
-	return result
+// Values are the block's binary encoding followed by its sideband.
+func (i *BlockItem) ToBlock() blocks.Block {
+	value, err := i.Value()
+	size := blocks.BinarySize(metaBlockType(i.UserMeta()))
+	if err != nil || len(value) < size {
+		return nil
+	}
+
+	block, err := blocks.FromBinary(metaBlockType(i.UserMeta()), value[:size])
+	if err != nil {
+		return nil
+	}
+	return block
+}
+
+func (i *BlockItem) Sideband() *Sideband {
+	value, err := i.Value()
+	size := blocks.BinarySize(metaBlockType(i.UserMeta()))
+	if err != nil || len(value) < size {
+		return nil
+	}
+
+	var sideband Sideband
+	err = sideband.UnmarshalBinary(value[size:])
+	if err != nil {
+		return nil
+	}
+	return &sideband
 }
 
 var LiveConfig = Config{
@@ -74,10 +127,6 @@ var TestConfigLive = Config{
 	blocks.LiveGenesisBlock,
 }
 
-// Blocks that we cannot store due to not having their parent
-// block stored
-var unconnectedBlockPool map[types.BlockHash]blocks.Block
-
 var Conf *Config
 var globalConn *badger.DB
 var currentTxn *badger.Txn
@@ -105,28 +154,61 @@ func getConn() *badger.Txn {
 	return currentTxn
 }
 
-func releaseConn(conn *badger.Txn) {
-	currentTxn.Commit(nil)
+// Commits the transaction and releases the connection. Most callers only
+// read, or can't undo what they wrote, so needn't check the error.
+func releaseConn(conn *badger.Txn) error {
+	err := currentTxn.Commit(nil)
+	currentTxn = nil
+	ledgerCounts.commit(err == nil)
+	missing := missingBlocks
+	missingBlocks = nil
+	connLock.Unlock()
+	if err != nil {
+		logger.Error("Failed to commit transaction", "err", err)
+		return err
+	}
+	requestMissing(missing)
+	return nil
+}
+
+// Drops the changes made in a transaction, for when an error leaves them
+// half done.
+func discardConn(conn *badger.Txn) {
+	currentTxn.Discard()
 	currentTxn = nil
+	ledgerCounts.commit(false)
+	missingBlocks = nil
 	connLock.Unlock()
 }
 
 func Init(config Config) {
 	var err error
-	unconnectedBlockPool = make(map[types.BlockHash]blocks.Block)
-
 	if globalConn != nil {
 		globalConn.Close()
 		globalConn = nil
 	}
 	Conf = &config
+	err = migrate()
+	if err != nil {
+		panic(err)
+	}
+
 	conn := getConn()
 	defer releaseConn(conn)
+	uncheckedCount = indexUnchecked(conn)
+	uncheckedRequests = make(map[types.BlockHash]time.Time)
+	count, accounts := countBlocks(conn)
+	ledgerCounts = ledgerCounter{blocks: count, accounts: accounts}
 
-	_, err = conn.Get(blocks.LiveGenesisBlockHash.ToBytes())
+	genesis := config.GenesisBlock.Hash()
+	_, err = conn.Get(genesis[:])
 
 	if err != nil {
-		uncheckedStoreBlock(conn, config.GenesisBlock)
+		sideband, err := computeSideband(conn, config.GenesisBlock)
+		if err != nil {
+			panic(err)
+		}
+		uncheckedStoreBlock(conn, config.GenesisBlock, sideband)
 	}
 }
 
@@ -137,18 +219,14 @@ func FetchOpen(account types.Account) (b *blocks.OpenBlock) {
 }
 
 func fetchOpen(conn *badger.Txn, account types.Account) (b *blocks.OpenBlock) {
-	account_bytes, err := address.AddressToPub(account)
+	item, err := conn.Get(account[:])
 	if err != nil {
 		return nil
 	}
 
-	item, err := conn.Get(account_bytes)
-	if err != nil {
-		return nil
-	}
-
-	blockItem := BlockItem{*item}
-	return blockItem.ToBlock().(*blocks.OpenBlock)
+	blockItem := BlockItem{item}
+	open, _ := blockItem.ToBlock().(*blocks.OpenBlock)
+	return open
 }
 
 func FetchBlock(hash types.BlockHash) (b blocks.Block) {
@@ -158,12 +236,12 @@ func FetchBlock(hash types.BlockHash) (b blocks.Block) {
 }
 
 func fetchBlock(conn *badger.Txn, hash types.BlockHash) (b blocks.Block) {
-	item, err := conn.Get(hash.ToBytes())
+	item, err := conn.Get(hash[:])
 	if err != nil {
 		return nil
 	}
 
-	blockItem := BlockItem{*item}
+	blockItem := BlockItem{item}
 	return blockItem.ToBlock()
 }
 
@@ -174,127 +252,302 @@ func GetBalance(block blocks.Block) uint128.Uint128 {
 }
 
 func getSendAmount(conn *badger.Txn, block *blocks.SendBlock) uint128.Uint128 {
-	prev := fetchBlock(conn, block.PreviousHash)
+	previous := fetchSideband(conn, block.PreviousHash)
+	if previous == nil {
+		return uint128.Uint128{}
+	}
 
-	return getBalance(conn, prev).Sub(getBalance(conn, block))
+	return previous.Balance.Sub(block.Balance)
 }
 
+// Balances come from the sideband, or are worked out from the previous
+// block's sideband for blocks that haven't been stored yet.
 func getBalance(conn *badger.Txn, block blocks.Block) uint128.Uint128 {
-	switch block.Type() {
-	case blocks.Open:
-		b := block.(*blocks.OpenBlock)
-		if b.SourceHash == Conf.GenesisBlock.SourceHash {
-			return blocks.GenesisAmount
+	sideband := fetchSideband(conn, block.Hash())
+	if sideband == nil {
+		sideband, _ = computeSideband(conn, block)
+	}
+	if sideband == nil {
+		return uint128.Uint128{}
+	}
+	return sideband.Balance
+}
+
+func receivableKey(destination types.Account, hash types.BlockHash) []byte {
+	key := append([]byte{}, receivablePrefix...)
+	key = append(key, destination[:]...)
+	return append(key, hash[:]...)
+}
+
+// FetchReceivable returns the sends to an account that it hasn't received.
+func FetchReceivable(account types.Account) []Receivable {
+	conn := getConn()
+	defer releaseConn(conn)
+	return fetchReceivable(conn, account)
+}
+
+func fetchReceivable(conn *badger.Txn, account types.Account) []Receivable {
+	prefix := append(append([]byte{}, receivablePrefix...), account[:]...)
+
+	result := make([]Receivable, 0)
+	it := conn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Item().Key()
+		value, err := it.Item().Value()
+		if err != nil {
+			continue
 		}
-		source := fetchBlock(conn, b.SourceHash).(*blocks.SendBlock)
-		return getSendAmount(conn, source)
+		result = append(result, Receivable{
+			types.BlockHashFromBytes(key[len(prefix):]),
+			uint128.FromBytes(value),
+		})
+	}
+	return result
+}
 
+// Keep the receivable index up to date: sends add an entry for their
+// destination, receives and opens remove the entry for their source.
+func updateReceivable(conn *badger.Txn, block blocks.Block) {
+	var source types.BlockHash
+	switch block.Type() {
 	case blocks.Send:
 		b := block.(*blocks.SendBlock)
-		return b.Balance
-
+		err := conn.Set(receivableKey(b.Destination, b.Hash()), getSendAmount(conn, b).GetBytes())
+		if err != nil {
+			panic(err)
+		}
+		return
+	case blocks.Open:
+		source = block.(*blocks.OpenBlock).SourceHash
 	case blocks.Receive:
-		b := block.(*blocks.ReceiveBlock)
-		prev := fetchBlock(conn, b.PreviousHash)
-		source := fetchBlock(conn, b.SourceHash).(*blocks.SendBlock)
-		received := getSendAmount(conn, source)
-		return getBalance(conn, prev).Add(received)
-
-	case blocks.Change:
-		b := block.(*blocks.ChangeBlock)
-		return getBalance(conn, fetchBlock(conn, b.PreviousHash))
-
+		source = block.(*blocks.ReceiveBlock).SourceHash
 	default:
-		panic("Unknown block type")
+		return
 	}
 
+	send, ok := fetchBlock(conn, source).(*blocks.SendBlock)
+	if !ok {
+		return
+	}
+	conn.Delete(receivableKey(send.Destination, source))
 }
 
 // Validate and store a block
 // TODO: Validate signature and balance
 func StoreBlock(block blocks.Block) error {
-	conn := getConn()
-	defer releaseConn(conn)
-	return storeBlock(conn, block)
+	var commitErr error
+	w := newBlockWriter(func(written []blocks.Block, err error) {
+		if len(written) > 0 && written[0] == block {
+			commitErr = err
+		}
+	})
+	err := w.process(block)
+	w.close()
+	if err != nil {
+		return err
+	}
+	return commitErr
+}
+
+// Stores blocks and the unchecked blocks they free, committing every
+// processorBatchSize blocks so a long cascade of dependents can't
+// outgrow a transaction.
+type blockWriter struct {
+	conn    *badger.Txn
+	written []blocks.Block
+	// Called with the blocks in each commit and the error committing
+	// them, once the connection has been released
+	onCommit func(written []blocks.Block, err error)
+}
+
+func newBlockWriter(onCommit func(written []blocks.Block, err error)) *blockWriter {
+	return &blockWriter{conn: getConn(), onCommit: onCommit}
+}
+
+// Stores a block and then the unchecked blocks waiting on it. Dependents
+// are worked through as a queue rather than recursively so a long chain
+// of them can't exhaust the stack. Commits only happen once all the
+// blocks waiting on one block are stored, so none are taken from the
+// unchecked table in one transaction and stored in the next.
+func (w *blockWriter) process(block blocks.Block) error {
+	err := storeBlock(w.conn, block)
+	countProcessed(block, err)
+	if err != nil {
+		return err
+	}
+	w.written = append(w.written, block)
+
+	queue := []types.BlockHash{block.Hash()}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		for _, dependent := range takeUnchecked(w.conn, hash) {
+			err := storeBlock(w.conn, dependent)
+			countProcessed(dependent, err)
+			if err == nil {
+				w.written = append(w.written, dependent)
+				queue = append(queue, dependent.Hash())
+			}
+		}
+		if len(w.written) >= processorBatchSize {
+			w.commit()
+			w.conn = getConn()
+		}
+	}
+	return nil
+}
+
+func (w *blockWriter) commit() {
+	err := releaseConn(w.conn)
+	written := w.written
+	w.written = nil
+	w.onCommit(written, err)
+}
+
+// Commits the blocks written since the last commit.
+func (w *blockWriter) close() {
+	w.commit()
 }
 
 func storeBlock(conn *badger.Txn, block blocks.Block) error {
 	if !blocks.ValidateBlockWork(block) {
-		return errors.New("Invalid work for block")
+		return errInvalidWork
+	}
+
+	if fetchBlock(conn, block.Hash()) != nil {
+		return errBlockStored
 	}
 
 	if block.Type() != blocks.Open && block.Type() != blocks.Change && block.Type() != blocks.Send && block.Type() != blocks.Receive {
-		return errors.New("Unknown block type")
+		return errUnknownType
 	}
 
-	if fetchBlock(conn, block.PreviousBlockHash()) == nil {
-		if unconnectedBlockPool[block.PreviousBlockHash()] == nil {
-			unconnectedBlockPool[block.PreviousBlockHash()] = block
-			log.Printf("Added block to unconnected pool, now %d", len(unconnectedBlockPool))
+	if dependency, missing := missingDependency(conn, block); missing {
+		addUnchecked(conn, dependency, block)
+		if block.Type() != blocks.Open && dependency == block.PreviousBlockHash() {
+			return errMissingParent
 		}
-		return errors.New("Cannot find parent block")
+		return errMissingSource
 	}
 
-	uncheckedStoreBlock(conn, block)
-	dependentBlock := unconnectedBlockPool[block.Hash()]
+	if isFork(conn, block) {
+		return errFork
+	}
+	if err := validateBlock(conn, block); err != nil {
+		return err
+	}
+
+	sideband, err := computeSideband(conn, block)
+	if err != nil {
+		return err
+	}
+
+	uncheckedStoreBlock(conn, block, sideband)
+	return nil
+}
+
+// Checks a block whose dependencies are stored is signed by its account,
+// doesn't send more than the account has, and only receives a send to
+// the account that hasn't been received yet. Representative weights are
+// built from stored blocks, so nothing unchecked can be stored.
+func validateBlock(conn *badger.Txn, block blocks.Block) error {
+	var account types.Account
+	if open, ok := block.(*blocks.OpenBlock); ok {
+		account = open.Account
+	} else {
+		previous := fetchSideband(conn, block.PreviousBlockHash())
+		if previous == nil {
+			return errMissingParent
+		}
+		if send, ok := block.(*blocks.SendBlock); ok && send.Balance.Compare(previous.Balance) > 0 {
+			return errNegativeSpend
+		}
+		account = previous.Account
+	}
+
+	if !blocks.VerifyBlockSignature(block, account) {
+		return errBadSignature
+	}
+	return validateSource(conn, block, account)
+}
 
-	if dependentBlock != nil {
-		// We have an unconnected block dependent on this: Store it now that
-		// it's connected
-		delete(unconnectedBlockPool, block.Hash())
-		storeBlock(conn, dependentBlock)
+// Checks the send an open or receive block takes its amount from is to
+// the block's account and hasn't been received already.
+func validateSource(conn *badger.Txn, block blocks.Block, account types.Account) error {
+	var source types.BlockHash
+	switch b := block.(type) {
+	case *blocks.OpenBlock:
+		source = b.SourceHash
+	case *blocks.ReceiveBlock:
+		source = b.SourceHash
+	default:
+		return nil
+	}
+	if source == Conf.GenesisBlock.SourceHash {
+		return nil
 	}
 
+	send, ok := fetchBlock(conn, source).(*blocks.SendBlock)
+	if !ok {
+		return errMissingSource
+	}
+	if send.Destination != account {
+		return errUnreceivable
+	}
+	if _, err := conn.Get(receivableKey(account, source)); err != nil {
+		return errUnreceivable
+	}
 	return nil
 }
 
+// A block forks its account's chain if its previous block already has a
+// successor, or for open blocks if the account is already opened.
+func isFork(conn *badger.Txn, block blocks.Block) bool {
+	if b, ok := block.(*blocks.OpenBlock); ok {
+		return fetchOpen(conn, b.Account) != nil
+	}
+	previous := fetchSideband(conn, block.PreviousBlockHash())
+	return previous != nil && previous.Successor != (types.BlockHash{})
+}
+
 // Store a block without checking whether it's valid
 // The block should be pre-checked to ensure it has a valid signature,
 // parent block, balance, etc.
-func uncheckedStoreBlock(conn *badger.Txn, block blocks.Block) {
-	var buf bytes.Buffer
-	var meta byte
-	enc := gob.NewEncoder(&buf)
-	switch block.Type() {
-	case blocks.Open:
-		b := block.(*blocks.OpenBlock)
-		meta = MetaOpen
-		err := enc.Encode(b)
-		if err != nil {
-			panic(err)
-		}
+func uncheckedStoreBlock(conn *badger.Txn, block blocks.Block, sideband *Sideband) {
+	writeBlock(conn, block, sideband)
+	if err := writeFrontier(conn, sideband.Account, block.Hash()); err != nil {
+		panic(err)
+	}
+	ledgerCounts.add(block)
+	if block.Type() != blocks.Open {
+		setSuccessor(conn, block.PreviousBlockHash(), block.Hash())
+	}
+
+	updateReceivable(conn, block)
+	updateWeights(conn, block, sideband)
+}
+
+func writeBlock(conn *badger.Txn, block blocks.Block, sideband *Sideband) {
+	meta := blockMeta(block.Type())
+	value, err := blocks.ToBinary(block)
+	if err != nil {
+		panic(err)
+	}
+	sideband_bytes, _ := sideband.MarshalBinary()
+	value = append(value, sideband_bytes...)
+
+	if b, ok := block.(*blocks.OpenBlock); ok {
 		// Open blocks need to be stored twice, once keyed on account,
 		// once keyed on hash.
-		err = conn.SetWithMeta(b.RootHash().ToBytes(), buf.Bytes(), meta)
-		if err != nil {
-			panic(err)
-		}
-	case blocks.Send:
-		b := block.(*blocks.SendBlock)
-		meta = MetaSend
-		err := enc.Encode(b)
+		err = conn.SetWithMeta(b.Account[:], value, meta)
 		if err != nil {
 			panic(err)
 		}
-	case blocks.Receive:
-		b := block.(*blocks.ReceiveBlock)
-		meta = MetaReceive
-		err := enc.Encode(b)
-		if err != nil {
-			panic(err)
-		}
-	case blocks.Change:
-		b := block.(*blocks.ChangeBlock)
-		meta = MetaChange
-		err := enc.Encode(b)
-		if err != nil {
-			panic(err)
-		}
-	default:
-		panic("Unknown block type")
 	}
 
-	err := conn.SetWithMeta(block.Hash().ToBytes(), buf.Bytes(), meta)
+	hash := block.Hash()
+	err = conn.SetWithMeta(hash[:], value, meta)
 	if err != nil {
 		panic("Failed to store block")
 	}
@@ -0,0 +1,414 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+// A problem found by CheckLedger. Hash is zero for problems with an
+// account rather than a block.
+type CheckIssue struct {
+	Hash    types.BlockHash
+	Account types.Account
+	Problem string
+	// Set when the problem was in a table derived from the blocks and it
+	// has been rewritten
+	Repaired bool
+}
+
+func (i CheckIssue) String() string {
+	s := i.Problem
+	if i.Hash != (types.BlockHash{}) {
+		s = fmt.Sprintf("block %s: %s", i.Hash, s)
+	} else if i.Account != (types.Account{}) {
+		s = fmt.Sprintf("account %s: %s", i.Account, s)
+	}
+	if i.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+type CheckResult struct {
+	Blocks   int
+	Accounts int
+	Issues   []CheckIssue
+	// Voting weight of each representative, the balances of the accounts
+	// whose latest open or change block names it
+	Weights map[types.Account]uint128.Uint128
+}
+
+type ledgerChecker struct {
+	conn   *badger.Txn
+	repair bool
+	result *CheckResult
+
+	stored      map[types.BlockHash]blocks.Block
+	sidebands   map[types.BlockHash]*Sideband
+	openKeys    map[types.Account]types.BlockHash
+	frontiers   map[types.Account]types.BlockHash
+	reps        map[types.Account]types.Account
+	weights     map[types.Account]uint128.Uint128
+	receivables map[string]uint128.Uint128
+	builder     *sidebandBuilder
+	repairs     []checkRepair
+}
+
+// A write that repairs the issue at index issue of the result.
+type checkRepair struct {
+	issue int
+	write func(conn *badger.Txn) error
+}
+
+func (c *ledgerChecker) issue(hash types.BlockHash, account types.Account, repaired bool, format string, args ...interface{}) {
+	c.result.Issues = append(c.result.Issues, CheckIssue{hash, account, fmt.Sprintf(format, args...), repaired})
+}
+
+// Reports a problem in a derived table, queueing write to fix it when
+// repairing.
+func (c *ledgerChecker) repairable(hash types.BlockHash, account types.Account, write func(conn *badger.Txn) error, format string, args ...interface{}) {
+	if c.repair {
+		c.repairs = append(c.repairs, checkRepair{len(c.result.Issues), write})
+	}
+	c.issue(hash, account, c.repair, format, args...)
+}
+
+// CheckLedger walks every account chain checking each block's work,
+// signature, balance and source send, and checks the tables derived
+// from the blocks: sidebands, frontiers, representatives and their
+// weights, open blocks keyed on account and the receivable index. With
+// repair set the derived tables are rewritten from the blocks where they
+// don't match, the blocks themselves are never changed. Repairs are
+// written after checking, so the node mustn't be storing blocks at the
+// same time.
+func CheckLedger(repair bool) *CheckResult {
+	conn := getConn()
+
+	c := &ledgerChecker{
+		conn:        conn,
+		repair:      repair,
+		result:      &CheckResult{Weights: make(map[types.Account]uint128.Uint128)},
+		stored:      make(map[types.BlockHash]blocks.Block),
+		sidebands:   make(map[types.BlockHash]*Sideband),
+		openKeys:    make(map[types.Account]types.BlockHash),
+		frontiers:   make(map[types.Account]types.BlockHash),
+		reps:        make(map[types.Account]types.Account),
+		weights:     make(map[types.Account]uint128.Uint128),
+		receivables: make(map[string]uint128.Uint128),
+	}
+	c.load()
+	c.builder = newSidebandBuilder(c.stored)
+
+	sources := c.checkBlocks()
+	c.checkAccounts()
+	c.checkReceivables(sources)
+	releaseConn(conn)
+
+	if c.repair {
+		c.writeRepairs()
+	}
+	return c.result
+}
+
+// A ledger can need more repairs than fit in one transaction, so they're
+// committed a batch at a time as migrations are. If a batch fails the
+// issues it and later batches were for are left unrepaired.
+func (c *ledgerChecker) writeRepairs() {
+	conn := getConn()
+	start := 0
+	for i, repair := range c.repairs {
+		err := repair.write(conn)
+		if err == nil && (i+1)%migrateBatchSize == 0 {
+			err = releaseConn(conn)
+			conn = getConn()
+			if err == nil {
+				start = i + 1
+			}
+		}
+		if err != nil {
+			discardConn(conn)
+			c.repairFailed(start, err)
+			return
+		}
+	}
+	if err := releaseConn(conn); err != nil {
+		c.repairFailed(start, err)
+	}
+}
+
+func (c *ledgerChecker) repairFailed(start int, err error) {
+	for _, repair := range c.repairs[start:] {
+		c.result.Issues[repair.issue].Repaired = false
+	}
+	c.issue(types.BlockHash{}, types.Account{}, false, "could not write repairs: %s", err)
+}
+
+func (c *ledgerChecker) load() {
+	it := c.conn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := BlockItem{it.Item()}
+		key := item.Key()
+
+		if bytes.HasPrefix(key, receivablePrefix) && len(key) == len(receivablePrefix)+64 {
+			value, err := item.Value()
+			if err == nil {
+				c.receivables[string(key)] = uint128.FromBytes(value)
+			}
+			continue
+		}
+		if bytes.HasPrefix(key, representativePrefix) && len(key) == len(representativePrefix)+32 {
+			value, err := item.Value()
+			if err == nil && len(value) == 32 {
+				c.reps[types.AccountFromBytes(key[len(representativePrefix):])] = types.AccountFromBytes(value)
+			}
+			continue
+		}
+		if bytes.HasPrefix(key, weightPrefix) && len(key) == len(weightPrefix)+32 {
+			value, err := item.Value()
+			if err == nil && len(value) == 16 {
+				c.weights[types.AccountFromBytes(key[len(weightPrefix):])] = uint128.FromBytes(value)
+			}
+			continue
+		}
+		if bytes.HasPrefix(key, frontierPrefix) && len(key) == len(frontierPrefix)+32 {
+			value, err := item.Value()
+			if err == nil && len(value) == 32 {
+				c.frontiers[types.AccountFromBytes(key[len(frontierPrefix):])] = types.BlockHashFromBytes(value)
+			}
+			continue
+		}
+		if len(key) != 32 {
+			continue
+		}
+
+		block := item.ToBlock()
+		if block == nil {
+			c.issue(types.BlockHashFromBytes(key), types.Account{}, false, "cannot decode stored block")
+			continue
+		}
+		if open, ok := block.(*blocks.OpenBlock); ok && bytes.Equal(key, open.Account[:]) {
+			c.openKeys[open.Account] = open.Hash()
+			continue
+		}
+
+		hash := block.Hash()
+		if !bytes.Equal(key, hash[:]) {
+			c.issue(types.BlockHashFromBytes(key), types.Account{}, false, "stored block hashes to %s", hash)
+			continue
+		}
+		c.stored[hash] = block
+		c.sidebands[hash] = item.Sideband()
+	}
+}
+
+// Checks each block on its own and against the chain it's in, returning
+// the sends that have been received.
+func (c *ledgerChecker) checkBlocks() map[types.BlockHash]bool {
+	received := make(map[types.BlockHash]bool)
+	previous := make(map[types.BlockHash]types.BlockHash)
+
+	for hash, block := range c.stored {
+		c.result.Blocks++
+
+		if !blocks.ValidateBlockWork(block) {
+			c.issue(hash, types.Account{}, false, "invalid work")
+		}
+
+		if block.Type() != blocks.Open {
+			if other, ok := previous[block.PreviousBlockHash()]; ok {
+				c.issue(hash, types.Account{}, false, "fork with %s", other)
+			}
+			previous[block.PreviousBlockHash()] = hash
+		}
+
+		expected, err := c.builder.sideband(hash)
+		if err != nil {
+			c.issue(hash, types.Account{}, false, "%s", err)
+			continue
+		}
+		account := expected.Account
+
+		if !blocks.VerifyBlockSignature(block, account) {
+			c.issue(hash, account, false, "invalid signature")
+		}
+
+		var source types.BlockHash
+		switch b := block.(type) {
+		case *blocks.SendBlock:
+			before := c.builder.sidebands[b.PreviousHash]
+			if b.Balance.Compare(before.Balance) > 0 {
+				c.issue(hash, account, false, "send increases balance")
+			}
+		case *blocks.OpenBlock:
+			source = b.SourceHash
+		case *blocks.ReceiveBlock:
+			source = b.SourceHash
+		}
+		if source != (types.BlockHash{}) && source != Conf.GenesisBlock.SourceHash {
+			if received[source] {
+				c.issue(hash, account, false, "send %s already received", source)
+			}
+			received[source] = true
+			send, ok := c.stored[source].(*blocks.SendBlock)
+			if !ok {
+				c.issue(hash, account, false, "source %s is missing or not a send", source)
+			} else if send.Destination != account {
+				c.issue(hash, account, false, "receives send %s to %s", source, send.Destination)
+			}
+		}
+
+		stored := c.sidebands[hash]
+		if stored == nil || stored.Account != expected.Account || stored.Height != expected.Height ||
+			stored.Balance != expected.Balance || stored.Successor != expected.Successor {
+			if stored != nil {
+				expected.Timestamp = stored.Timestamp
+			}
+			block := block
+			c.repairable(hash, account, func(conn *badger.Txn) error {
+				writeBlock(conn, block, expected)
+				return nil
+			}, "sideband doesn't match chain")
+		}
+	}
+
+	return received
+}
+
+// Checks each account's open block entry and frontier, and adds up
+// representative weights.
+func (c *ledgerChecker) checkAccounts() {
+	for hash, block := range c.stored {
+		open, ok := block.(*blocks.OpenBlock)
+		if !ok {
+			continue
+		}
+		c.result.Accounts++
+
+		if c.openKeys[open.Account] != hash {
+			value := c.value(open)
+			c.repairable(types.BlockHash{}, open.Account, func(conn *badger.Txn) error {
+				return conn.SetWithMeta(open.Account[:], value, MetaOpen)
+			}, "open block not stored under account")
+		}
+		delete(c.openKeys, open.Account)
+
+		// Walk the chain as it should be, the stored successors have been
+		// checked with the sidebands
+		frontier := hash
+		representative := open.Representative
+		for {
+			successor, ok := c.builder.successors[frontier]
+			if !ok {
+				break
+			}
+			frontier = successor
+			if change, ok := c.stored[frontier].(*blocks.ChangeBlock); ok {
+				representative = change.Representative
+			}
+		}
+		if stored, ok := c.frontiers[open.Account]; !ok || stored != frontier {
+			account, frontier := open.Account, frontier
+			c.repairable(types.BlockHash{}, open.Account, func(conn *badger.Txn) error {
+				return writeFrontier(conn, account, frontier)
+			}, "frontier is %s, expected %s", stored, frontier)
+		}
+		delete(c.frontiers, open.Account)
+
+		if stored, ok := c.reps[open.Account]; !ok || stored != representative {
+			key, value := representativeKey(open.Account), representative
+			c.repairable(types.BlockHash{}, open.Account, func(conn *badger.Txn) error {
+				return conn.Set(key, value[:])
+			}, "representative is %s, expected %s", stored, representative)
+		}
+		delete(c.reps, open.Account)
+
+		if sideband := c.builder.sidebands[frontier]; sideband != nil {
+			weight := c.result.Weights[representative]
+			c.result.Weights[representative] = weight.Add(sideband.Balance)
+		}
+	}
+
+	for account := range c.openKeys {
+		c.repairable(types.BlockHash{}, account, deleteKey(append([]byte{}, account[:]...)), "stored under account without its open block")
+	}
+	for account := range c.frontiers {
+		c.repairable(types.BlockHash{}, account, deleteKey(frontierKey(account)), "frontier stored without an open block")
+	}
+	for account := range c.reps {
+		c.repairable(types.BlockHash{}, account, deleteKey(representativeKey(account)), "representative stored without an open block")
+	}
+
+	for representative, weight := range c.result.Weights {
+		if c.weights[representative] != weight {
+			representative, weight := representative, weight
+			c.repairable(types.BlockHash{}, representative, func(conn *badger.Txn) error {
+				writeWeight(conn, representative, weight)
+				return nil
+			}, "weight is %s, expected %s", c.weights[representative], weight)
+		}
+		delete(c.weights, representative)
+	}
+	for representative, weight := range c.weights {
+		c.repairable(types.BlockHash{}, representative, deleteKey(weightKey(representative)), "weight is %s, expected 0", weight)
+	}
+}
+
+// Checks the receivable index holds exactly the sends that haven't been
+// received, and that balances and receivable amounts add up to the
+// genesis amount.
+func (c *ledgerChecker) checkReceivables(received map[types.BlockHash]bool) {
+	total := uint128.Uint128{}
+	for _, weight := range c.result.Weights {
+		total = total.Add(weight)
+	}
+
+	for hash, block := range c.stored {
+		send, ok := block.(*blocks.SendBlock)
+		if !ok || received[hash] {
+			continue
+		}
+		if _, ok := c.builder.sidebands[send.PreviousHash]; !ok {
+			continue
+		}
+		amount := c.builder.sendAmount(hash)
+		total = total.Add(amount)
+
+		key := string(receivableKey(send.Destination, hash))
+		stored, ok := c.receivables[key]
+		delete(c.receivables, key)
+		if ok && stored == amount {
+			continue
+		}
+		value := amount.GetBytes()
+		c.repairable(hash, send.Destination, func(conn *badger.Txn) error {
+			return conn.Set([]byte(key), value)
+		}, "missing or wrong receivable entry")
+	}
+
+	for key := range c.receivables {
+		hash := types.BlockHashFromBytes([]byte(key)[len(receivablePrefix)+32:])
+		c.repairable(hash, types.AccountFromBytes([]byte(key)[len(receivablePrefix):]), deleteKey([]byte(key)), "receivable entry for a received or unknown send")
+	}
+
+	if total != blocks.GenesisAmount {
+		c.issue(types.BlockHash{}, types.Account{}, false, "balances and receivable amounts total %s, not the genesis amount", total)
+	}
+}
+
+func deleteKey(key []byte) func(conn *badger.Txn) error {
+	return func(conn *badger.Txn) error {
+		return conn.Delete(key)
+	}
+}
+
+func (c *ledgerChecker) value(block blocks.Block) []byte {
+	value, _ := blocks.ToBinary(block)
+	sideband, _ := c.builder.sidebands[block.Hash()].MarshalBinary()
+	return append(value, sideband...)
+}
@@ -0,0 +1,166 @@
+package store
+
+import (
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/pkg/errors"
+)
+
+// A block in an account's history, described from the account's side.
+type HistoryEntry struct {
+	Hash types.BlockHash
+	Type blocks.BlockType
+	// The other side of the transfer: the destination of a send, the
+	// sender of a receive or open, the new representative of a change
+	Account types.Account
+	// Amount moved by the block, zero for changes
+	Amount  uint128.Uint128
+	Balance uint128.Uint128
+	Height  uint64
+}
+
+type HistoryOptions struct {
+	// Block to start from, which must be in the account's chain. Defaults
+	// to the frontier, or to the open block when Reverse is set.
+	Head *types.BlockHash
+	// Number of blocks to skip after Head
+	Offset int
+	// Maximum number of entries, 0 for no limit
+	Count int
+	// List oldest first instead of newest first
+	Reverse bool
+}
+
+// Keys in the frontier table are this prefix followed by the account,
+// and values are the hash of the account's newest block.
+var frontierPrefix = []byte{'f'}
+
+func frontierKey(account types.Account) []byte {
+	return append(append([]byte{}, frontierPrefix...), account[:]...)
+}
+
+func writeFrontier(conn *badger.Txn, account types.Account, hash types.BlockHash) error {
+	return conn.Set(frontierKey(account), hash[:])
+}
+
+// FetchFrontier returns the hash of the newest block in an account's
+// chain.
+func FetchFrontier(account types.Account) (types.BlockHash, bool) {
+	conn := getConn()
+	defer releaseConn(conn)
+	return fetchFrontier(conn, account)
+}
+
+func fetchFrontier(conn *badger.Txn, account types.Account) (types.BlockHash, bool) {
+	item, err := conn.Get(frontierKey(account))
+	if err != nil {
+		return types.BlockHash{}, false
+	}
+	value, err := item.Value()
+	if err != nil || len(value) != 32 {
+		return types.BlockHash{}, false
+	}
+	return types.BlockHashFromBytes(value), true
+}
+
+// FetchHistory lists an account's blocks, newest first unless
+// options.Reverse is set.
+func FetchHistory(account types.Account, options HistoryOptions) ([]HistoryEntry, error) {
+	conn := getConn()
+	defer releaseConn(conn)
+	return fetchHistory(conn, account, options)
+}
+
+func fetchHistory(conn *badger.Txn, account types.Account, options HistoryOptions) ([]HistoryEntry, error) {
+	result := make([]HistoryEntry, 0)
+
+	var hash types.BlockHash
+	if options.Head != nil {
+		hash = *options.Head
+	} else if options.Reverse {
+		open := fetchOpen(conn, account)
+		if open == nil {
+			return result, nil
+		}
+		hash = open.Hash()
+	} else {
+		frontier, ok := fetchFrontier(conn, account)
+		if !ok {
+			return result, nil
+		}
+		hash = frontier
+	}
+
+	for skipped := 0; options.Count == 0 || len(result) < options.Count; skipped++ {
+		block := fetchBlock(conn, hash)
+		sideband := fetchSideband(conn, hash)
+		if block == nil || sideband == nil {
+			return nil, errors.Errorf("Cannot find block %s", hash)
+		}
+		if sideband.Account != account {
+			return nil, errors.Errorf("Block %s isn't in the chain for %s", hash, account)
+		}
+
+		if skipped >= options.Offset {
+			entry, err := historyEntry(conn, block, sideband)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, entry)
+		}
+
+		if options.Reverse {
+			hash = sideband.Successor
+			if hash == (types.BlockHash{}) {
+				break
+			}
+		} else {
+			if block.Type() == blocks.Open {
+				break
+			}
+			hash = block.PreviousBlockHash()
+		}
+	}
+
+	return result, nil
+}
+
+func historyEntry(conn *badger.Txn, block blocks.Block, sideband *Sideband) (HistoryEntry, error) {
+	entry := HistoryEntry{
+		Hash:    block.Hash(),
+		Type:    block.Type(),
+		Balance: sideband.Balance,
+		Height:  sideband.Height,
+	}
+
+	var source types.BlockHash
+	switch b := block.(type) {
+	case *blocks.SendBlock:
+		entry.Account = b.Destination
+		entry.Amount = getSendAmount(conn, b)
+		return entry, nil
+	case *blocks.ChangeBlock:
+		entry.Account = b.Representative
+		return entry, nil
+	case *blocks.OpenBlock:
+		if b.SourceHash == Conf.GenesisBlock.SourceHash {
+			entry.Account = b.Account
+			entry.Amount = sideband.Balance
+			return entry, nil
+		}
+		source = b.SourceHash
+	case *blocks.ReceiveBlock:
+		source = b.SourceHash
+	}
+
+	send, ok := fetchBlock(conn, source).(*blocks.SendBlock)
+	sender := fetchSideband(conn, source)
+	if !ok || sender == nil {
+		return entry, errors.Errorf("Cannot find source send block %s", source)
+	}
+	entry.Account = sender.Account
+	entry.Amount = getSendAmount(conn, send)
+	return entry, nil
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/metrics"
+)
+
+var blocksProcessed = metrics.NewCounter("nano_blocks_processed_total",
+	"Blocks stored in the ledger, by block type.", "type")
+
+// Blocks rejected for a missing dependency are kept as unchecked, and
+// counted as processed if it arrives.
+var blocksRejected = metrics.NewCounter("nano_blocks_rejected_total",
+	"Blocks that couldn't be stored, by reason.", "reason")
+
+func init() {
+	metrics.NewGaugeFunc("nano_unchecked_blocks", "Blocks waiting on a block that hasn't arrived.", func() float64 {
+		if Conf == nil {
+			return 0
+		}
+		return float64(UncheckedCount())
+	})
+	metrics.NewGaugeFunc("nano_ledger_blocks", "Blocks in the ledger.", func() float64 {
+		count, _ := LedgerCounts()
+		return float64(count)
+	})
+	metrics.NewGaugeFunc("nano_ledger_accounts", "Opened accounts in the ledger.", func() float64 {
+		_, accounts := LedgerCounts()
+		return float64(accounts)
+	})
+}
+
+func rejectReason(err error) string {
+	switch err {
+	case errInvalidWork:
+		return "insufficient_work"
+	case errBlockStored:
+		return "old"
+	case errUnknownType:
+		return "invalid_type"
+	case errMissingParent:
+		return "gap_previous"
+	case errMissingSource:
+		return "gap_source"
+	case errFork:
+		return "fork"
+	case errBadSignature:
+		return "bad_signature"
+	case errNegativeSpend:
+		return "negative_spend"
+	case errUnreceivable:
+		return "unreceivable"
+	}
+	return "other"
+}
+
+func countProcessed(block blocks.Block, err error) {
+	if err != nil {
+		blocksRejected.Inc(rejectReason(err))
+		return
+	}
+	blocksProcessed.Inc(string(block.Type()))
+}
+
+// Counting the ledger means reading all of it, so it's counted once when
+// the store is opened and the counts are kept up to date from then on.
+// Blocks stored in a transaction are counted once it commits.
+type ledgerCounter struct {
+	blocks          int
+	accounts        int
+	pendingBlocks   int
+	pendingAccounts int
+}
+
+// Guarded by the connection lock
+var ledgerCounts ledgerCounter
+
+func (c *ledgerCounter) add(block blocks.Block) {
+	c.pendingBlocks++
+	if block.Type() == blocks.Open {
+		c.pendingAccounts++
+	}
+}
+
+// Counts the blocks stored in the transaction if it committed, and drops
+// them otherwise.
+func (c *ledgerCounter) commit(committed bool) {
+	if committed {
+		c.blocks += c.pendingBlocks
+		c.accounts += c.pendingAccounts
+	}
+	c.pendingBlocks, c.pendingAccounts = 0, 0
+}
+
+// LedgerCounts returns the number of blocks and accounts in the ledger,
+// as CountBlocks does but without reading the ledger each time.
+func LedgerCounts() (count int, accounts int) {
+	if Conf == nil {
+		return 0, 0
+	}
+	conn := getConn()
+	defer releaseConn(conn)
+	return ledgerCounts.blocks, ledgerCounts.accounts
+}
@@ -0,0 +1,469 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/pkg/errors"
+)
+
+// Database format versions. Databases from before the version was
+// stored hold gob encoded blocks, since version 2 blocks are stored in
+// the reference node's binary layout, since version 3 each block is
+// followed by its sideband, since version 4 each account's frontier is
+// kept in its own table, and since version 5 so are representatives and
+// their voting weights.
+const (
+	dbVersionGob      = 1
+	dbVersionBinary   = 2
+	dbVersionSideband = 3
+	dbVersionFrontier = 4
+	DbVersion         = 5
+)
+
+// The version is stored as a big endian uint32 under a one byte key,
+// which can't clash with block or receivable keys.
+var versionKey = []byte{'v'}
+
+// Number of blocks rewritten per transaction when migrating.
+const migrateBatchSize = 1000
+
+func readVersion(conn *badger.Txn) (uint32, bool) {
+	item, err := conn.Get(versionKey)
+	if err != nil {
+		return 0, false
+	}
+	value, err := item.Value()
+	if err != nil || len(value) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(value), true
+}
+
+func writeVersion(conn *badger.Txn, version uint32) error {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, version)
+	return conn.Set(versionKey, value)
+}
+
+func isEmpty(conn *badger.Txn) bool {
+	it := conn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	it.Rewind()
+	return !it.Valid()
+}
+
+// Brings the open database up to DbVersion. New databases are stamped
+// with the current version, and the version is stamped after each step
+// so an interrupted migration carries on from the step it was in.
+func migrate() error {
+	conn := getConn()
+	version, ok := readVersion(conn)
+	if !ok {
+		version = DbVersion
+		if !isEmpty(conn) {
+			version = dbVersionGob
+		}
+	}
+	releaseConn(conn)
+
+	if version > DbVersion {
+		return errors.Errorf("Database version %d is newer than this node supports", version)
+	}
+	if version == dbVersionGob {
+		err := migrateGob()
+		if err != nil {
+			return errors.Wrap(err, "could not migrate gob encoded blocks")
+		}
+		version = dbVersionBinary
+		if err := stampVersion(version); err != nil {
+			return err
+		}
+	}
+	if version == dbVersionBinary {
+		err := migrateSideband()
+		if err != nil {
+			return errors.Wrap(err, "could not add block sidebands")
+		}
+		version = dbVersionSideband
+		if err := stampVersion(version); err != nil {
+			return err
+		}
+	}
+	if version == dbVersionSideband {
+		err := migrateFrontiers()
+		if err != nil {
+			return errors.Wrap(err, "could not build the frontier table")
+		}
+		version = dbVersionFrontier
+		if err := stampVersion(version); err != nil {
+			return err
+		}
+	}
+	if version == dbVersionFrontier {
+		err := migrateWeights()
+		if err != nil {
+			return errors.Wrap(err, "could not build the representative weights")
+		}
+	}
+
+	return stampVersion(DbVersion)
+}
+
+func stampVersion(version uint32) error {
+	conn := getConn()
+	defer releaseConn(conn)
+	return writeVersion(conn, version)
+}
+
+// A block as gob encoded it before the binary format, when hashes,
+// accounts, work and signatures were strings. One struct covers every
+// block type as gob leaves fields that weren't encoded empty.
+type gobBlock struct {
+	SourceHash     string
+	PreviousHash   string
+	Representative string
+	Account        string
+	Destination    string
+	Balance        uint128.Uint128
+	CommonBlock    struct {
+		Work      string
+		Signature string
+	}
+}
+
+func (g *gobBlock) toBlock(t blocks.BlockType) (blocks.Block, error) {
+	var errs []error
+	hash := func(s string) types.BlockHash {
+		h, err := types.BlockHashFromString(s)
+		errs = append(errs, err)
+		return h
+	}
+	account := func(s string) types.Account {
+		a, err := types.ParseAccount(s)
+		errs = append(errs, err)
+		return a
+	}
+
+	var common blocks.CommonBlock
+	var err error
+	common.Work, err = types.WorkFromString(g.CommonBlock.Work)
+	errs = append(errs, err)
+	common.Signature, err = types.SignatureFromString(g.CommonBlock.Signature)
+	errs = append(errs, err)
+
+	var block blocks.Block
+	switch t {
+	case blocks.Open:
+		block = &blocks.OpenBlock{SourceHash: hash(g.SourceHash), Representative: account(g.Representative), Account: account(g.Account), CommonBlock: common}
+	case blocks.Send:
+		block = &blocks.SendBlock{PreviousHash: hash(g.PreviousHash), Destination: account(g.Destination), Balance: g.Balance, CommonBlock: common}
+	case blocks.Receive:
+		block = &blocks.ReceiveBlock{PreviousHash: hash(g.PreviousHash), SourceHash: hash(g.SourceHash), CommonBlock: common}
+	case blocks.Change:
+		block = &blocks.ChangeBlock{PreviousHash: hash(g.PreviousHash), Representative: account(g.Representative), CommonBlock: common}
+	default:
+		return nil, errors.Errorf("Unknown block type %q", t)
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return block, nil
+}
+
+type migratedItem struct {
+	key   []byte
+	value []byte
+	meta  byte
+}
+
+// Migrations stream through the blocks a batch at a time, and commit
+// every migrateBatchSize blocks written. Each step skips blocks that are
+// already in its target format, so if it's interrupted the blocks
+// committed so far aren't migrated again.
+type migration struct {
+	conn    *badger.Txn
+	written int
+}
+
+// Returns the next batch of blocks after a key, or from the start if
+// it's nil.
+func readBlockBatch(conn *badger.Txn, after []byte) []migratedItem {
+	items := make([]migratedItem, 0, migrateBatchSize)
+
+	it := conn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	if after == nil {
+		it.Rewind()
+	} else {
+		it.Seek(after)
+	}
+	for ; it.Valid() && len(items) < migrateBatchSize; it.Next() {
+		item := it.Item()
+		if len(item.Key()) != 32 || bytes.Equal(item.Key(), after) {
+			continue
+		}
+		value, err := item.Value()
+		if err != nil {
+			continue
+		}
+		items = append(items, migratedItem{
+			append([]byte{}, item.Key()...),
+			append([]byte{}, value...),
+			item.UserMeta(),
+		})
+	}
+	return items
+}
+
+// Calls fn for every block, under hash and account keys. Changes are
+// discarded back to the last commit if fn fails.
+func (m *migration) run(fn func(item migratedItem) error) error {
+	m.conn = getConn()
+	var after []byte
+	for {
+		items := readBlockBatch(m.conn, after)
+		if len(items) == 0 {
+			break
+		}
+		for _, item := range items {
+			if err := fn(item); err != nil {
+				discardConn(m.conn)
+				return err
+			}
+		}
+		after = items[len(items)-1].key
+	}
+	releaseConn(m.conn)
+	return nil
+}
+
+// Counts a block as written, committing once there's a batch of them.
+// Callers must have written everything that goes with the block, so a
+// commit never splits it from related changes.
+func (m *migration) countWritten() {
+	m.written++
+	if m.written%migrateBatchSize == 0 {
+		releaseConn(m.conn)
+		m.conn = getConn()
+	}
+}
+
+// Rewrites every gob encoded block, those under hash and account keys,
+// in the binary format.
+func migrateGob() error {
+	logger.Info("Migrating gob encoded blocks")
+	var m migration
+	err := m.run(func(item migratedItem) error {
+		t := metaBlockType(item.meta)
+		// Binary blocks, with or without a sideband, are always shorter
+		// than their gob encoding
+		size := blocks.BinarySize(t)
+		if len(item.value) == size || len(item.value) == size+SidebandSize {
+			return nil
+		}
+
+		var g gobBlock
+		err := gob.NewDecoder(bytes.NewReader(item.value)).Decode(&g)
+		if err != nil {
+			return errors.Wrapf(err, "could not decode block %X", item.key)
+		}
+		block, err := g.toBlock(t)
+		if err != nil {
+			return errors.Wrapf(err, "could not convert block %X", item.key)
+		}
+		value, _ := blocks.ToBinary(block)
+		if err := m.conn.SetWithMeta(item.key, value, item.meta); err != nil {
+			return err
+		}
+		m.countWritten()
+		return nil
+	})
+	logger.Info("Migrated gob encoded blocks", "blocks", m.written)
+	return err
+}
+
+// Works out sidebands for blocks that were stored without them.
+// Timestamps are left zero as the time a block was stored wasn't kept.
+func migrateSideband() error {
+	logger.Info("Adding sidebands")
+	var m migration
+	err := m.run(func(item migratedItem) error {
+		t := metaBlockType(item.meta)
+		size := blocks.BinarySize(t)
+		if len(item.value) < size {
+			return errors.Errorf("could not decode block %X", item.key)
+		}
+		block, err := blocks.FromBinary(t, item.value[:size])
+		if err != nil {
+			return errors.Wrapf(err, "could not decode block %X", item.key)
+		}
+		// Open blocks keyed on account are written with their hash key
+		if b, ok := block.(*blocks.OpenBlock); ok && bytes.Equal(item.key, b.Account[:]) {
+			return nil
+		}
+		return m.addSideband(block.Hash())
+	})
+	logger.Info("Added sidebands", "blocks", m.written)
+	return err
+}
+
+// Returns the blocks whose sidebands are needed to work out a block's:
+// its previous block and the block before its source send.
+func sidebandNeeds(conn *badger.Txn, block blocks.Block) ([]types.BlockHash, error) {
+	needs := make([]types.BlockHash, 0, 2)
+	var source types.BlockHash
+	switch b := block.(type) {
+	case *blocks.OpenBlock:
+		if b.SourceHash == Conf.GenesisBlock.SourceHash {
+			return needs, nil
+		}
+		source = b.SourceHash
+	case *blocks.ReceiveBlock:
+		needs = append(needs, b.PreviousHash)
+		source = b.SourceHash
+	default:
+		return append(needs, block.PreviousBlockHash()), nil
+	}
+
+	send, ok := fetchBlock(conn, source).(*blocks.SendBlock)
+	if !ok {
+		return nil, errors.Errorf("Cannot find source send block %s", source)
+	}
+	return append(needs, send.PreviousHash), nil
+}
+
+// Adds the sideband to a block, and first to the blocks it depends on
+// that don't have one. Chains can be very long so blocks are worked
+// through with a stack rather than recursively.
+func (m *migration) addSideband(hash types.BlockHash) error {
+	stack := []types.BlockHash{hash}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		if fetchSideband(m.conn, top) != nil {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		block := fetchBlock(m.conn, top)
+		if block == nil {
+			return errors.Errorf("Cannot find block %s", top)
+		}
+
+		needs, err := sidebandNeeds(m.conn, block)
+		if err != nil {
+			return err
+		}
+		pending := false
+		for _, h := range needs {
+			if fetchSideband(m.conn, h) == nil {
+				stack = append(stack, h)
+				pending = true
+			}
+		}
+		if pending {
+			continue
+		}
+
+		sideband, err := computeSideband(m.conn, block)
+		if err != nil {
+			return errors.Wrapf(err, "could not work out sideband for %s", top)
+		}
+		sideband.Timestamp = 0
+		writeBlock(m.conn, block, sideband)
+		if block.Type() != blocks.Open {
+			setSuccessor(m.conn, block.PreviousBlockHash(), top)
+		}
+		m.countWritten()
+		stack = stack[:len(stack)-1]
+	}
+	return nil
+}
+
+// Fills the frontier table from the blocks without a successor. Writing
+// a frontier twice does no harm, so there's nothing to skip when resuming.
+func migrateFrontiers() error {
+	logger.Info("Building the frontier table")
+	var m migration
+	err := m.run(func(item migratedItem) error {
+		t := metaBlockType(item.meta)
+		size := blocks.BinarySize(t)
+		if len(item.value) < size {
+			return errors.Errorf("could not decode block %X", item.key)
+		}
+		var sideband Sideband
+		if err := sideband.UnmarshalBinary(item.value[size:]); err != nil {
+			return errors.Wrapf(err, "could not decode sideband for %X", item.key)
+		}
+		if sideband.Successor != (types.BlockHash{}) {
+			return nil
+		}
+		block, err := blocks.FromBinary(t, item.value[:size])
+		if err != nil {
+			return errors.Wrapf(err, "could not decode block %X", item.key)
+		}
+		if err := writeFrontier(m.conn, sideband.Account, block.Hash()); err != nil {
+			return err
+		}
+		m.countWritten()
+		return nil
+	})
+	logger.Info("Built the frontier table", "accounts", m.written)
+	return err
+}
+
+// Fills the representative and weight tables by walking each account's
+// chain. Weights are added to, so accounts whose representative is
+// already stored were done before the migration was interrupted.
+func migrateWeights() error {
+	logger.Info("Building the representative weights")
+	var m migration
+	err := m.run(func(item migratedItem) error {
+		if item.meta != MetaOpen || len(item.value) < blocks.BinarySize(blocks.Open) {
+			return nil
+		}
+		block, err := blocks.FromBinary(blocks.Open, item.value[:blocks.BinarySize(blocks.Open)])
+		if err != nil {
+			return errors.Wrapf(err, "could not decode block %X", item.key)
+		}
+		open := block.(*blocks.OpenBlock)
+		if !bytes.Equal(item.key, open.Account[:]) {
+			return nil
+		}
+		if _, ok := fetchRepresentative(m.conn, open.Account); ok {
+			return nil
+		}
+
+		representative := open.Representative
+		hash := open.Hash()
+		for {
+			sideband := fetchSideband(m.conn, hash)
+			if sideband == nil {
+				return errors.Errorf("Cannot find sideband for %s", hash)
+			}
+			if change, ok := fetchBlock(m.conn, hash).(*blocks.ChangeBlock); ok {
+				representative = change.Representative
+			}
+			if sideband.Successor == (types.BlockHash{}) {
+				err := m.conn.Set(representativeKey(open.Account), representative[:])
+				if err != nil {
+					return err
+				}
+				writeWeight(m.conn, representative, fetchWeight(m.conn, representative).Add(sideband.Balance))
+				break
+			}
+			hash = sideband.Successor
+		}
+		m.countWritten()
+		return nil
+	})
+	logger.Info("Built the representative weights", "accounts", m.written)
+	return err
+}
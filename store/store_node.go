@@ -0,0 +1,32 @@
+package store
+
+import (
+	"github.com/frankh/crypto/ed25519"
+	"github.com/frankh/nano/address"
+)
+
+// The node's identity key is kept under a one byte key like the version,
+// so it's the same across restarts but isn't part of the ledger.
+var nodeKeyKey = []byte{'n'}
+
+// FetchNodeKey returns the private key peers know the node by, generating
+// it the first time.
+func FetchNodeKey() ed25519.PrivateKey {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	item, err := conn.Get(nodeKeyKey)
+	if err == nil {
+		value, err := item.Value()
+		if err == nil && len(value) == ed25519.PrivateKeySize {
+			return ed25519.PrivateKey(append([]byte{}, value...))
+		}
+	}
+
+	_, priv := address.GenerateKey()
+	err = conn.Set(nodeKeyKey, priv)
+	if err != nil {
+		panic(err)
+	}
+	return priv
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"sync/atomic"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+)
+
+// Maximum number of blocks taken off the queues at once, and stored in
+// one transaction.
+const processorBatchSize = 256
+
+type processorItem struct {
+	block blocks.Block
+	// Receives the result of storing a local block, nil for network blocks
+	result chan error
+}
+
+// A BlockProcessor stores blocks on its own goroutine so callers, like
+// the network read loop, don't wait on the database. Blocks are taken
+// off its queues in batches, with locally created blocks ahead of those
+// from the network, and stored in transactions of at most
+// processorBatchSize blocks.
+type BlockProcessor struct {
+	// Called with each block stored, including unchecked blocks stored
+	// once the block they were waiting on arrives.
+	OnStored func(blocks.Block)
+	local    chan processorItem
+	network  chan processorItem
+	done     chan bool
+	dropped  uint64
+}
+
+func NewBlockProcessor(queueSize int, onStored func(blocks.Block)) *BlockProcessor {
+	p := &BlockProcessor{
+		onStored,
+		make(chan processorItem, queueSize),
+		make(chan processorItem, queueSize),
+		make(chan bool),
+		0,
+	}
+
+	go p.Run()
+
+	return p
+}
+
+// Add queues a block received from the network. Blocks are dropped
+// rather than waiting when the queue is full, and Add returns false.
+func (p *BlockProcessor) Add(block blocks.Block) bool {
+	select {
+	case p.network <- processorItem{block, nil}:
+		return true
+	default:
+		atomic.AddUint64(&p.dropped, 1)
+		return false
+	}
+}
+
+// AddLocal queues a block created by this node and waits for it to be
+// stored, returning the error from storing it.
+func (p *BlockProcessor) AddLocal(block blocks.Block) error {
+	result := make(chan error, 1)
+	p.local <- processorItem{block, result}
+	return <-result
+}
+
+// Dropped returns the number of network blocks dropped with a full queue.
+func (p *BlockProcessor) Dropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+// QueueSize returns the number of blocks waiting to be stored.
+func (p *BlockProcessor) QueueSize() int {
+	return len(p.local) + len(p.network)
+}
+
+func (p *BlockProcessor) Run() {
+	for {
+		var item processorItem
+		select {
+		case item = <-p.local:
+		default:
+			select {
+			case <-p.done:
+				return
+			case item = <-p.local:
+			case item = <-p.network:
+			}
+		}
+
+		p.process(p.fill([]processorItem{item}))
+	}
+}
+
+func (p *BlockProcessor) Stop() {
+	p.done <- true
+}
+
+// Adds whatever is already queued to a batch, local blocks first.
+func (p *BlockProcessor) fill(batch []processorItem) []processorItem {
+	for len(batch) < processorBatchSize {
+		select {
+		case item := <-p.local:
+			batch = append(batch, item)
+			continue
+		default:
+		}
+
+		select {
+		case item := <-p.local:
+			batch = append(batch, item)
+		case item := <-p.network:
+			batch = append(batch, item)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (p *BlockProcessor) process(batch []processorItem) {
+	stored := make([]blocks.Block, 0, len(batch))
+	results := make([]error, len(batch))
+	local := make(map[types.BlockHash]int)
+
+	w := newBlockWriter(func(written []blocks.Block, err error) {
+		if err == nil {
+			stored = append(stored, written...)
+			return
+		}
+		for _, block := range written {
+			if i, ok := local[block.Hash()]; ok {
+				results[i] = err
+			}
+		}
+	})
+	for i, item := range batch {
+		results[i] = w.process(item.block)
+		if item.result != nil && results[i] == nil {
+			local[item.block.Hash()] = i
+		}
+	}
+	w.close()
+
+	// Only report back once the blocks are committed
+	for i, item := range batch {
+		if item.result != nil {
+			item.result <- results[i]
+		}
+	}
+	if p.OnStored != nil {
+		for _, block := range stored {
+			p.OnStored(block)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package store
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/pkg/errors"
+)
+
+// Sideband is the data about a block that isn't part of the block
+// itself, worked out when it's stored so it doesn't need recomputing
+// from the rest of the chain.
+type Sideband struct {
+	Account types.Account
+	// Position in the account's chain, the open block is 1
+	Height uint64
+	// Balance of the account after the block
+	Balance uint128.Uint128
+	// The next block in the account's chain, zero for the frontier
+	Successor types.BlockHash
+	// Unix time the block was stored locally, zero for blocks stored
+	// before sideband existed
+	Timestamp uint64
+}
+
+const SidebandSize = 32 + 8 + 16 + 32 + 8
+
+func (s Sideband) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, SidebandSize)
+	data = append(data, s.Account[:]...)
+	data = appendUint64(data, s.Height)
+	data = append(data, s.Balance.GetBytes()...)
+	data = append(data, s.Successor[:]...)
+	return appendUint64(data, s.Timestamp), nil
+}
+
+func (s *Sideband) UnmarshalBinary(data []byte) error {
+	if len(data) != SidebandSize {
+		return errors.Errorf("Sideband must be %d bytes, got %d", SidebandSize, len(data))
+	}
+	s.Account = types.AccountFromBytes(data[0:32])
+	s.Height = binary.BigEndian.Uint64(data[32:40])
+	s.Balance = uint128.FromBytes(data[40:56])
+	s.Successor = types.BlockHashFromBytes(data[56:88])
+	s.Timestamp = binary.BigEndian.Uint64(data[88:96])
+	return nil
+}
+
+func appendUint64(data []byte, n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return append(data, b...)
+}
+
+func FetchSideband(hash types.BlockHash) *Sideband {
+	conn := getConn()
+	defer releaseConn(conn)
+	return fetchSideband(conn, hash)
+}
+
+func fetchSideband(conn *badger.Txn, hash types.BlockHash) *Sideband {
+	item, err := conn.Get(hash[:])
+	if err != nil {
+		return nil
+	}
+
+	blockItem := BlockItem{item}
+	return blockItem.Sideband()
+}
+
+// Works out the sideband for a new block from the sideband of its
+// previous block, and its source's for receives.
+func computeSideband(conn *badger.Txn, block blocks.Block) (*Sideband, error) {
+	sideband := &Sideband{Timestamp: uint64(time.Now().Unix())}
+
+	if b, ok := block.(*blocks.OpenBlock); ok {
+		sideband.Account = b.Account
+		sideband.Height = 1
+		if b.SourceHash == Conf.GenesisBlock.SourceHash {
+			sideband.Balance = blocks.GenesisAmount
+			return sideband, nil
+		}
+		amount, err := getSendAmountForHash(conn, b.SourceHash)
+		if err != nil {
+			return nil, err
+		}
+		sideband.Balance = amount
+		return sideband, nil
+	}
+
+	previous := fetchSideband(conn, block.PreviousBlockHash())
+	if previous == nil {
+		return nil, errors.New("Cannot find parent block")
+	}
+	sideband.Account = previous.Account
+	sideband.Height = previous.Height + 1
+
+	switch b := block.(type) {
+	case *blocks.SendBlock:
+		sideband.Balance = b.Balance
+	case *blocks.ReceiveBlock:
+		amount, err := getSendAmountForHash(conn, b.SourceHash)
+		if err != nil {
+			return nil, err
+		}
+		sideband.Balance = previous.Balance.Add(amount)
+	case *blocks.ChangeBlock:
+		sideband.Balance = previous.Balance
+	default:
+		return nil, errors.New("Unknown block type")
+	}
+	return sideband, nil
+}
+
+func getSendAmountForHash(conn *badger.Txn, hash types.BlockHash) (uint128.Uint128, error) {
+	send, ok := fetchBlock(conn, hash).(*blocks.SendBlock)
+	if !ok {
+		return uint128.Uint128{}, errors.New("Cannot find source send block")
+	}
+	return getSendAmount(conn, send), nil
+}
+
+// Points a stored block's sideband at its new successor.
+func setSuccessor(conn *badger.Txn, hash types.BlockHash, successor types.BlockHash) {
+	block := fetchBlock(conn, hash)
+	sideband := fetchSideband(conn, hash)
+	if block == nil || sideband == nil {
+		return
+	}
+
+	sideband.Successor = successor
+	writeBlock(conn, block, sideband)
+}
+
+// Works out sidebands from blocks held in memory rather than from what's
+// stored, for databases where sidebands are missing or can't be trusted.
+// Timestamps are left zero.
+type sidebandBuilder struct {
+	blocks     map[types.BlockHash]blocks.Block
+	successors map[types.BlockHash]types.BlockHash
+	sidebands  map[types.BlockHash]*Sideband
+}
+
+func newSidebandBuilder(stored map[types.BlockHash]blocks.Block) *sidebandBuilder {
+	successors := make(map[types.BlockHash]types.BlockHash)
+	for hash, block := range stored {
+		if block.Type() != blocks.Open {
+			successors[block.PreviousBlockHash()] = hash
+		}
+	}
+	return &sidebandBuilder{stored, successors, make(map[types.BlockHash]*Sideband)}
+}
+
+// Returns the blocks whose sidebands are needed to work out this block's:
+// its previous block and the block before its source send.
+func (s *sidebandBuilder) needs(block blocks.Block) ([]types.BlockHash, error) {
+	needs := make([]types.BlockHash, 0, 2)
+	var source types.BlockHash
+	switch b := block.(type) {
+	case *blocks.OpenBlock:
+		if b.SourceHash == Conf.GenesisBlock.SourceHash {
+			return needs, nil
+		}
+		source = b.SourceHash
+	case *blocks.ReceiveBlock:
+		needs = append(needs, b.PreviousHash)
+		source = b.SourceHash
+	default:
+		return append(needs, block.PreviousBlockHash()), nil
+	}
+
+	send, ok := s.blocks[source].(*blocks.SendBlock)
+	if !ok {
+		return nil, errors.Errorf("Cannot find source send block %s", source)
+	}
+	return append(needs, send.PreviousHash), nil
+}
+
+func (s *sidebandBuilder) sendAmount(hash types.BlockHash) uint128.Uint128 {
+	send := s.blocks[hash].(*blocks.SendBlock)
+	return s.sidebands[send.PreviousHash].Balance.Sub(send.Balance)
+}
+
+// Chains can be very long so blocks are worked through with a stack
+// rather than recursively.
+func (s *sidebandBuilder) sideband(hash types.BlockHash) (*Sideband, error) {
+	stack := []types.BlockHash{hash}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		if _, ok := s.sidebands[top]; ok {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		block, ok := s.blocks[top]
+		if !ok {
+			return nil, errors.Errorf("Cannot find block %s", top)
+		}
+
+		needs, err := s.needs(block)
+		if err != nil {
+			return nil, err
+		}
+		pending := false
+		for _, h := range needs {
+			if _, ok := s.sidebands[h]; !ok {
+				stack = append(stack, h)
+				pending = true
+			}
+		}
+		if pending {
+			continue
+		}
+
+		sideband := &Sideband{Successor: s.successors[top]}
+		switch b := block.(type) {
+		case *blocks.OpenBlock:
+			sideband.Account = b.Account
+			sideband.Height = 1
+			sideband.Balance = blocks.GenesisAmount
+			if b.SourceHash != Conf.GenesisBlock.SourceHash {
+				sideband.Balance = s.sendAmount(b.SourceHash)
+			}
+		default:
+			previous := s.sidebands[block.PreviousBlockHash()]
+			sideband.Account = previous.Account
+			sideband.Height = previous.Height + 1
+			sideband.Balance = previous.Balance
+			switch b := block.(type) {
+			case *blocks.SendBlock:
+				sideband.Balance = b.Balance
+			case *blocks.ReceiveBlock:
+				sideband.Balance = previous.Balance.Add(s.sendAmount(b.SourceHash))
+			}
+		}
+
+		s.sidebands[top] = sideband
+		stack = stack[:len(stack)-1]
+	}
+	return s.sidebands[hash], nil
+}
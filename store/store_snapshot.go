@@ -0,0 +1,405 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"io"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/golang/crypto/blake2b"
+	"github.com/pkg/errors"
+)
+
+// A snapshot is the magic bytes, the format version as a big endian
+// uint32 and the hash of the network's genesis block, followed by records
+// each starting with a tag byte. Block records hold the block's user meta
+// then its binary encoding, and come after the previous and source blocks
+// they depend on. Account records hold the account, frontier hash,
+// balance and height. An end record finishes the records, and the file
+// ends with a 32 byte blake2b checksum of everything before it.
+var snapshotMagic = []byte("NANOSNAP")
+
+const SnapshotVersion = 1
+
+const (
+	snapshotBlock   byte = 'b'
+	snapshotAccount byte = 'a'
+	snapshotEnd     byte = 'e'
+)
+
+const snapshotAccountSize = 32 + 32 + 16 + 8
+
+// A snapshot's entry for an account, checked against the ledger built
+// from its blocks on import.
+type snapshotAccountEntry struct {
+	Account  types.Account
+	Frontier types.BlockHash
+	Balance  uint128.Uint128
+	Height   uint64
+}
+
+func (a snapshotAccountEntry) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, snapshotAccountSize)
+	data = append(data, a.Account[:]...)
+	data = append(data, a.Frontier[:]...)
+	data = append(data, a.Balance.GetBytes()...)
+	return appendUint64(data, a.Height), nil
+}
+
+func (a *snapshotAccountEntry) UnmarshalBinary(data []byte) error {
+	if len(data) != snapshotAccountSize {
+		return errors.Errorf("Account entry must be %d bytes, got %d", snapshotAccountSize, len(data))
+	}
+	a.Account = types.AccountFromBytes(data[0:32])
+	a.Frontier = types.BlockHashFromBytes(data[32:64])
+	a.Balance = uint128.FromBytes(data[64:80])
+	a.Height = binary.BigEndian.Uint64(data[80:88])
+	return nil
+}
+
+func newChecksum() hash.Hash {
+	h, err := blake2b.New(32, nil)
+	if err != nil {
+		panic("Unable to create hash")
+	}
+	return h
+}
+
+// Blocks a block depends on, that have to be stored before it.
+func blockDependencies(block blocks.Block) []types.BlockHash {
+	switch b := block.(type) {
+	case *blocks.OpenBlock:
+		if b.SourceHash == Conf.GenesisBlock.SourceHash {
+			return nil
+		}
+		return []types.BlockHash{b.SourceHash}
+	case *blocks.ReceiveBlock:
+		return []types.BlockHash{b.PreviousHash, b.SourceHash}
+	}
+	return []types.BlockHash{block.PreviousBlockHash()}
+}
+
+// Iterates over every stored block, skipping the copies of open blocks
+// keyed on account.
+func eachBlock(conn *badger.Txn, fn func(blocks.Block) error) error {
+	it := conn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := BlockItem{it.Item()}
+		if len(item.Key()) != 32 {
+			continue
+		}
+		block := item.ToBlock()
+		if block == nil {
+			return errors.Errorf("Cannot decode block %X", item.Key())
+		}
+		if b, ok := block.(*blocks.OpenBlock); ok && bytes.Equal(item.Key(), b.Account[:]) {
+			continue
+		}
+		if err := fn(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Iterates over every account's open block.
+func eachAccount(conn *badger.Txn, fn func(*blocks.OpenBlock) error) error {
+	it := conn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := BlockItem{it.Item()}
+		if len(item.Key()) != 32 || item.UserMeta() != MetaOpen {
+			continue
+		}
+		open, ok := item.ToBlock().(*blocks.OpenBlock)
+		if ok && bytes.Equal(item.Key(), open.Account[:]) {
+			if err := fn(open); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ExportSnapshot writes the whole ledger to w.
+func ExportSnapshot(w io.Writer) error {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	checksum := newChecksum()
+	out := bufio.NewWriter(io.MultiWriter(w, checksum))
+
+	version := make([]byte, 4)
+	binary.BigEndian.PutUint32(version, SnapshotVersion)
+	genesis := Conf.GenesisBlock.Hash()
+	out.Write(snapshotMagic)
+	out.Write(version)
+	out.Write(genesis[:])
+
+	// Depth first from each block so that dependencies are written
+	// first, with an explicit stack as chains can be very long.
+	written := make(map[types.BlockHash]bool)
+	count := 0
+	err := eachBlock(conn, func(block blocks.Block) error {
+		stack := []blocks.Block{block}
+		for len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if written[top.Hash()] {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+
+			pending := false
+			for _, dependency := range blockDependencies(top) {
+				if written[dependency] {
+					continue
+				}
+				b := fetchBlock(conn, dependency)
+				if b == nil {
+					return errors.Errorf("Block %s is missing dependency %s", top.Hash(), dependency)
+				}
+				stack = append(stack, b)
+				pending = true
+			}
+			if pending {
+				continue
+			}
+
+			value, err := blocks.ToBinary(top)
+			if err != nil {
+				return err
+			}
+			out.WriteByte(snapshotBlock)
+			out.WriteByte(blockMeta(top.Type()))
+			out.Write(value)
+			written[top.Hash()] = true
+			stack = stack[:len(stack)-1]
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	accounts := 0
+	err = eachAccount(conn, func(open *blocks.OpenBlock) error {
+		frontier, _ := fetchFrontier(conn, open.Account)
+		sideband := fetchSideband(conn, frontier)
+		if sideband == nil {
+			return errors.Errorf("Cannot find frontier for %s", open.Account)
+		}
+		entry, _ := snapshotAccountEntry{open.Account, frontier, sideband.Balance, sideband.Height}.MarshalBinary()
+		out.WriteByte(snapshotAccount)
+		out.Write(entry)
+		accounts++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	out.WriteByte(snapshotEnd)
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	_, err = w.Write(checksum.Sum(nil))
+	if err == nil {
+		logger.Info("Exported snapshot", "blocks", count, "accounts", accounts)
+	}
+	return err
+}
+
+// Checks the trailing checksum, leaving r at the start of the snapshot.
+func verifySnapshotChecksum(r io.ReadSeeker) error {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size < int64(len(snapshotMagic)+4+32+1+32) {
+		return errors.New("Snapshot is too short")
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	checksum := newChecksum()
+	if _, err := io.CopyN(checksum, r, size-32); err != nil {
+		return err
+	}
+	expected := make([]byte, 32)
+	if _, err := io.ReadFull(r, expected); err != nil {
+		return err
+	}
+	if !bytes.Equal(expected, checksum.Sum(nil)) {
+		return errors.New("Snapshot checksum doesn't match")
+	}
+
+	_, err = r.Seek(0, io.SeekStart)
+	return err
+}
+
+// Checks a block from a snapshot as storeBlock would. Snapshot blocks are
+// in dependency order, so there's no unchecked table to fall back on.
+func validateSnapshotBlock(conn *badger.Txn, block blocks.Block) error {
+	if !blocks.ValidateBlockWork(block) {
+		return errInvalidWork
+	}
+	if isFork(conn, block) {
+		return errFork
+	}
+	return validateBlock(conn, block)
+}
+
+// ImportSnapshot loads a snapshot written by ExportSnapshot into a ledger
+// holding nothing but the genesis block. With validate set every block
+// is checked as if it had come from the network, otherwise the snapshot
+// is trusted and only the checksum and account table are checked. Blocks
+// are committed in batches, so if the import fails the data directory
+// should be discarded.
+func ImportSnapshot(r io.ReadSeeker, validate bool) (err error) {
+	if err := verifySnapshotChecksum(r); err != nil {
+		return err
+	}
+	in := bufio.NewReader(r)
+
+	header := make([]byte, len(snapshotMagic)+4+32)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:len(snapshotMagic)], snapshotMagic) {
+		return errors.New("Not a snapshot file")
+	}
+	header = header[len(snapshotMagic):]
+	if version := binary.BigEndian.Uint32(header); version > SnapshotVersion {
+		return errors.Errorf("Snapshot version %d is newer than this node supports", version)
+	}
+	genesis := Conf.GenesisBlock.Hash()
+	if !bytes.Equal(header[4:], genesis[:]) {
+		return errors.New("Snapshot is for a different network")
+	}
+
+	conn := getConn()
+	blockCount, _ := countBlocks(conn)
+	releaseConn(conn)
+	if blockCount != 1 {
+		return errors.New("Snapshots can only be imported into an empty ledger")
+	}
+
+	count, accounts := 0, 0
+	conn = getConn()
+	defer func() {
+		if err != nil {
+			discardConn(conn)
+			return
+		}
+		err = releaseConn(conn)
+	}()
+	for {
+		tag, err := in.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch tag {
+		case snapshotBlock:
+			meta, err := in.ReadByte()
+			if err != nil {
+				return err
+			}
+			t := metaBlockType(meta)
+			if blocks.BinarySize(t) == 0 {
+				return errors.Errorf("Unknown block type %d", meta)
+			}
+			value := make([]byte, blocks.BinarySize(t))
+			if _, err := io.ReadFull(in, value); err != nil {
+				return err
+			}
+			block, err := blocks.FromBinary(t, value)
+			if err != nil {
+				return err
+			}
+			if block.Hash() == genesis {
+				continue
+			}
+
+			err = importBlock(conn, block, validate)
+			if err != nil {
+				return errors.Wrapf(err, "could not import block %s", block.Hash())
+			}
+			count++
+			if count%migrateBatchSize == 0 {
+				err := releaseConn(conn)
+				conn = getConn()
+				if err != nil {
+					return err
+				}
+			}
+		case snapshotAccount:
+			value := make([]byte, snapshotAccountSize)
+			if _, err := io.ReadFull(in, value); err != nil {
+				return err
+			}
+			var entry snapshotAccountEntry
+			entry.UnmarshalBinary(value)
+			frontier, _ := fetchFrontier(conn, entry.Account)
+			sideband := fetchSideband(conn, frontier)
+			if sideband == nil || frontier != entry.Frontier || sideband.Balance != entry.Balance || sideband.Height != entry.Height {
+				return errors.Errorf("Account %s doesn't match the snapshot's blocks", entry.Account)
+			}
+			accounts++
+		case snapshotEnd:
+			logger.Info("Imported snapshot", "blocks", count, "accounts", accounts)
+			return nil
+		default:
+			return errors.Errorf("Unknown snapshot record %q", tag)
+		}
+	}
+}
+
+func importBlock(conn *badger.Txn, block blocks.Block, validate bool) error {
+	if _, missing := missingDependency(conn, block); missing {
+		return errors.New("Block comes before its dependencies")
+	}
+	if fetchBlock(conn, block.Hash()) != nil {
+		return errors.New("Block already stored")
+	}
+
+	if validate {
+		if err := validateSnapshotBlock(conn, block); err != nil {
+			return err
+		}
+	}
+
+	sideband, err := computeSideband(conn, block)
+	if err != nil {
+		return err
+	}
+	uncheckedStoreBlock(conn, block, sideband)
+	return nil
+}
+
+// CountBlocks returns the number of blocks and accounts in the ledger.
+func CountBlocks() (count int, accounts int) {
+	conn := getConn()
+	defer releaseConn(conn)
+	return countBlocks(conn)
+}
+
+func countBlocks(conn *badger.Txn) (count int, accounts int) {
+	eachBlock(conn, func(blocks.Block) error {
+		count++
+		return nil
+	})
+	eachAccount(conn, func(*blocks.OpenBlock) error {
+		accounts++
+		return nil
+	})
+	return count, accounts
+}
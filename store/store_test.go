@@ -1,10 +1,17 @@
 package store
 
 import (
+	"bytes"
+	"encoding/gob"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/address"
 	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
 )
 
 func TestInit(t *testing.T) {
@@ -18,7 +25,7 @@ func TestGenesisBalance(t *testing.T) {
 
 	block := FetchBlock(blocks.LiveGenesisBlockHash)
 
-	if GetBalance(block).String() != "ffffffffffffffffffffffffffffffff" {
+	if GetBalance(block).Hex() != "ffffffffffffffffffffffffffffffff" {
 		t.Errorf("Genesis block has invalid initial balance")
 	}
 	os.RemoveAll(TestConfigLive.Path)
@@ -34,3 +41,911 @@ func TestMissingBlock(t *testing.T) {
 	}
 	os.RemoveAll(TestConfig.Path)
 }
+
+func TestReceivable(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+
+	_, genesisKey, _ := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	destination := address.PubKeyToAddress(pub)
+	genesis := blocks.TestGenesisBlock
+	amount := uint128.FromInts(0, 5)
+
+	send := &blocks.SendBlock{genesis.Hash(), destination, blocks.GenesisAmount.Sub(amount), blocks.CommonBlock{}}
+	send.Work = blocks.GenerateWork(genesis)
+	send.Signature = send.Hash().Sign(genesisKey)
+	if err := StoreBlock(send); err != nil {
+		t.Fatalf("Failed to store send: %s", err)
+	}
+
+	receivable := FetchReceivable(destination)
+	if len(receivable) != 1 || receivable[0].Hash != send.Hash() || receivable[0].Amount != amount {
+		t.Fatalf("Send not in receivable index %v", receivable)
+	}
+
+	open := &blocks.OpenBlock{send.Hash(), destination, destination, blocks.CommonBlock{}}
+	open.Work = blocks.GenerateWorkForHash(types.BlockHash(destination))
+	open.Signature = open.Hash().Sign(priv)
+	if err := StoreBlock(open); err != nil {
+		t.Fatalf("Failed to store open: %s", err)
+	}
+
+	if len(FetchReceivable(destination)) != 0 {
+		t.Errorf("Send still receivable after open")
+	}
+
+	receive := &blocks.ReceiveBlock{open.Hash(), send.Hash(), blocks.CommonBlock{}}
+	receive.Work = blocks.GenerateWork(open)
+	receive.Signature = receive.Hash().Sign(priv)
+	if err := StoreBlock(receive); err != errUnreceivable {
+		t.Errorf("Expected second receive of send to be rejected, got %v", err)
+	}
+}
+
+func TestMigrateGob(t *testing.T) {
+	if globalConn != nil {
+		globalConn.Close()
+		globalConn = nil
+	}
+	os.RemoveAll(TestConfig.Path)
+	defer os.RemoveAll(TestConfig.Path)
+
+	// Blocks as they were gob encoded before the binary format
+	type legacyCommon struct {
+		Work      string
+		Signature string
+		Confirmed bool
+	}
+	type legacyOpen struct {
+		SourceHash     string
+		Representative string
+		Account        string
+		CommonBlock    legacyCommon
+	}
+	genesis := blocks.TestGenesisBlock
+	legacy := legacyOpen{
+		genesis.SourceHash.String(),
+		genesis.Representative.String(),
+		genesis.Account.String(),
+		legacyCommon{genesis.Work.String(), genesis.Signature.String(), false},
+	}
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(legacy)
+
+	opts := badger.DefaultOptions
+	opts.Dir = TestConfig.Path
+	opts.ValueDir = TestConfig.Path
+	db, err := badger.Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := genesis.Hash()
+	txn := db.NewTransaction(true)
+	txn.SetWithMeta(hash[:], buf.Bytes(), MetaOpen)
+	txn.SetWithMeta(genesis.Account[:], buf.Bytes(), MetaOpen)
+	if err := txn.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	Init(TestConfig)
+
+	block := FetchBlock(hash)
+	if block == nil || block.Hash() != hash || block.GetSignature() != genesis.Signature || block.GetWork() != genesis.Work {
+		t.Fatalf("Block wasn't migrated %v", block)
+	}
+	if FetchOpen(genesis.Account) == nil {
+		t.Errorf("Open block keyed on account wasn't migrated")
+	}
+	sideband := FetchSideband(hash)
+	if sideband == nil || sideband.Height != 1 || sideband.Balance != blocks.GenesisAmount {
+		t.Errorf("Migrated block missing sideband %v", sideband)
+	}
+
+	conn := getConn()
+	version, ok := readVersion(conn)
+	releaseConn(conn)
+	if !ok || version != DbVersion {
+		t.Errorf("Database version not updated, got %d", version)
+	}
+}
+
+func TestMigrateInterrupted(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	os.RemoveAll(TestConfig.Path)
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+
+	_, genesisKey, _ := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+
+	genesis := blocks.TestGenesisBlock
+	send := &blocks.SendBlock{genesis.Hash(), genesis.Account, blocks.GenesisAmount.Sub(uint128.FromInts(0, 1)), blocks.CommonBlock{}}
+	send.Work = blocks.GenerateWork(genesis)
+	send.Signature = send.Hash().Sign(genesisKey)
+	if err := StoreBlock(send); err != nil {
+		t.Fatalf("Failed to store send: %s", err)
+	}
+	genesisHash := genesis.Hash()
+	sendHash := send.Hash()
+
+	withoutSideband := func(conn *badger.Txn, key []byte, block blocks.Block) {
+		value, _ := blocks.ToBinary(block)
+		conn.SetWithMeta(key, value, blockMeta(block.Type()))
+	}
+	checkMigrated := func() {
+		sideband := FetchSideband(sendHash)
+		if sideband == nil || sideband.Height != 2 {
+			t.Errorf("Send sideband wasn't added %v", sideband)
+		}
+		sideband = FetchSideband(genesisHash)
+		if sideband == nil || sideband.Successor != sendHash {
+			t.Errorf("Genesis successor wasn't set %v", sideband)
+		}
+		if FetchOpen(genesis.Account) == nil {
+			t.Errorf("Open block keyed on account is missing")
+		}
+		if frontier, _ := FetchFrontier(genesis.Account); frontier != sendHash {
+			t.Errorf("Wrong frontier %s", frontier)
+		}
+		conn := getConn()
+		version, _ := readVersion(conn)
+		releaseConn(conn)
+		if version != DbVersion {
+			t.Errorf("Database version not updated, got %d", version)
+		}
+	}
+
+	// Stopped part way through converting gob blocks, with no version
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(gobBlock{
+		SourceHash:     genesis.SourceHash.String(),
+		Representative: genesis.Representative.String(),
+		Account:        genesis.Account.String(),
+		CommonBlock: struct {
+			Work      string
+			Signature string
+		}{genesis.Work.String(), genesis.Signature.String()},
+	})
+	conn := getConn()
+	withoutSideband(conn, genesisHash[:], genesis)
+	conn.SetWithMeta(genesis.Account[:], buf.Bytes(), MetaOpen)
+	withoutSideband(conn, sendHash[:], send)
+	conn.Delete(versionKey)
+	releaseConn(conn)
+
+	Init(TestConfig)
+	checkMigrated()
+
+	// Stopped part way through adding sidebands
+	conn = getConn()
+	conn.Delete(frontierKey(genesis.Account))
+	withoutSideband(conn, sendHash[:], send)
+	setSuccessor(conn, genesisHash, types.BlockHash{})
+	writeVersion(conn, dbVersionBinary)
+	releaseConn(conn)
+
+	Init(TestConfig)
+	checkMigrated()
+}
+
+func TestSideband(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+
+	_, genesisKey, _ := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	destination := address.PubKeyToAddress(pub)
+	genesis := blocks.TestGenesisBlock
+	amount := uint128.FromInts(0, 5)
+
+	send := &blocks.SendBlock{genesis.Hash(), destination, blocks.GenesisAmount.Sub(amount), blocks.CommonBlock{}}
+	send.Work = blocks.GenerateWork(genesis)
+	send.Signature = send.Hash().Sign(genesisKey)
+	if err := StoreBlock(send); err != nil {
+		t.Fatalf("Failed to store send: %s", err)
+	}
+	if err := StoreBlock(send); err == nil {
+		t.Errorf("Stored the same block twice")
+	}
+
+	open := &blocks.OpenBlock{send.Hash(), destination, destination, blocks.CommonBlock{}}
+	open.Work = blocks.GenerateWorkForHash(types.BlockHash(destination))
+	open.Signature = open.Hash().Sign(priv)
+	if err := StoreBlock(open); err != nil {
+		t.Fatalf("Failed to store open: %s", err)
+	}
+
+	sideband := FetchSideband(genesis.Hash())
+	if sideband.Height != 1 || sideband.Successor != send.Hash() || sideband.Account != genesis.Account {
+		t.Errorf("Wrong genesis sideband %v", sideband)
+	}
+	sideband = FetchSideband(send.Hash())
+	if sideband.Height != 2 || sideband.Balance != send.Balance || sideband.Successor != (types.BlockHash{}) {
+		t.Errorf("Wrong send sideband %v", sideband)
+	}
+	sideband = FetchSideband(open.Hash())
+	if sideband.Height != 1 || sideband.Balance != amount || sideband.Account != destination || sideband.Timestamp == 0 {
+		t.Errorf("Wrong open sideband %v", sideband)
+	}
+	if GetBalance(open) != amount {
+		t.Errorf("Wrong balance for open %s", GetBalance(open).String())
+	}
+	if FetchOpen(destination) == nil {
+		t.Errorf("Open block keyed on account missing")
+	}
+
+	// Sidebands survive reopening without being recomputed
+	Init(TestConfig)
+	if sideband := FetchSideband(genesis.Hash()); sideband == nil || sideband.Successor != send.Hash() {
+		t.Errorf("Genesis successor lost on reopen %v", sideband)
+	}
+}
+
+func TestRepresentativeWeight(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	os.RemoveAll(TestConfig.Path)
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+
+	_, genesisKey, _ := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, _ := address.GenerateKey()
+	representative := address.PubKeyToAddress(pub)
+	genesis := blocks.TestGenesisBlock
+	if RepresentativeWeight(genesis.Account) != blocks.GenesisAmount {
+		t.Errorf("Genesis doesn't hold all the weight")
+	}
+
+	amount := uint128.FromInts(0, 5)
+	send := &blocks.SendBlock{genesis.Hash(), representative, blocks.GenesisAmount.Sub(amount), blocks.CommonBlock{}}
+	send.Work = blocks.GenerateWork(genesis)
+	send.Signature = send.Hash().Sign(genesisKey)
+	change := &blocks.ChangeBlock{send.Hash(), representative, blocks.CommonBlock{}}
+	change.Work = blocks.GenerateWork(send)
+	change.Signature = change.Hash().Sign(genesisKey)
+	for _, block := range []blocks.Block{send, change} {
+		if err := StoreBlock(block); err != nil {
+			t.Fatalf("Failed to store %s: %s", block.Type(), err)
+		}
+	}
+	if !RepresentativeWeight(genesis.Account).IsZero() || RepresentativeWeight(representative) != send.Balance {
+		t.Errorf("Weight not moved by change, genesis has %s", RepresentativeWeight(genesis.Account))
+	}
+
+	// Blocks not signed by the account, or sending more than it has,
+	// don't move weight
+	_, other := address.GenerateKey()
+	forged := &blocks.ChangeBlock{change.Hash(), genesis.Account, blocks.CommonBlock{}}
+	forged.Work = blocks.GenerateWork(change)
+	forged.Signature = forged.Hash().Sign(other)
+	if err := StoreBlock(forged); err != errBadSignature {
+		t.Errorf("Expected forged change to be rejected, got %v", err)
+	}
+	overspend := &blocks.SendBlock{change.Hash(), representative, blocks.GenesisAmount, blocks.CommonBlock{}}
+	overspend.Work = blocks.GenerateWork(change)
+	overspend.Signature = overspend.Hash().Sign(genesisKey)
+	if err := StoreBlock(overspend); err != errNegativeSpend {
+		t.Errorf("Expected send increasing balance to be rejected, got %v", err)
+	}
+	if RepresentativeWeight(representative) != send.Balance {
+		t.Errorf("Weight moved by rejected blocks")
+	}
+
+	// Rebuilt when migrating from before the table
+	conn := getConn()
+	conn.Delete(representativeKey(genesis.Account))
+	writeWeight(conn, representative, uint128.Uint128{})
+	writeVersion(conn, dbVersionFrontier)
+	releaseConn(conn)
+	Init(TestConfig)
+	if RepresentativeWeight(representative) != send.Balance {
+		t.Errorf("Weight not rebuilt by migration")
+	}
+}
+
+func TestFork(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	os.RemoveAll(TestConfig.Path)
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+
+	_, genesisKey, _ := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	destination := address.PubKeyToAddress(pub)
+	genesis := blocks.TestGenesisBlock
+	send := &blocks.SendBlock{genesis.Hash(), destination, blocks.GenesisAmount.Sub(uint128.FromInts(0, 5)), blocks.CommonBlock{}}
+	send.Work = blocks.GenerateWork(genesis)
+	send.Signature = send.Hash().Sign(genesisKey)
+	if err := StoreBlock(send); err != nil {
+		t.Fatalf("Failed to store send: %s", err)
+	}
+
+	fork := &blocks.SendBlock{genesis.Hash(), destination, blocks.GenesisAmount.Sub(uint128.FromInts(0, 6)), blocks.CommonBlock{}}
+	fork.Work = send.Work
+	fork.Signature = fork.Hash().Sign(genesisKey)
+	if err := StoreBlock(fork); err != errFork {
+		t.Errorf("Expected fork of send to be rejected, got %v", err)
+	}
+	if sideband := FetchSideband(genesis.Hash()); sideband.Successor != send.Hash() {
+		t.Errorf("Genesis successor was overwritten %v", sideband)
+	}
+
+	open := &blocks.OpenBlock{send.Hash(), destination, destination, blocks.CommonBlock{}}
+	open.Work = blocks.GenerateWorkForHash(types.BlockHash(destination))
+	open.Signature = open.Hash().Sign(priv)
+	if err := StoreBlock(open); err != nil {
+		t.Fatalf("Failed to store open: %s", err)
+	}
+	forkOpen := &blocks.OpenBlock{send.Hash(), genesis.Account, destination, blocks.CommonBlock{}}
+	forkOpen.Work = open.Work
+	forkOpen.Signature = forkOpen.Hash().Sign(priv)
+	if err := StoreBlock(forkOpen); err != errFork {
+		t.Errorf("Expected second open to be rejected, got %v", err)
+	}
+	if FetchOpen(destination).Hash() != open.Hash() {
+		t.Errorf("Open block was overwritten")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+
+	_, genesisKey, _ := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	destination := address.PubKeyToAddress(pub)
+	genesis := blocks.TestGenesisBlock
+
+	// Two sends from genesis, the first opens the destination and the
+	// second is received on top of it
+	send1 := &blocks.SendBlock{genesis.Hash(), destination, blocks.GenesisAmount.Sub(uint128.FromInts(0, 5)), blocks.CommonBlock{}}
+	send1.Work = blocks.GenerateWork(genesis)
+	send1.Signature = send1.Hash().Sign(genesisKey)
+	send2 := &blocks.SendBlock{send1.Hash(), destination, send1.Balance.Sub(uint128.FromInts(0, 3)), blocks.CommonBlock{}}
+	send2.Work = blocks.GenerateWork(send1)
+	send2.Signature = send2.Hash().Sign(genesisKey)
+	open := &blocks.OpenBlock{send1.Hash(), destination, destination, blocks.CommonBlock{}}
+	open.Work = blocks.GenerateWorkForHash(types.BlockHash(destination))
+	open.Signature = open.Hash().Sign(priv)
+	receive := &blocks.ReceiveBlock{open.Hash(), send2.Hash(), blocks.CommonBlock{}}
+	receive.Work = blocks.GenerateWork(open)
+	receive.Signature = receive.Hash().Sign(priv)
+
+	for _, block := range []blocks.Block{send1, send2, open, receive} {
+		if err := StoreBlock(block); err != nil {
+			t.Fatalf("Failed to store %s: %s", block.Type(), err)
+		}
+	}
+
+	if frontier, ok := FetchFrontier(genesis.Account); !ok || frontier != send2.Hash() {
+		t.Errorf("Wrong genesis frontier %s", frontier)
+	}
+
+	history, err := FetchHistory(genesis.Account, HistoryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].Hash != send2.Hash() || history[2].Hash != genesis.Hash() {
+		t.Fatalf("Wrong genesis history %v", history)
+	}
+	if history[0].Account != destination || history[0].Amount != uint128.FromInts(0, 3) || history[0].Balance != send2.Balance {
+		t.Errorf("Wrong send entry %v", history[0])
+	}
+
+	history, err = FetchHistory(destination, HistoryOptions{Reverse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Type != blocks.Open || history[1].Type != blocks.Receive {
+		t.Fatalf("Wrong destination history %v", history)
+	}
+	if history[1].Account != genesis.Account || history[1].Amount != uint128.FromInts(0, 3) || history[1].Balance != uint128.FromInts(0, 8) {
+		t.Errorf("Wrong receive entry %v", history[1])
+	}
+
+	head := send1.Hash()
+	history, err = FetchHistory(genesis.Account, HistoryOptions{Head: &head, Count: 1})
+	if err != nil || len(history) != 1 || history[0].Hash != send1.Hash() {
+		t.Errorf("Wrong history from head %v %s", history, err)
+	}
+	history, err = FetchHistory(genesis.Account, HistoryOptions{Offset: 1, Count: 1, Reverse: true})
+	if err != nil || len(history) != 1 || history[0].Hash != send1.Hash() {
+		t.Errorf("Wrong history with offset %v %s", history, err)
+	}
+
+	open_hash := open.Hash()
+	if _, err := FetchHistory(genesis.Account, HistoryOptions{Head: &open_hash}); err == nil {
+		t.Errorf("Allowed head from another account")
+	}
+}
+
+func TestUnchecked(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+
+	_, genesisKey, _ := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	destination := address.PubKeyToAddress(pub)
+	genesis := blocks.TestGenesisBlock
+
+	send1 := &blocks.SendBlock{genesis.Hash(), destination, blocks.GenesisAmount.Sub(uint128.FromInts(0, 5)), blocks.CommonBlock{}}
+	send1.Work = blocks.GenerateWork(genesis)
+	send1.Signature = send1.Hash().Sign(genesisKey)
+	send2 := &blocks.SendBlock{send1.Hash(), destination, send1.Balance.Sub(uint128.FromInts(0, 3)), blocks.CommonBlock{}}
+	send2.Work = blocks.GenerateWork(send1)
+	send2.Signature = send2.Hash().Sign(genesisKey)
+	open := &blocks.OpenBlock{send1.Hash(), destination, destination, blocks.CommonBlock{}}
+	open.Work = blocks.GenerateWorkForHash(types.BlockHash(destination))
+	open.Signature = open.Hash().Sign(priv)
+	receive := &blocks.ReceiveBlock{open.Hash(), send2.Hash(), blocks.CommonBlock{}}
+	receive.Work = blocks.GenerateWork(open)
+	receive.Signature = receive.Hash().Sign(priv)
+
+	// The handler can use the store as it's called once it's released
+	var missing []types.BlockHash
+	MissingBlockHandler = func(hash types.BlockHash) {
+		UncheckedCount()
+		missing = append(missing, hash)
+	}
+	defer func() { MissingBlockHandler = nil }()
+
+	// send2 and open both wait on send1, receive waits on open then send2
+	for _, block := range []blocks.Block{receive, send2, open} {
+		if err := StoreBlock(block); err == nil {
+			t.Fatalf("Stored %s before its dependencies", block.Type())
+		}
+	}
+	if UncheckedCount() != 3 || len(FetchUnchecked(send1.Hash())) != 2 {
+		t.Fatalf("Wrong unchecked blocks, %d in table", UncheckedCount())
+	}
+	if len(missing) != 2 || missing[0] != open.Hash() || missing[1] != send1.Hash() {
+		t.Errorf("Wrong missing blocks requested %v", missing)
+	}
+
+	// Only blocks not asked for recently are requested again
+	missing = nil
+	PruneUnchecked()
+	if len(missing) != 0 {
+		t.Errorf("Missing blocks requested again too soon %v", missing)
+	}
+	UncheckedRequestInterval = 0
+	PruneUnchecked()
+	if len(missing) != 2 {
+		t.Errorf("Missing blocks not requested again %v", missing)
+	}
+	UncheckedRequestInterval = 15 * time.Minute
+
+	if err := StoreBlock(send1); err != nil {
+		t.Fatalf("Failed to store send: %s", err)
+	}
+	for _, block := range []blocks.Block{send2, open, receive} {
+		if FetchBlock(block.Hash()) == nil {
+			t.Errorf("Dependent %s not stored", block.Type())
+		}
+	}
+	if UncheckedCount() != 0 {
+		t.Errorf("Unchecked table not emptied, %d left", UncheckedCount())
+	}
+
+	// Unchecked blocks are kept across restarts
+	orphan := &blocks.ChangeBlock{types.BlockHash{1}, destination, blocks.CommonBlock{}}
+	orphan.Work = blocks.GenerateWorkForHash(orphan.PreviousHash)
+	StoreBlock(orphan)
+	Init(TestConfig)
+	if UncheckedCount() != 1 {
+		t.Errorf("Unchecked table lost on restart")
+	}
+
+	UncheckedMaxCount = 1
+	other := &blocks.ChangeBlock{types.BlockHash{2}, destination, blocks.CommonBlock{}}
+	other.Work = blocks.GenerateWorkForHash(other.PreviousHash)
+	StoreBlock(other)
+	if UncheckedCount() != 1 || len(FetchUnchecked(other.PreviousHash)) != 1 {
+		t.Errorf("Unchecked table grew past its limit")
+	}
+	if len(FetchUnchecked(orphan.PreviousHash)) != 0 {
+		t.Errorf("Oldest unchecked block wasn't dropped")
+	}
+	UncheckedMaxCount = 65536
+
+	UncheckedMaxAge = -time.Second
+	if PruneUnchecked() != 1 || UncheckedCount() != 0 {
+		t.Errorf("Expired blocks not pruned")
+	}
+	UncheckedMaxAge = 4 * time.Hour
+}
+
+func TestBlockProcessor(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+
+	_, genesisKey, _ := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+
+	// A chain of changes from genesis, long enough that storing the
+	// dependents recursively would go deep
+	genesis := blocks.TestGenesisBlock
+	chain := make([]blocks.Block, 0)
+	var previous blocks.Block = genesis
+	for i := 0; i < 500; i++ {
+		change := &blocks.ChangeBlock{previous.Hash(), genesis.Account, blocks.CommonBlock{}}
+		change.Work = blocks.GenerateWork(previous)
+		change.Signature = change.Hash().Sign(genesisKey)
+		chain = append(chain, change)
+		previous = change
+	}
+
+	stored := make(chan blocks.Block, len(chain))
+	p := NewBlockProcessor(len(chain), func(b blocks.Block) { stored <- b })
+	defer p.Stop()
+
+	for i := len(chain) - 1; i > 0; i-- {
+		if !p.Add(chain[i]) {
+			t.Fatalf("Block dropped with space in the queue")
+		}
+	}
+	if err := p.AddLocal(chain[0]); err != nil {
+		t.Fatalf("Failed to store local block: %s", err)
+	}
+	for range chain {
+		select {
+		case <-stored:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for blocks to be stored")
+		}
+	}
+
+	if frontier, _ := FetchFrontier(genesis.Account); frontier != previous.Hash() {
+		t.Errorf("Chain not stored, frontier %s", frontier)
+	}
+	if err := p.AddLocal(chain[0]); err == nil {
+		t.Errorf("No error storing a block twice")
+	}
+
+	// A long cascade of dependents is split across transactions
+	chain = chain[:0]
+	for i := 0; i < processorBatchSize+10; i++ {
+		change := &blocks.ChangeBlock{previous.Hash(), genesis.Account, blocks.CommonBlock{}}
+		change.Work = blocks.GenerateWork(previous)
+		change.Signature = change.Hash().Sign(genesisKey)
+		chain = append(chain, change)
+		previous = change
+	}
+	for _, block := range chain[1:] {
+		StoreBlock(block)
+	}
+	var commits []int
+	w := newBlockWriter(func(written []blocks.Block, err error) {
+		if err != nil {
+			t.Errorf("Failed to commit: %s", err)
+		}
+		commits = append(commits, len(written))
+	})
+	if err := w.process(chain[0]); err != nil {
+		t.Fatal(err)
+	}
+	w.close()
+	if len(commits) != 2 || commits[0] != processorBatchSize || commits[1] != 10 {
+		t.Errorf("Wrong commits %v", commits)
+	}
+
+	// Network blocks are dropped rather than waiting on a full queue
+	full := &BlockProcessor{nil, make(chan processorItem, 1), make(chan processorItem, 1), make(chan bool), 0}
+	if !full.Add(genesis) || full.Add(genesis) || full.Dropped() != 1 {
+		t.Errorf("Full queue didn't drop block")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+
+	_, genesisKey, _ := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	destination := address.PubKeyToAddress(pub)
+	genesis := blocks.TestGenesisBlock
+
+	send := &blocks.SendBlock{genesis.Hash(), destination, blocks.GenesisAmount.Sub(uint128.FromInts(0, 5)), blocks.CommonBlock{}}
+	send.Work = blocks.GenerateWork(genesis)
+	send.Signature = send.Hash().Sign(genesisKey)
+	open := &blocks.OpenBlock{send.Hash(), destination, destination, blocks.CommonBlock{}}
+	open.Work = blocks.GenerateWorkForHash(types.BlockHash(destination))
+	open.Signature = open.Hash().Sign(priv)
+	change := &blocks.ChangeBlock{open.Hash(), genesis.Account, blocks.CommonBlock{}}
+	change.Work = blocks.GenerateWork(open)
+	change.Signature = change.Hash().Sign(priv)
+	for _, block := range []blocks.Block{send, open, change} {
+		if err := StoreBlock(block); err != nil {
+			t.Fatalf("Failed to store %s: %s", block.Type(), err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := ExportSnapshot(&buf); err != nil {
+		t.Fatalf("Failed to export: %s", err)
+	}
+	snapshot := buf.Bytes()
+
+	if err := ImportSnapshot(bytes.NewReader(snapshot), false); err == nil {
+		t.Errorf("Imported into a ledger that isn't empty")
+	}
+
+	os.RemoveAll(TestConfig.Path)
+	Init(TestConfig)
+	if err := ImportSnapshot(bytes.NewReader(snapshot), false); err != nil {
+		t.Fatalf("Failed to import: %s", err)
+	}
+	if frontier, _ := FetchFrontier(destination); frontier != change.Hash() {
+		t.Errorf("Wrong frontier after import %s", frontier)
+	}
+	if sideband := FetchSideband(change.Hash()); sideband == nil || sideband.Balance != uint128.FromInts(0, 5) || sideband.Height != 2 {
+		t.Errorf("Wrong sideband after import %v", sideband)
+	}
+
+	// StoreBlock won't take unsigned blocks, so write them as a trusted
+	// import would and export them again
+	exportUnsigned := func(unsigned ...blocks.Block) []byte {
+		os.RemoveAll(TestConfig.Path)
+		Init(TestConfig)
+		conn := getConn()
+		for _, block := range unsigned {
+			if err := importBlock(conn, block, false); err != nil {
+				t.Fatalf("Failed to write %s: %s", block.Type(), err)
+			}
+		}
+		releaseConn(conn)
+		var buf bytes.Buffer
+		ExportSnapshot(&buf)
+		os.RemoveAll(TestConfig.Path)
+		Init(TestConfig)
+		return buf.Bytes()
+	}
+	signature := send.Signature
+	send.Signature, open.Signature, change.Signature = types.Signature{}, types.Signature{}, types.Signature{}
+
+	// Test blocks aren't signed
+	unsigned := exportUnsigned(send, open, change)
+	if err := ImportSnapshot(bytes.NewReader(unsigned), true); err == nil {
+		t.Errorf("Imported unsigned blocks with validation")
+	}
+
+	// Blocks before the one that failed aren't committed
+	send.Signature = signature
+	unsigned = exportUnsigned(send, open, change)
+	if err := ImportSnapshot(bytes.NewReader(unsigned), true); err == nil {
+		t.Errorf("Imported unsigned open with validation")
+	}
+	if count, _ := CountBlocks(); count != 1 {
+		t.Errorf("Failed import left %d blocks", count)
+	}
+
+	os.RemoveAll(TestConfig.Path)
+	Init(TestConfig)
+	corrupt := append([]byte{}, snapshot...)
+	corrupt[len(snapshotMagic)+40] ^= 1
+	if err := ImportSnapshot(bytes.NewReader(corrupt), false); err == nil {
+		t.Errorf("Imported snapshot with bad checksum")
+	}
+}
+
+func TestValidateSnapshotBlock(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	os.RemoveAll(TestConfig.Path)
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+
+	_, genesisKey, _ := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	destination := address.PubKeyToAddress(pub)
+	otherPub, otherPriv := address.GenerateKey()
+	other := address.PubKeyToAddress(otherPub)
+	genesis := blocks.TestGenesisBlock
+
+	send := &blocks.SendBlock{genesis.Hash(), destination, blocks.GenesisAmount.Sub(uint128.FromInts(0, 5)), blocks.CommonBlock{}}
+	send.Work = blocks.GenerateWork(genesis)
+	send.Signature = send.Hash().Sign(genesisKey)
+	conn := getConn()
+	defer releaseConn(conn)
+	if err := importBlock(conn, send, true); err != nil {
+		t.Fatalf("Failed to import send: %s", err)
+	}
+
+	fork := &blocks.SendBlock{genesis.Hash(), other, send.Balance, blocks.CommonBlock{}}
+	fork.Work = send.Work
+	fork.Signature = fork.Hash().Sign(genesisKey)
+	if err := validateSnapshotBlock(conn, fork); err != errFork {
+		t.Errorf("Expected fork to be rejected, got %v", err)
+	}
+
+	stolen := &blocks.OpenBlock{send.Hash(), other, other, blocks.CommonBlock{}}
+	stolen.Work = blocks.GenerateWorkForHash(types.BlockHash(other))
+	stolen.Signature = stolen.Hash().Sign(otherPriv)
+	if err := validateSnapshotBlock(conn, stolen); err == nil {
+		t.Errorf("Opened from a send to another account")
+	}
+
+	open := &blocks.OpenBlock{send.Hash(), destination, destination, blocks.CommonBlock{}}
+	open.Work = blocks.GenerateWorkForHash(types.BlockHash(destination))
+	open.Signature = open.Hash().Sign(priv)
+	if err := importBlock(conn, open, true); err != nil {
+		t.Fatalf("Failed to import open: %s", err)
+	}
+
+	receive := &blocks.ReceiveBlock{open.Hash(), send.Hash(), blocks.CommonBlock{}}
+	receive.Work = blocks.GenerateWork(open)
+	receive.Signature = receive.Hash().Sign(priv)
+	if err := validateSnapshotBlock(conn, receive); err == nil {
+		t.Errorf("Received a send twice")
+	}
+}
+
+func TestCheckLedger(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+
+	_, genesisKey, _ := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	destination := address.PubKeyToAddress(pub)
+	genesis := blocks.TestGenesisBlock
+	amount := uint128.FromInts(0, 5)
+
+	send := &blocks.SendBlock{genesis.Hash(), destination, blocks.GenesisAmount.Sub(amount), blocks.CommonBlock{}}
+	send.Work = blocks.GenerateWork(genesis)
+	send.Signature = send.Hash().Sign(genesisKey)
+	unreceived := &blocks.SendBlock{send.Hash(), destination, send.Balance.Sub(amount), blocks.CommonBlock{}}
+	unreceived.Work = blocks.GenerateWork(send)
+	unreceived.Signature = unreceived.Hash().Sign(genesisKey)
+	open := &blocks.OpenBlock{send.Hash(), destination, destination, blocks.CommonBlock{}}
+	open.Work = blocks.GenerateWorkForHash(types.BlockHash(destination))
+	open.Signature = open.Hash().Sign(priv)
+	for _, block := range []blocks.Block{send, unreceived, open} {
+		if err := StoreBlock(block); err != nil {
+			t.Fatalf("Failed to store %s: %s", block.Type(), err)
+		}
+	}
+
+	result := CheckLedger(false)
+	if len(result.Issues) != 0 || result.Blocks != 4 || result.Accounts != 2 {
+		t.Fatalf("Problems in consistent ledger %v", result.Issues)
+	}
+	if result.Weights[destination] != amount || result.Weights[genesis.Account] != unreceived.Balance {
+		t.Errorf("Wrong representative weights %v", result.Weights)
+	}
+	if RepresentativeWeight(destination) != amount || RepresentativeWeight(genesis.Account) != unreceived.Balance {
+		t.Errorf("Stored weights don't match the ledger")
+	}
+
+	// Break each derived table
+	conn := getConn()
+	conn.Delete(receivableKey(destination, unreceived.Hash()))
+	conn.Delete(destination[:])
+	sideband := fetchSideband(conn, send.Hash())
+	sideband.Balance = amount
+	writeBlock(conn, send, sideband)
+	writeFrontier(conn, genesis.Account, send.Hash())
+	writeWeight(conn, destination, uint128.Uint128{})
+	releaseConn(conn)
+
+	if result := CheckLedger(false); len(result.Issues) != 5 {
+		t.Errorf("Expected 5 problems, found %v", result.Issues)
+	}
+	for _, issue := range CheckLedger(true).Issues {
+		if !issue.Repaired {
+			t.Errorf("Problem not repaired: %s", issue)
+		}
+	}
+	if result := CheckLedger(false); len(result.Issues) != 0 {
+		t.Errorf("Problems left after repair %v", result.Issues)
+	}
+	frontier, _ := FetchFrontier(genesis.Account)
+	if FetchOpen(destination) == nil || len(FetchReceivable(destination)) != 1 || frontier != unreceived.Hash() || RepresentativeWeight(destination) != amount {
+		t.Errorf("Derived tables not rebuilt")
+	}
+
+	// Receiving something that isn't a send is reported
+	conn = getConn()
+	bogus := &blocks.ReceiveBlock{PreviousHash: open.Hash(), SourceHash: open.Hash()}
+	writeBlock(conn, bogus, &Sideband{Account: destination, Height: 2, Balance: amount})
+	releaseConn(conn)
+	if result := CheckLedger(false); len(result.Issues) == 0 {
+		t.Errorf("Receive of an open block not reported")
+	}
+}
+
+func TestBlockMetrics(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+
+	_, genesisKey, _ := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	destination := address.PubKeyToAddress(pub)
+	genesis := blocks.TestGenesisBlock
+
+	send := &blocks.SendBlock{genesis.Hash(), destination, blocks.GenesisAmount.Sub(uint128.FromInts(0, 5)), blocks.CommonBlock{}}
+	send.Work = blocks.GenerateWork(genesis)
+	send.Signature = send.Hash().Sign(genesisKey)
+	open := &blocks.OpenBlock{send.Hash(), destination, destination, blocks.CommonBlock{}}
+	open.Work = blocks.GenerateWorkForHash(types.BlockHash(destination))
+	open.Signature = open.Hash().Sign(priv)
+
+	count, accounts := LedgerCounts()
+	if count != 1 || accounts != 1 {
+		t.Fatalf("Wrong ledger counts %d blocks %d accounts", count, accounts)
+	}
+
+	processed := blocksProcessed.Value("open")
+	gaps := blocksRejected.Value("gap_source")
+	old := blocksRejected.Value("old")
+
+	StoreBlock(open)
+	StoreBlock(send)
+	StoreBlock(send)
+
+	if blocksRejected.Value("gap_source") != gaps+1 || blocksRejected.Value("old") != old+1 {
+		t.Errorf("Rejected blocks not counted by reason")
+	}
+	if blocksProcessed.Value("open") != processed+1 {
+		t.Errorf("Unchecked open not counted once stored")
+	}
+
+	count, accounts = LedgerCounts()
+	if count != 3 || accounts != 2 {
+		t.Errorf("Ledger counts not updated, %d blocks %d accounts", count, accounts)
+	}
+	if c, a := CountBlocks(); c != count || a != accounts {
+		t.Errorf("Ledger counts %d %d don't match ledger %d %d", count, accounts, c, a)
+	}
+
+	// Blocks in a discarded transaction aren't counted
+	conn := getConn()
+	change := &blocks.ChangeBlock{PreviousHash: open.Hash(), Representative: destination}
+	uncheckedStoreBlock(conn, change, &Sideband{Account: destination, Height: 2, Balance: uint128.FromInts(0, 5)})
+	discardConn(conn)
+	if c, _ := LedgerCounts(); c != count {
+		t.Errorf("Discarded block counted, %d blocks", c)
+	}
+}
+
+func TestUncheckedKeyClash(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+
+	_, genesisKey, _ := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+
+	// The open block is also stored under the account, which starts with
+	// the unchecked prefix
+	pub, priv := address.GenerateKey()
+	for pub[0] != 'u' {
+		pub, priv = address.GenerateKey()
+	}
+	destination := address.PubKeyToAddress(pub)
+	genesis := blocks.TestGenesisBlock
+	send := &blocks.SendBlock{genesis.Hash(), destination, blocks.GenesisAmount.Sub(uint128.FromInts(0, 5)), blocks.CommonBlock{}}
+	send.Work = blocks.GenerateWork(genesis)
+	send.Signature = send.Hash().Sign(genesisKey)
+	open := &blocks.OpenBlock{send.Hash(), destination, destination, blocks.CommonBlock{}}
+	open.Work = blocks.GenerateWorkForHash(types.BlockHash(destination))
+	open.Signature = open.Hash().Sign(priv)
+
+	for _, block := range []blocks.Block{send, open} {
+		if err := StoreBlock(block); err != nil {
+			t.Fatalf("Failed to store %s: %s", block.Type(), err)
+		}
+	}
+
+	Init(TestConfig)
+	if UncheckedCount() != 0 {
+		t.Errorf("Account key counted as unchecked, %d in table", UncheckedCount())
+	}
+	if PruneUnchecked() != 0 || FetchOpen(destination) == nil {
+		t.Errorf("Account key pruned as unchecked")
+	}
+}
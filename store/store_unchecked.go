@@ -0,0 +1,365 @@
+package store
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+)
+
+// Blocks that can't be stored yet because their previous or source block
+// is missing are kept in the unchecked table until it arrives. Keys are
+// this prefix, the hash of the missing block and the hash of the waiting
+// block, so any number of blocks can wait on the same dependency. Values
+// are the unix time the block was added followed by its binary encoding,
+// with the block type in the user meta as for stored blocks.
+var uncheckedPrefix = []byte{'u'}
+
+// Block and account keys are 32 bytes and can start with the prefix too,
+// so unchecked keys are also told apart by their length.
+const uncheckedKeySize = 1 + 64
+
+// The unchecked table is also indexed by age, under this prefix followed
+// by the unix time the block was added and the rest of its unchecked key,
+// so the oldest blocks are found without reading the whole table.
+var uncheckedAgePrefix = []byte{'t'}
+
+const uncheckedAgeKeySize = 1 + 8 + 64
+
+// Limits on the unchecked table. Blocks older than UncheckedMaxAge are
+// dropped by PruneUnchecked, and the oldest block is dropped to make room
+// for a new one while the table holds UncheckedMaxCount.
+var (
+	UncheckedMaxAge   = 4 * time.Hour
+	UncheckedMaxCount = 65536
+)
+
+// A block unchecked blocks are waiting on is asked for when the first of
+// them arrives, and again by PruneUnchecked once this long has passed.
+var UncheckedRequestInterval = 15 * time.Minute
+
+// Unchecked keys are read this many at a time by PruneUnchecked, each
+// page in its own transaction.
+const uncheckedPageSize = 1000
+
+// Called with the hash of a block that unchecked blocks are waiting on, so
+// the node can ask peers for it. It's called once the store has been
+// released, so it's free to use the store.
+var MissingBlockHandler func(hash types.BlockHash)
+
+var uncheckedCount int
+
+// Blocks found missing while the connection was held, for releaseConn to
+// pass to MissingBlockHandler. Guarded by the connection lock.
+var missingBlocks []types.BlockHash
+
+// When each block unchecked blocks are waiting on was last asked for.
+// Guarded by the connection lock.
+var uncheckedRequests = make(map[types.BlockHash]time.Time)
+
+func requestMissing(hashes []types.BlockHash) {
+	if MissingBlockHandler == nil {
+		return
+	}
+	for _, hash := range hashes {
+		MissingBlockHandler(hash)
+	}
+}
+
+// Queues a request for a missing block unless it was asked for within
+// UncheckedRequestInterval.
+func requestDependency(dependency types.BlockHash, now time.Time) {
+	if last, ok := uncheckedRequests[dependency]; ok && now.Sub(last) < UncheckedRequestInterval {
+		return
+	}
+	uncheckedRequests[dependency] = now
+	missingBlocks = append(missingBlocks, dependency)
+}
+
+func uncheckedKey(dependency types.BlockHash, hash types.BlockHash) []byte {
+	key := append([]byte{}, uncheckedPrefix...)
+	key = append(key, dependency[:]...)
+	return append(key, hash[:]...)
+}
+
+func uncheckedAgeKey(added time.Time, key []byte) []byte {
+	ageKey := appendUint64(append([]byte{}, uncheckedAgePrefix...), uint64(added.Unix()))
+	return append(ageKey, key[len(uncheckedPrefix):]...)
+}
+
+func uncheckedDependencyPrefix(dependency types.BlockHash) []byte {
+	return append(append([]byte{}, uncheckedPrefix...), dependency[:]...)
+}
+
+// Returns the first block that needs to be stored before this one can be.
+func missingDependency(conn *badger.Txn, block blocks.Block) (types.BlockHash, bool) {
+	var source types.BlockHash
+	switch b := block.(type) {
+	case *blocks.OpenBlock:
+		if b.SourceHash == Conf.GenesisBlock.SourceHash {
+			return types.BlockHash{}, false
+		}
+		source = b.SourceHash
+	case *blocks.ReceiveBlock:
+		source = b.SourceHash
+	}
+
+	if block.Type() != blocks.Open && fetchBlock(conn, block.PreviousBlockHash()) == nil {
+		return block.PreviousBlockHash(), true
+	}
+	if source != (types.BlockHash{}) && fetchBlock(conn, source) == nil {
+		return source, true
+	}
+	return types.BlockHash{}, false
+}
+
+func UncheckedCount() int {
+	conn := getConn()
+	defer releaseConn(conn)
+	return uncheckedCount
+}
+
+// Counts the unchecked blocks, and adds any missing from the age index as
+// databases from before it have none.
+func indexUnchecked(conn *badger.Txn) int {
+	items := fetchUnchecked(conn, uncheckedPrefix)
+	for _, item := range items {
+		ageKey := uncheckedAgeKey(item.added, item.key)
+		if _, err := conn.Get(ageKey); err == nil {
+			continue
+		}
+		if err := conn.Set(ageKey, nil); err != nil {
+			panic(err)
+		}
+	}
+	return len(items)
+}
+
+// FetchUnchecked returns the blocks waiting on a missing block.
+func FetchUnchecked(dependency types.BlockHash) []blocks.Block {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	result := make([]blocks.Block, 0)
+	for _, item := range fetchUnchecked(conn, uncheckedDependencyPrefix(dependency)) {
+		result = append(result, item.block)
+	}
+	return result
+}
+
+type uncheckedItem struct {
+	key   []byte
+	added time.Time
+	block blocks.Block
+}
+
+func fetchUnchecked(conn *badger.Txn, prefix []byte) []uncheckedItem {
+	result := make([]uncheckedItem, 0)
+	it := conn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		if len(item.Key()) != uncheckedKeySize {
+			continue
+		}
+		value, err := item.Value()
+		if err != nil || len(value) < 8 {
+			continue
+		}
+		block, err := blocks.FromBinary(metaBlockType(item.UserMeta()), value[8:])
+		if err != nil {
+			continue
+		}
+		result = append(result, uncheckedItem{
+			append([]byte{}, item.Key()...),
+			time.Unix(int64(binary.BigEndian.Uint64(value)), 0),
+			block,
+		})
+	}
+	return result
+}
+
+func addUnchecked(conn *badger.Txn, dependency types.BlockHash, block blocks.Block) {
+	key := uncheckedKey(dependency, block.Hash())
+	if _, err := conn.Get(key); err == nil {
+		return
+	}
+
+	value, err := blocks.ToBinary(block)
+	if err != nil {
+		return
+	}
+
+	for uncheckedCount >= UncheckedMaxCount {
+		if !dropOldestUnchecked(conn) {
+			break
+		}
+	}
+
+	added := time.Now()
+	value = append(appendUint64(nil, uint64(added.Unix())), value...)
+	err = conn.SetWithMeta(key, value, blockMeta(block.Type()))
+	if err != nil {
+		panic(err)
+	}
+	err = conn.Set(uncheckedAgeKey(added, key), nil)
+	if err != nil {
+		panic(err)
+	}
+
+	uncheckedCount++
+	logger.Debug("Added block to unchecked table", "hash", block.Hash(), "dependency", dependency, "unchecked", uncheckedCount)
+
+	requestDependency(dependency, added)
+}
+
+// Returns age keys of unchecked blocks, oldest first, stopping at the
+// first added at or after before unless it's zero.
+func oldestUnchecked(conn *badger.Txn, before time.Time, limit int) [][]byte {
+	result := make([][]byte, 0)
+	it := conn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(uncheckedAgePrefix); it.ValidForPrefix(uncheckedAgePrefix) && len(result) < limit; it.Next() {
+		ageKey := it.Item().Key()
+		if len(ageKey) != uncheckedAgeKeySize {
+			continue
+		}
+		added := int64(binary.BigEndian.Uint64(ageKey[len(uncheckedAgePrefix):]))
+		if !before.IsZero() && added >= before.Unix() {
+			break
+		}
+		result = append(result, append([]byte{}, ageKey...))
+	}
+	return result
+}
+
+// Deletes an unchecked block by its age key, returning whether it was
+// still in the table.
+func deleteUnchecked(conn *badger.Txn, ageKey []byte) bool {
+	conn.Delete(ageKey)
+	key := append(append([]byte{}, uncheckedPrefix...), ageKey[len(uncheckedAgePrefix)+8:]...)
+	if _, err := conn.Get(key); err != nil {
+		return false
+	}
+	conn.Delete(key)
+	uncheckedCount--
+	return true
+}
+
+// Drops the oldest unchecked block to make room for another, returning
+// false if there was none to drop.
+func dropOldestUnchecked(conn *badger.Txn) bool {
+	for {
+		oldest := oldestUnchecked(conn, time.Time{}, 1)
+		if len(oldest) == 0 {
+			return false
+		}
+		if deleteUnchecked(conn, oldest[0]) {
+			logger.Limit(time.Minute).Warn("Unchecked table full, dropped oldest block", "hash", types.BlockHashFromBytes(oldest[0][len(oldest[0])-32:]))
+			return true
+		}
+	}
+}
+
+// Removes and returns the blocks that were waiting on a block which has
+// now been stored.
+func takeUnchecked(conn *badger.Txn, dependency types.BlockHash) []blocks.Block {
+	result := make([]blocks.Block, 0)
+	for _, item := range fetchUnchecked(conn, uncheckedDependencyPrefix(dependency)) {
+		conn.Delete(item.key)
+		conn.Delete(uncheckedAgeKey(item.added, item.key))
+		uncheckedCount--
+		result = append(result, item.block)
+	}
+	delete(uncheckedRequests, dependency)
+	return result
+}
+
+// PruneUnchecked drops unchecked blocks older than UncheckedMaxAge and
+// asks again for the blocks the rest are waiting on, unless they were
+// asked for within UncheckedRequestInterval. The table is read a page at
+// a time, so the store isn't held while all of it is read. It returns the
+// number of blocks dropped.
+func PruneUnchecked() int {
+	dropped := 0
+	for {
+		conn := getConn()
+		n, more := pruneUnchecked(conn)
+		releaseConn(conn)
+		dropped += n
+		if !more {
+			break
+		}
+	}
+	if dropped > 0 {
+		conn := getConn()
+		logger.Info("Dropped expired blocks from unchecked table", "dropped", dropped, "unchecked", uncheckedCount)
+		releaseConn(conn)
+	}
+
+	now := time.Now()
+	waiting := make(map[types.BlockHash]bool)
+	start := uncheckedPrefix
+	for start != nil {
+		conn := getConn()
+		var dependencies []types.BlockHash
+		dependencies, start = uncheckedDependencies(conn, start)
+		for _, dependency := range dependencies {
+			if !waiting[dependency] {
+				waiting[dependency] = true
+				requestDependency(dependency, now)
+			}
+		}
+		releaseConn(conn)
+	}
+
+	// Forget requests for blocks nothing waits on any more, unless they
+	// were made while the table was being read
+	conn := getConn()
+	for dependency, last := range uncheckedRequests {
+		if !waiting[dependency] && last.Before(now) {
+			delete(uncheckedRequests, dependency)
+		}
+	}
+	releaseConn(conn)
+	return dropped
+}
+
+// Drops up to a page of unchecked blocks older than UncheckedMaxAge,
+// returning the number dropped and whether there may be more.
+func pruneUnchecked(conn *badger.Txn) (int, bool) {
+	cutoff := time.Now().Add(-UncheckedMaxAge)
+
+	dropped := 0
+	expired := oldestUnchecked(conn, cutoff, uncheckedPageSize)
+	for _, ageKey := range expired {
+		if deleteUnchecked(conn, ageKey) {
+			dropped++
+		}
+	}
+	return dropped, len(expired) == uncheckedPageSize
+}
+
+// Returns the blocks waited on by up to a page of unchecked keys from
+// start on, and the key to start the next page from, or nil after the
+// last page. Only keys are read.
+func uncheckedDependencies(conn *badger.Txn, start []byte) ([]types.BlockHash, []byte) {
+	result := make([]types.BlockHash, 0)
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := conn.NewIterator(opts)
+	defer it.Close()
+	for it.Seek(start); it.ValidForPrefix(uncheckedPrefix); it.Next() {
+		key := it.Item().Key()
+		if len(key) != uncheckedKeySize {
+			continue
+		}
+		if len(result) == uncheckedPageSize {
+			return result, append([]byte{}, key...)
+		}
+		result = append(result, types.BlockHashFromBytes(key[len(uncheckedPrefix):]))
+	}
+	return result, nil
+}
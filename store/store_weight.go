@@ -0,0 +1,101 @@
+package store
+
+import (
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+// Each account's representative is kept under this prefix followed by the
+// account, so it's known without walking back to the account's last open
+// or change block.
+var representativePrefix = []byte{'p'}
+
+// A representative's voting weight, the total balance of the accounts
+// naming it, is kept under this prefix followed by the representative.
+var weightPrefix = []byte{'w'}
+
+func representativeKey(account types.Account) []byte {
+	return append(append([]byte{}, representativePrefix...), account[:]...)
+}
+
+func weightKey(representative types.Account) []byte {
+	return append(append([]byte{}, weightPrefix...), representative[:]...)
+}
+
+func fetchRepresentative(conn *badger.Txn, account types.Account) (types.Account, bool) {
+	item, err := conn.Get(representativeKey(account))
+	if err != nil {
+		return types.Account{}, false
+	}
+	value, err := item.Value()
+	if err != nil || len(value) != 32 {
+		return types.Account{}, false
+	}
+	return types.AccountFromBytes(value), true
+}
+
+// RepresentativeWeight returns the total balance of the accounts whose
+// latest open or change block names the representative.
+func RepresentativeWeight(representative types.Account) uint128.Uint128 {
+	conn := getConn()
+	defer releaseConn(conn)
+	return fetchWeight(conn, representative)
+}
+
+func fetchWeight(conn *badger.Txn, representative types.Account) uint128.Uint128 {
+	item, err := conn.Get(weightKey(representative))
+	if err != nil {
+		return uint128.Uint128{}
+	}
+	value, err := item.Value()
+	if err != nil || len(value) != 16 {
+		return uint128.Uint128{}
+	}
+	return uint128.FromBytes(value)
+}
+
+func writeWeight(conn *badger.Txn, representative types.Account, weight uint128.Uint128) {
+	var err error
+	if weight.IsZero() {
+		err = conn.Delete(weightKey(representative))
+	} else {
+		err = conn.Set(weightKey(representative), weight.GetBytes())
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Moves the account's balance before the block from its old
+// representative, and its balance after the block to the representative
+// it names from then on.
+func updateWeights(conn *badger.Txn, block blocks.Block, sideband *Sideband) {
+	representative, ok := fetchRepresentative(conn, sideband.Account)
+	if ok {
+		if previous := fetchSideband(conn, block.PreviousBlockHash()); previous != nil {
+			weight := fetchWeight(conn, representative)
+			if weight.Compare(previous.Balance) < 0 {
+				// Every balance delegated to the representative is in its
+				// weight, so the table is out of step with the ledger
+				logger.Error("Representative weight less than delegated balance",
+					"representative", representative, "weight", weight,
+					"balance", previous.Balance, "block", block.Hash())
+				weight = previous.Balance
+			}
+			writeWeight(conn, representative, weight.Sub(previous.Balance))
+		}
+	}
+
+	switch b := block.(type) {
+	case *blocks.OpenBlock:
+		representative = b.Representative
+	case *blocks.ChangeBlock:
+		representative = b.Representative
+	}
+	if err := conn.Set(representativeKey(sideband.Account), representative[:]); err != nil {
+		panic(err)
+	}
+	writeWeight(conn, representative, fetchWeight(conn, representative).Add(sideband.Balance))
+}
@@ -0,0 +1,93 @@
+package types
+
+import (
+	"encoding/base32"
+	"strings"
+
+	"github.com/frankh/nano/utils"
+	"github.com/golang/crypto/blake2b"
+	"github.com/pkg/errors"
+)
+
+// nano uses a non-standard base32 character set.
+const EncodeNano = "13456789abcdefghijkmnopqrstuwxyz"
+
+var NanoEncoding = base32.NewEncoding(EncodeNano)
+
+func AccountFromBytes(b []byte) (account Account) {
+	copy(account[:], b)
+	return account
+}
+
+// AddressChecksum is the 5 byte checksum on the end of an address,
+// the blake2b hash of the public key with its bytes reversed.
+func AddressChecksum(pub []byte) []byte {
+	hash, err := blake2b.New(5, nil)
+	if err != nil {
+		panic("Unable to create hash")
+	}
+
+	hash.Write(pub)
+	return utils.Reversed(hash.Sum(nil))
+}
+
+// ParseAccount parses a nano_ or xrb_ address, checking its checksum.
+func ParseAccount(s string) (account Account, err error) {
+	address := s
+	if strings.HasPrefix(address, "xrb_") {
+		address = address[4:]
+	} else if strings.HasPrefix(address, "nano_") {
+		address = address[5:]
+	} else {
+		return account, errors.Errorf("Invalid address format %s", s)
+	}
+	// A valid nano address is 64 bytes long
+	// First 5 are simply a hard-coded string nano_ for ease of use
+	// The following 52 characters form the address, and the final
+	// 8 are a checksum.
+	// They are base 32 encoded with a custom encoding.
+	if len(address) != 60 {
+		return account, errors.Errorf("Invalid address format %s", s)
+	}
+
+	// The nano address string is 260bits which doesn't fall on a
+	// byte boundary. pad with zeros to 280bits.
+	// (zeros are encoded as 1 in nano's 32bit alphabet)
+	key_b32nano := "1111" + address[0:52]
+	input_checksum := address[52:]
+
+	key_bytes, err := NanoEncoding.DecodeString(key_b32nano)
+	if err != nil {
+		return account, errors.Errorf("Invalid address format %s", s)
+	}
+	// strip off upper 24 bits (3 bytes). 20 padding was added by us,
+	// 4 is unused as account is 256 bits.
+	key_bytes = key_bytes[3:]
+
+	// nano checksum is calculated by hashing the key and reversing the bytes
+	if NanoEncoding.EncodeToString(AddressChecksum(key_bytes)) != input_checksum {
+		return account, errors.Errorf("Invalid address checksum %s", s)
+	}
+	return AccountFromBytes(key_bytes), nil
+}
+
+// String returns the nano_ address of the account.
+func (account Account) String() string {
+	// Pubkey is 256bits, base32 must be multiple of 5 bits
+	// to encode properly.
+	// Pad the start with 0's and strip them off after base32 encoding
+	padded := append([]byte{0, 0, 0}, account[:]...)
+	address := NanoEncoding.EncodeToString(padded)[4:]
+	checksum := NanoEncoding.EncodeToString(AddressChecksum(account[:]))
+
+	return "nano_" + address + checksum
+}
+
+func (account Account) MarshalText() ([]byte, error) {
+	return []byte(account.String()), nil
+}
+
+func (account *Account) UnmarshalText(text []byte) (err error) {
+	*account, err = ParseAccount(string(text))
+	return err
+}
@@ -2,37 +2,112 @@ package types
 
 import (
 	"encoding/hex"
+	"fmt"
 	"strings"
 
 	"github.com/frankh/crypto/ed25519"
+	"github.com/pkg/errors"
 )
 
-type BlockHash string
-type Account string
-type Work string
-type Signature string
+// Hashes, accounts and signatures are held as raw bytes and work as the
+// nonce value. They're only converted to and from strings at the edges:
+// JSON, logging and user input.
+type BlockHash [32]byte
+type Account [32]byte
+type Work uint64
+type Signature [64]byte
 
-func (hash BlockHash) ToBytes() []byte {
-	bytes, err := hex.DecodeString(string(hash))
+func BlockHashFromBytes(b []byte) (hash BlockHash) {
+	copy(hash[:], b)
+	return hash
+}
+
+func decodeHex(s string, size int, name string) ([]byte, error) {
+	if len(s) != size*2 {
+		return nil, errors.Errorf("%s must be %d hex characters", name, size*2)
+	}
+	b, err := hex.DecodeString(s)
 	if err != nil {
-		panic(err)
+		return nil, errors.Errorf("could not decode %s %s as hex", name, s)
 	}
-	return bytes
+	return b, nil
 }
 
-func (sig Signature) ToBytes() []byte {
-	bytes, err := hex.DecodeString(string(sig))
+// BlockHashFromString parses a 64 character hex block hash, in either case.
+func BlockHashFromString(s string) (hash BlockHash, err error) {
+	b, err := decodeHex(s, 32, "block hash")
 	if err != nil {
-		panic(err)
+		return hash, err
 	}
-	return bytes
+	return BlockHashFromBytes(b), nil
+}
+
+func (hash BlockHash) String() string {
+	return strings.ToUpper(hex.EncodeToString(hash[:]))
+}
+
+func (hash BlockHash) Sign(private_key ed25519.PrivateKey) (sig Signature) {
+	copy(sig[:], ed25519.Sign(private_key, hash[:]))
+	return sig
+}
+
+func SignatureFromString(s string) (sig Signature, err error) {
+	b, err := decodeHex(s, 64, "signature")
+	if err != nil {
+		return sig, err
+	}
+	copy(sig[:], b)
+	return sig, nil
+}
+
+func (sig Signature) String() string {
+	return strings.ToUpper(hex.EncodeToString(sig[:]))
+}
+
+// WorkFromString parses work as the reference node writes it, 16 hex
+// characters of the big endian nonce.
+func WorkFromString(s string) (Work, error) {
+	b, err := decodeHex(s, 8, "work")
+	if err != nil {
+		return 0, err
+	}
+	var work uint64
+	for _, c := range b {
+		work = work<<8 | uint64(c)
+	}
+	return Work(work), nil
+}
+
+func (work Work) String() string {
+	return fmt.Sprintf("%016x", uint64(work))
+}
+
+// Text marshalling matches the reference node's case, which also makes
+// these types encode correctly with encoding/json.
+
+func (hash BlockHash) MarshalText() ([]byte, error) {
+	return []byte(hash.String()), nil
+}
+
+func (hash *BlockHash) UnmarshalText(text []byte) (err error) {
+	*hash, err = BlockHashFromString(string(text))
+	return err
+}
+
+func (sig Signature) MarshalText() ([]byte, error) {
+	return []byte(sig.String()), nil
+}
+
+func (sig *Signature) UnmarshalText(text []byte) (err error) {
+	*sig, err = SignatureFromString(string(text))
+	return err
 }
 
-func (hash BlockHash) Sign(private_key ed25519.PrivateKey) Signature {
-	sig := hex.EncodeToString(ed25519.Sign(private_key, hash.ToBytes()))
-	return Signature(strings.ToUpper(sig))
+func (work Work) MarshalText() ([]byte, error) {
+	return []byte(work.String()), nil
 }
 
-func BlockHashFromBytes(b []byte) BlockHash {
-	return BlockHash(strings.ToUpper(hex.EncodeToString(b)))
+func (work *Work) UnmarshalText(text []byte) (err error) {
+	*work, err = WorkFromString(string(text))
+	return err
 }
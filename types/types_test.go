@@ -0,0 +1,101 @@
+package types
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJson(t *testing.T) {
+	var v struct {
+		Hash      BlockHash
+		Work      Work
+		Signature Signature
+		Account   Account
+	}
+
+	raw := `{"Hash":"991cf190094c00f0b68e2e5f75f6bee95a2e0bd93ceaa4a6734db9f19b728948","Work":"62F05417DD3FB691","Signature":"9f0c933c8ade004d808ea1985fa746a7e95ba2a38f867640f53ec8f180bdfe9e2c1268dead7c2664f356e37aba362bc58e46dba03e523a7b5a19e4b6eb12bb02","Account":"nano_3t6k35gi95xu6tergt6p69ck76ogmitsa8mnijtpxm9fkcm736xtoncuohr3"}`
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		t.Fatalf("Failed to decode json: %s", err)
+	}
+
+	if v.Hash.String() != "991CF190094C00F0B68E2E5F75F6BEE95A2E0BD93CEAA4A6734DB9F19B728948" || v.Work != 0x62f05417dd3fb691 {
+		t.Errorf("Decoded wrong values %s %s", v.Hash, v.Work)
+	}
+
+	encoded, _ := json.Marshal(v)
+	if string(encoded) != `{"Hash":"991CF190094C00F0B68E2E5F75F6BEE95A2E0BD93CEAA4A6734DB9F19B728948","Work":"62f05417dd3fb691","Signature":"9F0C933C8ADE004D808EA1985FA746A7E95BA2A38F867640F53EC8F180BDFE9E2C1268DEAD7C2664F356E37ABA362BC58E46DBA03E523A7B5A19E4B6EB12BB02","Account":"nano_3t6k35gi95xu6tergt6p69ck76ogmitsa8mnijtpxm9fkcm736xtoncuohr3"}` {
+		t.Errorf("Encoding didn't normalise case %s", encoded)
+	}
+
+	invalid := []string{
+		`{"Hash":"991C"}`,
+		`{"Hash":"ZZ1CF190094C00F0B68E2E5F75F6BEE95A2E0BD93CEAA4A6734DB9F19B728948"}`,
+		`{"Work":"62f05417dd3fb6"}`,
+		`{"Signature":"9F0C"}`,
+		`{"Account":"nano_3t6k"}`,
+	}
+	for _, raw := range invalid {
+		if json.Unmarshal([]byte(raw), &v) == nil {
+			t.Errorf("Decoded invalid json %s", raw)
+		}
+	}
+}
+
+func TestFromString(t *testing.T) {
+	hash, err := BlockHashFromString("991CF190094C00F0B68E2E5F75F6BEE95A2E0BD93CEAA4A6734DB9F19B728948")
+	if err != nil || hash[0] != 0x99 || hash[31] != 0x48 {
+		t.Errorf("Decoded hash badly")
+	}
+
+	for _, invalid := range []string{"", "991C", "ZZ1CF190094C00F0B68E2E5F75F6BEE95A2E0BD93CEAA4A6734DB9F19B728948"} {
+		if _, err := BlockHashFromString(invalid); err == nil {
+			t.Errorf("Decoded invalid hash %s", invalid)
+		}
+	}
+	if _, err := SignatureFromString("9F0C"); err == nil {
+		t.Errorf("Decoded short signature")
+	}
+}
+
+func TestAccount(t *testing.T) {
+	// The burn address is the zero account
+	var zero Account
+	if zero.String() != "nano_1111111111111111111111111111111111111111111111111111hifc8npp" {
+		t.Errorf("Wrong address for zero account %s", zero)
+	}
+
+	account, err := ParseAccount("xrb_3t6k35gi95xu6tergt6p69ck76ogmitsa8mnijtpxm9fkcm736xtoncuohr3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.String() != "nano_3t6k35gi95xu6tergt6p69ck76ogmitsa8mnijtpxm9fkcm736xtoncuohr3" {
+		t.Errorf("Account didn't round trip %s", account)
+	}
+}
+
+func FuzzUnmarshalText(f *testing.F) {
+	f.Add("991CF190094C00F0B68E2E5F75F6BEE95A2E0BD93CEAA4A6734DB9F19B728948")
+	f.Add("62f05417dd3fb691")
+	f.Add("nano_3t6k35gi95xu6tergt6p69ck76ogmitsa8mnijtpxm9fkcm736xtoncuohr3")
+	f.Fuzz(func(t *testing.T, text string) {
+		var hash BlockHash
+		if hash.UnmarshalText([]byte(text)) == nil && !strings.EqualFold(hash.String(), text) {
+			t.Errorf("Hash didn't round trip %s", text)
+		}
+		var sig Signature
+		if sig.UnmarshalText([]byte(text)) == nil && !strings.EqualFold(sig.String(), text) {
+			t.Errorf("Signature didn't round trip %s", text)
+		}
+		var work Work
+		if work.UnmarshalText([]byte(text)) == nil && !strings.EqualFold(work.String(), text) {
+			t.Errorf("Work didn't round trip %s", text)
+		}
+		var account Account
+		if account.UnmarshalText([]byte(text)) == nil {
+			if _, err := ParseAccount(account.String()); err != nil {
+				t.Errorf("Account didn't round trip %s", text)
+			}
+		}
+	})
+}
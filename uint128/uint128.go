@@ -17,10 +17,19 @@ package uint128
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"math/bits"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 )
 
+var (
+	ErrOverflow     = errors.New("uint128 overflow")
+	ErrUnderflow    = errors.New("uint128 underflow")
+	ErrDivideByZero = errors.New("uint128 divide by zero")
+)
+
 // Uint128 is a big-endian 128 bit unsigned integer which wraps two uint64s.
 type Uint128 struct {
 	Hi, Lo uint64
@@ -34,11 +43,53 @@ func (u Uint128) GetBytes() []byte {
 	return buf
 }
 
-// String returns a hexadecimal string representation.
+// String returns a decimal string representation.
 func (u Uint128) String() string {
+	if u.IsZero() {
+		return "0"
+	}
+
+	// Peel off 19 decimal digits at a time, the most that fit in a uint64.
+	chunk := Uint128{0, 1e19}
+	result := ""
+	for !u.IsZero() {
+		var r Uint128
+		u, r = u.QuoRem(chunk)
+		digits := strconv.FormatUint(r.Lo, 10)
+		if !u.IsZero() {
+			digits = strings.Repeat("0", 19-len(digits)) + digits
+		}
+		result = digits + result
+	}
+	return result
+}
+
+// Hex returns a hexadecimal string representation.
+func (u Uint128) Hex() string {
 	return hex.EncodeToString(u.GetBytes())
 }
 
+// MarshalText encodes the Uint128 as a decimal string, which is also
+// how encoding/json will encode it.
+func (u Uint128) MarshalText() ([]byte, error) {
+	return []byte(u.String()), nil
+}
+
+// UnmarshalText parses a decimal string.
+func (u *Uint128) UnmarshalText(text []byte) error {
+	result, err := FromString(string(text))
+	if err != nil {
+		return err
+	}
+	*u = result
+	return nil
+}
+
+// IsZero returns whether or not the Uint128 is zero.
+func (u Uint128) IsZero() bool {
+	return u.Hi == 0 && u.Lo == 0
+}
+
 // Equal returns whether or not the Uint128 are equivalent.
 func (u Uint128) Equal(o Uint128) bool {
 	return u.Hi == o.Hi && u.Lo == o.Lo
@@ -68,6 +119,7 @@ func (u Uint128) Add(n Uint128) Uint128 {
 	return Uint128{hi, lo}
 }
 
+// Sub returns a new Uint128 decremented by n.
 func (u Uint128) Sub(n Uint128) Uint128 {
 	lo := u.Lo - n.Lo
 	hi := u.Hi - n.Hi
@@ -77,6 +129,147 @@ func (u Uint128) Sub(n Uint128) Uint128 {
 	return Uint128{hi, lo}
 }
 
+// AddChecked returns u + n, or an error if the result overflows.
+func (u Uint128) AddChecked(n Uint128) (Uint128, error) {
+	result := u.Add(n)
+	if result.Compare(u) < 0 {
+		return Uint128{}, ErrOverflow
+	}
+	return result, nil
+}
+
+// SubChecked returns u - n, or an error if n is larger than u.
+func (u Uint128) SubChecked(n Uint128) (Uint128, error) {
+	if n.Compare(u) > 0 {
+		return Uint128{}, ErrUnderflow
+	}
+	return u.Sub(n), nil
+}
+
+// mul64 returns the 128 bit product of two uint64s.
+func mul64(x, y uint64) Uint128 {
+	const mask32 = 1<<32 - 1
+	x0, x1 := x&mask32, x>>32
+	y0, y1 := y&mask32, y>>32
+
+	w0 := x0 * y0
+	t := x1*y0 + w0>>32
+	w1 := t & mask32
+	w2 := t >> 32
+	w1 += x0 * y1
+
+	return Uint128{x1*y1 + w2 + w1>>32, x * y}
+}
+
+// Mul returns u * n, wrapping on overflow.
+func (u Uint128) Mul(n Uint128) Uint128 {
+	result := mul64(u.Lo, n.Lo)
+	result.Hi += u.Hi*n.Lo + u.Lo*n.Hi
+	return result
+}
+
+// MulChecked returns u * n, or an error if the result overflows.
+func (u Uint128) MulChecked(n Uint128) (Uint128, error) {
+	if u.Hi != 0 && n.Hi != 0 {
+		return Uint128{}, ErrOverflow
+	}
+
+	result := mul64(u.Lo, n.Lo)
+	cross := mul64(u.Hi, n.Lo).Add(mul64(u.Lo, n.Hi))
+	if cross.Hi != 0 {
+		return Uint128{}, ErrOverflow
+	}
+
+	hi := result.Hi + cross.Lo
+	if hi < result.Hi {
+		return Uint128{}, ErrOverflow
+	}
+	return Uint128{hi, result.Lo}, nil
+}
+
+// BitLen returns the number of bits needed to represent u.
+func (u Uint128) BitLen() int {
+	if u.Hi != 0 {
+		return 64 + bits.Len64(u.Hi)
+	}
+	return bits.Len64(u.Lo)
+}
+
+// Lsh returns u shifted left by n bits.
+func (u Uint128) Lsh(n uint) Uint128 {
+	switch {
+	case n >= 128:
+		return Uint128{}
+	case n >= 64:
+		return Uint128{u.Lo << (n - 64), 0}
+	case n == 0:
+		return u
+	}
+	return Uint128{u.Hi<<n | u.Lo>>(64-n), u.Lo << n}
+}
+
+// Rsh returns u shifted right by n bits.
+func (u Uint128) Rsh(n uint) Uint128 {
+	switch {
+	case n >= 128:
+		return Uint128{}
+	case n >= 64:
+		return Uint128{0, u.Hi >> (n - 64)}
+	case n == 0:
+		return u
+	}
+	return Uint128{u.Hi >> n, u.Lo>>n | u.Hi<<(64-n)}
+}
+
+// QuoRem returns the quotient and remainder of u / n. It panics if n is
+// zero.
+func (u Uint128) QuoRem(n Uint128) (q, r Uint128) {
+	if n.IsZero() {
+		panic(ErrDivideByZero)
+	}
+	if u.Compare(n) < 0 {
+		return Uint128{}, u
+	}
+	if u.Hi == 0 {
+		return Uint128{0, u.Lo / n.Lo}, Uint128{0, u.Lo % n.Lo}
+	}
+
+	// Binary long division, starting from the highest bit at which n
+	// fits into u.
+	shift := uint(u.BitLen() - n.BitLen())
+	d := n.Lsh(shift)
+	r = u
+	for i := int(shift); i >= 0; i-- {
+		q = q.Lsh(1)
+		if r.Compare(d) >= 0 {
+			r = r.Sub(d)
+			q.Lo |= 1
+		}
+		d = d.Rsh(1)
+	}
+	return q, r
+}
+
+// Div returns u / n. It panics if n is zero.
+func (u Uint128) Div(n Uint128) Uint128 {
+	q, _ := u.QuoRem(n)
+	return q
+}
+
+// Mod returns u % n. It panics if n is zero.
+func (u Uint128) Mod(n Uint128) Uint128 {
+	_, r := u.QuoRem(n)
+	return r
+}
+
+// DivChecked returns u / n, or an error if n is zero.
+func (u Uint128) DivChecked(n Uint128) (Uint128, error) {
+	if n.IsZero() {
+		return Uint128{}, ErrDivideByZero
+	}
+	return u.Div(n), nil
+}
+
 // FromBytes parses the byte slice as a 128 bit big-endian unsigned integer.
 func FromBytes(b []byte) Uint128 {
 	hi := binary.BigEndian.Uint64(b[:8])
@@ -84,8 +277,32 @@ func FromBytes(b []byte) Uint128 {
 	return Uint128{hi, lo}
 }
 
-// FromString parses a hexadecimal string as a 128-bit big-endian unsigned integer.
+// FromString parses a decimal string as a 128-bit unsigned integer.
 func FromString(s string) (Uint128, error) {
+	if len(s) == 0 {
+		return Uint128{}, errors.New("empty string is not a valid uint128")
+	}
+
+	ten := Uint128{0, 10}
+	var result Uint128
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return Uint128{}, errors.Errorf("could not decode %s as decimal", s)
+		}
+		var err error
+		result, err = result.MulChecked(ten)
+		if err == nil {
+			result, err = result.AddChecked(Uint128{0, uint64(c - '0')})
+		}
+		if err != nil {
+			return Uint128{}, errors.Errorf("input string %s too large for uint128", s)
+		}
+	}
+	return result, nil
+}
+
+// FromHex parses a hexadecimal string as a 128-bit big-endian unsigned integer.
+func FromHex(s string) (Uint128, error) {
 	if len(s) > 32 {
 		return Uint128{}, errors.Errorf("input string %s too large for uint128", s)
 	}
@@ -16,6 +16,7 @@ package uint128
 
 import (
 	"bytes"
+	"encoding/json"
 	"strings"
 	"testing"
 )
@@ -30,20 +31,20 @@ func TestBytes(t *testing.T) {
 	}
 }
 
-func TestString(t *testing.T) {
+func TestHex(t *testing.T) {
 	s := "a95e31998f38490651c02b97c7f2acca"
 
-	i, _ := FromString(s)
+	i, _ := FromHex(s)
 
-	if s != i.String() {
+	if s != i.Hex() {
 		t.Errorf("incorrect string representation for num: %v", i)
 	}
 }
 
-func TestStringTooLong(t *testing.T) {
+func TestHexTooLong(t *testing.T) {
 	s := "ba95e31998f38490651c02b97c7f2acca"
 
-	_, err := FromString(s)
+	_, err := FromHex(s)
 
 	if err == nil || !strings.Contains(err.Error(), "too large") {
 		t.Error("did not get error for encoding invalid uint128 string")
@@ -53,7 +54,7 @@ func TestStringTooLong(t *testing.T) {
 func TestStringInvalidHex(t *testing.T) {
 	s := "bazz95e31998849051c02b97c7f2acca"
 
-	_, err := FromString(s)
+	_, err := FromHex(s)
 
 	if err == nil || !strings.Contains(err.Error(), "could not decode") {
 		t.Error("did not get error for encoding invalid uint128 string")
@@ -124,3 +125,172 @@ func TestEqual(t *testing.T) {
 		}
 	}
 }
+
+func TestString(t *testing.T) {
+	testData := []struct {
+		num Uint128
+		s   string
+	}{
+		{Uint128{0, 0}, "0"},
+		{Uint128{0, 1}, "1"},
+		{Uint128{0, 18446744073709551615}, "18446744073709551615"},
+		{Uint128{1, 0}, "18446744073709551616"},
+		{Uint128{0, 10000000000000000000}, "10000000000000000000"},
+		{Uint128{18446744073709551615, 18446744073709551615}, "340282366920938463463374607431768211455"},
+	}
+
+	for _, test := range testData {
+		if test.num.String() != test.s {
+			t.Errorf("expected %v.String() = %s but got %s", test.num, test.s, test.num.String())
+		}
+		parsed, err := FromString(test.s)
+		if err != nil || parsed != test.num {
+			t.Errorf("expected FromString(%s) = %v but got %v %s", test.s, test.num, parsed, err)
+		}
+	}
+}
+
+func TestStringInvalid(t *testing.T) {
+	for _, s := range []string{"", "-1", "1.5", "12a", "340282366920938463463374607431768211456"} {
+		if _, err := FromString(s); err == nil {
+			t.Errorf("did not get error parsing %q", s)
+		}
+	}
+}
+
+func TestMul(t *testing.T) {
+	testData := []struct {
+		num      Uint128
+		mul      Uint128
+		expected Uint128
+		overflow bool
+	}{
+		{Uint128{0, 3}, Uint128{0, 5}, Uint128{0, 15}, false},
+		{Uint128{0, 18446744073709551615}, Uint128{0, 18446744073709551615}, Uint128{18446744073709551614, 1}, false},
+		{Uint128{1, 0}, Uint128{0, 25}, Uint128{25, 0}, false},
+		{Uint128{1, 1}, Uint128{1, 0}, Uint128{1, 0}, true},
+		{Uint128{9223372036854775808, 0}, Uint128{0, 2}, Uint128{0, 0}, true},
+	}
+
+	for _, test := range testData {
+		res := test.num.Mul(test.mul)
+		if res != test.expected {
+			t.Errorf("expected: %v * %v = %v but got %v", test.num, test.mul, test.expected, res)
+		}
+		_, err := test.num.MulChecked(test.mul)
+		if (err != nil) != test.overflow {
+			t.Errorf("expected overflow %v for %v * %v", test.overflow, test.num, test.mul)
+		}
+	}
+}
+
+func TestQuoRem(t *testing.T) {
+	testData := []struct {
+		num Uint128
+		div Uint128
+		q   Uint128
+		r   Uint128
+	}{
+		{Uint128{0, 15}, Uint128{0, 4}, Uint128{0, 3}, Uint128{0, 3}},
+		{Uint128{0, 3}, Uint128{0, 4}, Uint128{0, 0}, Uint128{0, 3}},
+		{Uint128{25, 7}, Uint128{1, 0}, Uint128{0, 25}, Uint128{0, 7}},
+		{Uint128{18446744073709551614, 1}, Uint128{0, 18446744073709551615}, Uint128{0, 18446744073709551615}, Uint128{0, 0}},
+		{Uint128{18446744073709551615, 18446744073709551615}, Uint128{0, 10}, Uint128{1844674407370955161, 11068046444225730969}, Uint128{0, 5}},
+	}
+
+	for _, test := range testData {
+		q, r := test.num.QuoRem(test.div)
+		if q != test.q || r != test.r {
+			t.Errorf("expected: %v / %v = %v r %v but got %v r %v", test.num, test.div, test.q, test.r, q, r)
+		}
+		if test.num.Div(test.div) != q || test.num.Mod(test.div) != r {
+			t.Errorf("Div or Mod disagree with QuoRem for %v / %v", test.num, test.div)
+		}
+	}
+
+	if _, err := (Uint128{0, 1}).DivChecked(Uint128{}); err != ErrDivideByZero {
+		t.Errorf("did not get error dividing by zero")
+	}
+}
+
+func TestShift(t *testing.T) {
+	u := Uint128{0, 1}
+	if u.Lsh(64) != (Uint128{1, 0}) || u.Lsh(127) != (Uint128{9223372036854775808, 0}) || u.Lsh(128) != (Uint128{}) {
+		t.Errorf("incorrect left shift")
+	}
+
+	u = Uint128{1, 2}
+	if u.Rsh(1) != (Uint128{0, 9223372036854775809}) || u.Rsh(64) != (Uint128{0, 1}) || u.Rsh(0) != u {
+		t.Errorf("incorrect right shift")
+	}
+}
+
+func TestChecked(t *testing.T) {
+	max := Uint128{18446744073709551615, 18446744073709551615}
+	if _, err := max.AddChecked(Uint128{0, 1}); err != ErrOverflow {
+		t.Errorf("did not get overflow error")
+	}
+	if _, err := (Uint128{0, 1}).SubChecked(Uint128{0, 2}); err != ErrUnderflow {
+		t.Errorf("did not get underflow error")
+	}
+	if res, err := (Uint128{1, 0}).SubChecked(Uint128{0, 1}); err != nil || res != (Uint128{0, 18446744073709551615}) {
+		t.Errorf("incorrect checked subtraction")
+	}
+}
+
+func TestUnits(t *testing.T) {
+	testData := []struct {
+		raw    string
+		unit   Unit
+		amount string
+	}{
+		{"1000000000000000000000000000000", MNano, "1"},
+		{"1500000000000000000000000000000", MNano, "1.5"},
+		{"1", MNano, "0.000000000000000000000000000001"},
+		{"0", MNano, "0"},
+		{"340282366920938463463374607431768211455", MNano, "340282366.920938463463374607431768211455"},
+		{"2000000000000000000000000000", KNano, "2"},
+		{"123", Raw, "123"},
+	}
+
+	for _, test := range testData {
+		raw, _ := FromString(test.raw)
+		if raw.Format(test.unit) != test.amount {
+			t.Errorf("expected %s raw to be %s %s but got %s", test.raw, test.amount, test.unit, raw.Format(test.unit))
+		}
+		parsed, err := Parse(test.amount, test.unit)
+		if err != nil || parsed != raw {
+			t.Errorf("expected %s %s to be %s raw but got %v %s", test.amount, test.unit, test.raw, parsed, err)
+		}
+	}
+
+	if _, err := Parse("1.5", Raw); err == nil {
+		t.Errorf("did not get error for fractional raw")
+	}
+	if _, err := Parse("340282367", MNano); err == nil {
+		t.Errorf("did not get error for amount too large")
+	}
+	if MNano.Raw().String() != "1000000000000000000000000000000" {
+		t.Errorf("incorrect raw for Mnano")
+	}
+}
+
+func TestJson(t *testing.T) {
+	var v struct {
+		Amount Uint128 `json:"amount"`
+	}
+
+	err := json.Unmarshal([]byte(`{"amount":"18446744073709551616"}`), &v)
+	if err != nil || v.Amount != (Uint128{1, 0}) {
+		t.Errorf("failed to decode decimal json %v %s", v.Amount, err)
+	}
+
+	encoded, _ := json.Marshal(v)
+	if string(encoded) != `{"amount":"18446744073709551616"}` {
+		t.Errorf("incorrect json encoding %s", encoded)
+	}
+
+	if json.Unmarshal([]byte(`{"amount":{"Hi":1,"Lo":0}}`), &v) == nil {
+		t.Errorf("did not get error for struct encoded uint128")
+	}
+}
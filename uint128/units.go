@@ -0,0 +1,87 @@
+package uint128
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A Unit is a denomination of nano, expressed as the number of decimal
+// places it has in raw.
+type Unit int
+
+const (
+	Raw   Unit = 0
+	Nano  Unit = 24
+	KNano Unit = 27
+	MNano Unit = 30
+)
+
+// Raw returns the number of raw in one of the unit.
+func (unit Unit) Raw() Uint128 {
+	result := Uint128{0, 1}
+	for i := 0; i < int(unit); i++ {
+		result = result.Mul(Uint128{0, 10})
+	}
+	return result
+}
+
+func (unit Unit) String() string {
+	switch unit {
+	case Raw:
+		return "raw"
+	case Nano:
+		return "nano"
+	case KNano:
+		return "knano"
+	case MNano:
+		return "Mnano"
+	}
+	return "unknown"
+}
+
+// Format returns u, an amount in raw, as an exact decimal amount of the
+// unit without trailing zeros, e.g. 1.5 rather than 1.500.
+func (u Uint128) Format(unit Unit) string {
+	digits := u.String()
+	places := int(unit)
+	if places == 0 {
+		return digits
+	}
+
+	if len(digits) <= places {
+		digits = strings.Repeat("0", places-len(digits)+1) + digits
+	}
+	whole := digits[:len(digits)-places]
+	fraction := strings.TrimRight(digits[len(digits)-places:], "0")
+	if fraction == "" {
+		return whole
+	}
+	return whole + "." + fraction
+}
+
+// Parse parses a decimal amount of the unit, e.g. "1.5" Mnano, returning
+// the amount in raw. Amounts with more decimal places than the unit
+// allows are an error rather than being rounded.
+func Parse(s string, unit Unit) (Uint128, error) {
+	whole, fraction := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, fraction = s[:i], s[i+1:]
+	}
+	if whole == "" && fraction == "" {
+		return Uint128{}, errors.Errorf("could not parse %s as an amount", s)
+	}
+	if len(fraction) > int(unit) {
+		return Uint128{}, errors.Errorf("%s has too many decimal places for %s", s, unit)
+	}
+	if whole == "" {
+		whole = "0"
+	}
+
+	digits := whole + fraction + strings.Repeat("0", int(unit)-len(fraction))
+	result, err := FromString(digits)
+	if err != nil {
+		return Uint128{}, errors.Wrapf(err, "could not parse %s as an amount", s)
+	}
+	return result, nil
+}
@@ -1,8 +1,6 @@
 package wallet
 
 import (
-	"encoding/hex"
-
 	"github.com/frankh/crypto/ed25519"
 	"github.com/frankh/nano/address"
 	"github.com/frankh/nano/blocks"
@@ -24,18 +22,34 @@ func (w *Wallet) Address() types.Account {
 	return address.PubKeyToAddress(w.PublicKey)
 }
 
-func New(private string) (w Wallet) {
-	w.PublicKey, w.privateKey = address.KeypairFromPrivateKey(private)
+func New(private string) (w Wallet, err error) {
+	pub, priv, err := address.KeypairFromPrivateKey(private)
+	if err != nil {
+		return w, err
+	}
+	return fromKeypair(pub, priv), nil
+}
+
+func fromKeypair(pub ed25519.PublicKey, priv ed25519.PrivateKey) (w Wallet) {
+	w.PublicKey, w.privateKey = pub, priv
 	account := address.PubKeyToAddress(w.PublicKey)
 
-	open := store.FetchOpen(account)
-	if open != nil {
-		w.Head = open
+	if frontier, ok := store.FetchFrontier(account); ok {
+		w.Head = store.FetchBlock(frontier)
 	}
 
 	return w
 }
 
+// Zeroes the private key in place, so every copy of the wallet stops
+// signing.
+func (w *Wallet) wipe() {
+	for i := range w.privateKey {
+		w.privateKey[i] = 0
+	}
+	w.privateKey = nil
+}
+
 // Returns true if the wallet has prepared proof of work,
 func (w *Wallet) HasPoW() bool {
 	select {
@@ -77,7 +91,7 @@ func (w *Wallet) GeneratePoWAsync() error {
 
 	go func(c chan types.Work, w *Wallet) {
 		if w.Head == nil {
-			c <- blocks.GenerateWorkForHash(types.BlockHash(hex.EncodeToString(w.PublicKey)))
+			c <- blocks.GenerateWorkForHash(types.BlockHash(w.Address()))
 		} else {
 			c <- blocks.GenerateWork(w.Head)
 		}
@@ -96,6 +110,10 @@ func (w *Wallet) GetBalance() uint128.Uint128 {
 }
 
 func (w *Wallet) Open(source types.BlockHash, representative types.Account) (*blocks.OpenBlock, error) {
+	if w.privateKey == nil {
+		return nil, ErrLocked
+	}
+
 	if w.Head != nil {
 		return nil, errors.Errorf("Cannot open a non empty account")
 	}
@@ -115,8 +133,7 @@ func (w *Wallet) Open(source types.BlockHash, representative types.Account) (*bl
 	}
 
 	common := blocks.CommonBlock{
-		Work:      *w.Work,
-		Signature: "",
+		Work: *w.Work,
 	}
 
 	block := blocks.OpenBlock{
@@ -137,6 +154,10 @@ func (w *Wallet) Open(source types.BlockHash, representative types.Account) (*bl
 }
 
 func (w *Wallet) Send(destination types.Account, amount uint128.Uint128) (*blocks.SendBlock, error) {
+	if w.privateKey == nil {
+		return nil, ErrLocked
+	}
+
 	if w.Head == nil {
 		return nil, errors.Errorf("Cannot send from empty account")
 	}
@@ -150,8 +171,7 @@ func (w *Wallet) Send(destination types.Account, amount uint128.Uint128) (*block
 	}
 
 	common := blocks.CommonBlock{
-		Work:      *w.Work,
-		Signature: "",
+		Work: *w.Work,
 	}
 
 	block := blocks.SendBlock{
@@ -168,6 +188,10 @@ func (w *Wallet) Send(destination types.Account, amount uint128.Uint128) (*block
 }
 
 func (w *Wallet) Receive(source types.BlockHash) (*blocks.ReceiveBlock, error) {
+	if w.privateKey == nil {
+		return nil, ErrLocked
+	}
+
 	if w.Head == nil {
 		return nil, errors.Errorf("Cannot receive to empty account")
 	}
@@ -191,8 +215,7 @@ func (w *Wallet) Receive(source types.BlockHash) (*blocks.ReceiveBlock, error) {
 	}
 
 	common := blocks.CommonBlock{
-		Work:      *w.Work,
-		Signature: "",
+		Work: *w.Work,
 	}
 
 	block := blocks.ReceiveBlock{
@@ -208,6 +231,10 @@ func (w *Wallet) Receive(source types.BlockHash) (*blocks.ReceiveBlock, error) {
 }
 
 func (w *Wallet) Change(representative types.Account) (*blocks.ChangeBlock, error) {
+	if w.privateKey == nil {
+		return nil, ErrLocked
+	}
+
 	if w.Head == nil {
 		return nil, errors.Errorf("Cannot change on empty account")
 	}
@@ -217,8 +244,7 @@ func (w *Wallet) Change(representative types.Account) (*blocks.ChangeBlock, erro
 	}
 
 	common := blocks.CommonBlock{
-		Work:      *w.Work,
-		Signature: "",
+		Work: *w.Work,
 	}
 
 	block := blocks.ChangeBlock{
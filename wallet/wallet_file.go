@@ -0,0 +1,431 @@
+package wallet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/golang/crypto/argon2"
+	"github.com/pkg/errors"
+)
+
+const WalletFileVersion = 1
+
+// Argon2id parameters used for newly encrypted files. Existing files
+// keep the parameters they were written with.
+var KdfTime uint32 = 3
+var KdfMemory uint32 = 64 * 1024
+var KdfThreads uint8 = 4
+
+var ErrLocked = errors.New("Wallet is locked")
+var ErrWrongPassword = errors.New("Wrong password")
+
+type kdfParams struct {
+	Name    string `json:"name"`
+	Salt    string `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+}
+
+type cipherParams struct {
+	Name       string `json:"name"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+type walletFileData struct {
+	Version        int                      `json:"version"`
+	Kdf            kdfParams                `json:"kdf"`
+	Cipher         cipherParams             `json:"cipher"`
+	Derivation     Derivation               `json:"derivation"`
+	Indices        []uint32                 `json:"indices"`
+	Representative *types.Account           `json:"representative,omitempty"`
+	Labels         map[types.Account]string `json:"labels,omitempty"`
+}
+
+// A WalletFile is a SeedWallet persisted to disk with its seed encrypted
+// by a password. While locked the seed is not held in memory and nothing
+// can be signed.
+type WalletFile struct {
+	path string
+	// Guards data and seed
+	lock sync.Mutex
+	data walletFileData
+	seed *SeedWallet
+}
+
+func deriveKey(password string, kdf kdfParams) ([]byte, error) {
+	if kdf.Name != "argon2id" {
+		return nil, errors.Errorf("Unsupported kdf %s", kdf.Name)
+	}
+	salt, err := hex.DecodeString(kdf.Salt)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode salt")
+	}
+	return argon2.IDKey([]byte(password), salt, kdf.Time, kdf.Memory, kdf.Threads, 32), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypts the seed with a fresh salt and nonce.
+func (f *WalletFile) encrypt(seed string, password string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	kdf := kdfParams{"argon2id", hex.EncodeToString(salt), KdfTime, KdfMemory, KdfThreads}
+
+	key, err := deriveKey(password, kdf)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	seed_bytes, _ := hex.DecodeString(seed)
+	ciphertext := aead.Seal(nil, nonce, seed_bytes, nil)
+
+	f.data.Kdf = kdf
+	f.data.Cipher = cipherParams{"aes-256-gcm", hex.EncodeToString(nonce), hex.EncodeToString(ciphertext)}
+	return nil
+}
+
+func (f *WalletFile) decrypt(password string) (string, error) {
+	if f.data.Cipher.Name != "aes-256-gcm" {
+		return "", errors.Errorf("Unsupported cipher %s", f.data.Cipher.Name)
+	}
+	key, err := deriveKey(password, f.data.Kdf)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := hex.DecodeString(f.data.Cipher.Nonce)
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return "", errors.New("Invalid nonce")
+	}
+	ciphertext, err := hex.DecodeString(f.data.Cipher.Ciphertext)
+	if err != nil {
+		return "", errors.Wrap(err, "could not decode ciphertext")
+	}
+
+	seed_bytes, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", ErrWrongPassword
+	}
+	return hex.EncodeToString(seed_bytes), nil
+}
+
+// CreateWalletFile encrypts the wallet's seed with the password and writes
+// a new wallet file, which is returned unlocked.
+func CreateWalletFile(path string, s *SeedWallet, password string) (*WalletFile, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, errors.Errorf("Wallet file %s already exists", path)
+	}
+
+	f := &WalletFile{path: path, seed: s}
+	f.data.Version = WalletFileVersion
+	f.data.Derivation = s.derivation
+	f.data.Labels = make(map[types.Account]string)
+	err := f.encrypt(s.seed, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, f.save()
+}
+
+// OpenWalletFile reads a wallet file, which is returned locked.
+func OpenWalletFile(path string) (*WalletFile, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &WalletFile{path: path}
+	err = json.Unmarshal(raw, &f.data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse wallet file %s", path)
+	}
+	if f.data.Version != WalletFileVersion {
+		return nil, errors.Errorf("Unsupported wallet file version %d", f.data.Version)
+	}
+	if f.data.Labels == nil {
+		f.data.Labels = make(map[types.Account]string)
+	}
+	if f.data.Derivation == "" {
+		f.data.Derivation = DerivationNano
+	}
+
+	return f, nil
+}
+
+// Save writes the wallet file, replacing the previous version atomically.
+func (f *WalletFile) Save() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.save()
+}
+
+func (f *WalletFile) save() error {
+	if f.seed != nil {
+		f.data.Indices = f.seed.Indices()
+	}
+
+	raw, err := json.MarshalIndent(&f.data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), ".wallet")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(raw)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (f *WalletFile) Locked() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.seed == nil
+}
+
+func (f *WalletFile) Unlock(password string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	seed, err := f.decrypt(password)
+	if err != nil {
+		return err
+	}
+
+	s, err := newSeedWallet(seed, f.data.Derivation)
+	if err != nil {
+		return err
+	}
+	for _, index := range f.data.Indices {
+		s.Account(index)
+	}
+	f.seed = s
+	return nil
+}
+
+// Lock drops the seed and derived private keys from memory. Keys are
+// wiped from the shared seed wallet, so wallets returned by Wallet and
+// any AutoReceiver stop signing as well.
+func (f *WalletFile) Lock() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.seed != nil {
+		f.data.Indices = f.seed.Indices()
+		f.seed.wipe()
+	}
+	f.seed = nil
+}
+
+func (f *WalletFile) ChangePassword(oldPassword string, newPassword string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	seed, err := f.decrypt(oldPassword)
+	if err != nil {
+		return err
+	}
+
+	err = f.encrypt(seed, newPassword)
+	if err != nil {
+		return err
+	}
+	return f.save()
+}
+
+// Accounts returns the addresses of the in use accounts. Addresses are
+// derived from the seed so the wallet must be unlocked.
+func (f *WalletFile) Accounts() ([]types.Account, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.seed == nil {
+		return nil, ErrLocked
+	}
+
+	accounts := make([]types.Account, 0)
+	for _, index := range f.seed.Indices() {
+		accounts = append(accounts, f.seed.Account(index).Address())
+	}
+	return accounts, nil
+}
+
+// Indices returns the in use account indices, which are stored in the
+// clear so they're available while locked.
+func (f *WalletFile) Indices() []uint32 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.seed != nil {
+		return f.seed.Indices()
+	}
+	return f.data.Indices
+}
+
+func (f *WalletFile) NewAccount() (types.Account, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.seed == nil {
+		return types.Account{}, ErrLocked
+	}
+
+	_, w := f.seed.NewAccount()
+	return w.Address(), f.save()
+}
+
+// Restore marks every opened account derived from the seed as in use.
+func (f *WalletFile) Restore(gapLimit uint32) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.seed == nil {
+		return 0, ErrLocked
+	}
+
+	found := f.seed.Restore(gapLimit)
+	return found, f.save()
+}
+
+// Representative returns the representative used when opening accounts,
+// or false if none has been set.
+func (f *WalletFile) Representative() (types.Account, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.data.Representative == nil {
+		return types.Account{}, false
+	}
+	return *f.data.Representative, true
+}
+
+func (f *WalletFile) SetRepresentative(representative types.Account) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.data.Representative = &representative
+	return f.save()
+}
+
+func (f *WalletFile) Label(account types.Account) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.data.Labels[account]
+}
+
+func (f *WalletFile) SetLabel(account types.Account, label string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if label == "" {
+		delete(f.data.Labels, account)
+	} else {
+		f.data.Labels[account] = label
+	}
+	return f.save()
+}
+
+func (f *WalletFile) Wallet(account types.Account) (*Wallet, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.seed == nil {
+		return nil, ErrLocked
+	}
+	return f.seed.Wallet(account)
+}
+
+func (f *WalletFile) GetBalance() (uint128.Uint128, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.seed == nil {
+		return uint128.Uint128{}, ErrLocked
+	}
+	return f.seed.GetBalance(), nil
+}
+
+// Open creates an open block for the account using the wallet's
+// representative.
+func (f *WalletFile) Open(account types.Account, source types.BlockHash) (*blocks.OpenBlock, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.seed == nil {
+		return nil, ErrLocked
+	}
+	if f.data.Representative == nil {
+		return nil, errors.New("No representative set")
+	}
+	return f.seed.Open(account, source, *f.data.Representative)
+}
+
+func (f *WalletFile) Send(account types.Account, destination types.Account, amount uint128.Uint128) (*blocks.SendBlock, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.seed == nil {
+		return nil, ErrLocked
+	}
+	return f.seed.Send(account, destination, amount)
+}
+
+func (f *WalletFile) Receive(account types.Account, source types.BlockHash) (*blocks.ReceiveBlock, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.seed == nil {
+		return nil, ErrLocked
+	}
+	return f.seed.Receive(account, source)
+}
+
+func (f *WalletFile) Change(account types.Account, representative types.Account) (*blocks.ChangeBlock, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.seed == nil {
+		return nil, ErrLocked
+	}
+	return f.seed.Change(account, representative)
+}
+
+// AutoReceiver returns a receiver for the wallet's accounts that opens
+// them with the wallet's representative, which must be set.
+func (f *WalletFile) AutoReceiver(threshold uint128.Uint128) (*AutoReceiver, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.seed == nil {
+		return nil, ErrLocked
+	}
+	if f.data.Representative == nil {
+		return nil, errors.New("No representative set")
+	}
+	return NewAutoReceiver(f.seed, *f.data.Representative, threshold), nil
+}
@@ -0,0 +1,140 @@
+package wallet
+
+import (
+	"time"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/logging"
+	"github.com/frankh/nano/node"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/pkg/errors"
+)
+
+var logger = logging.New("wallet")
+
+// An AutoReceiver watches the receivable index for a seed wallet's
+// accounts and creates, stores and publishes the open or receive block
+// for each incoming send.
+type AutoReceiver struct {
+	Wallet *SeedWallet
+	// Representative for accounts that need opening
+	Representative types.Account
+	// Sends of less than this amount are left unreceived
+	Threshold uint128.Uint128
+	Publish   func(blocks.Block) error
+	alarm     *node.Alarm
+}
+
+func NewAutoReceiver(s *SeedWallet, representative types.Account, threshold uint128.Uint128) *AutoReceiver {
+	return &AutoReceiver{s, representative, threshold, node.PublishBlock, nil}
+}
+
+// Poll receives every receivable send above the threshold and returns
+// the blocks it created.
+func (r *AutoReceiver) Poll() []blocks.Block {
+	created := make([]blocks.Block, 0)
+
+	for _, index := range r.Wallet.Indices() {
+		created = append(created, r.pollAccount(index)...)
+	}
+
+	return created
+}
+
+// The wallet is locked while an account's head is updated, so balances
+// read meanwhile from another goroutine are consistent. Work is generated
+// without holding the lock.
+func (r *AutoReceiver) pollAccount(index uint32) []blocks.Block {
+	created := make([]blocks.Block, 0)
+	r.Wallet.lock.Lock()
+	// Locking the wallet file wipes the keys, nothing can be signed
+	if r.Wallet.seed == "" {
+		r.Wallet.lock.Unlock()
+		return created
+	}
+	w := r.Wallet.account(index)
+	r.Wallet.lock.Unlock()
+
+	for _, receivable := range store.FetchReceivable(w.Address()) {
+		if receivable.Amount.Compare(r.Threshold) < 0 {
+			continue
+		}
+
+		block, err := r.receive(w, receivable.Hash)
+		if err != nil {
+			logger.Warn("Failed to receive", "hash", receivable.Hash, "account", w.Address(), "err", err)
+			continue
+		}
+		created = append(created, block)
+	}
+	return created
+}
+
+func (r *AutoReceiver) receive(w *Wallet, source types.BlockHash) (blocks.Block, error) {
+	r.Wallet.lock.Lock()
+	head := w.Head
+	r.Wallet.lock.Unlock()
+	if head == nil && r.Representative == (types.Account{}) {
+		return nil, errors.New("No representative set")
+	}
+
+	var work types.Work
+	if head == nil {
+		work = blocks.GenerateWorkForHash(types.BlockHash(w.Address()))
+	} else {
+		work = blocks.GenerateWork(head)
+	}
+
+	r.Wallet.lock.Lock()
+	if w.Head != head {
+		r.Wallet.lock.Unlock()
+		return nil, errors.New("Account changed while generating work")
+	}
+	w.Work = &work
+	var block blocks.Block
+	var err error
+	if head == nil {
+		block, err = w.Open(source, r.Representative)
+	} else {
+		block, err = w.Receive(source)
+	}
+	if err == nil {
+		err = node.ProcessLocal(block)
+		if err != nil {
+			w.Head = head
+		}
+	}
+	r.Wallet.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Publish != nil {
+		err = r.Publish(block)
+		if err != nil {
+			logger.Warn("Failed to publish", "hash", block.Hash(), "err", err)
+		}
+	}
+	return block, nil
+}
+
+// Start polls the receivable index every interval until Stop is called.
+// Accounts can't be opened without a representative, so it's an error if
+// none is set.
+func (r *AutoReceiver) Start(interval time.Duration) error {
+	if r.Representative == (types.Account{}) {
+		return errors.New("No representative set")
+	}
+	poll := func([]interface{}) { r.Poll() }
+	r.alarm = node.NewAlarm(node.AlarmFn(poll), nil, interval)
+	return nil
+}
+
+func (r *AutoReceiver) Stop() {
+	if r.alarm != nil {
+		r.alarm.Stop()
+		r.alarm = nil
+	}
+}
@@ -0,0 +1,251 @@
+package wallet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/frankh/crypto/ed25519"
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/mnemonic"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/pkg/errors"
+)
+
+// Number of consecutive unused indices to check before Restore gives up.
+const DefaultGapLimit = 20
+
+// How account keys are derived from a wallet's seed.
+type Derivation string
+
+const (
+	// blake2b(seed || index) from a 32 byte seed, as the reference wallet does
+	DerivationNano Derivation = "nano"
+	// SLIP-0010 44'/165'/index' from a 64 byte BIP39 seed, as hardware
+	// and mobile wallets do
+	DerivationBip44 Derivation = "bip44"
+)
+
+// A SeedWallet derives its accounts from a single seed, so the seed is
+// all that's needed to recover every account.
+type SeedWallet struct {
+	seed       string
+	derivation Derivation
+	// Guards accounts, and the accounts' heads while an AutoReceiver
+	// updates them
+	lock     sync.Mutex
+	accounts map[uint32]*Wallet
+}
+
+func GenerateSeed() (string, error) {
+	seed := make([]byte, 32)
+	_, err := rand.Read(seed)
+	if err != nil {
+		return "", errors.Wrap(err, "could not generate seed")
+	}
+	return strings.ToUpper(hex.EncodeToString(seed)), nil
+}
+
+func newSeedWallet(seed string, derivation Derivation) (*SeedWallet, error) {
+	seed_bytes, err := hex.DecodeString(seed)
+	if err != nil {
+		return nil, errors.Errorf("Seed must be hex encoded")
+	}
+
+	switch derivation {
+	case DerivationNano:
+		if len(seed_bytes) != 32 {
+			return nil, errors.Errorf("Seed must be 64 hex characters")
+		}
+	case DerivationBip44:
+		if len(seed_bytes) != 64 {
+			return nil, errors.Errorf("BIP39 seed must be 128 hex characters")
+		}
+	default:
+		return nil, errors.Errorf("Unknown derivation %s", derivation)
+	}
+
+	return &SeedWallet{seed: seed, derivation: derivation, accounts: make(map[uint32]*Wallet)}, nil
+}
+
+func NewSeedWallet(seed string) (*SeedWallet, error) {
+	return newSeedWallet(seed, DerivationNano)
+}
+
+// NewBip44Wallet creates a wallet deriving accounts from a 64 byte BIP39
+// seed, see mnemonic.Bip39Seed.
+func NewBip44Wallet(seed string) (*SeedWallet, error) {
+	return newSeedWallet(seed, DerivationBip44)
+}
+
+// NewMnemonicWallet creates a wallet from a BIP39 mnemonic. With
+// DerivationNano the mnemonic must be 24 words and encodes the seed
+// directly, the passphrase is not used.
+func NewMnemonicWallet(words string, passphrase string, derivation Derivation) (*SeedWallet, error) {
+	var seed string
+	var err error
+	switch derivation {
+	case DerivationNano:
+		seed, err = mnemonic.ToSeed(words)
+	case DerivationBip44:
+		seed, err = mnemonic.Bip39Seed(words, passphrase)
+	default:
+		err = errors.Errorf("Unknown derivation %s", derivation)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newSeedWallet(seed, derivation)
+}
+
+func (s *SeedWallet) Derivation() Derivation {
+	return s.derivation
+}
+
+func (s *SeedWallet) keypair(index uint32) (ed25519.PublicKey, ed25519.PrivateKey) {
+	if s.derivation == DerivationBip44 {
+		return address.KeypairFromBip39Seed(s.seed, index)
+	}
+	return address.KeypairFromSeed(s.seed, index)
+}
+
+// Drops the seed and zeroes every derived private key. Wallets already
+// handed out share their keys with the seed wallet, so they can't sign
+// either and return ErrLocked.
+func (s *SeedWallet) wipe() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.seed = ""
+	for _, w := range s.accounts {
+		w.wipe()
+	}
+}
+
+// Account returns the wallet for the account at index, deriving it and
+// marking the index as in use if needed.
+func (s *SeedWallet) Account(index uint32) *Wallet {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.account(index)
+}
+
+func (s *SeedWallet) account(index uint32) *Wallet {
+	if w, ok := s.accounts[index]; ok {
+		return w
+	}
+
+	pub, priv := s.keypair(index)
+	w := fromKeypair(pub, priv)
+	s.accounts[index] = &w
+	return &w
+}
+
+// NewAccount derives the account at the lowest unused index.
+func (s *SeedWallet) NewAccount() (uint32, *Wallet) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var index uint32
+	for s.accounts[index] != nil {
+		index++
+	}
+	return index, s.account(index)
+}
+
+func (s *SeedWallet) RemoveAccount(index uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.accounts, index)
+}
+
+// Indices returns the in use account indices in ascending order.
+func (s *SeedWallet) Indices() []uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	indices := make([]uint32, 0, len(s.accounts))
+	for index := range s.accounts {
+		indices = append(indices, index)
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+	return indices
+}
+
+// Wallet looks up an in use account by address.
+func (s *SeedWallet) Wallet(account types.Account) (*Wallet, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, w := range s.accounts {
+		if w.Address() == account {
+			return w, nil
+		}
+	}
+
+	return nil, errors.Errorf("Account %s is not in this wallet", account)
+}
+
+// Restore scans the ledger for accounts derived from the seed that have
+// been opened, stopping after gapLimit consecutive unopened indices.
+// Every opened account is marked as in use. Returns the number found.
+func (s *SeedWallet) Restore(gapLimit uint32) int {
+	found := 0
+	var gap uint32
+	for index := uint32(0); gap < gapLimit; index++ {
+		pub, _ := s.keypair(index)
+		if store.FetchOpen(address.PubKeyToAddress(pub)) == nil {
+			gap++
+			continue
+		}
+
+		gap = 0
+		s.Account(index)
+		found++
+	}
+	return found
+}
+
+func (s *SeedWallet) GetBalance() uint128.Uint128 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	total := uint128.FromInts(0, 0)
+	for _, w := range s.accounts {
+		total = total.Add(w.GetBalance())
+	}
+	return total
+}
+
+func (s *SeedWallet) Open(account types.Account, source types.BlockHash, representative types.Account) (*blocks.OpenBlock, error) {
+	w, err := s.Wallet(account)
+	if err != nil {
+		return nil, err
+	}
+	return w.Open(source, representative)
+}
+
+func (s *SeedWallet) Send(account types.Account, destination types.Account, amount uint128.Uint128) (*blocks.SendBlock, error) {
+	w, err := s.Wallet(account)
+	if err != nil {
+		return nil, err
+	}
+	return w.Send(destination, amount)
+}
+
+func (s *SeedWallet) Receive(account types.Account, source types.BlockHash) (*blocks.ReceiveBlock, error) {
+	w, err := s.Wallet(account)
+	if err != nil {
+		return nil, err
+	}
+	return w.Receive(source)
+}
+
+func (s *SeedWallet) Change(account types.Account, representative types.Account) (*blocks.ChangeBlock, error) {
+	w, err := s.Wallet(account)
+	if err != nil {
+		return nil, err
+	}
+	return w.Change(representative)
+}
@@ -2,6 +2,10 @@ package wallet
 
 import (
 	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/frankh/nano/address"
@@ -13,16 +17,25 @@ import (
 func TestNew(t *testing.T) {
 	store.Init(store.TestConfig)
 
-	w := New(blocks.TestPrivateKey)
+	w, err := New(blocks.TestPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if w.GetBalance() != blocks.GenesisAmount {
 		t.Errorf("Genesis block doesn't have correct balance")
 	}
+
+	for _, private := range []string{"", "34F0", "not hex", blocks.TestPrivateKey + "00"} {
+		if _, err := New(private); err == nil {
+			t.Errorf("Created wallet from invalid private key %q", private)
+		}
+	}
 }
 
 func TestPoW(t *testing.T) {
 	blocks.WorkThreshold = 0xff00000000000000
 	store.Init(store.TestConfig)
-	w := New(blocks.TestPrivateKey)
+	w, _ := New(blocks.TestPrivateKey)
 
 	if w.GeneratePoWAsync() != nil || !w.WaitingForPoW() {
 		t.Errorf("Failed to start PoW generation")
@@ -51,7 +64,7 @@ func TestPoW(t *testing.T) {
 func TestSend(t *testing.T) {
 	blocks.WorkThreshold = 0xff00000000000000
 	store.Init(store.TestConfig)
-	w := New(blocks.TestPrivateKey)
+	w, _ := New(blocks.TestPrivateKey)
 
 	w.GeneratePowSync()
 	amount := uint128.FromInts(1, 1)
@@ -83,11 +96,11 @@ func TestOpen(t *testing.T) {
 	store.Init(store.TestConfig)
 	amount := uint128.FromInts(1, 1)
 
-	sendW := New(blocks.TestPrivateKey)
+	sendW, _ := New(blocks.TestPrivateKey)
 	sendW.GeneratePowSync()
 
 	_, priv := address.GenerateKey()
-	openW := New(hex.EncodeToString(priv))
+	openW, _ := New(hex.EncodeToString(priv))
 	send, _ := sendW.Send(openW.Address(), amount)
 	openW.GeneratePowSync()
 
@@ -116,3 +129,294 @@ func TestOpen(t *testing.T) {
 	}
 
 }
+
+func TestSeedWallet(t *testing.T) {
+	store.Init(store.TestConfig)
+
+	if _, err := NewSeedWallet("1234"); err == nil {
+		t.Errorf("Expected error for short seed")
+	}
+
+	s, err := NewSeedWallet("1234567890123456789012345678901234567890123456789012345678901234")
+	if err != nil {
+		t.Fatalf("Failed to create seed wallet: %s", err)
+	}
+
+	if s.Account(1).Address().String() != "nano_3a9d1h6wt3zp8cqd6dhhgoyizmk1ciemqkrw97ysrphn7anm6xko1wxakaa1" {
+		t.Errorf("Derived wrong account for index 1")
+	}
+
+	index, w := s.NewAccount()
+	if index != 0 || w.Address().String() != "nano_3iwi45me3cgo9aza9wx5f7rder37hw11xtc1ek8psqxw5oxb8cujjad6qp9y" {
+		t.Errorf("NewAccount should use the lowest unused index")
+	}
+
+	if index, _ = s.NewAccount(); index != 2 {
+		t.Errorf("NewAccount reused an index in use")
+	}
+
+	if len(s.Indices()) != 3 {
+		t.Errorf("Wrong number of indices in use %v", s.Indices())
+	}
+
+	found, err := s.Wallet(w.Address())
+	if err != nil || found != w {
+		t.Errorf("Failed to look up account by address")
+	}
+
+	if _, err := s.Change(blocks.TestGenesisBlock.Account, w.Address()); err == nil {
+		t.Errorf("Expected error for account not in wallet")
+	}
+}
+
+func TestSeedWalletRestore(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	store.Init(store.TestConfig)
+
+	seed, _ := GenerateSeed()
+	s, _ := NewSeedWallet(seed)
+	amount := uint128.FromInts(0, 1)
+
+	sendW, _ := New(blocks.TestPrivateKey)
+	for _, index := range []uint32{2, 6} {
+		w := s.Account(index)
+		sendW.GeneratePowSync()
+		send, _ := sendW.Send(w.Address(), amount)
+		store.StoreBlock(send)
+
+		w.GeneratePowSync()
+		open, err := s.Open(w.Address(), send.Hash(), w.Address())
+		if err != nil {
+			t.Fatalf("Failed to open account: %s", err)
+		}
+		store.StoreBlock(open)
+	}
+
+	restored, _ := NewSeedWallet(seed)
+	if n := restored.Restore(3); n != 1 {
+		t.Errorf("Gap limit of 3 should only find index 2, found %d", n)
+	}
+
+	restored, _ = NewSeedWallet(seed)
+	if n := restored.Restore(DefaultGapLimit); n != 2 {
+		t.Errorf("Expected to restore 2 accounts, found %d", n)
+	}
+
+	indices := restored.Indices()
+	if len(indices) != 2 || indices[0] != 2 || indices[1] != 6 {
+		t.Errorf("Restored wrong indices %v", indices)
+	}
+
+	if restored.GetBalance() != amount.Add(amount) {
+		t.Errorf("Restored wallet has wrong balance")
+	}
+}
+
+func TestWalletFile(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	KdfMemory = 1024
+	store.Init(store.TestConfig)
+
+	dir, _ := ioutil.TempDir("", "wallet")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wallet.json")
+
+	seed, _ := GenerateSeed()
+	s, _ := NewSeedWallet(seed)
+	f, err := CreateWalletFile(path, s, "password")
+	if err != nil {
+		t.Fatalf("Failed to create wallet file: %s", err)
+	}
+	if _, err := CreateWalletFile(path, s, "password"); err == nil {
+		t.Errorf("Overwrote existing wallet file")
+	}
+
+	account, _ := f.NewAccount()
+	f.SetLabel(account, "savings")
+	f.SetRepresentative(blocks.TestGenesisBlock.Account)
+
+	raw, _ := ioutil.ReadFile(path)
+	if strings.Contains(strings.ToUpper(string(raw)), seed) {
+		t.Errorf("Seed stored unencrypted")
+	}
+
+	f, err = OpenWalletFile(path)
+	if err != nil {
+		t.Fatalf("Failed to open wallet file: %s", err)
+	}
+	if !f.Locked() {
+		t.Errorf("Opened wallet file should be locked")
+	}
+	if _, err := f.Change(account, account); err != ErrLocked {
+		t.Errorf("Signed while locked")
+	}
+	if f.Unlock("wrong") != ErrWrongPassword {
+		t.Errorf("Unlocked with wrong password")
+	}
+	if err := f.Unlock("password"); err != nil {
+		t.Fatalf("Failed to unlock: %s", err)
+	}
+
+	accounts, _ := f.Accounts()
+	if len(accounts) != 1 || accounts[0] != account {
+		t.Errorf("Account indices not restored")
+	}
+	if representative, ok := f.Representative(); !ok || representative != blocks.TestGenesisBlock.Account || f.Label(account) != "savings" {
+		t.Errorf("Label or representative not restored")
+	}
+
+	sendW, _ := New(blocks.TestPrivateKey)
+	sendW.GeneratePowSync()
+	send, _ := sendW.Send(account, uint128.FromInts(0, 1))
+	store.StoreBlock(send)
+
+	w, _ := f.Wallet(account)
+	w.GeneratePowSync()
+	open, err := f.Open(account, send.Hash())
+	if err != nil || open.Representative != blocks.TestGenesisBlock.Account {
+		t.Errorf("Failed to open account with wallet representative: %s", err)
+	}
+
+	f.Lock()
+	if _, err := f.Wallet(account); err != ErrLocked {
+		t.Errorf("Accessed keys while locked")
+	}
+	w.GeneratePowSync()
+	if _, err := w.Change(account); err != ErrLocked {
+		t.Errorf("Wallet from before locking still signs")
+	}
+
+	if f.ChangePassword("wrong", "new") != ErrWrongPassword {
+		t.Errorf("Changed password without the old password")
+	}
+	if err := f.ChangePassword("password", "new"); err != nil {
+		t.Fatalf("Failed to change password: %s", err)
+	}
+
+	f, _ = OpenWalletFile(path)
+	if f.Unlock("password") == nil || f.Unlock("new") != nil {
+		t.Errorf("Password not changed")
+	}
+}
+
+func TestMnemonicWallet(t *testing.T) {
+	KdfMemory = 1024
+	words := "edge defense waste choose enrich upon flee junk siren film clown finish luggage leader kid quick brick print evidence swap drill paddle truly occur"
+
+	s, err := NewMnemonicWallet(words, "some password", DerivationBip44)
+	if err != nil {
+		t.Fatalf("Failed to create wallet from mnemonic: %s", err)
+	}
+	if s.Account(0).Address().String() != "nano_1pu7p5n3ghq1i1p4rhmek41f5add1uh34xpb94nkbxe8g4a6x1p69emk8y1d" {
+		t.Errorf("Derived wrong BIP44 account %s", s.Account(0).Address())
+	}
+
+	legacy, err := NewMnemonicWallet(words, "", DerivationNano)
+	if err != nil {
+		t.Fatalf("Failed to create legacy wallet from mnemonic: %s", err)
+	}
+	if legacy.Account(0).Address() == s.Account(0).Address() {
+		t.Errorf("Derivation modes should derive different accounts")
+	}
+
+	dir, _ := ioutil.TempDir("", "wallet")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wallet.json")
+
+	if _, err := CreateWalletFile(path, s, "password"); err != nil {
+		t.Fatalf("Failed to create wallet file: %s", err)
+	}
+	f, _ := OpenWalletFile(path)
+	f.Unlock("password")
+	accounts, _ := f.Accounts()
+	if len(accounts) != 1 || accounts[0] != s.Account(0).Address() {
+		t.Errorf("Derivation mode not restored from wallet file")
+	}
+}
+
+func TestAutoReceiver(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	store.Init(store.TestConfig)
+
+	seed, _ := GenerateSeed()
+	s, _ := NewSeedWallet(seed)
+	_, w := s.NewAccount()
+
+	published := make([]blocks.Block, 0)
+	r := NewAutoReceiver(s, blocks.TestGenesisBlock.Account, uint128.FromInts(0, 10))
+	r.Publish = func(b blocks.Block) error {
+		published = append(published, b)
+		return nil
+	}
+
+	sendW, _ := New(blocks.TestPrivateKey)
+	for _, amount := range []uint64{100, 1, 50} {
+		sendW.GeneratePowSync()
+		send, _ := sendW.Send(w.Address(), uint128.FromInts(0, amount))
+		store.StoreBlock(send)
+	}
+
+	created := r.Poll()
+	if len(created) != 2 || len(published) != 2 {
+		t.Fatalf("Expected 2 blocks, created %d, published %d", len(created), len(published))
+	}
+	if created[0].Type() != blocks.Open || created[1].Type() != blocks.Receive {
+		t.Errorf("Expected an open then a receive")
+	}
+	if w.GetBalance() != uint128.FromInts(0, 150) {
+		t.Errorf("Wrong balance after receiving %v", w.GetBalance())
+	}
+
+	if len(r.Poll()) != 0 {
+		t.Errorf("Received sends twice")
+	}
+	if len(store.FetchReceivable(w.Address())) != 1 {
+		t.Errorf("Dust send should remain receivable")
+	}
+}
+
+func TestWalletFileAutoReceiver(t *testing.T) {
+	blocks.WorkThreshold = 0xff00000000000000
+	KdfMemory = 1024
+	store.Init(store.TestConfig)
+
+	dir, _ := ioutil.TempDir("", "wallet")
+	defer os.RemoveAll(dir)
+	seed, _ := GenerateSeed()
+	s, _ := NewSeedWallet(seed)
+	_, w := s.NewAccount()
+	f, _ := CreateWalletFile(filepath.Join(dir, "wallet.json"), s, "password")
+
+	if _, err := f.AutoReceiver(uint128.FromInts(0, 1)); err == nil {
+		t.Errorf("Receiver created without a representative")
+	}
+	f.SetRepresentative(blocks.TestGenesisBlock.Account)
+	r, err := f.AutoReceiver(uint128.FromInts(0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Publish = nil
+
+	sendW, _ := New(blocks.TestPrivateKey)
+	sendW.GeneratePowSync()
+	send, _ := sendW.Send(w.Address(), uint128.FromInts(0, 100))
+	store.StoreBlock(send)
+
+	// Balances are read while the receiver updates the account's head
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			s.GetBalance()
+		}
+		done <- true
+	}()
+	created := r.Poll()
+	<-done
+
+	if len(created) != 1 {
+		t.Fatalf("Expected an open block, created %d", len(created))
+	}
+	if open := created[0].(*blocks.OpenBlock); open.Representative != blocks.TestGenesisBlock.Account {
+		t.Errorf("Account not opened with the wallet representative")
+	}
+}
@@ -0,0 +1,272 @@
+package ws
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/logging"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/gorilla/websocket"
+)
+
+var logger = logging.New("ws")
+
+// Topic names match the reference node's websocket server where one exists.
+type Topic string
+
+const (
+	TopicConfirmation    Topic = "confirmation"
+	TopicNewBlock        Topic = "new_unconfirmed_block"
+	TopicVote            Topic = "vote"
+	TopicStartedElection Topic = "started_election"
+	TopicStoppedElection Topic = "stopped_election"
+	TopicPeer            Topic = "peer"
+)
+
+// Outgoing messages are buffered per client, if a client can't keep up
+// we drop notifications rather than stall the node.
+const sendBufferSize = 256
+const writeTimeout = 10 * time.Second
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type request struct {
+	Action  string `json:"action"`
+	Topic   Topic  `json:"topic"`
+	Ack     bool   `json:"ack"`
+	Id      string `json:"id"`
+	Options struct {
+		Accounts []string `json:"accounts"`
+	} `json:"options"`
+}
+
+type notification struct {
+	Topic   Topic       `json:"topic"`
+	Time    string      `json:"time"`
+	Message interface{} `json:"message"`
+}
+
+type ack struct {
+	Ack  string `json:"ack"`
+	Time string `json:"time"`
+	Id   string `json:"id,omitempty"`
+}
+
+// Sent instead of an ack when a request can't be carried out.
+type requestError struct {
+	Error string `json:"error"`
+	Time  string `json:"time"`
+	Id    string `json:"id,omitempty"`
+}
+
+type subscription struct {
+	// Empty means every account.
+	accounts map[types.Account]bool
+}
+
+func (s *subscription) matches(accounts []types.Account) bool {
+	if len(s.accounts) == 0 {
+		return true
+	}
+	for _, account := range accounts {
+		if s.accounts[account] {
+			return true
+		}
+	}
+	return false
+}
+
+type client struct {
+	conn          *websocket.Conn
+	send          chan []byte
+	subscriptions map[Topic]*subscription
+}
+
+var clients = make(map[*client]bool)
+var clientsLock sync.Mutex
+
+func timestamp() string {
+	return strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+}
+
+// Handler upgrades the request to a websocket and serves subscriptions
+// until the client disconnects.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Warn("Failed to upgrade websocket", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+
+	c := &client{conn, make(chan []byte, sendBufferSize), make(map[Topic]*subscription)}
+	clientsLock.Lock()
+	clients[c] = true
+	clientsLock.Unlock()
+
+	go c.writeLoop()
+	c.readLoop()
+}
+
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", Handler)
+	logger.Info("Listening for websocket connections", "addr", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+func (c *client) readLoop() {
+	defer func() {
+		clientsLock.Lock()
+		delete(clients, c)
+		close(c.send)
+		clientsLock.Unlock()
+		c.conn.Close()
+	}()
+
+	for {
+		var req request
+		err := c.conn.ReadJSON(&req)
+		if err != nil {
+			return
+		}
+		c.handle(&req)
+	}
+}
+
+func (c *client) writeLoop() {
+	for message := range c.send {
+		c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		err := c.conn.WriteMessage(websocket.TextMessage, message)
+		if err != nil {
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+func (c *client) handle(req *request) {
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+
+	switch req.Action {
+	case "subscribe":
+		// Skipping an invalid address could leave the filter empty,
+		// which means every account
+		sub := &subscription{make(map[types.Account]bool)}
+		for _, address := range req.Options.Accounts {
+			account, err := types.ParseAccount(address)
+			if err != nil {
+				c.queue(requestError{"Invalid account " + address, timestamp(), req.Id})
+				return
+			}
+			sub.accounts[account] = true
+		}
+		c.subscriptions[req.Topic] = sub
+	case "unsubscribe":
+		delete(c.subscriptions, req.Topic)
+	case "ping":
+		req.Ack = true
+		req.Action = "pong"
+	default:
+		return
+	}
+
+	if req.Ack {
+		c.queue(ack{req.Action, timestamp(), req.Id})
+	}
+}
+
+// Must be called with clientsLock held
+func (c *client) queue(v interface{}) {
+	message, err := json.Marshal(v)
+	if err != nil {
+		logger.Error("Failed to encode websocket message", "err", err)
+		return
+	}
+	select {
+	case c.send <- message:
+	default:
+	}
+}
+
+// Sends a notification to every client subscribed to the topic whose
+// account filter matches any of the given accounts.
+func broadcast(topic Topic, message interface{}, accounts ...types.Account) {
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+
+	if len(clients) == 0 {
+		return
+	}
+
+	n := notification{topic, timestamp(), message}
+	for c := range clients {
+		sub := c.subscriptions[topic]
+		if sub != nil && sub.matches(accounts) {
+			c.queue(n)
+		}
+	}
+}
+
+// Accounts a block notification should be delivered to, sends are
+// also of interest to their destination.
+func blockAccounts(block blocks.Block, account types.Account) []types.Account {
+	accounts := []types.Account{account}
+	if send, ok := block.(*blocks.SendBlock); ok {
+		accounts = append(accounts, send.Destination)
+	}
+	return accounts
+}
+
+// NewBlock notifies subscribers of a block that has been stored but
+// not yet confirmed.
+func NewBlock(block blocks.Block) {
+	broadcast(TopicNewBlock, block)
+}
+
+// Confirmation notifies subscribers that a block on the given account's
+// chain has been confirmed.
+func Confirmation(block blocks.Block, account types.Account, amount uint128.Uint128) {
+	message := map[string]interface{}{
+		"account": account,
+		"amount":  amount.String(),
+		"hash":    block.Hash(),
+		"block":   block,
+	}
+	broadcast(TopicConfirmation, message, blockAccounts(block, account)...)
+}
+
+func Vote(account types.Account, signature types.Signature, sequence [8]byte, hashes []types.BlockHash) {
+	message := map[string]interface{}{
+		"account":   account,
+		"signature": signature,
+		"sequence":  strconv.FormatUint(binary.LittleEndian.Uint64(sequence[:]), 10),
+		"blocks":    hashes,
+	}
+	broadcast(TopicVote, message, account)
+}
+
+func ElectionStarted(hash types.BlockHash) {
+	broadcast(TopicStartedElection, map[string]interface{}{"hash": hash})
+}
+
+// ElectionStopped notifies subscribers of an election outcome, confirmed
+// is false if the election expired without reaching quorum.
+func ElectionStopped(hash types.BlockHash, confirmed bool) {
+	broadcast(TopicStoppedElection, map[string]interface{}{
+		"hash":      hash,
+		"confirmed": confirmed,
+	})
+}
+
+func PeerAdded(peer string) {
+	broadcast(TopicPeer, map[string]interface{}{"action": "added", "peer": peer})
+}
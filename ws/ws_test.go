@@ -0,0 +1,132 @@
+package ws
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/gorilla/websocket"
+)
+
+func connect(t *testing.T, server *httptest.Server) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	return conn
+}
+
+func subscribe(t *testing.T, conn *websocket.Conn, topic Topic, accounts ...string) {
+	req := map[string]interface{}{
+		"action":  "subscribe",
+		"topic":   topic,
+		"ack":     true,
+		"options": map[string]interface{}{"accounts": accounts},
+	}
+	if err := conn.WriteJSON(req); err != nil {
+		t.Fatalf("Failed to subscribe: %s", err)
+	}
+
+	var a ack
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&a); err != nil || a.Ack != "subscribe" {
+		t.Fatalf("Expected subscribe ack, got %v %s", a, err)
+	}
+}
+
+func readNotification(t *testing.T, conn *websocket.Conn) (topic Topic, message map[string]interface{}) {
+	var n struct {
+		Topic   Topic
+		Message map[string]interface{}
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&n); err != nil {
+		t.Fatalf("Failed to read notification: %s", err)
+	}
+	return n.Topic, n.Message
+}
+
+func TestNewBlock(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(Handler))
+	defer server.Close()
+	conn := connect(t, server)
+	defer conn.Close()
+
+	subscribe(t, conn, TopicNewBlock)
+	NewBlock(blocks.LiveGenesisBlock)
+
+	topic, message := readNotification(t, conn)
+	if topic != TopicNewBlock {
+		t.Errorf("Wrong topic %s", topic)
+	}
+	if message["account"] != blocks.LiveGenesisBlock.Account.String() || message["type"] != "open" {
+		t.Errorf("Wrong block in notification %v", message)
+	}
+}
+
+func TestConfirmationFilter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(Handler))
+	defer server.Close()
+	conn := connect(t, server)
+	defer conn.Close()
+
+	// Subscribe with the xrb_ prefix to check filters compare keys
+	account := blocks.TestGenesisBlock.Account
+	subscribe(t, conn, TopicConfirmation, "xrb_"+strings.TrimPrefix(account.String(), "nano_"))
+
+	amount := uint128.FromInts(0, 1)
+	Confirmation(blocks.LiveGenesisBlock, blocks.LiveGenesisBlock.Account, amount)
+	Vote(account, types.Signature{}, [8]byte{}, nil)
+	Confirmation(blocks.TestGenesisBlock, account, amount)
+
+	topic, message := readNotification(t, conn)
+	if topic != TopicConfirmation {
+		t.Errorf("Wrong topic %s", topic)
+	}
+	if message["hash"] != blocks.TestGenesisBlock.Hash().String() {
+		t.Errorf("Received confirmation for unsubscribed account %v", message)
+	}
+
+	raw, _ := json.Marshal(message["block"])
+	if !strings.Contains(string(raw), blocks.TestGenesisBlock.SourceHash.String()) {
+		t.Errorf("Confirmation missing block contents %s", raw)
+	}
+}
+
+func TestSubscribeInvalidAccount(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(Handler))
+	defer server.Close()
+	conn := connect(t, server)
+	defer conn.Close()
+
+	req := map[string]interface{}{
+		"action":  "subscribe",
+		"topic":   TopicConfirmation,
+		"ack":     true,
+		"id":      "1",
+		"options": map[string]interface{}{"accounts": []string{"nano_invalid"}},
+	}
+	if err := conn.WriteJSON(req); err != nil {
+		t.Fatal(err)
+	}
+	var e requestError
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&e); err != nil || e.Error == "" || e.Id != "1" {
+		t.Fatalf("Expected an error, got %v %v", e, err)
+	}
+
+	// The subscription wasn't made, so it doesn't match every account
+	subscribe(t, conn, TopicNewBlock)
+	Confirmation(blocks.TestGenesisBlock, blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1))
+	NewBlock(blocks.TestGenesisBlock)
+	if topic, _ := readNotification(t, conn); topic != TopicNewBlock {
+		t.Errorf("Received %s notification without a subscription", topic)
+	}
+}